@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -57,6 +58,10 @@ func (br *SignalBridge) RegisterCommands() {
 		cmdResolvePhone,
 		cmdSyncSpace,
 		cmdDeleteSession,
+		cmdSubmitCaptcha,
+		cmdResetSession,
+		cmdExportLogin,
+		cmdImportLogin,
 		cmdSetRelay,
 		cmdUnsetRelay,
 		cmdDeletePortal,
@@ -140,6 +145,219 @@ func fnDeleteSession(ce *WrappedCommandEvent) {
 	ce.Reply("Disconnected from Signal")
 }
 
+var cmdSubmitCaptcha = &commands.FullHandler{
+	Func: wrapCommand(fnSubmitCaptcha),
+	Name: "submit-captcha",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Submit a captcha to lift a Signal rate limit challenge",
+		Args:        "<_captcha token_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSubmitCaptcha(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage:** `submit-captcha <captcha token>`\n\nSolve the captcha at %s and copy the link from the \"Open Signal\" button", signalmeow.CaptchaURL)
+		return
+	}
+	challenge := ce.User.Client.PendingRateLimitChallenge()
+	if challenge == nil {
+		ce.Reply("You don't have any pending rate limit challenges")
+		return
+	}
+	err := ce.User.Client.SubmitRateLimitChallenge(ce.Ctx, challenge.Token, ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to submit captcha: %v", err)
+		return
+	}
+	ce.Reply("Captcha accepted, resending paused messages")
+	ce.User.retryRateLimitedMessages()
+}
+
+var cmdResetSession = &commands.FullHandler{
+	Func: wrapCommand(fnResetSession),
+	Name: "reset-session",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Reset the secure session with a Signal user. The user can be omitted in private chat portals.",
+		Args:        "[_international phone number or UUID_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnResetSession(ce *WrappedCommandEvent) {
+	var targetUUID uuid.UUID
+	if len(ce.Args) == 0 {
+		if ce.Portal == nil || !ce.Portal.IsPrivateChat() || ce.Portal.IsNoteToSelf() {
+			ce.Reply("**Usage:** `reset-session <international phone number or UUID>`")
+			return
+		}
+		targetUUID = ce.Portal.UserID()
+	} else if parsed, err := uuid.Parse(ce.Args[0]); err == nil {
+		targetUUID = parsed
+	} else if number, err := strconv.ParseUint(numberCleaner.Replace(strings.Join(ce.Args, "")), 10, 64); err != nil {
+		ce.Reply("Failed to parse phone number or UUID")
+		return
+	} else if contact, err := ce.User.Client.ContactByE164(ce.Ctx, fmt.Sprintf("+%d", number)); err != nil {
+		ce.Reply("Error looking up number in local contact list: %v", err)
+		return
+	} else if contact == nil {
+		ce.Reply("+%d isn't in your contact list", number)
+		return
+	} else {
+		targetUUID = contact.UUID
+	}
+	err := ce.User.Client.ResetSession(ce.Ctx, targetUUID)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("target_uuid", targetUUID).Msg("Failed to reset session")
+		ce.Reply("Failed to reset session: %v", err)
+		return
+	}
+	ce.Reply("Reset secure session with %s", targetUUID)
+}
+
+var cmdExportLogin = &commands.FullHandler{
+	Func: wrapCommand(fnExportLogin),
+	Name: "export-login",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Move a user's Signal login into an encrypted file in this room, to be imported into another bridge instance",
+		Args:        "<_Matrix user ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnExportLogin(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 1 {
+		ce.Reply("**Usage:** `export-login <Matrix user ID>`")
+		return
+	}
+	passphrase, err := getLoginArchivePassphrase()
+	if err != nil {
+		ce.Reply("Failed to get login archive passphrase: %v", err)
+		return
+	}
+	user := ce.Bridge.GetUserByMXIDIfExists(id.UserID(ce.Args[0]))
+	if user == nil {
+		ce.Reply("User %s not found", ce.Args[0])
+		return
+	}
+	signalID := user.SignalID
+	err = ce.Bridge.ExportLogin(ce.Ctx, user, passphrase, func(archive []byte) error {
+		resp, err := ce.Bot.UploadBytesWithName(ce.Ctx, archive, "application/octet-stream", "signal-login.bin")
+		if err != nil {
+			return fmt.Errorf("failed to upload archive: %w", err)
+		}
+		_, err = ce.Bot.SendMessageEvent(ce.Ctx, ce.RoomID, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgFile,
+			Body:    "signal-login.bin",
+			Info: &event.FileInfo{
+				MimeType: "application/octet-stream",
+				Size:     len(archive),
+			},
+			URL: resp.ContentURI.CUString(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send archive: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("user_id", user.MXID).Msg("Failed to export login")
+		ce.Reply("Failed to export login: %v", err)
+		return
+	}
+	ce.Reply("Exported the Signal login of %s (UUID: %s). The login has been removed from this bridge.", user.MXID, signalID)
+}
+
+var cmdImportLogin = &commands.FullHandler{
+	Func: wrapCommand(fnImportLogin),
+	Name: "import-login",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Import a Signal login exported from another bridge instance for a user. Must be sent as a reply to the archive file.",
+		Args:        "<_Matrix user ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnImportLogin(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 1 || ce.ReplyTo == "" {
+		ce.Reply("**Usage:** `import-login <Matrix user ID>` as a reply to the login archive file")
+		return
+	}
+	passphrase, err := getLoginArchivePassphrase()
+	if err != nil {
+		ce.Reply("Failed to get login archive passphrase: %v", err)
+		return
+	}
+	user := ce.Bridge.GetUserByMXID(id.UserID(ce.Args[0]))
+	if user == nil {
+		ce.Reply("Invalid user ID %s", ce.Args[0])
+		return
+	}
+	archive, err := downloadReplyFile(ce)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("reply_to", ce.ReplyTo).Msg("Failed to download login archive")
+		ce.Reply("Failed to download login archive: %v", err)
+		return
+	}
+	err = ce.Bridge.ImportLogin(ce.Ctx, user, archive, passphrase)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("user_id", user.MXID).Msg("Failed to import login")
+		ce.Reply("Failed to import login: %v", err)
+		return
+	}
+	user.Connect()
+	ce.Reply("Imported the Signal login of %s (UUID: %s)", user.MXID, user.SignalID)
+}
+
+// downloadReplyFile downloads and decrypts the file in the message that the command is replying to.
+func downloadReplyFile(ce *WrappedCommandEvent) ([]byte, error) {
+	evt, err := ce.Bot.GetEvent(ce.Ctx, ce.RoomID, ce.ReplyTo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event: %w", err)
+	}
+	evt.RoomID = ce.RoomID
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content: %w", err)
+	}
+	if evt.Type == event.EventEncrypted {
+		if ce.Bridge.Crypto == nil {
+			return nil, errors.New("event is encrypted, but encryption is not enabled")
+		}
+		evt, err = ce.Bridge.Crypto.Decrypt(ce.Ctx, evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt event: %w", err)
+		}
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.MsgType != event.MsgFile {
+		return nil, errors.New("replied message is not a file")
+	}
+	mxc := content.URL
+	if content.File != nil {
+		mxc = content.File.URL
+	}
+	parsedMXC, err := mxc.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file URL: %w", err)
+	}
+	data, err := ce.Bot.DownloadBytes(ce.Ctx, parsedMXC)
+	if err != nil {
+		return nil, err
+	}
+	if content.File != nil {
+		err = content.File.DecryptInPlace(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt file: %w", err)
+		}
+	}
+	return data, nil
+}
+
 var cmdPing = &commands.FullHandler{
 	Func: wrapCommand(fnPing),
 	Name: "ping",
@@ -50,6 +50,7 @@ type BridgeConfig struct {
 	ResendBridgeInfo        bool `yaml:"resend_bridge_info"`
 	CaptionInMessage        bool `yaml:"caption_in_message"`
 	FederateRooms           bool `yaml:"federate_rooms"`
+	StickerPacks            bool `yaml:"sticker_packs"`
 
 	DoublePuppetConfig bridgeconfig.DoublePuppetConfig `yaml:",inline"`
 
@@ -61,6 +62,26 @@ type BridgeConfig struct {
 		Deadline   time.Duration `yaml:"-"`
 	} `yaml:"message_handling_timeout"`
 
+	Outbox struct {
+		MaxAgeStr string        `yaml:"max_age"`
+		MaxAge    time.Duration `yaml:"-"`
+	} `yaml:"outbox"`
+
+	MediaBatchWindowStr string        `yaml:"media_batch_window"`
+	MediaBatchWindow    time.Duration `yaml:"-"`
+
+	Location struct {
+		MapURL           string `yaml:"map_url"`
+		StaticMapTileURL string `yaml:"static_map_tile_url"`
+		StaticMapZoom    int    `yaml:"static_map_zoom"`
+	} `yaml:"location"`
+
+	FileTransfers struct {
+		Async       bool `yaml:"async"`
+		Workers     int  `yaml:"workers"`
+		MaxAttempts int  `yaml:"max_attempts"`
+	} `yaml:"file_transfers"`
+
 	CommandPrefix      string                           `yaml:"command_prefix"`
 	ManagementRoomText bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
 
@@ -128,6 +149,18 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	if bc.Outbox.MaxAgeStr != "" {
+		bc.Outbox.MaxAge, err = time.ParseDuration(bc.Outbox.MaxAgeStr)
+		if err != nil {
+			return fmt.Errorf("invalid outbox max age: %w", err)
+		}
+	}
+	if bc.MediaBatchWindowStr != "" {
+		bc.MediaBatchWindow, err = time.ParseDuration(bc.MediaBatchWindowStr)
+		if err != nil {
+			return fmt.Errorf("invalid media batch window: %w", err)
+		}
+	}
 
 	return nil
 }
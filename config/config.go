@@ -29,13 +29,31 @@ type Config struct {
 		Listen  string `yaml:"listen"`
 	} `yaml:"metrics"`
 
-	Signal struct {
-		DeviceName string `yaml:"device_name"`
-	} `yaml:"signal"`
+	Signal SignalConfig `yaml:"signal"`
 
 	Bridge BridgeConfig `yaml:"bridge"`
 }
 
+type SignalConfig struct {
+	DeviceName string `yaml:"device_name"`
+
+	Environment string `yaml:"environment"`
+	Hosts       struct {
+		API              string            `yaml:"api"`
+		Storage          string            `yaml:"storage"`
+		ContactDiscovery string            `yaml:"contact_discovery"`
+		CDN              map[uint32]string `yaml:"cdn"`
+	} `yaml:"hosts"`
+	ServerPublicParams        string `yaml:"server_public_params"`
+	TrustRoot                 string `yaml:"trust_root"`
+	ContactDiscoveryMrenclave string `yaml:"contact_discovery_mrenclave"`
+
+	Proxy        string   `yaml:"proxy"`
+	ExtraCACerts []string `yaml:"extra_ca_certs"`
+
+	StoreEncryptionKey string `yaml:"store_encryption_key"`
+}
+
 func (config *Config) CanAutoDoublePuppet(userID id.UserID) bool {
 	_, homeserver, _ := userID.Parse()
 	_, hasSecret := config.Bridge.DoublePuppetConfig.SharedSecretMap[homeserver]
@@ -70,6 +70,17 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "metrics", "listen")
 
 	helper.Copy(up.Str, "signal", "device_name")
+	helper.Copy(up.Str, "signal", "environment")
+	helper.Copy(up.Str|up.Null, "signal", "hosts", "api")
+	helper.Copy(up.Str|up.Null, "signal", "hosts", "storage")
+	helper.Copy(up.Str|up.Null, "signal", "hosts", "contact_discovery")
+	helper.Copy(up.Map, "signal", "hosts", "cdn")
+	helper.Copy(up.Str|up.Null, "signal", "server_public_params")
+	helper.Copy(up.Str|up.Null, "signal", "trust_root")
+	helper.Copy(up.Str|up.Null, "signal", "contact_discovery_mrenclave")
+	helper.Copy(up.Str|up.Null, "signal", "proxy")
+	helper.Copy(up.List, "signal", "extra_ca_certs")
+	helper.Copy(up.Str|up.Null, "signal", "store_encryption_key")
 
 	if usernameTemplate, ok := helper.Get(up.Str, "bridge", "username_template"); ok && strings.Contains(usernameTemplate, "{userid}") {
 		helper.Set(up.Str, strings.ReplaceAll(usernameTemplate, "{userid}", "{{.}}"), "bridge", "username_template")
@@ -95,9 +106,18 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
 	helper.Copy(up.Bool, "bridge", "caption_in_message")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
+	helper.Copy(up.Bool, "bridge", "sticker_packs")
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
 	helper.Copy(up.Map, "bridge", "login_shared_secret_map")
+	helper.Copy(up.Str, "bridge", "outbox", "max_age")
+	helper.Copy(up.Str, "bridge", "media_batch_window")
+	helper.Copy(up.Str, "bridge", "location", "map_url")
+	helper.Copy(up.Str, "bridge", "location", "static_map_tile_url")
+	helper.Copy(up.Int, "bridge", "location", "static_map_zoom")
+	helper.Copy(up.Bool, "bridge", "file_transfers", "async")
+	helper.Copy(up.Int, "bridge", "file_transfers", "workers")
+	helper.Copy(up.Int, "bridge", "file_transfers", "max_attempts")
 	helper.Copy(up.Str, "bridge", "command_prefix")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_connected")
@@ -152,6 +172,9 @@ var SpacedBlocks = [][]string{
 	{"appservice", "as_token"},
 	{"metrics"},
 	{"signal"},
+	{"signal", "environment"},
+	{"signal", "proxy"},
+	{"signal", "store_encryption_key"},
 	{"bridge"},
 	{"bridge", "personal_filtering_spaces"},
 	{"bridge", "command_prefix"},
@@ -36,6 +36,12 @@ type Database struct {
 	Message             *MessageQuery
 	Reaction            *ReactionQuery
 	DisappearingMessage *DisappearingMessageQuery
+	OutgoingMessage     *OutgoingMessageQuery
+	StickerPack         *StickerPackQuery
+	Sticker             *StickerQuery
+	FileTransfer        *FileTransferQuery
+	SignalMediaCache    *SignalMediaCacheQuery
+	MatrixMediaCache    *MatrixMediaCacheQuery
 }
 
 func New(db *dbutil.Database) *Database {
@@ -49,5 +55,11 @@ func New(db *dbutil.Database) *Database {
 		Message:             &MessageQuery{dbutil.MakeQueryHelper(db, newMessage)},
 		Reaction:            &ReactionQuery{dbutil.MakeQueryHelper(db, newReaction)},
 		DisappearingMessage: &DisappearingMessageQuery{dbutil.MakeQueryHelper(db, newDisappearingMessage)},
+		OutgoingMessage:     &OutgoingMessageQuery{dbutil.MakeQueryHelper(db, newOutgoingMessage)},
+		StickerPack:         &StickerPackQuery{dbutil.MakeQueryHelper(db, newStickerPack)},
+		Sticker:             &StickerQuery{dbutil.MakeQueryHelper(db, newSticker)},
+		FileTransfer:        &FileTransferQuery{dbutil.MakeQueryHelper(db, newFileTransfer)},
+		SignalMediaCache:    &SignalMediaCacheQuery{dbutil.MakeQueryHelper(db, newSignalMediaCache)},
+		MatrixMediaCache:    &MatrixMediaCacheQuery{dbutil.MakeQueryHelper(db, newMatrixMediaCache)},
 	}
 }
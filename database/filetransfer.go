@@ -0,0 +1,108 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getAllFileTransfersQuery = `
+		SELECT event_id, room_id, user_mxid, sender_uuid, message_ts, file_name, attachment, created_at, attempts
+		FROM file_transfer ORDER BY created_at ASC
+	`
+	insertFileTransferQuery = `
+		INSERT INTO file_transfer (event_id, room_id, user_mxid, sender_uuid, message_ts, file_name, attachment, created_at, attempts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	updateFileTransferAttemptsQuery = `
+		UPDATE file_transfer SET attempts=$2 WHERE event_id=$1
+	`
+	deleteFileTransferQuery = `
+		DELETE FROM file_transfer WHERE event_id=$1
+	`
+)
+
+type FileTransferQuery struct {
+	*dbutil.QueryHelper[*FileTransfer]
+}
+
+// FileTransfer is a Signal attachment that is being downloaded in the background.
+// A placeholder has already been sent to Matrix as EventID, which is edited into the attachment once the transfer finishes.
+type FileTransfer struct {
+	qh *dbutil.QueryHelper[*FileTransfer]
+
+	EventID id.EventID
+	RoomID  id.RoomID
+	// UserMXID is the user whose Signal client is used to download the attachment.
+	UserMXID id.UserID
+	// Sender is the Signal user who sent the attachment, whose puppet sends the edit.
+	Sender uuid.UUID
+
+	MessageTimestamp uint64
+	FileName         string
+	// Attachment is the serialized signalpb.AttachmentPointer to download.
+	Attachment []byte
+	CreatedAt  time.Time
+	Attempts   int
+}
+
+func newFileTransfer(qh *dbutil.QueryHelper[*FileTransfer]) *FileTransfer {
+	return &FileTransfer{qh: qh}
+}
+
+func (ftq *FileTransferQuery) GetAll(ctx context.Context) ([]*FileTransfer, error) {
+	return ftq.QueryMany(ctx, getAllFileTransfersQuery)
+}
+
+func (ft *FileTransfer) Scan(row dbutil.Scannable) (*FileTransfer, error) {
+	var createdAt int64
+	err := row.Scan(
+		&ft.EventID, &ft.RoomID, &ft.UserMXID, &ft.Sender,
+		&ft.MessageTimestamp, &ft.FileName, &ft.Attachment, &createdAt, &ft.Attempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ft.CreatedAt = time.UnixMilli(createdAt)
+	return ft, nil
+}
+
+func (ft *FileTransfer) sqlVariables() []any {
+	return []any{
+		ft.EventID, ft.RoomID, ft.UserMXID, ft.Sender,
+		ft.MessageTimestamp, ft.FileName, ft.Attachment, ft.CreatedAt.UnixMilli(), ft.Attempts,
+	}
+}
+
+func (ft *FileTransfer) Insert(ctx context.Context) error {
+	return ft.qh.Exec(ctx, insertFileTransferQuery, ft.sqlVariables()...)
+}
+
+func (ft *FileTransfer) SetAttempts(ctx context.Context, attempts int) error {
+	ft.Attempts = attempts
+	return ft.qh.Exec(ctx, updateFileTransferAttemptsQuery, ft.EventID, attempts)
+}
+
+func (ft *FileTransfer) Delete(ctx context.Context) error {
+	return ft.qh.Exec(ctx, deleteFileTransferQuery, ft.EventID)
+}
@@ -0,0 +1,136 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getSignalMediaCacheQuery = `
+		SELECT signal_key, encrypted, content, extra, expires_at FROM signal_media_cache
+		WHERE signal_key=$1 AND encrypted=$2 AND expires_at>$3
+	`
+	upsertSignalMediaCacheQuery = `
+		INSERT INTO signal_media_cache (signal_key, encrypted, content, extra, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (signal_key, encrypted) DO UPDATE SET content=excluded.content, extra=excluded.extra, expires_at=excluded.expires_at
+	`
+	deleteExpiredSignalMediaCacheQuery = `
+		DELETE FROM signal_media_cache WHERE expires_at<=$1
+	`
+	getMatrixMediaCacheQuery = `
+		SELECT mxc, file_hash, attachment, expires_at FROM matrix_media_cache
+		WHERE mxc=$1 AND file_hash=$2 AND expires_at>$3
+	`
+	upsertMatrixMediaCacheQuery = `
+		INSERT INTO matrix_media_cache (mxc, file_hash, attachment, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (mxc, file_hash) DO UPDATE SET attachment=excluded.attachment, expires_at=excluded.expires_at
+	`
+	deleteExpiredMatrixMediaCacheQuery = `
+		DELETE FROM matrix_media_cache WHERE expires_at<=$1
+	`
+)
+
+type SignalMediaCacheQuery struct {
+	*dbutil.QueryHelper[*SignalMediaCache]
+}
+
+// SignalMediaCache is a Signal attachment or sticker that has already been uploaded to the Matrix media repo.
+// Media in encrypted rooms is cached separately, as the encryption keys are included in the content.
+type SignalMediaCache struct {
+	qh *dbutil.QueryHelper[*SignalMediaCache]
+
+	// SignalKey identifies the media on Signal, e.g. the attachment digest or the sticker pack and ID.
+	SignalKey string
+	Encrypted bool
+	// Content is the JSON-encoded Matrix message content, and Extra is the JSON-encoded extra fields of the event.
+	Content   string
+	Extra     string
+	ExpiresAt time.Time
+}
+
+func newSignalMediaCache(qh *dbutil.QueryHelper[*SignalMediaCache]) *SignalMediaCache {
+	return &SignalMediaCache{qh: qh}
+}
+
+func (smcq *SignalMediaCacheQuery) Get(ctx context.Context, signalKey string, encrypted bool) (*SignalMediaCache, error) {
+	return smcq.QueryOne(ctx, getSignalMediaCacheQuery, signalKey, encrypted, time.Now().UnixMilli())
+}
+
+func (smcq *SignalMediaCacheQuery) DeleteExpired(ctx context.Context) error {
+	return smcq.Exec(ctx, deleteExpiredSignalMediaCacheQuery, time.Now().UnixMilli())
+}
+
+func (smc *SignalMediaCache) Scan(row dbutil.Scannable) (*SignalMediaCache, error) {
+	var expiresAt int64
+	err := row.Scan(&smc.SignalKey, &smc.Encrypted, &smc.Content, &smc.Extra, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	smc.ExpiresAt = time.UnixMilli(expiresAt)
+	return smc, nil
+}
+
+func (smc *SignalMediaCache) Upsert(ctx context.Context) error {
+	return smc.qh.Exec(ctx, upsertSignalMediaCacheQuery, smc.SignalKey, smc.Encrypted, smc.Content, smc.Extra, smc.ExpiresAt.UnixMilli())
+}
+
+type MatrixMediaCacheQuery struct {
+	*dbutil.QueryHelper[*MatrixMediaCache]
+}
+
+// MatrixMediaCache is a Matrix file that has already been uploaded to the Signal CDN.
+type MatrixMediaCache struct {
+	qh *dbutil.QueryHelper[*MatrixMediaCache]
+
+	MXC id.ContentURIString
+	// FileHash is the SHA-256 hash of the encrypted file, or empty for unencrypted files.
+	FileHash string
+	// Attachment is the serialized signalpb.AttachmentPointer that can be reused to send the file.
+	Attachment []byte
+	ExpiresAt  time.Time
+}
+
+func newMatrixMediaCache(qh *dbutil.QueryHelper[*MatrixMediaCache]) *MatrixMediaCache {
+	return &MatrixMediaCache{qh: qh}
+}
+
+func (mmcq *MatrixMediaCacheQuery) Get(ctx context.Context, mxc id.ContentURIString, fileHash string) (*MatrixMediaCache, error) {
+	return mmcq.QueryOne(ctx, getMatrixMediaCacheQuery, mxc, fileHash, time.Now().UnixMilli())
+}
+
+func (mmcq *MatrixMediaCacheQuery) DeleteExpired(ctx context.Context) error {
+	return mmcq.Exec(ctx, deleteExpiredMatrixMediaCacheQuery, time.Now().UnixMilli())
+}
+
+func (mmc *MatrixMediaCache) Scan(row dbutil.Scannable) (*MatrixMediaCache, error) {
+	var expiresAt int64
+	err := row.Scan(&mmc.MXC, &mmc.FileHash, &mmc.Attachment, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	mmc.ExpiresAt = time.UnixMilli(expiresAt)
+	return mmc, nil
+}
+
+func (mmc *MatrixMediaCache) Upsert(ctx context.Context) error {
+	return mmc.qh.Exec(ctx, upsertMatrixMediaCacheQuery, mmc.MXC, mmc.FileHash, mmc.Attachment, mmc.ExpiresAt.UnixMilli())
+}
@@ -0,0 +1,122 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getOutgoingMessagesForUserQuery = `
+		SELECT mxid, mx_room, mx_sender, user_mxid, signal_chat_id, signal_receiver, timestamp, content, created_at, attempts
+		FROM outgoing_message WHERE user_mxid=$1
+		ORDER BY created_at ASC, timestamp ASC
+	`
+	hasOutgoingMessagesForPortalQuery = `
+		SELECT EXISTS(SELECT 1 FROM outgoing_message WHERE user_mxid=$1 AND signal_chat_id=$2 AND signal_receiver=$3)
+	`
+	insertOutgoingMessageQuery = `
+		INSERT INTO outgoing_message (mxid, mx_room, mx_sender, user_mxid, signal_chat_id, signal_receiver, timestamp, content, created_at, attempts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	updateOutgoingMessageAttemptsQuery = `
+		UPDATE outgoing_message SET attempts=$2 WHERE mxid=$1
+	`
+	deleteOutgoingMessageQuery = `
+		DELETE FROM outgoing_message WHERE mxid=$1
+	`
+)
+
+type OutgoingMessageQuery struct {
+	*dbutil.QueryHelper[*OutgoingMessage]
+}
+
+// OutgoingMessage is a Matrix event that has been converted to a Signal message,
+// but couldn't be sent yet because the user wasn't connected to Signal.
+type OutgoingMessage struct {
+	qh *dbutil.QueryHelper[*OutgoingMessage]
+
+	MXID     id.EventID
+	RoomID   id.RoomID
+	Sender   id.UserID
+	UserMXID id.UserID
+
+	SignalChatID   string
+	SignalReceiver uuid.UUID
+
+	// Timestamp is the Signal message timestamp, which is also included in Content.
+	Timestamp uint64
+	// Content is the serialized signalpb.Content to send.
+	Content   []byte
+	CreatedAt time.Time
+	Attempts  int
+}
+
+func newOutgoingMessage(qh *dbutil.QueryHelper[*OutgoingMessage]) *OutgoingMessage {
+	return &OutgoingMessage{qh: qh}
+}
+
+func (omq *OutgoingMessageQuery) GetAllForUser(ctx context.Context, userID id.UserID) ([]*OutgoingMessage, error) {
+	return omq.QueryMany(ctx, getOutgoingMessagesForUserQuery, userID)
+}
+
+func (omq *OutgoingMessageQuery) HasPendingForPortal(ctx context.Context, userID id.UserID, key PortalKey) (exists bool, err error) {
+	err = omq.GetDB().QueryRow(ctx, hasOutgoingMessagesForPortalQuery, userID, key.ChatID, key.Receiver).Scan(&exists)
+	return
+}
+
+func (msg *OutgoingMessage) Scan(row dbutil.Scannable) (*OutgoingMessage, error) {
+	var createdAt int64
+	err := row.Scan(
+		&msg.MXID, &msg.RoomID, &msg.Sender, &msg.UserMXID, &msg.SignalChatID, &msg.SignalReceiver,
+		&msg.Timestamp, &msg.Content, &createdAt, &msg.Attempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	msg.CreatedAt = time.UnixMilli(createdAt)
+	return msg, nil
+}
+
+func (msg *OutgoingMessage) PortalKey() PortalKey {
+	return PortalKey{ChatID: msg.SignalChatID, Receiver: msg.SignalReceiver}
+}
+
+func (msg *OutgoingMessage) sqlVariables() []any {
+	return []any{
+		msg.MXID, msg.RoomID, msg.Sender, msg.UserMXID, msg.SignalChatID, msg.SignalReceiver,
+		msg.Timestamp, msg.Content, msg.CreatedAt.UnixMilli(), msg.Attempts,
+	}
+}
+
+func (msg *OutgoingMessage) Insert(ctx context.Context) error {
+	return msg.qh.Exec(ctx, insertOutgoingMessageQuery, msg.sqlVariables()...)
+}
+
+func (msg *OutgoingMessage) SetAttempts(ctx context.Context, attempts int) error {
+	msg.Attempts = attempts
+	return msg.qh.Exec(ctx, updateOutgoingMessageAttemptsQuery, msg.MXID, attempts)
+}
+
+func (msg *OutgoingMessage) Delete(ctx context.Context) error {
+	return msg.qh.Exec(ctx, deleteOutgoingMessageQuery, msg.MXID)
+}
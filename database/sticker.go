@@ -0,0 +1,81 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getStickerBaseQuery = `
+		SELECT pack_id, sticker_id, emoji, content_type, mxc FROM sticker
+	`
+	getStickerByIDQuery    = getStickerBaseQuery + `WHERE pack_id=$1 AND sticker_id=$2`
+	getStickersByPackQuery = getStickerBaseQuery + `WHERE pack_id=$1 ORDER BY sticker_id ASC`
+	getStickerByMXCQuery   = getStickerBaseQuery + `WHERE mxc=$1 LIMIT 1`
+	upsertStickerQuery     = `
+		INSERT INTO sticker (pack_id, sticker_id, emoji, content_type, mxc) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (pack_id, sticker_id) DO UPDATE SET emoji=excluded.emoji, content_type=excluded.content_type, mxc=excluded.mxc
+	`
+)
+
+type StickerQuery struct {
+	*dbutil.QueryHelper[*Sticker]
+}
+
+// Sticker is a single sticker in a Signal sticker pack.
+// MXC is empty until the sticker image has been reuploaded to Matrix.
+type Sticker struct {
+	qh *dbutil.QueryHelper[*Sticker]
+
+	PackID      []byte
+	ID          uint32
+	Emoji       string
+	ContentType string
+	MXC         id.ContentURIString
+}
+
+func newSticker(qh *dbutil.QueryHelper[*Sticker]) *Sticker {
+	return &Sticker{qh: qh}
+}
+
+func (sq *StickerQuery) GetByID(ctx context.Context, packID []byte, stickerID uint32) (*Sticker, error) {
+	return sq.QueryOne(ctx, getStickerByIDQuery, packID, stickerID)
+}
+
+func (sq *StickerQuery) GetAllByPack(ctx context.Context, packID []byte) ([]*Sticker, error) {
+	return sq.QueryMany(ctx, getStickersByPackQuery, packID)
+}
+
+func (sq *StickerQuery) GetByMXC(ctx context.Context, mxc id.ContentURIString) (*Sticker, error) {
+	return sq.QueryOne(ctx, getStickerByMXCQuery, mxc)
+}
+
+func (sticker *Sticker) Scan(row dbutil.Scannable) (*Sticker, error) {
+	err := row.Scan(&sticker.PackID, &sticker.ID, &sticker.Emoji, &sticker.ContentType, &sticker.MXC)
+	if err != nil {
+		return nil, err
+	}
+	return sticker, nil
+}
+
+func (sticker *Sticker) Upsert(ctx context.Context) error {
+	return sticker.qh.Exec(ctx, upsertStickerQuery, sticker.PackID, sticker.ID, sticker.Emoji, sticker.ContentType, sticker.MXC)
+}
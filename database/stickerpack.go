@@ -0,0 +1,93 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getStickerPackByIDQuery = `
+		SELECT id, pack_key, title, author, cover_id FROM sticker_pack WHERE id=$1
+	`
+	getStickerPacksForUserQuery = `
+		SELECT id, pack_key, title, author, cover_id FROM sticker_pack
+		INNER JOIN user_sticker_pack ON user_sticker_pack.pack_id=sticker_pack.id
+		WHERE user_sticker_pack.user_mxid=$1
+	`
+	upsertStickerPackQuery = `
+		INSERT INTO sticker_pack (id, pack_key, title, author, cover_id) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET pack_key=excluded.pack_key, title=excluded.title, author=excluded.author, cover_id=excluded.cover_id
+	`
+	addStickerPackToUserQuery = `
+		INSERT INTO user_sticker_pack (user_mxid, pack_id) VALUES ($1, $2) ON CONFLICT (user_mxid, pack_id) DO NOTHING
+	`
+	removeStickerPackFromUserQuery = `
+		DELETE FROM user_sticker_pack WHERE user_mxid=$1 AND pack_id=$2
+	`
+)
+
+type StickerPackQuery struct {
+	*dbutil.QueryHelper[*StickerPack]
+}
+
+// StickerPack is the manifest of a Signal sticker pack. The stickers themselves are stored in the sticker table.
+type StickerPack struct {
+	qh *dbutil.QueryHelper[*StickerPack]
+
+	ID      []byte
+	Key     []byte
+	Title   string
+	Author  string
+	CoverID uint32
+}
+
+func newStickerPack(qh *dbutil.QueryHelper[*StickerPack]) *StickerPack {
+	return &StickerPack{qh: qh}
+}
+
+func (spq *StickerPackQuery) GetByID(ctx context.Context, packID []byte) (*StickerPack, error) {
+	return spq.QueryOne(ctx, getStickerPackByIDQuery, packID)
+}
+
+// GetAllForUser returns the sticker packs the user has installed on Signal.
+func (spq *StickerPackQuery) GetAllForUser(ctx context.Context, userID id.UserID) ([]*StickerPack, error) {
+	return spq.QueryMany(ctx, getStickerPacksForUserQuery, userID)
+}
+
+func (pack *StickerPack) Scan(row dbutil.Scannable) (*StickerPack, error) {
+	err := row.Scan(&pack.ID, &pack.Key, &pack.Title, &pack.Author, &pack.CoverID)
+	if err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+func (pack *StickerPack) Upsert(ctx context.Context) error {
+	return pack.qh.Exec(ctx, upsertStickerPackQuery, pack.ID, pack.Key, pack.Title, pack.Author, pack.CoverID)
+}
+
+func (pack *StickerPack) AddToUser(ctx context.Context, userID id.UserID) error {
+	return pack.qh.Exec(ctx, addStickerPackToUserQuery, userID, pack.ID)
+}
+
+func (pack *StickerPack) RemoveFromUser(ctx context.Context, userID id.UserID) error {
+	return pack.qh.Exec(ctx, removeStickerPackFromUserQuery, userID, pack.ID)
+}
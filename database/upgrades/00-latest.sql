@@ -1,4 +1,4 @@
--- v0 -> v19 (compatible with v17+): Latest revision
+-- v0 -> v23 (compatible with v17+): Latest revision
 
 CREATE TABLE portal (
     chat_id     TEXT    NOT NULL,
@@ -113,3 +113,91 @@ CREATE TABLE disappearing_message (
     expiration_seconds  BIGINT NOT NULL,
     expiration_ts       BIGINT
 );
+
+CREATE TABLE outgoing_message (
+    mxid      TEXT NOT NULL PRIMARY KEY,
+    mx_room   TEXT NOT NULL,
+    mx_sender TEXT NOT NULL,
+    user_mxid TEXT NOT NULL,
+
+    signal_chat_id  TEXT NOT NULL,
+    signal_receiver uuid NOT NULL,
+
+    timestamp  BIGINT  NOT NULL,
+    content    bytea   NOT NULL,
+    created_at BIGINT  NOT NULL,
+    attempts   INTEGER NOT NULL DEFAULT 0,
+
+    CONSTRAINT outgoing_message_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT outgoing_message_portal_fkey FOREIGN KEY (signal_chat_id, signal_receiver)
+        REFERENCES portal(chat_id, receiver) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX outgoing_message_user_idx ON outgoing_message (user_mxid, created_at);
+
+CREATE TABLE sticker_pack (
+    id       bytea   NOT NULL PRIMARY KEY,
+    pack_key bytea   NOT NULL,
+    title    TEXT    NOT NULL,
+    author   TEXT    NOT NULL,
+    cover_id BIGINT  NOT NULL
+);
+
+CREATE TABLE sticker (
+    pack_id      bytea  NOT NULL,
+    sticker_id   BIGINT NOT NULL,
+    emoji        TEXT   NOT NULL,
+    content_type TEXT   NOT NULL,
+    mxc          TEXT   NOT NULL,
+
+    PRIMARY KEY (pack_id, sticker_id),
+    CONSTRAINT sticker_pack_fkey FOREIGN KEY (pack_id)
+        REFERENCES sticker_pack(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX sticker_mxc_idx ON sticker (mxc);
+
+CREATE TABLE user_sticker_pack (
+    user_mxid TEXT  NOT NULL,
+    pack_id   bytea NOT NULL,
+
+    PRIMARY KEY (user_mxid, pack_id),
+    CONSTRAINT user_sticker_pack_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT user_sticker_pack_pack_fkey FOREIGN KEY (pack_id)
+        REFERENCES sticker_pack(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE file_transfer (
+    event_id    TEXT    NOT NULL PRIMARY KEY,
+    room_id     TEXT    NOT NULL,
+    user_mxid   TEXT    NOT NULL,
+    sender_uuid uuid    NOT NULL,
+
+    message_ts  BIGINT  NOT NULL,
+    file_name   TEXT    NOT NULL,
+    attachment  bytea   NOT NULL,
+    created_at  BIGINT  NOT NULL,
+    attempts    INTEGER NOT NULL DEFAULT 0,
+
+    CONSTRAINT file_transfer_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE signal_media_cache (
+    signal_key TEXT    NOT NULL,
+    encrypted  BOOLEAN NOT NULL,
+    content    TEXT    NOT NULL,
+    extra      TEXT    NOT NULL,
+    expires_at BIGINT  NOT NULL,
+
+    PRIMARY KEY (signal_key, encrypted)
+);
+
+CREATE TABLE matrix_media_cache (
+    mxc        TEXT   NOT NULL,
+    file_hash  TEXT   NOT NULL,
+    attachment bytea  NOT NULL,
+    expires_at BIGINT NOT NULL,
+
+    PRIMARY KEY (mxc, file_hash)
+);
@@ -0,0 +1,21 @@
+-- v20 (compatible with v17+): Add table for queued outgoing messages
+CREATE TABLE outgoing_message (
+    mxid      TEXT NOT NULL PRIMARY KEY,
+    mx_room   TEXT NOT NULL,
+    mx_sender TEXT NOT NULL,
+    user_mxid TEXT NOT NULL,
+
+    signal_chat_id  TEXT NOT NULL,
+    signal_receiver uuid NOT NULL,
+
+    timestamp  BIGINT  NOT NULL,
+    content    bytea   NOT NULL,
+    created_at BIGINT  NOT NULL,
+    attempts   INTEGER NOT NULL DEFAULT 0,
+
+    CONSTRAINT outgoing_message_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT outgoing_message_portal_fkey FOREIGN KEY (signal_chat_id, signal_receiver)
+        REFERENCES portal(chat_id, receiver) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX outgoing_message_user_idx ON outgoing_message (user_mxid, created_at);
@@ -0,0 +1,32 @@
+-- v21 (compatible with v17+): Add tables for Signal sticker packs
+CREATE TABLE sticker_pack (
+    id       bytea   NOT NULL PRIMARY KEY,
+    pack_key bytea   NOT NULL,
+    title    TEXT    NOT NULL,
+    author   TEXT    NOT NULL,
+    cover_id BIGINT  NOT NULL
+);
+
+CREATE TABLE sticker (
+    pack_id      bytea  NOT NULL,
+    sticker_id   BIGINT NOT NULL,
+    emoji        TEXT   NOT NULL,
+    content_type TEXT   NOT NULL,
+    mxc          TEXT   NOT NULL,
+
+    PRIMARY KEY (pack_id, sticker_id),
+    CONSTRAINT sticker_pack_fkey FOREIGN KEY (pack_id)
+        REFERENCES sticker_pack(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX sticker_mxc_idx ON sticker (mxc);
+
+CREATE TABLE user_sticker_pack (
+    user_mxid TEXT  NOT NULL,
+    pack_id   bytea NOT NULL,
+
+    PRIMARY KEY (user_mxid, pack_id),
+    CONSTRAINT user_sticker_pack_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    CONSTRAINT user_sticker_pack_pack_fkey FOREIGN KEY (pack_id)
+        REFERENCES sticker_pack(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,16 @@
+-- v22 (compatible with v17+): Add table for asynchronous file transfers
+CREATE TABLE file_transfer (
+    event_id    TEXT    NOT NULL PRIMARY KEY,
+    room_id     TEXT    NOT NULL,
+    user_mxid   TEXT    NOT NULL,
+    sender_uuid uuid    NOT NULL,
+
+    message_ts  BIGINT  NOT NULL,
+    file_name   TEXT    NOT NULL,
+    attachment  bytea   NOT NULL,
+    created_at  BIGINT  NOT NULL,
+    attempts    INTEGER NOT NULL DEFAULT 0,
+
+    CONSTRAINT file_transfer_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
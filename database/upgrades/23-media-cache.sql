@@ -0,0 +1,19 @@
+-- v23 (compatible with v17+): Add tables for caching bridged media
+CREATE TABLE signal_media_cache (
+    signal_key TEXT    NOT NULL,
+    encrypted  BOOLEAN NOT NULL,
+    content    TEXT    NOT NULL,
+    extra      TEXT    NOT NULL,
+    expires_at BIGINT  NOT NULL,
+
+    PRIMARY KEY (signal_key, encrypted)
+);
+
+CREATE TABLE matrix_media_cache (
+    mxc        TEXT   NOT NULL,
+    file_hash  TEXT   NOT NULL,
+    attachment bytea  NOT NULL,
+    expires_at BIGINT NOT NULL,
+
+    PRIMARY KEY (mxc, file_hash)
+);
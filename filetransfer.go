@@ -0,0 +1,252 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2023 Scott Weber
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/msgconv"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	fileTransferMinBackoff   = 5 * time.Second
+	fileTransferMaxBackoff   = 5 * time.Minute
+	fileTransferPollInterval = 1 * time.Minute
+)
+
+// FileTransferManager downloads Signal attachments in the background and edits the placeholder
+// Matrix events that were sent for them into the actual media.
+type FileTransferManager struct {
+	DB     *database.Database
+	Log    zerolog.Logger
+	Bridge *SignalBridge
+
+	queue chan *database.FileTransfer
+	// active contains the transfers that are queued, in progress or waiting for a retry,
+	// so that polling the database doesn't queue them again.
+	active     map[id.EventID]struct{}
+	activeLock sync.Mutex
+}
+
+// Start starts the worker pool and periodically queues unfinished transfers from the database.
+func (ftm *FileTransferManager) Start(ctx context.Context) {
+	workers := ftm.Bridge.Config.Bridge.FileTransfers.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go ftm.worker(ftm.Log.With().Int("worker", i).Logger().WithContext(ctx))
+	}
+	ftm.queueUnfinished(ctx, true)
+	ticker := time.NewTicker(fileTransferPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ftm.queueUnfinished(ctx, false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ftm *FileTransferManager) queueUnfinished(ctx context.Context, initial bool) {
+	transfers, err := ftm.DB.FileTransfer.GetAll(ctx)
+	if err != nil {
+		ftm.Log.Err(err).Msg("Failed to get unfinished file transfers")
+		return
+	}
+	if initial && len(transfers) > 0 {
+		ftm.Log.Info().Int("transfer_count", len(transfers)).Msg("Resuming unfinished file transfers")
+	}
+	for _, transfer := range transfers {
+		ftm.Queue(transfer)
+	}
+}
+
+// Queue adds a transfer to the queue of the worker pool. It never blocks, so it's safe to call from portal loops.
+// If the queue is full, the transfer is left in the database to be picked up by the next poll.
+func (ftm *FileTransferManager) Queue(transfer *database.FileTransfer) {
+	ftm.activeLock.Lock()
+	defer ftm.activeLock.Unlock()
+	if _, alreadyActive := ftm.active[transfer.EventID]; alreadyActive {
+		return
+	}
+	select {
+	case ftm.queue <- transfer:
+		ftm.active[transfer.EventID] = struct{}{}
+	default:
+		ftm.Log.Debug().
+			Stringer("event_id", transfer.EventID).
+			Msg("File transfer queue is full, transfer will be retried from the database")
+	}
+}
+
+func (ftm *FileTransferManager) markInactive(transfer *database.FileTransfer) {
+	ftm.activeLock.Lock()
+	delete(ftm.active, transfer.EventID)
+	ftm.activeLock.Unlock()
+}
+
+func (ftm *FileTransferManager) worker(ctx context.Context) {
+	for transfer := range ftm.queue {
+		ftm.handleTransfer(ctx, transfer)
+	}
+}
+
+func (ftm *FileTransferManager) handleTransfer(ctx context.Context, transfer *database.FileTransfer) {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("event_id", transfer.EventID).
+		Stringer("room_id", transfer.RoomID).
+		Uint64("msg_ts", transfer.MessageTimestamp).
+		Int("attempts", transfer.Attempts).
+		Logger()
+	ctx = log.WithContext(ctx)
+	portal := ftm.Bridge.GetPortalByMXID(transfer.RoomID)
+	if portal == nil {
+		log.Warn().Msg("Portal of file transfer not found, dropping transfer")
+		ftm.deleteTransfer(ctx, transfer)
+		ftm.markInactive(transfer)
+		return
+	}
+	err := ftm.transfer(ctx, portal, transfer)
+	if err == nil {
+		log.Debug().Msg("File transfer finished")
+		ftm.deleteTransfer(ctx, transfer)
+		ftm.markInactive(transfer)
+		return
+	}
+	log.Err(err).Msg("File transfer failed")
+	if transfer.Attempts+1 >= ftm.Bridge.Config.Bridge.FileTransfers.MaxAttempts {
+		ftm.deleteTransfer(ctx, transfer)
+		ftm.markInactive(transfer)
+		portal.editFileTransferPlaceholder(ctx, transfer, &msgconv.ConvertedMessagePart{
+			Type: event.EventMessage,
+			Content: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("Failed to transfer %s from Signal: %v", transfer.FileName, err),
+			},
+		})
+		return
+	}
+	if dbErr := transfer.SetAttempts(ctx, transfer.Attempts+1); dbErr != nil {
+		log.Err(dbErr).Msg("Failed to update file transfer attempt count")
+	}
+	backoff := fileTransferMinBackoff << transfer.Attempts
+	if backoff > fileTransferMaxBackoff || backoff <= 0 {
+		backoff = fileTransferMaxBackoff
+	}
+	time.AfterFunc(backoff, func() {
+		ftm.markInactive(transfer)
+		ftm.Queue(transfer)
+	})
+}
+
+func (ftm *FileTransferManager) transfer(ctx context.Context, portal *Portal, transfer *database.FileTransfer) error {
+	var att signalpb.AttachmentPointer
+	err := proto.Unmarshal(transfer.Attachment, &att)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal attachment pointer: %w", err)
+	}
+	user := ftm.Bridge.GetUserByMXIDIfExists(transfer.UserMXID)
+	if user == nil || user.Client == nil {
+		return fmt.Errorf("user isn't logged in")
+	}
+	sender := ftm.Bridge.GetPuppetBySignalID(transfer.Sender)
+	if sender == nil {
+		return fmt.Errorf("sender puppet not found")
+	}
+	ctx = context.WithValue(ctx, msgconvContextKeyIntent, sender.IntentFor(portal))
+	ctx = context.WithValue(ctx, msgconvContextKeyClient, user.Client)
+	part, err := portal.MsgConv.TransferAttachment(ctx, &att)
+	if err != nil {
+		return err
+	}
+	return portal.editFileTransferPlaceholder(ctx, transfer, part)
+}
+
+func (ftm *FileTransferManager) deleteTransfer(ctx context.Context, transfer *database.FileTransfer) {
+	err := transfer.Delete(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to delete file transfer from database")
+	}
+}
+
+// editFileTransferPlaceholder replaces the placeholder of a file transfer with the transferred attachment,
+// or with an error notice if the transfer failed.
+func (portal *Portal) editFileTransferPlaceholder(ctx context.Context, transfer *database.FileTransfer, part *msgconv.ConvertedMessagePart) error {
+	intent := portal.MainIntent()
+	if sender := portal.bridge.GetPuppetBySignalID(transfer.Sender); sender != nil {
+		intent = sender.IntentFor(portal)
+	}
+	part.Content.SetEdit(transfer.EventID)
+	part.Content.Mentions = &event.Mentions{}
+	if part.Extra != nil {
+		part.Extra = map[string]any{
+			"m.new_content": part.Extra,
+		}
+	}
+	_, err := portal.sendMatrixEvent(ctx, intent, part.Type, part.Content, part.Extra, 0)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to edit file transfer placeholder")
+		return fmt.Errorf("failed to send edit: %w", err)
+	}
+	return nil
+}
+
+var _ msgconv.ExtendedPortalMethods = (*Portal)(nil)
+
+// QueueFileTransfer persists a background transfer for the attachment of a placeholder that was sent as the given event.
+// The transfer uses the Signal client in the context, like the rest of the message conversion.
+func (portal *Portal) QueueFileTransfer(ctx context.Context, placeholder id.EventID, sender uuid.UUID, msgTS uint64, ap *signalpb.AttachmentPointer) error {
+	client := portal.GetClient(ctx)
+	source := portal.bridge.GetUserBySignalID(client.Store.ACI)
+	if source == nil {
+		return errors.New("user of signal client not found")
+	}
+	attachmentBytes, err := proto.Marshal(ap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment pointer: %w", err)
+	}
+	transfer := portal.bridge.DB.FileTransfer.New()
+	transfer.EventID = placeholder
+	transfer.RoomID = portal.MXID
+	transfer.UserMXID = source.MXID
+	transfer.Sender = sender
+	transfer.MessageTimestamp = msgTS
+	transfer.FileName = msgconv.AttachmentFileName(ap)
+	transfer.Attachment = attachmentBytes
+	transfer.CreatedAt = time.Now()
+	err = transfer.Insert(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert file transfer: %w", err)
+	}
+	portal.bridge.fileTransferManager.Queue(transfer)
+	return nil
+}
@@ -0,0 +1,165 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+)
+
+// LoginArchivePassphraseEnv is the environment variable that the passphrase for login archives is read from.
+// Alternatively, LoginArchivePassphraseFileEnv can point at a file containing the passphrase.
+// The passphrase is never accepted in chat commands, as it would be stored in the room history.
+const (
+	LoginArchivePassphraseEnv     = "MAUTRIX_SIGNAL_LOGIN_ARCHIVE_PASSPHRASE"
+	LoginArchivePassphraseFileEnv = "MAUTRIX_SIGNAL_LOGIN_ARCHIVE_PASSPHRASE_FILE"
+)
+
+var (
+	errNoSignalLogin            = errors.New("user isn't logged into Signal")
+	errAlreadyLoggedIn          = errors.New("user is already logged into Signal")
+	errLoginOwnedByOtherUser    = errors.New("the Signal account in the archive is already logged in by another user")
+	errMissingArchivePassphrase = fmt.Errorf("the %s or %s environment variable must be set", LoginArchivePassphraseEnv, LoginArchivePassphraseFileEnv)
+)
+
+// getLoginArchivePassphrase reads the login archive passphrase from the environment or the file it points at.
+func getLoginArchivePassphrase() (string, error) {
+	if passphrase := os.Getenv(LoginArchivePassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	path := os.Getenv(LoginArchivePassphraseFileEnv)
+	if path == "" {
+		return "", errMissingArchivePassphrase
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	passphrase := strings.TrimSpace(string(data))
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+// ExportLogin exports the Signal login of the user into a passphrase-encrypted archive and passes it to save.
+// The login is moved rather than copied: after it has been saved, it's removed from this bridge,
+// as two bridges using the same login would break its sessions.
+func (br *SignalBridge) ExportLogin(ctx context.Context, user *User, passphrase string, save func(archive []byte) error) error {
+	if user.SignalID == uuid.Nil {
+		return errNoSignalLogin
+	}
+	user.Lock()
+	defer user.Unlock()
+	if user.Client != nil {
+		_, err := user.disconnectNoLock()
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to disconnect user before exporting login")
+		}
+	}
+	archive, err := br.MeowStore.ExportDevice(ctx, user.SignalID, passphrase)
+	if errors.Is(err, store.ErrDeviceNotFound) {
+		return errNoSignalLogin
+	} else if err != nil {
+		return err
+	}
+	err = save(archive)
+	if err != nil {
+		return fmt.Errorf("failed to save exported login: %w", err)
+	}
+	err = br.MeowStore.DeleteDevice(ctx, &store.DeviceData{ACI: user.SignalID})
+	if err != nil {
+		return fmt.Errorf("failed to remove exported login: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().Stringer("signal_id", user.SignalID).Msg("Exported Signal login")
+	user.saveSignalID(ctx, uuid.Nil, "")
+	return nil
+}
+
+// ImportLogin imports a Signal login from an archive created by ExportLogin. The caller is responsible for
+// connecting the user afterwards.
+func (br *SignalBridge) ImportLogin(ctx context.Context, user *User, archive []byte, passphrase string) error {
+	export, err := store.OpenDeviceExport(archive, passphrase)
+	if err != nil {
+		return err
+	}
+	// The persisted ID is checked rather than the connection state, as a user whose client is disconnected
+	// still owns the login in the store.
+	if user.SignalID != uuid.Nil && user.SignalID != export.ACI() {
+		return errAlreadyLoggedIn
+	}
+	if existingUser := br.GetUserBySignalID(export.ACI()); existingUser != nil && existingUser != user {
+		return fmt.Errorf("%w (%s)", errLoginOwnedByOtherUser, existingUser.MXID)
+	}
+	device, err := br.MeowStore.ImportDevice(ctx, export)
+	if err != nil {
+		return err
+	}
+	user.saveSignalID(ctx, device.ACI, device.Number)
+	zerolog.Ctx(ctx).Info().Stringer("signal_id", device.ACI).Msg("Imported Signal login")
+	return nil
+}
+
+// runLoginArchiveFlags handles the --export-login and --import-login flags.
+// It returns false if neither flag was used and the bridge should start normally.
+func (br *SignalBridge) runLoginArchiveFlags() bool {
+	if *exportLoginFlag == "" && *importLoginFlag == "" {
+		return false
+	}
+	log := br.ZLog.With().Str("action", "login archive").Logger()
+	ctx := log.WithContext(context.TODO())
+	err := br.handleLoginArchiveFlags(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to handle login archive")
+		os.Exit(1)
+	}
+	return true
+}
+
+func (br *SignalBridge) handleLoginArchiveFlags(ctx context.Context) error {
+	passphrase, err := getLoginArchivePassphrase()
+	if err != nil {
+		return err
+	}
+	if *exportLoginFlag != "" {
+		user := br.GetUserByMXIDIfExists(id.UserID(*exportLoginFlag))
+		if user == nil {
+			return fmt.Errorf("user %s not found", *exportLoginFlag)
+		}
+		return br.ExportLogin(ctx, user, passphrase, func(archive []byte) error {
+			return os.WriteFile(*loginArchiveFlag, archive, 0600)
+		})
+	}
+	user := br.GetUserByMXID(id.UserID(*importLoginFlag))
+	if user == nil {
+		return fmt.Errorf("invalid user ID %s", *importLoginFlag)
+	}
+	archive, err := os.ReadFile(*loginArchiveFlag)
+	if err != nil {
+		return err
+	}
+	return br.ImportLogin(ctx, user, archive, passphrase)
+}
@@ -19,14 +19,17 @@ package main
 import (
 	"context"
 	_ "embed"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/configupgrade"
 	"go.mau.fi/util/dbutil"
+	flag "maunium.net/go/mauflag"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
@@ -45,6 +48,11 @@ import (
 //go:embed example-config.yaml
 var ExampleConfig string
 
+var exportLoginFlag = flag.Make().LongKey("export-login").Usage("Export the Signal login of the given Matrix user into the file specified with --login-archive and quit.").String()
+var importLoginFlag = flag.Make().LongKey("import-login").Usage("Import the Signal login in the file specified with --login-archive for the given Matrix user and quit.").String()
+var loginArchiveFlag = flag.Make().LongKey("login-archive").Usage("Path to the login archive for --export-login and --import-login.").Default("signal-login.bin").String()
+var rotateStoreKeyFlag = flag.Make().LongKey("rotate-store-key").Usage("Re-encrypt the Signal keys in the database with the key in the " + NewStoreKeyEnv + " environment variable and quit.").Bool()
+
 // Information to find out exactly which commit the bridge was built from.
 // These are filled at build time with the -X linker flag.
 var (
@@ -61,6 +69,8 @@ type SignalBridge struct {
 	Metrics   *MetricsHandler
 	MeowStore *store.StoreContainer
 
+	SignalServer *signalmeow.Server
+
 	provisioning *ProvisioningAPI
 
 	usersByMXID     map[id.UserID]*User
@@ -79,9 +89,13 @@ type SignalBridge struct {
 	puppetsLock         sync.Mutex
 
 	disappearingMessagesManager *DisappearingMessagesManager
+	fileTransferManager         *FileTransferManager
 }
 
-var _ bridge.ChildOverride = (*SignalBridge)(nil)
+var (
+	_ bridge.ChildOverride          = (*SignalBridge)(nil)
+	_ bridge.ConfigValidatingBridge = (*SignalBridge)(nil)
+)
 
 func (br *SignalBridge) GetExampleConfig() string {
 	return ExampleConfig
@@ -101,8 +115,20 @@ func (br *SignalBridge) Init() {
 
 	signalmeow.SetLogger(br.ZLog.With().Str("component", "signalmeow").Logger())
 
+	var err error
+	br.SignalServer, err = br.initSignalServer()
+	if err != nil {
+		br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to initialize Signal server config")
+		os.Exit(14)
+	}
+
 	br.DB = database.New(br.Bridge.DB)
 	br.MeowStore = store.NewStore(br.Bridge.DB, dbutil.ZeroLogger(br.ZLog.With().Str("db_section", "signalmeow").Logger()))
+	err = br.initStoreEncryption()
+	if err != nil {
+		br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to initialize signalmeow store encryption")
+		os.Exit(14)
+	}
 
 	ss := br.Config.Bridge.Provisioning.SharedSecret
 	if len(ss) > 0 && ss != "disable" {
@@ -113,6 +139,13 @@ func (br *SignalBridge) Init() {
 		Log:    br.ZLog.With().Str("component", "disappearing messages").Logger(),
 		Bridge: br,
 	}
+	br.fileTransferManager = &FileTransferManager{
+		DB:     br.DB,
+		Log:    br.ZLog.With().Str("component", "file transfers").Logger(),
+		Bridge: br,
+		queue:  make(chan *database.FileTransfer, 128),
+		active: make(map[id.EventID]struct{}),
+	}
 
 	br.Metrics = NewMetricsHandler(br.Config.Metrics.Listen, br.Log.Sub("Metrics"), br.DB)
 	br.MatrixHandler.TrackEventDuration = br.Metrics.TrackMatrixEvent
@@ -151,6 +184,78 @@ func (br *SignalBridge) Init() {
 	}
 }
 
+// signalEnvironment returns the configured Signal environment preset with the overrides from the config applied.
+func (br *SignalBridge) signalEnvironment() (*signalmeow.Environment, error) {
+	cfg := &br.Config.Signal
+	env := signalmeow.EnvironmentByName(cfg.Environment)
+	if env == nil {
+		return nil, fmt.Errorf("unknown environment %q", cfg.Environment)
+	}
+	if cfg.Hosts.API != "" {
+		env.Hosts.API = cfg.Hosts.API
+	}
+	if cfg.Hosts.Storage != "" {
+		env.Hosts.Storage = cfg.Hosts.Storage
+	}
+	if cfg.Hosts.ContactDiscovery != "" {
+		env.Hosts.ContactDiscovery = cfg.Hosts.ContactDiscovery
+	}
+	for num, host := range cfg.Hosts.CDN {
+		env.Hosts.CDN[num] = host
+	}
+	if cfg.ServerPublicParams != "" {
+		params, err := base64.StdEncoding.DecodeString(cfg.ServerPublicParams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode server public params: %w", err)
+		}
+		env.ServerPublicParams = params
+	}
+	if cfg.TrustRoot != "" {
+		env.TrustRoot = cfg.TrustRoot
+	}
+	if cfg.ContactDiscoveryMrenclave != "" {
+		env.ContactDiscoveryMrenclave = cfg.ContactDiscoveryMrenclave
+	}
+	return env, nil
+}
+
+func (br *SignalBridge) initSignalServer() (*signalmeow.Server, error) {
+	env, err := br.signalEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.Connect(br.Config.Signal.Proxy, br.Config.Signal.ExtraCACerts)
+}
+
+func (br *SignalBridge) ValidateConfig() error {
+	env, err := br.signalEnvironment()
+	if err != nil {
+		return fmt.Errorf("invalid signal config: %w", err)
+	} else if err = env.Validate(); err != nil {
+		return fmt.Errorf("invalid signal config: %w", err)
+	}
+	return nil
+}
+
+// pruneMediaCache periodically deletes cached media mappings which refer to expired Signal attachments.
+func (br *SignalBridge) pruneMediaCache(ctx context.Context) {
+	for {
+		err := br.DB.SignalMediaCache.DeleteExpired(ctx)
+		if err != nil {
+			br.ZLog.Err(err).Msg("Failed to delete expired Signal media cache entries")
+		}
+		err = br.DB.MatrixMediaCache.DeleteExpired(ctx)
+		if err != nil {
+			br.ZLog.Err(err).Msg("Failed to delete expired Matrix media cache entries")
+		}
+		select {
+		case <-time.After(24 * time.Hour):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (br *SignalBridge) logLostPortals(ctx context.Context) {
 	exists, err := br.DB.TableExists(ctx, "lost_portals")
 	if err != nil {
@@ -183,6 +288,17 @@ func (br *SignalBridge) Start() {
 		br.Log.Fatalln("Failed to upgrade signalmeow database: %v", err)
 		os.Exit(15)
 	}
+	if br.runStoreKeyRotationFlag() {
+		os.Exit(0)
+	}
+	err = br.MeowStore.MigrateEncryption(br.ZLog.WithContext(context.TODO()))
+	if err != nil {
+		br.ZLog.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to migrate signalmeow store encryption")
+		os.Exit(15)
+	}
+	if br.runLoginArchiveFlags() {
+		os.Exit(0)
+	}
 	if br.provisioning != nil {
 		br.Log.Debugln("Initializing provisioning API")
 		br.provisioning.Init()
@@ -192,6 +308,8 @@ func (br *SignalBridge) Start() {
 		go br.Metrics.Start()
 	}
 	go br.disappearingMessagesManager.StartDisappearingLoop(context.TODO())
+	go br.fileTransferManager.Start(context.TODO())
+	go br.pruneMediaCache(context.TODO())
 }
 
 func (br *SignalBridge) Stop() {
@@ -336,6 +454,8 @@ func main() {
 		BeeperServiceName: "signal",
 		BeeperNetworkName: "signal",
 
+		AdditionalLongFlags: " [--export-login <mxid> | --import-login <mxid>] [--login-archive <path>]",
+
 		CryptoPickleKey: "mautrix.bridge.e2ee",
 
 		ConfigUpgrader: &configupgrade.StructUpgrader{
@@ -0,0 +1,173 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// Signal clients don't allow sending more than 32 attachments in one message
+const maxMediaBatchSize = 32
+
+type mediaBatchItem struct {
+	orig portalMatrixMessage
+	msg  *signalpb.DataMessage
+	ms   *metricSender
+}
+
+// pendingMediaBatch is a set of consecutive Matrix media events from one user that will be sent to Signal as a single album.
+type pendingMediaBatch struct {
+	sender *User
+	items  []mediaBatchItem
+	timer  *time.Timer
+}
+
+func (batch *pendingMediaBatch) hasCaption() bool {
+	for _, item := range batch.items {
+		if item.msg.GetBody() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isBatchableMedia checks if the message contains a single image or video, which can be combined with others into an album.
+func isBatchableMedia(msg *signalpb.DataMessage) bool {
+	if len(msg.Attachments) != 1 || msg.Sticker != nil || len(msg.Contact) > 0 {
+		return false
+	}
+	att := msg.Attachments[0]
+	if att.GetFlags()&uint32(signalpb.AttachmentPointer_VOICE_MESSAGE) != 0 {
+		return false
+	}
+	contentType := att.GetContentType()
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/")
+}
+
+// isBatchCaption checks if the message is a plain text message that can be used as the caption of an album.
+func isBatchCaption(msg *signalpb.DataMessage) bool {
+	return msg.GetBody() != "" && len(msg.Attachments) == 0 && msg.Sticker == nil && len(msg.Contact) == 0 &&
+		msg.Quote == nil && len(msg.Preview) == 0
+}
+
+func (portal *Portal) mediaBatchTimeout() <-chan time.Time {
+	if portal.mediaBatch == nil {
+		return nil
+	}
+	return portal.mediaBatch.timer.C
+}
+
+// addToMediaBatch adds a converted Matrix message to the pending media batch if batching is enabled and the message
+// can be combined with the previous ones. Returns false if the message should be sent normally instead.
+func (portal *Portal) addToMediaBatch(ctx context.Context, sender *User, orig portalMatrixMessage, msg *signalpb.DataMessage, ms *metricSender) bool {
+	window := portal.bridge.Config.Bridge.MediaBatchWindow
+	if window <= 0 {
+		return false
+	}
+	batch := portal.mediaBatch
+	if batch != nil && batch.sender == sender && !batch.hasCaption() && isBatchCaption(msg) {
+		// A text message right after the media is used as the caption of the album
+		batch.items = append(batch.items, mediaBatchItem{orig: orig, msg: msg, ms: ms})
+		portal.flushMediaBatch()
+		return true
+	} else if !isBatchableMedia(msg) {
+		return false
+	}
+	if batch != nil && (batch.sender != sender || msg.Quote != nil || (msg.GetBody() != "" && batch.hasCaption())) {
+		portal.flushMediaBatch()
+		batch = nil
+	}
+	if batch == nil {
+		batch = &pendingMediaBatch{sender: sender, timer: time.NewTimer(window)}
+		portal.mediaBatch = batch
+	} else {
+		if !batch.timer.Stop() {
+			<-batch.timer.C
+		}
+		batch.timer.Reset(window)
+	}
+	batch.items = append(batch.items, mediaBatchItem{orig: orig, msg: msg, ms: ms})
+	zerolog.Ctx(ctx).Debug().Int("batch_size", len(batch.items)).Msg("Added media to pending batch")
+	if len(batch.items) >= maxMediaBatchSize {
+		portal.flushMediaBatch()
+	}
+	return true
+}
+
+// mergeMediaBatch combines the messages in the batch into one message, using the timestamp and quote of the first one.
+func mergeMediaBatch(items []mediaBatchItem) *signalpb.DataMessage {
+	merged := proto.Clone(items[0].msg).(*signalpb.DataMessage)
+	for _, item := range items[1:] {
+		merged.Attachments = append(merged.Attachments, item.msg.Attachments...)
+		if merged.GetBody() == "" && item.msg.GetBody() != "" {
+			merged.Body = item.msg.Body
+			merged.BodyRanges = item.msg.BodyRanges
+		}
+	}
+	return merged
+}
+
+// flushMediaBatch sends the pending media batch to Signal as a single message.
+// All the Matrix events in the batch are mapped to the same Signal message.
+func (portal *Portal) flushMediaBatch() {
+	batch := portal.mediaBatch
+	if batch == nil {
+		return
+	}
+	portal.mediaBatch = nil
+	batch.timer.Stop()
+
+	first := batch.items[0]
+	log := portal.log.With().
+		Str("action", "send media batch").
+		Stringer("first_event_id", first.orig.evt.ID).
+		Int("batch_size", len(batch.items)).
+		Logger()
+	metricsCtx := log.WithContext(context.TODO())
+	ctx := metricsCtx
+	if deadline := portal.bridge.Config.Bridge.MessageHandlingTimeout.Deadline; deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	msg := mergeMediaBatch(batch.items)
+	log.Debug().Uint64("msg_ts", msg.GetTimestamp()).Msg("Sending media batch")
+	err := portal.sendConvertedMatrixMessage(ctx, batch.sender, first.orig.evt, &signalpb.Content{DataMessage: msg}, msg.GetTimestamp())
+
+	isQueued := errors.Is(err, errMessageQueued) || errors.Is(err, errMessageRateLimited)
+	for i, item := range batch.items {
+		item.ms.lock.Lock()
+		item.ms.ctx = metricsCtx
+		item.ms.lock.Unlock()
+		go item.ms.sendMessageMetrics(item.orig.evt, err, "Error sending", true)
+		// The first event is stored after sending from the outbox, but the rest of the batch needs to be stored now
+		if err == nil || (isQueued && i > 0) {
+			portal.storeMessageInDB(ctx, item.orig.evt.ID, batch.sender.SignalID, msg.GetTimestamp(), i)
+			if portal.ExpirationTime > 0 {
+				portal.addDisappearingMessage(ctx, item.orig.evt.ID, uint32(portal.ExpirationTime), true)
+			}
+		}
+	}
+}
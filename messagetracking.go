@@ -30,6 +30,7 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-signal/msgconv"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
 )
 
 var (
@@ -52,10 +53,17 @@ var (
 
 	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
 	errTimeoutBeforeHandling = errors.New("message timed out before handling was started")
+
+	errMessageQueued        = errors.New("not connected to Signal, message was queued")
+	errMessageRateLimited   = errors.New("rate limited by Signal, message was queued")
+	errOutboxMessageExpired = errors.New("message was queued for too long")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string) {
+	var challengeErr *signalmeow.RateLimitChallengeError
 	switch {
+	case errors.Is(err, errMessageRateLimited), errors.As(err, &challengeErr):
+		return event.MessageStatusGenericError, event.MessageStatusPending, true, false, "Signal is rate limiting your messages, the message will be sent after you solve a captcha"
 	case errors.Is(err, errUnexpectedParsedContentType),
 		errors.Is(err, msgconv.ErrUnsupportedMsgType),
 		errors.Is(err, msgconv.ErrInvalidGeoURI):
@@ -70,6 +78,10 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, "the message was too old when it reached the bridge, so it was not handled"
 	case errors.Is(err, context.DeadlineExceeded):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, false, true, "handling the message took too long and was cancelled"
+	case errors.Is(err, errMessageQueued):
+		return event.MessageStatusNetworkError, event.MessageStatusPending, true, false, "the message will be sent when the bridge reconnects to Signal"
+	case errors.Is(err, errOutboxMessageExpired):
+		return event.MessageStatusTooOld, event.MessageStatusFail, true, true, "the bridge was disconnected from Signal for too long, so the message was not sent"
 	case errors.Is(err, errMessageTakingLong):
 		return event.MessageStatusTooOld, event.MessageStatusPending, false, true, err.Error()
 	case errors.Is(err, errRedactionTargetNotFound),
@@ -24,6 +24,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -32,6 +33,8 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-signal/database"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
 )
 
 type MetricsHandler struct {
@@ -49,6 +52,10 @@ type MetricsHandler struct {
 	countCollection         prometheus.Histogram
 	disconnections          *prometheus.CounterVec
 	incomingRetryReceipts   *prometheus.CounterVec
+	duplicateEnvelopes      *prometheus.CounterVec
+	envelopeQueueDepth      prometheus.Gauge
+	envelopeStageDuration   *prometheus.HistogramVec
+	preKeyCounts            *prometheus.GaugeVec
 	connectionFailures      *prometheus.CounterVec
 	puppetCount             prometheus.Gauge
 	userCount               prometheus.Gauge
@@ -107,6 +114,22 @@ func NewMetricsHandler(address string, log log.Logger, db *database.Database) *M
 			Name: "bridge_incoming_retry_receipts",
 			Help: "Number of times a remote Signal user has requested a retry from the bridge. retry_count = 5 is usually the last attempt (and very likely means a failed message)",
 		}, []string{"retry_count", "message_found"}),
+		duplicateEnvelopes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "bridge_duplicate_envelopes",
+			Help: "Number of envelopes redelivered by the Signal server that were dropped because they were already processed",
+		}, []string{"envelope_type"}),
+		envelopeQueueDepth: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "bridge_envelope_queue_depth",
+			Help: "Number of envelopes received from Signal that are waiting to be decrypted",
+		}),
+		envelopeStageDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "bridge_envelope_stage",
+			Help: "Time spent in each stage of handling envelopes received from Signal",
+		}, []string{"stage"}),
+		preKeyCounts: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bridge_signal_prekeys",
+			Help: "Number of one-time prekeys left on the Signal server",
+		}, []string{"signal_id", "identity", "type"}),
 		puppetCount: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "bridge_puppets_total",
 			Help: "Number of Signal users bridged into Matrix",
@@ -192,6 +215,38 @@ func (mh *MetricsHandler) TrackRetryReceipt(count int, found bool) {
 	}).Inc()
 }
 
+func (mh *MetricsHandler) TrackDuplicateEnvelope(envelopeType signalpb.Envelope_Type) {
+	if !mh.running {
+		return
+	}
+	mh.duplicateEnvelopes.With(prometheus.Labels{"envelope_type": envelopeType.String()}).Inc()
+}
+
+func (mh *MetricsHandler) TrackEnvelopeQueue(delta int) {
+	if !mh.running {
+		return
+	}
+	mh.envelopeQueueDepth.Add(float64(delta))
+}
+
+func (mh *MetricsHandler) TrackEnvelopeStage(stage string, duration time.Duration) {
+	if !mh.running {
+		return
+	}
+	mh.envelopeStageDuration.With(prometheus.Labels{"stage": stage}).Observe(duration.Seconds())
+}
+
+func (mh *MetricsHandler) TrackPreKeyCounts(aci uuid.UUID, uuidKind types.UUIDKind, preKeyCount, kyberPreKeyCount int) {
+	if !mh.running {
+		return
+	}
+	labels := prometheus.Labels{"signal_id": aci.String(), "identity": string(uuidKind)}
+	labels["type"] = "ec"
+	mh.preKeyCounts.With(labels).Set(float64(preKeyCount))
+	labels["type"] = "kyber"
+	mh.preKeyCounts.With(labels).Set(float64(kyberPreKeyCount))
+}
+
 func (mh *MetricsHandler) TrackLoginState(signalID string, loggedIn bool) {
 	if !mh.running {
 		return
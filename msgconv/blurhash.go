@@ -0,0 +1,132 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	blurHashXComponents = 4
+	blurHashYComponents = 3
+	// The image is sampled down to at most this many pixels in each direction before encoding,
+	// as the blurhash only contains the lowest frequencies anyway.
+	blurHashMaxSampleSize = 64
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(buf *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		buf.WriteByte(base83Chars[digit])
+	}
+}
+
+func sRGBToLinear(value uint32) float64 {
+	v := float64(value>>8) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// encodeBlurHash calculates the blurhash (https://blurha.sh) of the given image
+// with the same number of components that Signal clients use.
+func encodeBlurHash(img image.Image) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > blurHashMaxSampleSize {
+		width = blurHashMaxSampleSize
+	}
+	if height > blurHashMaxSampleSize {
+		height = blurHashMaxSampleSize
+	}
+	if width == 0 || height == 0 {
+		return ""
+	}
+	var factors [blurHashYComponents][blurHashXComponents][3]float64
+	for y := 0; y < height; y++ {
+		srcY := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			srcX := bounds.Min.X + x*bounds.Dx()/width
+			r, g, b, _ := img.At(srcX, srcY).RGBA()
+			linear := [3]float64{sRGBToLinear(r), sRGBToLinear(g), sRGBToLinear(b)}
+			for j := 0; j < blurHashYComponents; j++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for i := 0; i < blurHashXComponents; i++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					for c := range linear {
+						factors[j][i][c] += basis * linear[c]
+					}
+				}
+			}
+		}
+	}
+	maxAC := 0.0
+	for j := range factors {
+		for i := range factors[j] {
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			scale := normalization / float64(width*height)
+			for c := range factors[j][i] {
+				factors[j][i][c] *= scale
+				if i != 0 || j != 0 {
+					maxAC = math.Max(maxAC, math.Abs(factors[j][i][c]))
+				}
+			}
+		}
+	}
+
+	var buf strings.Builder
+	encodeBase83(&buf, (blurHashXComponents-1)+(blurHashYComponents-1)*9, 1)
+	quantizedMaxAC := int(math.Max(0, math.Min(82, math.Floor(maxAC*166-0.5))))
+	maxACValue := float64(quantizedMaxAC+1) / 166
+	encodeBase83(&buf, quantizedMaxAC, 1)
+	dc := factors[0][0]
+	encodeBase83(&buf, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for j := range factors {
+		for i := range factors[j] {
+			if i == 0 && j == 0 {
+				continue
+			}
+			value := 0
+			for _, component := range factors[j][i] {
+				quantized := int(math.Max(0, math.Min(18, math.Floor(signPow(component/maxACValue, 0.5)*9+9.5))))
+				value = value*19 + quantized
+			}
+			encodeBase83(&buf, value, 2)
+		}
+	}
+	return buf.String()
+}
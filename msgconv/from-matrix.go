@@ -17,21 +17,29 @@
 package msgconv
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/emersion/go-vcard"
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/exerrors"
 	"go.mau.fi/util/exmime"
 	"go.mau.fi/util/ffmpeg"
 	"go.mau.fi/util/variationselector"
 	"golang.org/x/exp/constraints"
+	"golang.org/x/exp/slices"
 	"google.golang.org/protobuf/proto"
 	"maunium.net/go/mautrix/event"
 
 	"go.mau.fi/mautrix-signal/msgconv/matrixfmt"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 )
 
@@ -57,7 +65,7 @@ func (mc *MessageConverter) ToSignal(ctx context.Context, evt *event.Event, cont
 	}
 	dm := &signalpb.DataMessage{
 		Timestamp: &ts,
-		Quote:     mc.GetSignalReply(ctx, content),
+		Quote:     mc.convertQuoteToSignal(ctx, content),
 		Preview:   mc.convertURLPreviewToSignal(ctx, evt),
 	}
 	if expirationTime := mc.GetData(ctx).ExpirationTime; expirationTime != 0 {
@@ -75,6 +83,15 @@ func (mc *MessageConverter) ToSignal(ctx context.Context, evt *event.Event, cont
 		dm.Body = proto.String(body)
 		dm.BodyRanges = bodyRanges
 	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		if content.MsgType == event.MsgFile && isVCard(content) {
+			contacts, err := mc.convertVCardToSignal(ctx, content)
+			if err == nil {
+				dm.Contact = contacts
+				break
+			}
+			// Send unparseable vCards as normal files
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert vCard to Signal contact")
+		}
 		att, err := mc.convertFileToSignal(ctx, evt, content)
 		if err != nil {
 			return nil, fmt.Errorf("failed to convert attachment: %w", err)
@@ -93,27 +110,35 @@ func (mc *MessageConverter) ToSignal(ctx context.Context, evt *event.Event, cont
 			return nil, fmt.Errorf("failed to convert sticker: %w", err)
 		}
 		att.Flags = proto.Uint32(uint32(signalpb.AttachmentPointer_BORDERLESS))
-		var emoji *string
-		// TODO check for single grapheme cluster?
-		if len([]rune(content.Body)) == 1 {
-			emoji = proto.String(variationselector.Remove(content.Body))
+		dm.Sticker = mc.getSignalSticker(ctx, evt, content)
+		if dm.Sticker == nil {
+			dm.Sticker = &signalpb.DataMessage_Sticker{
+				// Signal iOS validates that pack id/key are of the correct length.
+				// Android is fine with any non-nil values (like a zero-length byte string).
+				PackId:    make([]byte, signalmeow.StickerPackIDLength),
+				PackKey:   make([]byte, signalmeow.StickerPackKeyLength),
+				StickerId: proto.Uint32(0),
+			}
 		}
-		dm.Sticker = &signalpb.DataMessage_Sticker{
-			// Signal iOS validates that pack id/key are of the correct length.
-			// Android is fine with any non-nil values (like a zero-length byte string).
-			PackId:    make([]byte, 16),
-			PackKey:   make([]byte, 32),
-			StickerId: proto.Uint32(0),
-
-			Data:  att,
-			Emoji: emoji,
+		dm.Sticker.Data = att
+		// TODO check for single grapheme cluster?
+		if dm.Sticker.Emoji == nil && len([]rune(content.Body)) == 1 {
+			dm.Sticker.Emoji = proto.String(variationselector.Remove(content.Body))
 		}
 	case event.MsgLocation:
-		// TODO implement
-		fallthrough
+		err := mc.convertLocationToSignal(ctx, evt, content, dm)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("%w %s", ErrUnsupportedMsgType, content.MsgType)
 	}
+	mc.convertRoomMentionToSignal(ctx, content, dm)
+	mc.convertUserMentionsToSignal(content, dm)
+	err := mc.convertLongTextToSignal(ctx, dm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert long text: %w", err)
+	}
 	return dm, nil
 }
 
@@ -124,8 +149,7 @@ func maybeInt[T constraints.Integer](v T) *T {
 	return &v
 }
 
-func (mc *MessageConverter) convertFileToSignal(ctx context.Context, evt *event.Event, content *event.MessageEventContent) (*signalpb.AttachmentPointer, error) {
-	log := zerolog.Ctx(ctx)
+func (mc *MessageConverter) downloadMatrixFile(ctx context.Context, content *event.MessageEventContent) ([]byte, error) {
 	mxc := content.URL
 	if content.File != nil {
 		mxc = content.File.URL
@@ -140,11 +164,29 @@ func (mc *MessageConverter) convertFileToSignal(ctx context.Context, evt *event.
 			return nil, exerrors.NewDualError(ErrMediaDecryptFailed, err)
 		}
 	}
+	return data, nil
+}
+
+func (mc *MessageConverter) convertFileToSignal(ctx context.Context, evt *event.Event, content *event.MessageEventContent) (*signalpb.AttachmentPointer, error) {
+	log := zerolog.Ctx(ctx)
+	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
+	// Voice messages and stickers are converted differently than normal files,
+	// so only normal files are cached to avoid reusing the wrong conversion.
+	useCache := !isVoice && evt.Type != event.EventSticker
+	if useCache {
+		if att := mc.getCachedMatrixMedia(ctx, content); att != nil {
+			return att, nil
+		}
+	}
+	data, err := mc.downloadMatrixFile(ctx, content)
+	if err != nil {
+		return nil, err
+	}
 	fileName := content.Body
 	if content.FileName != "" {
 		fileName = content.FileName
 	}
-	_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
+	isGIF := content.MsgType == event.MsgVideo && isMatrixGIF(evt)
 	mime := content.GetInfo().MimeType
 	if isVoice {
 		data, err = ffmpeg.ConvertBytes(ctx, data, ".m4a", []string{}, []string{"-c:a", "aac"}, mime)
@@ -170,6 +212,17 @@ func (mc *MessageConverter) convertFileToSignal(ctx context.Context, evt *event.
 		default:
 			return nil, fmt.Errorf("unsupported content type for sticker %s", mime)
 		}
+	} else if mime == "image/gif" && content.MsgType == event.MsgImage && mc.ConvertGIFToMP4 && ffmpeg.Supported() {
+		converted, err := convertGIFToMP4(ctx, data)
+		if err != nil {
+			// Signal can display plain GIFs too, they just won't be shown as looping videos
+			log.Warn().Err(err).Msg("Failed to convert GIF to MP4, sending as-is")
+		} else {
+			data = converted
+			mime = "video/mp4"
+			fileName = strings.TrimSuffix(fileName, ".gif") + ".mp4"
+			isGIF = true
+		}
 	}
 	att, err := mc.GetClient(ctx).UploadAttachment(ctx, data)
 	if err != nil {
@@ -178,15 +231,232 @@ func (mc *MessageConverter) convertFileToSignal(ctx context.Context, evt *event.
 	}
 	if isVoice {
 		att.Flags = proto.Uint32(uint32(signalpb.AttachmentPointer_VOICE_MESSAGE))
+	} else if isGIF {
+		att.Flags = proto.Uint32(uint32(signalpb.AttachmentPointer_GIF))
 	}
 	att.ContentType = proto.String(mime)
 	att.FileName = &fileName
-	att.Height = maybeInt(uint32(content.Info.Height))
-	att.Width = maybeInt(uint32(content.Info.Width))
-	if content.Info.Blurhash != "" {
-		att.BlurHash = proto.String(content.Info.Blurhash)
-	} else if content.Info.AnoaBlurhash != "" {
-		att.BlurHash = proto.String(content.Info.AnoaBlurhash)
+	info := content.GetInfo()
+	att.Height = maybeInt(uint32(info.Height))
+	att.Width = maybeInt(uint32(info.Width))
+	if info.Blurhash != "" {
+		att.BlurHash = proto.String(info.Blurhash)
+	} else if info.AnoaBlurhash != "" {
+		att.BlurHash = proto.String(info.AnoaBlurhash)
+	}
+	err = fillAttachmentMetadata(ctx, att, data)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to find dimensions and blurhash of attachment")
+	}
+	if useCache {
+		mc.cacheMatrixMedia(ctx, content, att)
+	}
+	return att, nil
+}
+
+// isMatrixGIF checks if the given Matrix video event is marked as a GIF (i.e. a silent looping video).
+func isMatrixGIF(evt *event.Event) bool {
+	info, ok := evt.Content.Raw["info"].(map[string]any)
+	if !ok {
+		return false
+	}
+	isGIF, _ := info["fi.mau.gif"].(bool)
+	return isGIF
+}
+
+func isVCard(content *event.MessageEventContent) bool {
+	switch strings.ToLower(content.GetInfo().MimeType) {
+	case "text/vcard", "text/x-vcard", "text/vcf", "text/directory":
+		return true
+	}
+	fileName := content.FileName
+	if fileName == "" {
+		fileName = content.Body
+	}
+	return strings.HasSuffix(strings.ToLower(fileName), ".vcf")
+}
+
+func (mc *MessageConverter) convertVCardToSignal(ctx context.Context, content *event.MessageEventContent) ([]*signalpb.DataMessage_Contact, error) {
+	data, err := mc.downloadMatrixFile(ctx, content)
+	if err != nil {
+		return nil, err
+	}
+	decoder := vcard.NewDecoder(bytes.NewReader(data))
+	var contacts []*signalpb.DataMessage_Contact
+	for {
+		card, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse vCard: %w", err)
+		}
+		contact := mc.convertVCardContactToSignal(ctx, card)
+		if contact != nil {
+			contacts = append(contacts, contact)
+		}
+	}
+	if len(contacts) == 0 {
+		return nil, fmt.Errorf("no contacts found in vCard")
 	}
+	return contacts, nil
+}
+
+func (mc *MessageConverter) convertVCardContactToSignal(ctx context.Context, card vcard.Card) *signalpb.DataMessage_Contact {
+	contact := &signalpb.DataMessage_Contact{
+		Name: &signalpb.DataMessage_Contact_Name{},
+	}
+	if name := card.Name(); name != nil {
+		contact.Name.FamilyName = maybeString(name.FamilyName)
+		contact.Name.GivenName = maybeString(name.GivenName)
+		contact.Name.MiddleName = maybeString(name.AdditionalName)
+		contact.Name.Prefix = maybeString(name.HonorificPrefix)
+		contact.Name.Suffix = maybeString(name.HonorificSuffix)
+	}
+	contact.Name.DisplayName = maybeString(card.PreferredValue(vcard.FieldFormattedName))
+	if org := card.PreferredValue(vcard.FieldOrganization); org != "" {
+		contact.Organization = proto.String(strings.Join(slices.DeleteFunc(strings.Split(org, ";"), func(s string) bool {
+			return s == ""
+		}), ", "))
+	}
+	for _, field := range card[vcard.FieldTelephone] {
+		if field.Value == "" {
+			continue
+		}
+		phoneType, label := vCardFieldType(field)
+		contact.Number = append(contact.Number, &signalpb.DataMessage_Contact_Phone{
+			Value: proto.String(strings.TrimPrefix(field.Value, "tel:")),
+			Type:  signalpb.DataMessage_Contact_Phone_Type(phoneType).Enum(),
+			Label: maybeString(label),
+		})
+	}
+	for _, field := range card[vcard.FieldEmail] {
+		if field.Value == "" {
+			continue
+		}
+		emailType, label := vCardFieldType(field)
+		contact.Email = append(contact.Email, &signalpb.DataMessage_Contact_Email{
+			Value: proto.String(field.Value),
+			Type:  signalpb.DataMessage_Contact_Email_Type(emailType).Enum(),
+			Label: maybeString(label),
+		})
+	}
+	for _, addr := range card.Addresses() {
+		addrType, label := vCardFieldType(addr.Field)
+		// Postal addresses don't have a mobile type, so the other values are shifted by one
+		var signalAddrType signalpb.DataMessage_Contact_PostalAddress_Type
+		switch addrType {
+		case signalpb.DataMessage_Contact_Phone_HOME:
+			signalAddrType = signalpb.DataMessage_Contact_PostalAddress_HOME
+		case signalpb.DataMessage_Contact_Phone_WORK:
+			signalAddrType = signalpb.DataMessage_Contact_PostalAddress_WORK
+		default:
+			signalAddrType = signalpb.DataMessage_Contact_PostalAddress_CUSTOM
+		}
+		street := addr.StreetAddress
+		if addr.ExtendedAddress != "" {
+			street = strings.TrimSpace(street + " " + addr.ExtendedAddress)
+		}
+		if addrLabel := addr.Params.Get("LABEL"); addrLabel != "" {
+			label = addrLabel
+		}
+		contact.Address = append(contact.Address, &signalpb.DataMessage_Contact_PostalAddress{
+			Type:     signalAddrType.Enum(),
+			Label:    maybeString(label),
+			Street:   maybeString(street),
+			Pobox:    maybeString(addr.PostOfficeBox),
+			City:     maybeString(addr.Locality),
+			Region:   maybeString(addr.Region),
+			Postcode: maybeString(addr.PostalCode),
+			Country:  maybeString(addr.Country),
+		})
+	}
+	if contact.Name.DisplayName == nil && contact.Name.GivenName == nil && contact.Name.FamilyName == nil &&
+		contact.Organization == nil && len(contact.Number) == 0 && len(contact.Email) == 0 {
+		return nil
+	}
+	if photo := card.Get(vcard.FieldPhoto); photo != nil {
+		avatar, err := mc.convertVCardPhotoToSignal(ctx, photo)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert vCard photo to Signal contact avatar")
+		} else if avatar != nil {
+			contact.Avatar = &signalpb.DataMessage_Contact_Avatar{
+				Avatar:    avatar,
+				IsProfile: proto.Bool(false),
+			}
+		}
+	}
+	return contact
+}
+
+// vCardFieldType maps the TYPE parameter of a vCard field to a Signal contact field type.
+// The phone type enum is used for emails too, as they have the same values.
+func vCardFieldType(field *vcard.Field) (signalpb.DataMessage_Contact_Phone_Type, string) {
+	label := field.Params.Get("LABEL")
+	var customType string
+	for _, fieldType := range field.Params.Types() {
+		switch fieldType {
+		case vcard.TypeCell, "mobile", "iphone":
+			return signalpb.DataMessage_Contact_Phone_MOBILE, label
+		case vcard.TypeHome:
+			return signalpb.DataMessage_Contact_Phone_HOME, label
+		case vcard.TypeWork:
+			return signalpb.DataMessage_Contact_Phone_WORK, label
+		case "custom", "pref", "voice", "internet", "other":
+		default:
+			if customType == "" {
+				customType = fieldType
+			}
+		}
+	}
+	if label == "" {
+		label = customType
+	}
+	if label == "" && field.Params.HasType("custom") {
+		return signalpb.DataMessage_Contact_Phone_CUSTOM, ""
+	} else if label == "" {
+		return signalpb.DataMessage_Contact_Phone_HOME, ""
+	}
+	return signalpb.DataMessage_Contact_Phone_CUSTOM, label
+}
+
+func (mc *MessageConverter) convertVCardPhotoToSignal(ctx context.Context, photo *vcard.Field) (*signalpb.AttachmentPointer, error) {
+	var data []byte
+	var mimeType string
+	var err error
+	if strings.HasPrefix(photo.Value, "data:") {
+		// vCard 4.0 style data URI
+		meta, encoded, ok := strings.Cut(strings.TrimPrefix(photo.Value, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, fmt.Errorf("unsupported data URI")
+		}
+		mimeType = strings.TrimSuffix(meta, ";base64")
+		data, err = base64.StdEncoding.DecodeString(encoded)
+	} else if encoding := strings.ToLower(photo.Params.Get("ENCODING")); encoding == "b" || encoding == "base64" {
+		// vCard 2.1 and 3.0 style inline base64
+		data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(photo.Value), ""))
+	} else {
+		// Photo URLs aren't supported
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode photo: %w", err)
+	} else if len(data) == 0 {
+		return nil, nil
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	att, err := mc.GetClient(ctx).UploadAttachment(ctx, data)
+	if err != nil {
+		return nil, exerrors.NewDualError(ErrMediaUploadFailed, err)
+	}
+	att.ContentType = proto.String(mimeType)
 	return att, nil
 }
+
+func maybeString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
@@ -0,0 +1,84 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const testVCard = `BEGIN:VCARD
+VERSION:3.0
+N:Doe;John;Q.;Dr.;Jr.
+FN:Dr. John Doe
+ORG:Example Corp;Engineering
+TEL;TYPE=CELL:+15550000001
+TEL;TYPE=WORK,VOICE:+15550000002
+TEL;TYPE=pager:+15550000003
+EMAIL;TYPE=INTERNET,HOME:john@example.com
+ADR;TYPE=WORK:;Suite 100;1 Example Street;Springfield;IL;62701;USA
+END:VCARD
+`
+
+func TestConvertVCardContactToSignal(t *testing.T) {
+	card, err := vcard.NewDecoder(strings.NewReader(testVCard)).Decode()
+	require.NoError(t, err)
+	contact := (&MessageConverter{}).convertVCardContactToSignal(context.Background(), card)
+	require.NotNil(t, contact)
+
+	assert.Equal(t, "Dr. John Doe", contact.GetName().GetDisplayName())
+	assert.Equal(t, "John", contact.GetName().GetGivenName())
+	assert.Equal(t, "Doe", contact.GetName().GetFamilyName())
+	assert.Equal(t, "Q.", contact.GetName().GetMiddleName())
+	assert.Equal(t, "Dr.", contact.GetName().GetPrefix())
+	assert.Equal(t, "Jr.", contact.GetName().GetSuffix())
+	assert.Equal(t, "Example Corp, Engineering", contact.GetOrganization())
+
+	require.Len(t, contact.GetNumber(), 3)
+	assert.Equal(t, "+15550000001", contact.GetNumber()[0].GetValue())
+	assert.Equal(t, signalpb.DataMessage_Contact_Phone_MOBILE, contact.GetNumber()[0].GetType())
+	assert.Equal(t, signalpb.DataMessage_Contact_Phone_WORK, contact.GetNumber()[1].GetType())
+	assert.Equal(t, signalpb.DataMessage_Contact_Phone_CUSTOM, contact.GetNumber()[2].GetType())
+	assert.Equal(t, "pager", contact.GetNumber()[2].GetLabel())
+
+	require.Len(t, contact.GetEmail(), 1)
+	assert.Equal(t, "john@example.com", contact.GetEmail()[0].GetValue())
+	assert.Equal(t, signalpb.DataMessage_Contact_Email_HOME, contact.GetEmail()[0].GetType())
+
+	require.Len(t, contact.GetAddress(), 1)
+	addr := contact.GetAddress()[0]
+	assert.Equal(t, signalpb.DataMessage_Contact_PostalAddress_WORK, addr.GetType())
+	assert.Equal(t, "1 Example Street Suite 100", addr.GetStreet())
+	assert.Equal(t, "Springfield", addr.GetCity())
+	assert.Equal(t, "IL", addr.GetRegion())
+	assert.Equal(t, "62701", addr.GetPostcode())
+	assert.Equal(t, "USA", addr.GetCountry())
+	assert.Nil(t, contact.GetAvatar())
+}
+
+func TestConvertVCardContactToSignal_Empty(t *testing.T) {
+	card, err := vcard.NewDecoder(strings.NewReader("BEGIN:VCARD\nVERSION:3.0\nNOTE:nothing useful\nEND:VCARD\n")).Decode()
+	require.NoError(t, err)
+	assert.Nil(t, (&MessageConverter{}).convertVCardContactToSignal(context.Background(), card))
+}
@@ -21,6 +21,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"image"
 	"net/http"
 	"strings"
 	"time"
@@ -36,7 +37,6 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-signal/msgconv/signalfmt"
-	"go.mau.fi/mautrix-signal/pkg/signalmeow"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 )
 
@@ -61,6 +61,7 @@ func (cm *ConvertedMessage) MergeCaption() {
 	mediaContent.Body = textContent.Body
 	mediaContent.Format = textContent.Format
 	mediaContent.FormattedBody = textContent.FormattedBody
+	mergeMentions(mediaContent, textContent)
 	cm.Parts = cm.Parts[:1]
 }
 
@@ -68,6 +69,9 @@ type ConvertedMessagePart struct {
 	Type    event.Type
 	Content *event.MessageEventContent
 	Extra   map[string]any
+	// PendingAttachment is set if the part is a placeholder for an attachment that
+	// should be transferred in the background with TransferAttachment.
+	PendingAttachment *signalpb.AttachmentPointer
 }
 
 func calculateLength(dm *signalpb.DataMessage) int {
@@ -115,7 +119,8 @@ func (mc *MessageConverter) ToMatrix(ctx context.Context, dm *signalpb.DataMessa
 		// Don't allow any other parts in a sticker message
 		return cm
 	}
-	for i, att := range dm.GetAttachments() {
+	body, attachments := mc.extractLongText(ctx, dm)
+	for i, att := range attachments {
 		cm.Parts = append(cm.Parts, mc.convertAttachmentToMatrix(ctx, i, att))
 	}
 	for _, contact := range dm.GetContact() {
@@ -127,8 +132,11 @@ func (mc *MessageConverter) ToMatrix(ctx context.Context, dm *signalpb.DataMessa
 	if dm.GiftBadge != nil {
 		cm.Parts = append(cm.Parts, mc.convertGiftBadgeToMatrix(ctx, dm.GiftBadge))
 	}
-	if dm.Body != nil {
-		cm.Parts = append(cm.Parts, mc.convertTextToMatrix(ctx, dm))
+	var textPart *ConvertedMessagePart
+	if dm.Body != nil || body != "" {
+		textPart = mc.convertTextToMatrix(ctx, dm, body)
+		mc.convertLocationToMatrix(textPart)
+		cm.Parts = append(cm.Parts, textPart)
 	}
 	if len(cm.Parts) == 0 && dm.GetRequiredProtocolVersion() > uint32(signalpb.DataMessage_CURRENT) {
 		cm.Parts = append(cm.Parts, &ConvertedMessagePart{
@@ -143,6 +151,16 @@ func (mc *MessageConverter) ToMatrix(ctx context.Context, dm *signalpb.DataMessa
 	var sender id.UserID
 	if dm.Quote != nil {
 		replyTo, sender = mc.GetMatrixReply(ctx, dm.Quote)
+		if replyTo == "" && len(cm.Parts) > 0 {
+			if textPart == nil || textPart.Content.MsgType == event.MsgLocation {
+				textPart = &ConvertedMessagePart{
+					Type:    event.EventMessage,
+					Content: &event.MessageEventContent{MsgType: event.MsgText},
+				}
+				cm.Parts = append(cm.Parts, textPart)
+			}
+			mc.addUnknownQuoteToMatrix(ctx, textPart, dm.Quote)
+		}
 	}
 	for _, part := range cm.Parts {
 		if part.Content.Mentions == nil {
@@ -180,8 +198,8 @@ func (mc *MessageConverter) ConvertDisappearingTimerChangeToMatrix(ctx context.C
 	return part
 }
 
-func (mc *MessageConverter) convertTextToMatrix(ctx context.Context, dm *signalpb.DataMessage) *ConvertedMessagePart {
-	content := signalfmt.Parse(dm.GetBody(), dm.GetBodyRanges(), mc.SignalFmtParams)
+func (mc *MessageConverter) convertTextToMatrix(ctx context.Context, dm *signalpb.DataMessage, body string) *ConvertedMessagePart {
+	content := signalfmt.Parse(body, dm.GetBodyRanges(), mc.SignalFmtParams)
 	extra := map[string]any{}
 	if len(dm.Preview) > 0 {
 		extra["com.beeper.linkpreviews"] = mc.convertURLPreviewsToBeeper(ctx, dm.Preview)
@@ -281,7 +299,7 @@ func (mc *MessageConverter) convertContactToVCard(ctx context.Context, contact *
 		card.Add(vcard.FieldTelephone, &field)
 	}
 	if contact.GetAvatar().GetAvatar() != nil {
-		avatarData, err := signalmeow.DownloadAttachment(ctx, contact.GetAvatar().GetAvatar())
+		avatarData, err := mc.GetClient(ctx).DownloadAttachment(ctx, contact.GetAvatar().GetAvatar())
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to download contact avatar")
 		} else {
@@ -374,6 +392,12 @@ func (mc *MessageConverter) convertContactToMatrix(ctx context.Context, contact
 }
 
 func (mc *MessageConverter) convertAttachmentToMatrix(ctx context.Context, index int, att *signalpb.AttachmentPointer) *ConvertedMessagePart {
+	if mc.MaxFileSize > 0 && int64(att.GetSize()) > mc.MaxFileSize {
+		return mc.convertTooLargeAttachmentToMatrix(ctx, att, att.GetThumbnail())
+	}
+	if _, canQueue := mc.PortalMethods.(ExtendedPortalMethods); mc.AsyncFiles && canQueue {
+		return mc.makeAttachmentPlaceholder(att)
+	}
 	part, err := mc.reuploadAttachment(ctx, att)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Int("attachment_index", index).Msg("Failed to handle attachment")
@@ -389,7 +413,7 @@ func (mc *MessageConverter) convertAttachmentToMatrix(ctx context.Context, index
 }
 
 func (mc *MessageConverter) convertStickerToMatrix(ctx context.Context, sticker *signalpb.DataMessage_Sticker) *ConvertedMessagePart {
-	converted, err := mc.reuploadAttachment(ctx, sticker.GetData())
+	converted, err := mc.reuploadAttachmentWithCacheKey(ctx, sticker.GetData(), stickerCacheKey(sticker))
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to handle sticker")
 		return &ConvertedMessagePart{
@@ -408,20 +432,40 @@ func (mc *MessageConverter) convertStickerToMatrix(ctx context.Context, sticker
 	converted.Content.Body = sticker.GetEmoji()
 	converted.Type = event.EventSticker
 	converted.Content.MsgType = ""
-	// TODO fetch full pack metadata like the old bridge did?
-	converted.Extra["fi.mau.signal.sticker"] = map[string]any{
-		"id":    sticker.GetStickerId(),
-		"emoji": sticker.GetEmoji(),
-		"pack": map[string]any{
-			"id":  sticker.GetPackId(),
-			"key": sticker.GetPackKey(),
+	info := &SignalStickerInfo{
+		ID:    sticker.GetStickerId(),
+		Emoji: sticker.GetEmoji(),
+		Pack: SignalStickerPackInfo{
+			ID:  sticker.GetPackId(),
+			Key: sticker.GetPackKey(),
 		},
 	}
+	if pack := mc.GetStickerPack(ctx, sticker.GetPackId(), sticker.GetPackKey()); pack != nil {
+		info.Pack.Title = pack.Title
+		info.Pack.Author = pack.Author
+	}
+	converted.Extra["fi.mau.signal.sticker"] = info
 	return converted
 }
 
 func (mc *MessageConverter) reuploadAttachment(ctx context.Context, att *signalpb.AttachmentPointer) (*ConvertedMessagePart, error) {
-	data, err := signalmeow.DownloadAttachment(ctx, att)
+	return mc.reuploadAttachmentWithCacheKey(ctx, att, attachmentCacheKey(att))
+}
+
+func (mc *MessageConverter) reuploadAttachmentWithCacheKey(ctx context.Context, att *signalpb.AttachmentPointer, cacheKey string) (*ConvertedMessagePart, error) {
+	if part := mc.getCachedSignalMedia(ctx, cacheKey); part != nil {
+		return part, nil
+	}
+	part, err := mc.downloadAndReuploadAttachment(ctx, att)
+	if err != nil {
+		return nil, err
+	}
+	mc.cacheSignalMedia(ctx, cacheKey, part)
+	return part, nil
+}
+
+func (mc *MessageConverter) downloadAndReuploadAttachment(ctx context.Context, att *signalpb.AttachmentPointer) (*ConvertedMessagePart, error) {
+	data, err := mc.GetClient(ctx).DownloadAttachment(ctx, att)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download attachment: %w", err)
 	}
@@ -431,67 +475,143 @@ func (mc *MessageConverter) reuploadAttachment(ctx context.Context, att *signalp
 	}
 	fileName := att.GetFileName()
 	extra := map[string]any{}
-	if mc.ConvertVoiceMessages && att.GetFlags()&uint32(signalpb.AttachmentPointer_VOICE_MESSAGE) != 0 {
+	isVoice := att.GetFlags()&uint32(signalpb.AttachmentPointer_VOICE_MESSAGE) != 0
+	probed := probeSignalMedia(ctx, data, mimeType)
+	if mc.ConvertVoiceMessages && isVoice {
 		data, err = ffmpeg.ConvertBytes(ctx, data, ".ogg", []string{}, []string{"-c:a", "libopus"}, mimeType)
 		if err != nil {
 			return nil, fmt.Errorf("failed to convert audio to ogg/opus: %w", err)
 		}
 		fileName += ".ogg"
 		mimeType = "audio/ogg"
-		extra["org.matrix.msc3245.voice"] = map[string]any{}
-		extra["org.matrix.msc1767.audio"] = map[string]any{}
-	}
-	var file *event.EncryptedFileInfo
-	uploadMime := mimeType
-	uploadFileName := fileName
-	if mc.GetData(ctx).Encrypted {
-		file = &event.EncryptedFileInfo{
-			EncryptedFile: *attachment.NewEncryptedFile(),
-			URL:           "",
+		audioInfo := map[string]any{}
+		if probed.Duration > 0 {
+			audioInfo["duration"] = probed.Duration.Milliseconds()
 		}
-		file.EncryptInPlace(data)
-		uploadMime = "application/octet-stream"
-		uploadFileName = ""
+		extra["org.matrix.msc3245.voice"] = map[string]any{}
+		extra["org.matrix.msc1767.audio"] = audioInfo
 	}
-	mxc, err := mc.UploadMatrixMedia(ctx, data, uploadFileName, uploadMime)
+	size := len(data)
+	mxc, file, err := mc.uploadMedia(ctx, data, fileName, mimeType)
 	if err != nil {
 		return nil, err
 	}
 	content := &event.MessageEventContent{
 		Body: fileName,
+		URL:  mxc,
+		File: file,
 		Info: &event.FileInfo{
 			MimeType: mimeType,
 			Width:    int(att.GetWidth()),
 			Height:   int(att.GetHeight()),
-			Size:     len(data),
+			Size:     size,
+			Duration: int(probed.Duration.Milliseconds()),
 		},
 	}
 	if att.GetBlurHash() != "" {
 		content.Info.Blurhash = att.GetBlurHash()
 		content.Info.AnoaBlurhash = att.GetBlurHash()
 	}
-	switch strings.Split(mimeType, "/")[0] {
-	case "image":
-		content.MsgType = event.MsgImage
-	case "video":
-		content.MsgType = event.MsgVideo
-	case "audio":
-		content.MsgType = event.MsgAudio
-	default:
-		content.MsgType = event.MsgFile
+	if probed.Poster != nil {
+		err = mc.addThumbnailToMatrix(ctx, content, probed.Poster)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to add video thumbnail")
+		}
 	}
+	content.MsgType = msgTypeForMime(mimeType)
 	if content.Body == "" {
 		content.Body = strings.TrimPrefix(string(content.MsgType), "m.") + exmime.ExtensionFromMimetype(mimeType)
 	}
-	if file != nil {
-		file.URL = mxc
-		content.File = file
-	} else {
-		content.URL = mxc
-	}
 	return &ConvertedMessagePart{
 		Type:    event.EventMessage,
 		Content: content,
 		Extra:   extra,
 	}, nil
 }
+
+// makeAttachmentPlaceholder creates a Matrix message for an attachment which will be transferred in the background.
+// The placeholder is a notice rather than an empty media event, so that it works in encrypted rooms too.
+func (mc *MessageConverter) makeAttachmentPlaceholder(att *signalpb.AttachmentPointer) *ConvertedMessagePart {
+	return &ConvertedMessagePart{
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("Transferring %s from Signal...", AttachmentFileName(att)),
+		},
+		Extra:             map[string]any{},
+		PendingAttachment: att,
+	}
+}
+
+// TransferAttachment downloads an attachment whose placeholder was sent earlier and uploads it to Matrix.
+// The returned part should be sent as an edit of the placeholder.
+func (mc *MessageConverter) TransferAttachment(ctx context.Context, att *signalpb.AttachmentPointer) (*ConvertedMessagePart, error) {
+	return mc.reuploadAttachment(ctx, att)
+}
+
+// AttachmentFileName returns the file name of an attachment, or a generic name based on the type if it doesn't have one.
+func AttachmentFileName(att *signalpb.AttachmentPointer) string {
+	if fileName := att.GetFileName(); fileName != "" {
+		return fileName
+	}
+	return strings.TrimPrefix(string(msgTypeForMime(att.GetContentType())), "m.") + exmime.ExtensionFromMimetype(att.GetContentType())
+}
+
+func msgTypeForMime(mimeType string) event.MessageType {
+	switch strings.Split(mimeType, "/")[0] {
+	case "image":
+		return event.MsgImage
+	case "video":
+		return event.MsgVideo
+	case "audio":
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// convertTooLargeAttachmentToMatrix creates a placeholder for an attachment that is larger than the
+// homeserver's upload limit. If Signal included a thumbnail of the attachment, it's bridged instead of the full file.
+func (mc *MessageConverter) convertTooLargeAttachmentToMatrix(ctx context.Context, att *signalpb.AttachmentPointer, thumbnail []byte) *ConvertedMessagePart {
+	fileName := AttachmentFileName(att)
+	body := fmt.Sprintf("%s is too large to bridge (%.1f MiB)", fileName, float64(att.GetSize())/1024/1024)
+	part := &ConvertedMessagePart{
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    body,
+		},
+		Extra: map[string]any{},
+	}
+	if len(thumbnail) == 0 {
+		return part
+	}
+	mimeType := http.DetectContentType(thumbnail)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to decode thumbnail of too large attachment")
+		return part
+	}
+	size := len(thumbnail)
+	mxc, file, err := mc.uploadMedia(ctx, thumbnail, "thumbnail"+exmime.ExtensionFromMimetype(mimeType), mimeType)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to upload thumbnail of too large attachment")
+		return part
+	}
+	part.Content = &event.MessageEventContent{
+		MsgType:  event.MsgImage,
+		Body:     body,
+		FileName: "thumbnail" + exmime.ExtensionFromMimetype(mimeType),
+		URL:      mxc,
+		File:     file,
+		Info: &event.FileInfo{
+			MimeType:     mimeType,
+			Width:        cfg.Width,
+			Height:       cfg.Height,
+			Size:         size,
+			Blurhash:     att.GetBlurHash(),
+			AnoaBlurhash: att.GetBlurHash(),
+		},
+	}
+	return part
+}
@@ -0,0 +1,56 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type fakeTransferPortal struct {
+	PortalMethods
+}
+
+func (fakeTransferPortal) QueueFileTransfer(context.Context, id.EventID, uuid.UUID, uint64, *signalpb.AttachmentPointer) error {
+	return nil
+}
+
+func TestConvertAttachmentToMatrix_Placeholder(t *testing.T) {
+	mc := &MessageConverter{PortalMethods: fakeTransferPortal{}, AsyncFiles: true}
+	att := &signalpb.AttachmentPointer{
+		ContentType: proto.String("video/mp4"),
+		Size:        proto.Uint32(1234),
+	}
+	part := mc.convertAttachmentToMatrix(context.Background(), 0, att)
+	assert.Equal(t, event.MsgNotice, part.Content.MsgType)
+	assert.Equal(t, "Transferring video.mp4 from Signal...", part.Content.Body)
+	assert.Same(t, att, part.PendingAttachment)
+
+	// Attachments that are too large aren't transferred at all
+	mc.MaxFileSize = 1000
+	part = mc.convertAttachmentToMatrix(context.Background(), 0, att)
+	assert.Equal(t, "video.mp4 is too large to bridge (0.0 MiB)", part.Content.Body)
+	assert.Nil(t, part.PendingAttachment)
+}
@@ -0,0 +1,304 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type LocationParams struct {
+	// MapURL is the link sent to Signal for Matrix locations. {lat} and {long} are replaced with the coordinates.
+	MapURL string
+	// TileURL is a map tile server URL template used to render static map images. {z}, {x} and {y} are replaced
+	// with the tile coordinates. If it's empty, locations are sent without an image.
+	TileURL string
+	// Zoom is the zoom level used for static map images.
+	Zoom int
+}
+
+const (
+	DefaultMapURL  = "https://maps.google.com/maps?q={lat}%2C{long}"
+	staticMapSize  = 512
+	mapTileSize    = 256
+	mapMarkerSize  = 12
+	maxTileDLBytes = 1024 * 1024
+)
+
+var mapLinkRegexes = []*regexp.Regexp{
+	// Signal Android
+	regexp.MustCompile(`https://maps\.google\.com/maps\?q=(-?\d+(?:\.\d+)?)(?:%2C|,)(-?\d+(?:\.\d+)?)`),
+	// Signal iOS
+	regexp.MustCompile(`https://maps\.apple\.com/\?(?:\S*&)?(?:q|ll)=(-?\d+(?:\.\d+)?)(?:%2C|,)(-?\d+(?:\.\d+)?)`),
+}
+
+// parseGeoURI parses the latitude and longitude from a RFC 5870 geo: URI.
+func parseGeoURI(uri string) (lat, long float64, err error) {
+	if !strings.HasPrefix(uri, "geo:") {
+		return 0, 0, ErrInvalidGeoURI
+	}
+	coordinates, _, _ := strings.Cut(strings.TrimPrefix(uri, "geo:"), ";")
+	parts := strings.Split(coordinates, ",")
+	if len(parts) < 2 {
+		return 0, 0, ErrInvalidGeoURI
+	}
+	lat, err = strconv.ParseFloat(parts[0], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, ErrInvalidGeoURI
+	}
+	long, err = strconv.ParseFloat(parts[1], 64)
+	if err != nil || long < -180 || long > 180 {
+		return 0, 0, ErrInvalidGeoURI
+	}
+	return lat, long, nil
+}
+
+func formatCoordinate(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// findMapLink finds a map link like the ones Signal mobile clients send when sharing locations.
+// The returned description is the rest of the message with the link removed.
+func findMapLink(body string) (geoURI, description string, ok bool) {
+	for _, re := range mapLinkRegexes {
+		match := re.FindStringSubmatchIndex(body)
+		if match == nil {
+			continue
+		}
+		lat, latErr := strconv.ParseFloat(body[match[2]:match[3]], 64)
+		long, longErr := strconv.ParseFloat(body[match[4]:match[5]], 64)
+		if latErr != nil || longErr != nil || lat < -90 || lat > 90 || long < -180 || long > 180 {
+			continue
+		}
+		// Skip the rest of the URL in case it has more query parameters
+		end := match[1]
+		if nextSpace := strings.IndexAny(body[end:], " \n"); nextSpace >= 0 {
+			end += nextSpace
+		} else {
+			end = len(body)
+		}
+		description = strings.TrimSpace(body[:match[0]] + body[end:])
+		if strings.Contains(description, "\n") {
+			// Location shares only have a short address before the link, don't convert normal messages with links
+			continue
+		}
+		return fmt.Sprintf("geo:%s,%s", formatCoordinate(lat), formatCoordinate(long)), description, true
+	}
+	return "", "", false
+}
+
+func (mc *MessageConverter) convertLocationToMatrix(part *ConvertedMessagePart) {
+	geoURI, description, ok := findMapLink(part.Content.Body)
+	if !ok {
+		return
+	}
+	part.Content.MsgType = event.MsgLocation
+	part.Content.GeoURI = geoURI
+	if part.Extra == nil {
+		part.Extra = map[string]any{}
+	}
+	location := map[string]any{"uri": geoURI}
+	if description != "" {
+		location["description"] = description
+	}
+	part.Extra["org.matrix.msc3488.location"] = location
+}
+
+func (mc *MessageConverter) getLocationParams() *LocationParams {
+	if mc.LocationParams == nil {
+		return &LocationParams{MapURL: DefaultMapURL}
+	}
+	return mc.LocationParams
+}
+
+func (mc *MessageConverter) convertLocationToSignal(ctx context.Context, evt *event.Event, content *event.MessageEventContent, dm *signalpb.DataMessage) error {
+	lat, long, err := parseGeoURI(content.GeoURI)
+	if err != nil {
+		return err
+	}
+	params := mc.getLocationParams()
+	mapURL := params.MapURL
+	if mapURL == "" {
+		mapURL = DefaultMapURL
+	}
+	mapURL = strings.NewReplacer("{lat}", formatCoordinate(lat), "{long}", formatCoordinate(long)).Replace(mapURL)
+
+	var description string
+	if location, ok := evt.Content.Raw["org.matrix.msc3488.location"].(map[string]any); ok {
+		description, _ = location["description"].(string)
+	}
+	if description == "" && !strings.HasPrefix(content.Body, "geo:") && !strings.Contains(content.Body, content.GeoURI) {
+		description = content.Body
+	}
+	body := mapURL
+	if description != "" {
+		body = description + "\n" + mapURL
+	}
+	dm.Body = proto.String(body)
+	title := description
+	if title == "" {
+		title = "Location"
+	}
+	dm.Preview = []*signalpb.Preview{{
+		Url:   proto.String(mapURL),
+		Title: proto.String(title),
+		Date:  dm.Timestamp,
+	}}
+	if params.TileURL != "" {
+		att, err := mc.renderStaticMapToSignal(ctx, params, lat, long)
+		if err != nil {
+			// The map image is optional, so just log the error and send the link
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to render static map for location")
+		} else {
+			dm.Attachments = []*signalpb.AttachmentPointer{att}
+		}
+	}
+	return nil
+}
+
+func (mc *MessageConverter) renderStaticMapToSignal(ctx context.Context, params *LocationParams, lat, long float64) (*signalpb.AttachmentPointer, error) {
+	data, err := renderStaticMap(ctx, params, lat, long)
+	if err != nil {
+		return nil, err
+	}
+	att, err := mc.GetClient(ctx).UploadAttachment(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMediaUploadFailed, err)
+	}
+	att.ContentType = proto.String("image/png")
+	att.FileName = proto.String("location.png")
+	att.Width = proto.Uint32(staticMapSize)
+	att.Height = proto.Uint32(staticMapSize)
+	return att, nil
+}
+
+// mapPixel returns the global Web Mercator pixel coordinates of the given point at the given zoom level.
+func mapPixel(lat, long float64, zoom int) (x, y float64) {
+	scale := float64(mapTileSize) * math.Exp2(float64(zoom))
+	latRad := lat * math.Pi / 180
+	x = (long + 180) / 360 * scale
+	y = (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * scale
+	return
+}
+
+func downloadMapTile(ctx context.Context, tileURL string, zoom, x, y int) (image.Image, error) {
+	url := strings.NewReplacer(
+		"{z}", strconv.Itoa(zoom),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+	).Replace(tileURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Most public tile servers require a user agent that identifies the application
+	req.Header.Set("User-Agent", mautrix.DefaultUserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	img, _, err := image.Decode(io.LimitReader(resp.Body, maxTileDLBytes))
+	return img, err
+}
+
+// renderStaticMap stitches map tiles around the given point into a PNG image with a marker in the middle.
+func renderStaticMap(ctx context.Context, params *LocationParams, lat, long float64) ([]byte, error) {
+	zoom := params.Zoom
+	if zoom <= 0 {
+		zoom = 15
+	}
+	centerX, centerY := mapPixel(lat, long, zoom)
+	// Top left corner of the output image in global pixel coordinates
+	originX := int(centerX) - staticMapSize/2
+	originY := int(centerY) - staticMapSize/2
+	tileCount := 1 << zoom
+	output := image.NewRGBA(image.Rect(0, 0, staticMapSize, staticMapSize))
+	draw.Draw(output, output.Bounds(), image.NewUniform(color.Gray{Y: 0xdd}), image.Point{}, draw.Src)
+
+	tiles := make(map[image.Point]image.Image)
+	for tileY := floorDiv(originY, mapTileSize); tileY <= floorDiv(originY+staticMapSize-1, mapTileSize); tileY++ {
+		if tileY < 0 || tileY >= tileCount {
+			continue
+		}
+		for tileX := floorDiv(originX, mapTileSize); tileX <= floorDiv(originX+staticMapSize-1, mapTileSize); tileX++ {
+			tile, err := downloadMapTile(ctx, params.TileURL, zoom, ((tileX%tileCount)+tileCount)%tileCount, tileY)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download tile %d/%d/%d: %w", zoom, tileX, tileY, err)
+			}
+			tiles[image.Pt(tileX, tileY)] = tile
+		}
+	}
+	for pos, tile := range tiles {
+		dstMin := image.Pt(pos.X*mapTileSize-originX, pos.Y*mapTileSize-originY)
+		dst := image.Rectangle{Min: dstMin, Max: dstMin.Add(image.Pt(mapTileSize, mapTileSize))}
+		draw.Draw(output, dst, tile, tile.Bounds().Min, draw.Src)
+	}
+	drawMarker(output, staticMapSize/2, staticMapSize/2)
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode map image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+// drawMarker draws a red dot with a white border at the given point.
+func drawMarker(img *image.RGBA, cx, cy int) {
+	border := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	fill := color.RGBA{R: 0xe0, G: 0x2a, B: 0x2a, A: 0xff}
+	for y := -mapMarkerSize; y <= mapMarkerSize; y++ {
+		for x := -mapMarkerSize; x <= mapMarkerSize; x++ {
+			distSq := x*x + y*y
+			if distSq <= (mapMarkerSize-3)*(mapMarkerSize-3) {
+				img.Set(cx+x, cy+y, fill)
+			} else if distSq <= mapMarkerSize*mapMarkerSize {
+				img.Set(cx+x, cy+y, border)
+			}
+		}
+	}
+}
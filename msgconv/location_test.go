@@ -0,0 +1,61 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGeoURI(t *testing.T) {
+	lat, long, err := parseGeoURI("geo:60.1699,24.9384;u=35")
+	require.NoError(t, err)
+	assert.Equal(t, 60.1699, lat)
+	assert.Equal(t, 24.9384, long)
+
+	for _, invalid := range []string{"", "60.1699,24.9384", "geo:60.1699", "geo:abc,24.9384", "geo:91,0", "geo:0,181"} {
+		_, _, err = parseGeoURI(invalid)
+		assert.ErrorIs(t, err, ErrInvalidGeoURI, invalid)
+	}
+}
+
+func TestFindMapLink(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		geoURI      string
+		description string
+		ok          bool
+	}{
+		{"android", "https://maps.google.com/maps?q=60.1699%2C24.9384", "geo:60.1699,24.9384", "", true},
+		{"android with address", "Helsinki Central Station\nhttps://maps.google.com/maps?q=60.1712%2C24.9414", "geo:60.1712,24.9414", "Helsinki Central Station", true},
+		{"ios", "https://maps.apple.com/?ll=-33.8568,151.2153&q=Sydney", "geo:-33.8568,151.2153", "", true},
+		{"normal message with link", "Look at this place\nthe food is great\nhttps://maps.google.com/maps?q=60.1699%2C24.9384", "", "", false},
+		{"out of range", "https://maps.google.com/maps?q=95%2C24.9384", "", "", false},
+		{"no link", "hello world", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			geoURI, description, ok := findMapLink(test.body)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.geoURI, geoURI)
+			assert.Equal(t, test.description, description)
+		})
+	}
+}
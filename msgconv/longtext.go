@@ -0,0 +1,90 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exerrors"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	// LongTextContentType is the content type Signal clients use for attachments containing the full body of a long message.
+	LongTextContentType = "text/x-signal-plain"
+	// MaxInlineBodyLength is the maximum number of bytes of text Signal clients include in the message body.
+	// Anything longer is sent as a long text attachment with a truncated body.
+	MaxInlineBodyLength = 2000
+)
+
+// extractLongText finds long text attachments in the given message and returns the full message body
+// and the remaining attachments. If there's no long text attachment, or downloading it fails,
+// the inline body is returned instead.
+func (mc *MessageConverter) extractLongText(ctx context.Context, dm *signalpb.DataMessage) (string, []*signalpb.AttachmentPointer) {
+	body := dm.GetBody()
+	attachments := make([]*signalpb.AttachmentPointer, 0, len(dm.GetAttachments()))
+	for _, att := range dm.GetAttachments() {
+		if att.GetContentType() != LongTextContentType {
+			attachments = append(attachments, att)
+			continue
+		}
+		data, err := mc.GetClient(ctx).DownloadAttachment(ctx, att)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to download long text attachment, using truncated body")
+		} else if !utf8.Valid(data) {
+			zerolog.Ctx(ctx).Warn().Msg("Long text attachment isn't valid UTF-8, using truncated body")
+		} else {
+			body = string(data)
+		}
+	}
+	return body, attachments
+}
+
+// truncateLongText cuts the given text to at most maxLength bytes without splitting any UTF-8 sequences.
+func truncateLongText(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+	cut := maxLength
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut]
+}
+
+// convertLongTextToSignal moves the body of the given message into a long text attachment
+// if it's too long to be sent inline, leaving a truncated body in the message itself.
+func (mc *MessageConverter) convertLongTextToSignal(ctx context.Context, dm *signalpb.DataMessage) error {
+	body := dm.GetBody()
+	if len(body) <= MaxInlineBodyLength {
+		return nil
+	}
+	att, err := mc.GetClient(ctx).UploadAttachment(ctx, []byte(body))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to upload long text attachment")
+		return exerrors.NewDualError(ErrMediaUploadFailed, err)
+	}
+	att.ContentType = proto.String(LongTextContentType)
+	dm.Attachments = append(dm.Attachments, att)
+	// Body ranges are kept as-is, as they refer to the full text in the attachment
+	dm.Body = proto.String(truncateLongText(body, MaxInlineBodyLength))
+	return nil
+}
@@ -0,0 +1,39 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateLongText(t *testing.T) {
+	assert.Equal(t, "hello", truncateLongText("hello", MaxInlineBodyLength))
+	assert.Equal(t, "hel", truncateLongText("hello", 3))
+
+	ascii := strings.Repeat("a", MaxInlineBodyLength+10)
+	assert.Len(t, truncateLongText(ascii, MaxInlineBodyLength), MaxInlineBodyLength)
+
+	// 3-byte characters don't divide evenly into 2000 bytes
+	multibyte := strings.Repeat("€", MaxInlineBodyLength)
+	truncated := truncateLongText(multibyte, MaxInlineBodyLength)
+	assert.True(t, utf8.ValidString(truncated))
+	assert.Len(t, truncated, MaxInlineBodyLength-MaxInlineBodyLength%3)
+}
@@ -0,0 +1,286 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exmime"
+	"go.mau.fi/util/ffmpeg"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func isVisualMedia(mime string) bool {
+	return strings.HasPrefix(mime, "image/") || strings.HasPrefix(mime, "video/")
+}
+
+// decodeFirstFrame decodes the given image, or the first frame of a video or an image format
+// that the standard library doesn't support using ffmpeg.
+func decodeFirstFrame(ctx context.Context, data []byte, mime string) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err == nil {
+		return img, nil
+	}
+	switch mime {
+	case "image/png", "image/jpeg", "image/gif":
+		// The standard library should've been able to decode these, so the file is probably broken
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if !ffmpeg.Supported() {
+		return nil, fmt.Errorf("ffmpeg is not available to decode %s", mime)
+	}
+	frame, err := ffmpeg.ConvertBytes(ctx, data, ".png", []string{}, []string{"-frames:v", "1"}, mime)
+	if err != nil {
+		return nil, fmt.Errorf("%w first frame to png: %w", ErrMediaConvertFailed, err)
+	}
+	img, err = png.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode extracted frame: %w", err)
+	}
+	return img, nil
+}
+
+// fillAttachmentMetadata fills the width, height and blurhash of an image or video attachment
+// if the Matrix event didn't include them.
+func fillAttachmentMetadata(ctx context.Context, att *signalpb.AttachmentPointer, data []byte) error {
+	if !isVisualMedia(att.GetContentType()) || (att.Width != nil && att.Height != nil && att.BlurHash != nil) {
+		return nil
+	}
+	img, err := decodeFirstFrame(ctx, data, att.GetContentType())
+	if err != nil {
+		return err
+	}
+	if att.Width == nil || att.Height == nil {
+		size := img.Bounds().Size()
+		att.Width = maybeInt(uint32(size.X))
+		att.Height = maybeInt(uint32(size.Y))
+	}
+	if att.BlurHash == nil {
+		if blurHash := encodeBlurHash(img); blurHash != "" {
+			att.BlurHash = proto.String(blurHash)
+		}
+	}
+	return nil
+}
+
+// convertGIFToMP4 converts a GIF into a silent MP4 like the ones Signal clients send with the GIF flag.
+func convertGIFToMP4(ctx context.Context, data []byte) ([]byte, error) {
+	return ffmpeg.ConvertBytes(ctx, data, ".mp4", []string{}, []string{
+		"-movflags", "+faststart",
+		"-pix_fmt", "yuv420p",
+		"-c:v", "libx264",
+		"-an",
+		// libx264 requires even dimensions
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+	}, "image/gif")
+}
+
+// probeWithFFmpeg finds the duration of an audio or video file, and optionally extracts its first video frame,
+// in a single ffmpeg run. The duration is read from the progress report of copying all streams into a null
+// output, which doesn't need to decode the media.
+func probeWithFFmpeg(ctx context.Context, data []byte, mime string, extractFrame bool) (duration time.Duration, frame image.Image, err error) {
+	if !ffmpeg.Supported() {
+		return 0, nil, errors.New("ffmpeg is not available")
+	}
+	tempDir, err := os.MkdirTemp("", "mautrix_probe_*")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+	inputPath := filepath.Join(tempDir, "input"+exmime.ExtensionFromMimetype(mime))
+	progressPath := filepath.Join(tempDir, "progress.txt")
+	framePath := filepath.Join(tempDir, "frame.png")
+	err = os.WriteFile(inputPath, data, 0600)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to write temp file: %w", err)
+	}
+	var outputArgs []string
+	if extractFrame {
+		outputArgs = append(outputArgs, "-map", "0:v:0", "-frames:v", "1", framePath)
+	}
+	// The output path of the null muxer is appended by ConvertPath, but nothing is written to it
+	outputArgs = append(outputArgs, "-map", "0", "-c", "copy", "-f", "null")
+	_, err = ffmpeg.ConvertPath(ctx, inputPath, ".null", []string{"-nostats", "-progress", progressPath}, outputArgs, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	progress, err := os.ReadFile(progressPath)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read ffmpeg progress: %w", err)
+	}
+	duration, err = parseFFmpegProgressDuration(progress)
+	if err != nil {
+		return 0, nil, err
+	}
+	if extractFrame {
+		var frameData []byte
+		frameData, err = os.ReadFile(framePath)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read extracted frame: %w", err)
+		}
+		frame, err = png.Decode(bytes.NewReader(frameData))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to decode extracted frame: %w", err)
+		}
+	}
+	return
+}
+
+// parseFFmpegProgressDuration finds the last output timestamp in an ffmpeg -progress report.
+func parseFFmpegProgressDuration(progress []byte) (time.Duration, error) {
+	var outTime string
+	for _, line := range strings.Split(string(progress), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		if key == "out_time_us" {
+			outTime = value
+		}
+	}
+	if outTime == "" || outTime == "N/A" {
+		return 0, errors.New("ffmpeg didn't report the duration")
+	}
+	micros, err := strconv.ParseInt(outTime, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration %q: %w", outTime, err)
+	}
+	return time.Duration(micros) * time.Microsecond, nil
+}
+
+// uploadMedia uploads the given data to the Matrix media repo, encrypting it first if the portal is encrypted.
+// The data is encrypted in place, so it must not be used after calling this.
+func (mc *MessageConverter) uploadMedia(ctx context.Context, data []byte, fileName, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	var file *event.EncryptedFileInfo
+	if mc.GetData(ctx).Encrypted {
+		file = &event.EncryptedFileInfo{
+			EncryptedFile: *attachment.NewEncryptedFile(),
+			URL:           "",
+		}
+		file.EncryptInPlace(data)
+		mimeType = "application/octet-stream"
+		fileName = ""
+	}
+	mxc, err := mc.UploadMatrixMedia(ctx, data, fileName, mimeType)
+	if err != nil {
+		return "", nil, err
+	}
+	if file != nil {
+		file.URL = mxc
+		mxc = ""
+	}
+	return mxc, file, nil
+}
+
+// probedMedia contains metadata extracted from Signal attachments that the attachment pointer doesn't include.
+type probedMedia struct {
+	Duration time.Duration
+	Poster   image.Image
+}
+
+// probeSignalMedia finds the duration of audio and video attachments and the poster frame of videos.
+// Failures are only logged, as the attachment can be bridged without the metadata.
+func probeSignalMedia(ctx context.Context, data []byte, mime string) (probed probedMedia) {
+	log := zerolog.Ctx(ctx)
+	isVideo := strings.HasPrefix(mime, "video/")
+	if !isVideo && !strings.HasPrefix(mime, "audio/") {
+		return
+	}
+	var err error
+	probed.Duration, probed.Poster, err = probeWithFFmpeg(ctx, data, mime, isVideo)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to find duration and poster frame of media")
+	}
+	return
+}
+
+// addThumbnailToMatrix uploads the given image as the thumbnail of the Matrix media message,
+// and fills the dimensions and blurhash if the Signal attachment didn't include them.
+func (mc *MessageConverter) addThumbnailToMatrix(ctx context.Context, content *event.MessageEventContent, thumbnail image.Image) error {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80})
+	if err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	size := thumbnail.Bounds().Size()
+	content.Info.ThumbnailInfo = &event.FileInfo{
+		MimeType: "image/jpeg",
+		Width:    size.X,
+		Height:   size.Y,
+		Size:     buf.Len(),
+	}
+	if content.Info.Width == 0 || content.Info.Height == 0 {
+		content.Info.Width = size.X
+		content.Info.Height = size.Y
+	}
+	if content.Info.Blurhash == "" {
+		content.Info.Blurhash = encodeBlurHash(thumbnail)
+		content.Info.AnoaBlurhash = content.Info.Blurhash
+	}
+	content.Info.ThumbnailURL, content.Info.ThumbnailFile, err = mc.uploadMedia(ctx, buf.Bytes(), "thumbnail.jpg", "image/jpeg")
+	if err != nil {
+		content.Info.ThumbnailInfo = nil
+		return fmt.Errorf("failed to upload thumbnail: %w", err)
+	}
+	return nil
+}
+
+// scaleDownImage resizes the given image with nearest-neighbor sampling so that neither side is longer than maxSize.
+// Images that are already small enough are returned as-is.
+func scaleDownImage(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+	if width > height {
+		height = height * maxSize / width
+		width = maxSize
+	} else {
+		width = width * maxSize / height
+		height = maxSize
+	}
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		srcY := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			scaled.Set(x, y, img.At(bounds.Min.X+x*bounds.Dx()/width, srcY))
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,109 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestEncodeBlurHash_SolidColor(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	assert.Equal(t, "L00000fQfQfQfQfQfQfQfQfQfQfQ", encodeBlurHash(black))
+	white := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	whiteHash := encodeBlurHash(white)
+	assert.Len(t, whiteHash, 28)
+	// The average color is stored in characters 2-5
+	assert.Equal(t, "TSUA", whiteHash[2:6])
+}
+
+func TestFillAttachmentMetadata(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	for x := 0; x < 30; x++ {
+		for y := 0; y < 20; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 8), G: uint8(y * 12), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	att := &signalpb.AttachmentPointer{ContentType: proto.String("image/png")}
+	require.NoError(t, fillAttachmentMetadata(context.Background(), att, buf.Bytes()))
+	assert.Equal(t, uint32(30), att.GetWidth())
+	assert.Equal(t, uint32(20), att.GetHeight())
+	assert.Len(t, att.GetBlurHash(), 28)
+
+	att = &signalpb.AttachmentPointer{ContentType: proto.String("application/pdf")}
+	require.NoError(t, fillAttachmentMetadata(context.Background(), att, buf.Bytes()))
+	assert.Nil(t, att.Width)
+	assert.Nil(t, att.BlurHash)
+}
+
+func TestConvertTooLargeAttachmentToMatrix_NoThumbnail(t *testing.T) {
+	mc := &MessageConverter{}
+	part := mc.convertTooLargeAttachmentToMatrix(context.Background(), &signalpb.AttachmentPointer{
+		ContentType: proto.String("video/mp4"),
+		Size:        proto.Uint32(150 * 1024 * 1024),
+	}, nil)
+	assert.Equal(t, event.MsgNotice, part.Content.MsgType)
+	assert.Equal(t, "video.mp4 is too large to bridge (150.0 MiB)", part.Content.Body)
+}
+
+func TestParseFFmpegProgressDuration(t *testing.T) {
+	duration, err := parseFFmpegProgressDuration([]byte("out_time_us=N/A\nprogress=continue\nout_time_us=5120000\nout_time=00:00:05.120000\nprogress=end\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 5120*time.Millisecond, duration)
+	_, err = parseFFmpegProgressDuration([]byte("out_time_us=N/A\nprogress=end\n"))
+	assert.Error(t, err)
+}
+
+func TestStickerCacheKey(t *testing.T) {
+	data := &signalpb.AttachmentPointer{Digest: []byte{1, 2, 3}}
+	assert.Equal(t, "sticker:0102:5:digest:AQID", stickerCacheKey(&signalpb.DataMessage_Sticker{
+		PackId:    []byte{1, 2},
+		StickerId: proto.Uint32(5),
+		Data:      data,
+	}))
+	// Stickers without a digest can't be verified, so they're not cached
+	assert.Equal(t, "", stickerCacheKey(&signalpb.DataMessage_Sticker{
+		PackId:    []byte{1, 2},
+		StickerId: proto.Uint32(5),
+		Data:      &signalpb.AttachmentPointer{},
+	}))
+	// Stickers without a real pack fall back to the attachment digest
+	assert.Equal(t, "digest:AQID", stickerCacheKey(&signalpb.DataMessage_Sticker{
+		PackId:    make([]byte, 16),
+		StickerId: proto.Uint32(0),
+		Data:      data,
+	}))
+	assert.Equal(t, "", attachmentCacheKey(&signalpb.AttachmentPointer{}))
+}
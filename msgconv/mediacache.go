@@ -0,0 +1,163 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// Signal deletes attachments from the CDN 30 days after they're uploaded,
+// so cached attachment pointers (and digests of attachments) are useless after that.
+const MediaCacheTTL = 29 * 24 * time.Hour
+
+func attachmentCacheKey(att *signalpb.AttachmentPointer) string {
+	if len(att.GetDigest()) == 0 {
+		return ""
+	}
+	return "digest:" + base64.StdEncoding.EncodeToString(att.GetDigest())
+}
+
+// stickerCacheKey returns the cache key for a sticker. The image comes from the attachment the sender
+// included rather than the sticker pack, so the digest is part of the key to stop a sender from
+// poisoning the cache with a different image for someone else's sticker.
+func stickerCacheKey(sticker *signalpb.DataMessage_Sticker) string {
+	packID := sticker.GetPackId()
+	digestKey := attachmentCacheKey(sticker.GetData())
+	// Stickers sent from Matrix without a pack have a zeroed pack ID
+	if digestKey == "" || len(packID) == 0 || bytes.Equal(packID, make([]byte, len(packID))) {
+		return digestKey
+	}
+	return fmt.Sprintf("sticker:%s:%d:%s", hex.EncodeToString(packID), sticker.GetStickerId(), digestKey)
+}
+
+func (mc *MessageConverter) getCachedSignalMedia(ctx context.Context, key string) *ConvertedMessagePart {
+	if mc.SignalMediaCache == nil || key == "" {
+		return nil
+	}
+	log := zerolog.Ctx(ctx)
+	cached, err := mc.SignalMediaCache.Get(ctx, key, mc.GetData(ctx).Encrypted)
+	if err != nil {
+		log.Err(err).Msg("Failed to get cached media")
+		return nil
+	} else if cached == nil {
+		return nil
+	}
+	part := &ConvertedMessagePart{Type: event.EventMessage}
+	err = json.Unmarshal([]byte(cached.Content), &part.Content)
+	if err == nil {
+		err = json.Unmarshal([]byte(cached.Extra), &part.Extra)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to unmarshal cached media")
+		return nil
+	}
+	if part.Extra == nil {
+		part.Extra = map[string]any{}
+	}
+	log.Debug().Str("cache_key", key).Msg("Reusing cached media")
+	return part
+}
+
+func (mc *MessageConverter) cacheSignalMedia(ctx context.Context, key string, part *ConvertedMessagePart) {
+	if mc.SignalMediaCache == nil || key == "" {
+		return
+	}
+	content, err := json.Marshal(part.Content)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to marshal media content for cache")
+		return
+	}
+	extra, err := json.Marshal(part.Extra)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to marshal media extra content for cache")
+		return
+	}
+	cached := mc.SignalMediaCache.New()
+	cached.SignalKey = key
+	cached.Encrypted = mc.GetData(ctx).Encrypted
+	cached.Content = string(content)
+	cached.Extra = string(extra)
+	cached.ExpiresAt = time.Now().Add(MediaCacheTTL)
+	err = cached.Upsert(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to cache media")
+	}
+}
+
+func matrixMediaCacheKey(content *event.MessageEventContent) (id.ContentURIString, string) {
+	if content.File != nil {
+		return content.File.URL, content.File.Hashes.SHA256
+	}
+	return content.URL, ""
+}
+
+func (mc *MessageConverter) getCachedMatrixMedia(ctx context.Context, content *event.MessageEventContent) *signalpb.AttachmentPointer {
+	mxc, fileHash := matrixMediaCacheKey(content)
+	if mc.MatrixMediaCache == nil || mxc == "" {
+		return nil
+	}
+	log := zerolog.Ctx(ctx)
+	cached, err := mc.MatrixMediaCache.Get(ctx, mxc, fileHash)
+	if err != nil {
+		log.Err(err).Msg("Failed to get cached attachment")
+		return nil
+	} else if cached == nil {
+		return nil
+	}
+	var att signalpb.AttachmentPointer
+	err = proto.Unmarshal(cached.Attachment, &att)
+	if err != nil {
+		log.Err(err).Msg("Failed to unmarshal cached attachment")
+		return nil
+	}
+	log.Debug().Str("mxc", string(mxc)).Msg("Reusing cached attachment")
+	return &att
+}
+
+func (mc *MessageConverter) cacheMatrixMedia(ctx context.Context, content *event.MessageEventContent, att *signalpb.AttachmentPointer) {
+	mxc, fileHash := matrixMediaCacheKey(content)
+	if mc.MatrixMediaCache == nil || mxc == "" {
+		return
+	}
+	attBytes, err := proto.Marshal(att)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to marshal attachment for cache")
+		return
+	}
+	cached := mc.MatrixMediaCache.New()
+	cached.MXC = mxc
+	cached.FileHash = fileHash
+	cached.Attachment = attBytes
+	cached.ExpiresAt = time.Now().Add(MediaCacheTTL)
+	err = cached.Upsert(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to cache attachment")
+	}
+}
@@ -0,0 +1,165 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/msgconv/signalfmt"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const roomMentionText = "@room"
+
+// mergeMentions adds the users mentioned in the source content to the mentions of the target content.
+func mergeMentions(target, source *event.MessageEventContent) {
+	if source.Mentions == nil {
+		return
+	}
+	if target.Mentions == nil {
+		target.Mentions = &event.Mentions{}
+	}
+	for _, userID := range source.Mentions.UserIDs {
+		if !slices.Contains(target.Mentions.UserIDs, userID) {
+			target.Mentions.UserIDs = append(target.Mentions.UserIDs, userID)
+		}
+	}
+	target.Mentions.Room = target.Mentions.Room || source.Mentions.Room
+}
+
+// convertRoomMentionToSignal replaces the @room ping in a Matrix message with mentions of all other members
+// of the Signal group, as Signal doesn't have a way to mention everyone.
+func (mc *MessageConverter) convertRoomMentionToSignal(ctx context.Context, content *event.MessageEventContent, dm *signalpb.DataMessage) {
+	if content.Mentions == nil || !content.Mentions.Room || dm.Body == nil {
+		return
+	}
+	groupID := mc.GetData(ctx).GroupID()
+	if groupID == "" {
+		return
+	}
+	client := mc.GetClient(ctx)
+	group, err := client.RetrieveGroupByID(ctx, groupID, 0)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get group members for @room mention")
+		return
+	}
+	members := make([]uuid.UUID, 0, len(group.Members))
+	for _, member := range group.Members {
+		if member.UserID != client.Store.ACI {
+			members = append(members, member.UserID)
+		}
+	}
+	body, bodyRanges := replaceRoomMention(dm.GetBody(), dm.BodyRanges, members)
+	dm.Body = proto.String(body)
+	dm.BodyRanges = bodyRanges
+}
+
+// convertUserMentionsToSignal adds Signal mentions for users in m.mentions that weren't mentioned with a pill
+// in the formatted body. The mentions are appended to the end of the body, as there's no text to replace.
+func (mc *MessageConverter) convertUserMentionsToSignal(content *event.MessageEventContent, dm *signalpb.DataMessage) {
+	if content.Mentions == nil || len(content.Mentions.UserIDs) == 0 || dm.Body == nil || mc.MatrixFmtParams == nil {
+		return
+	}
+	alreadyMentioned := make(map[string]struct{}, len(dm.BodyRanges)+1)
+	// Matrix clients include the sender of the replied-to message in m.mentions, but Signal notifies them of quotes anyway
+	if quoteAuthor := dm.GetQuote().GetAuthorAci(); quoteAuthor != "" {
+		alreadyMentioned[quoteAuthor] = struct{}{}
+	}
+	for _, br := range dm.BodyRanges {
+		if aci := br.GetMentionAci(); aci != "" {
+			alreadyMentioned[aci] = struct{}{}
+		}
+	}
+	var users []uuid.UUID
+	for _, userID := range content.Mentions.UserIDs {
+		u := mc.MatrixFmtParams.GetUUIDFromMXID(userID)
+		if u == uuid.Nil {
+			continue
+		} else if _, ok := alreadyMentioned[u.String()]; ok {
+			continue
+		}
+		alreadyMentioned[u.String()] = struct{}{}
+		users = append(users, u)
+	}
+	body, bodyRanges := appendMentions(dm.GetBody(), dm.BodyRanges, users)
+	dm.Body = proto.String(body)
+	dm.BodyRanges = bodyRanges
+}
+
+// appendMentions adds mentions of the given users to the end of the body on a new line.
+func appendMentions(body string, bodyRanges []*signalpb.BodyRange, users []uuid.UUID) (string, []*signalpb.BodyRange) {
+	if len(users) == 0 {
+		return body, bodyRanges
+	}
+	if body != "" {
+		body += "\n"
+	}
+	return body + mentionPlaceholders(len(users)), appendMentionRanges(bodyRanges, len(signalfmt.NewUTF16String(body)), users)
+}
+
+// mentionPlaceholders returns the text for the given number of mentions separated by spaces.
+func mentionPlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("\uFFFC ", count), " ")
+}
+
+// appendMentionRanges adds body ranges for mentions of the given users, assuming the text from mentionPlaceholders
+// was inserted at the given UTF-16 offset.
+func appendMentionRanges(bodyRanges []*signalpb.BodyRange, start int, users []uuid.UUID) []*signalpb.BodyRange {
+	for i, user := range users {
+		bodyRanges = append(bodyRanges, &signalpb.BodyRange{
+			Start:           proto.Uint32(uint32(start + i*2)),
+			Length:          proto.Uint32(1),
+			AssociatedValue: &signalpb.BodyRange_MentionAci{MentionAci: user.String()},
+		})
+	}
+	return bodyRanges
+}
+
+// replaceRoomMention replaces the first @room in the body with mentions of the given users,
+// or appends the mentions to the end of the body if it doesn't contain @room.
+// Body ranges after the replaced text are shifted accordingly.
+func replaceRoomMention(body string, bodyRanges []*signalpb.BodyRange, members []uuid.UUID) (string, []*signalpb.BodyRange) {
+	if len(members) == 0 {
+		return body, bodyRanges
+	}
+	index := strings.Index(body, roomMentionText)
+	if index < 0 {
+		return appendMentions(body, bodyRanges, members)
+	}
+	prefix, suffix := body[:index], body[index+len(roomMentionText):]
+	mentionStart := len(signalfmt.NewUTF16String(prefix))
+	replacedLength := len(signalfmt.NewUTF16String(body)) - mentionStart - len(signalfmt.NewUTF16String(suffix))
+	mentionText := mentionPlaceholders(len(members))
+	delta := len(signalfmt.NewUTF16String(mentionText)) - replacedLength
+	replacedEnd := mentionStart + replacedLength
+	for _, br := range bodyRanges {
+		start, end := int(br.GetStart()), int(br.GetStart()+br.GetLength())
+		if start >= replacedEnd && replacedLength > 0 {
+			br.Start = proto.Uint32(uint32(start + delta))
+		} else if start <= mentionStart && end >= replacedEnd {
+			br.Length = proto.Uint32(uint32(end - start + delta))
+		}
+	}
+	return prefix + mentionText + suffix, appendMentionRanges(bodyRanges, mentionStart, members)
+}
@@ -0,0 +1,97 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/msgconv/matrixfmt"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func TestReplaceRoomMention(t *testing.T) {
+	members := []uuid.UUID{uuid.MustParse("00000000-0000-0000-0000-000000000001"), uuid.MustParse("00000000-0000-0000-0000-000000000002")}
+	bold := &signalpb.BodyRange{
+		Start:           proto.Uint32(12),
+		Length:          proto.Uint32(4),
+		AssociatedValue: &signalpb.BodyRange_Style_{Style: signalpb.BodyRange_BOLD},
+	}
+	body, ranges := replaceRoomMention("hello @room look", []*signalpb.BodyRange{bold}, members)
+	assert.Equal(t, "hello \uFFFC \uFFFC look", body)
+	assert.Equal(t, uint32(10), bold.GetStart())
+	if assert.Len(t, ranges, 3) {
+		assert.Equal(t, uint32(6), ranges[1].GetStart())
+		assert.Equal(t, members[0].String(), ranges[1].GetMentionAci())
+		assert.Equal(t, uint32(8), ranges[2].GetStart())
+		assert.Equal(t, members[1].String(), ranges[2].GetMentionAci())
+	}
+
+	body, ranges = replaceRoomMention("no ping", nil, members[:1])
+	assert.Equal(t, "no ping\n\uFFFC", body)
+	assert.Equal(t, uint32(8), ranges[0].GetStart())
+}
+
+func TestConvertUserMentionsToSignal(t *testing.T) {
+	pilled := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	unpilled := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	mc := &MessageConverter{MatrixFmtParams: &matrixfmt.HTMLParser{
+		GetUUIDFromMXID: func(userID id.UserID) uuid.UUID {
+			if userID.Homeserver() == "signal" {
+				return uuid.MustParse(userID.Localpart())
+			}
+			return uuid.Nil
+		},
+	}}
+	dm := &signalpb.DataMessage{
+		Body: proto.String("hi \uFFFC"),
+		BodyRanges: []*signalpb.BodyRange{{
+			Start:           proto.Uint32(3),
+			Length:          proto.Uint32(1),
+			AssociatedValue: &signalpb.BodyRange_MentionAci{MentionAci: pilled.String()},
+		}},
+	}
+	mc.convertUserMentionsToSignal(&event.MessageEventContent{Mentions: &event.Mentions{UserIDs: []id.UserID{
+		id.UserID("@" + pilled.String() + ":signal"),
+		id.UserID("@" + unpilled.String() + ":signal"),
+		"@matrixuser:example.com",
+	}}}, dm)
+	assert.Equal(t, "hi \uFFFC\n\uFFFC", dm.GetBody())
+	if assert.Len(t, dm.BodyRanges, 2) {
+		assert.Equal(t, uint32(5), dm.BodyRanges[1].GetStart())
+		assert.Equal(t, unpilled.String(), dm.BodyRanges[1].GetMentionAci())
+	}
+
+	// Reply targets aren't mentioned again
+	dm = &signalpb.DataMessage{Body: proto.String("reply"), Quote: &signalpb.DataMessage_Quote{AuthorAci: proto.String(unpilled.String())}}
+	mc.convertUserMentionsToSignal(&event.MessageEventContent{Mentions: &event.Mentions{UserIDs: []id.UserID{
+		id.UserID("@" + unpilled.String() + ":signal"),
+	}}}, dm)
+	assert.Equal(t, "reply", dm.GetBody())
+	assert.Empty(t, dm.BodyRanges)
+}
+
+func TestMergeMentions(t *testing.T) {
+	target := &event.MessageEventContent{Mentions: &event.Mentions{UserIDs: []id.UserID{"@a:example.com"}}}
+	mergeMentions(target, &event.MessageEventContent{Mentions: &event.Mentions{UserIDs: []id.UserID{"@a:example.com", "@b:example.com"}}})
+	assert.Equal(t, []id.UserID{"@a:example.com", "@b:example.com"}, target.Mentions.UserIDs)
+}
@@ -34,15 +34,20 @@ type PortalMethods interface {
 	UploadMatrixMedia(ctx context.Context, data []byte, fileName, contentType string) (id.ContentURIString, error)
 	DownloadMatrixMedia(ctx context.Context, uri id.ContentURIString) ([]byte, error)
 	GetMatrixReply(ctx context.Context, msg *signalpb.DataMessage_Quote) (replyTo id.EventID, replyTargetSender id.UserID)
-	GetSignalReply(ctx context.Context, content *event.MessageEventContent) *signalpb.DataMessage_Quote
+	GetSignalReply(ctx context.Context, content *event.MessageEventContent) (quote *signalpb.DataMessage_Quote, target *event.Event)
+	GetStickerPack(ctx context.Context, packID, packKey []byte) *database.StickerPack
+	GetSignalSticker(ctx context.Context, mxc id.ContentURIString) *signalpb.DataMessage_Sticker
 
 	GetClient(ctx context.Context) *signalmeow.Client
 
 	GetData(ctx context.Context) *database.Portal
 }
 
+// ExtendedPortalMethods are optional methods of PortalMethods.
 type ExtendedPortalMethods interface {
-	QueueFileTransfer(ctx context.Context, msgTS uint64, fileName string, ap *signalpb.AttachmentPointer) (id.ContentURIString, error)
+	// QueueFileTransfer starts transferring an attachment in the background after its placeholder has been
+	// sent as the given event, so that the placeholder can be edited into the attachment once it's done.
+	QueueFileTransfer(ctx context.Context, placeholder id.EventID, sender uuid.UUID, msgTS uint64, ap *signalpb.AttachmentPointer) error
 }
 
 type MessageConverter struct {
@@ -50,11 +55,20 @@ type MessageConverter struct {
 
 	SignalFmtParams *signalfmt.FormatParams
 	MatrixFmtParams *matrixfmt.HTMLParser
+	LocationParams  *LocationParams
 
 	ConvertVoiceMessages bool
 	ConvertGIFToAPNG     bool
+	ConvertGIFToMP4      bool
 	MaxFileSize          int64
-	AsyncFiles           bool
+	// AsyncFiles makes attachments be converted into placeholders if PortalMethods implements
+	// ExtendedPortalMethods. The caller must pass the PendingAttachment of sent placeholders to QueueFileTransfer.
+	AsyncFiles bool
+
+	// SignalMediaCache and MatrixMediaCache are used to avoid transferring the same media multiple times.
+	// Both are optional.
+	SignalMediaCache *database.SignalMediaCacheQuery
+	MatrixMediaCache *database.MatrixMediaCacheQuery
 }
 
 func (mc *MessageConverter) IsPrivateChat(ctx context.Context) bool {
@@ -0,0 +1,207 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"image/jpeg"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/msgconv/matrixfmt"
+	"go.mau.fi/mautrix-signal/msgconv/signalfmt"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// maxQuoteThumbnailSize is the maximum width and height of thumbnails of quoted media sent to Signal.
+const maxQuoteThumbnailSize = 256
+
+// convertQuoteToSignal creates a Signal quote for the Matrix reply or thread message,
+// including the text and a thumbnail of the quoted message if the portal could fetch it.
+func (mc *MessageConverter) convertQuoteToSignal(ctx context.Context, content *event.MessageEventContent) *signalpb.DataMessage_Quote {
+	quote, target := mc.GetSignalReply(ctx, content)
+	if quote == nil || target == nil {
+		return quote
+	}
+	targetContent, ok := target.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return quote
+	}
+	if targetContent.NewContent != nil {
+		targetContent = targetContent.NewContent
+	}
+	targetContent.RemoveReplyFallback()
+	if target.Type == event.EventSticker {
+		targetContent.MsgType = event.MessageType(event.EventSticker.Type)
+	}
+	switch targetContent.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile, event.MessageType(event.EventSticker.Type):
+		quote.Attachments = []*signalpb.DataMessage_Quote_QuotedAttachment{mc.convertQuotedMediaToSignal(ctx, targetContent)}
+		if targetContent.FileName == "" || targetContent.FileName == targetContent.Body {
+			// No caption
+			return quote
+		}
+	default:
+		quote.Attachments = nil
+	}
+	text, bodyRanges := matrixfmt.Parse(mc.MatrixFmtParams, targetContent)
+	if len(text) > MaxInlineBodyLength {
+		// The ranges may point past the truncated text, so drop them entirely
+		text = truncateLongText(text, MaxInlineBodyLength)
+		bodyRanges = nil
+	}
+	quote.Text = proto.String(text)
+	quote.BodyRanges = bodyRanges
+	return quote
+}
+
+// convertQuotedMediaToSignal describes the quoted Matrix media for a Signal quote. Images and videos also get a
+// small thumbnail, which is generated from the Matrix thumbnail if there is one, or the full media otherwise.
+func (mc *MessageConverter) convertQuotedMediaToSignal(ctx context.Context, content *event.MessageEventContent) *signalpb.DataMessage_Quote_QuotedAttachment {
+	info := content.GetInfo()
+	fileName := content.Body
+	if content.FileName != "" {
+		fileName = content.FileName
+	}
+	quoted := &signalpb.DataMessage_Quote_QuotedAttachment{
+		ContentType: proto.String(info.MimeType),
+		FileName:    proto.String(fileName),
+	}
+	if !isVisualMedia(info.MimeType) {
+		return quoted
+	}
+	thumbnail, err := mc.makeQuoteThumbnail(ctx, content)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to create thumbnail for quoted media")
+	} else {
+		quoted.Thumbnail = thumbnail
+	}
+	return quoted
+}
+
+func (mc *MessageConverter) makeQuoteThumbnail(ctx context.Context, content *event.MessageEventContent) (*signalpb.AttachmentPointer, error) {
+	info := content.GetInfo()
+	mime := info.MimeType
+	mediaContent := content
+	if info.ThumbnailURL != "" || info.ThumbnailFile != nil {
+		mediaContent = &event.MessageEventContent{URL: info.ThumbnailURL, File: info.ThumbnailFile}
+		mime = "image/jpeg"
+		if info.ThumbnailInfo != nil && info.ThumbnailInfo.MimeType != "" {
+			mime = info.ThumbnailInfo.MimeType
+		}
+	}
+	data, err := mc.downloadMatrixFile(ctx, mediaContent)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeFirstFrame(ctx, data, mime)
+	if err != nil {
+		return nil, err
+	}
+	img = scaleDownImage(img, maxQuoteThumbnailSize)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	att, err := mc.GetClient(ctx).UploadAttachment(ctx, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMediaUploadFailed, err)
+	}
+	size := img.Bounds().Size()
+	att.ContentType = proto.String("image/jpeg")
+	att.Width = maybeInt(uint32(size.X))
+	att.Height = maybeInt(uint32(size.Y))
+	return att, nil
+}
+
+// describeQuotedAttachments returns a short plaintext description of the attachments in a Signal quote,
+// which is used when the quote doesn't have any text.
+func describeQuotedAttachments(attachments []*signalpb.DataMessage_Quote_QuotedAttachment) string {
+	names := make([]string, 0, len(attachments))
+	for _, att := range attachments {
+		switch {
+		case att.GetFileName() != "":
+			names = append(names, att.GetFileName())
+		case strings.HasPrefix(att.GetContentType(), "image/"):
+			names = append(names, "Photo")
+		case strings.HasPrefix(att.GetContentType(), "video/"):
+			names = append(names, "Video")
+		case strings.HasPrefix(att.GetContentType(), "audio/"):
+			names = append(names, "Audio")
+		default:
+			names = append(names, "Attachment")
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// addUnknownQuoteToMatrix renders a Signal quote whose target message isn't bridged as a blockquote
+// at the start of the given text part, as Matrix replies can only point at existing events.
+func (mc *MessageConverter) addUnknownQuoteToMatrix(ctx context.Context, part *ConvertedMessagePart, quote *signalpb.DataMessage_Quote) {
+	var quoted *event.MessageEventContent
+	if quote.GetText() != "" {
+		quoted = signalfmt.Parse(quote.GetText(), quote.GetBodyRanges(), mc.SignalFmtParams)
+	} else if len(quote.GetAttachments()) > 0 {
+		quoted = &event.MessageEventContent{Body: describeQuotedAttachments(quote.GetAttachments())}
+	} else {
+		return
+	}
+	quotedHTML := quoted.FormattedBody
+	if quoted.Format != event.FormatHTML {
+		quotedHTML = event.TextToHTML(quoted.Body)
+	}
+	authorName := "Unknown user"
+	var authorMXID string
+	if authorUUID, err := uuid.Parse(quote.GetAuthorAci()); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse author of unknown quote")
+	} else if mc.SignalFmtParams != nil {
+		userInfo := mc.SignalFmtParams.GetUserInfo(authorUUID)
+		if userInfo.Name != "" {
+			authorName = userInfo.Name
+		}
+		authorMXID = userInfo.MXID.String()
+	}
+	authorHTML := html.EscapeString(authorName)
+	if authorMXID != "" {
+		authorHTML = fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, html.EscapeString(authorMXID), authorHTML)
+	}
+
+	content := part.Content
+	if content.Format != event.FormatHTML {
+		content.FormattedBody = event.TextToHTML(content.Body)
+		content.Format = event.FormatHTML
+	}
+	content.FormattedBody = fmt.Sprintf("<blockquote>%s<br>%s</blockquote>%s", authorHTML, quotedHTML, content.FormattedBody)
+	var plainQuote strings.Builder
+	plainQuote.WriteString("> " + authorName + ":\n")
+	for _, line := range strings.Split(quoted.Body, "\n") {
+		plainQuote.WriteString("> " + line + "\n")
+	}
+	if content.Body == "" {
+		content.Body = strings.TrimSuffix(plainQuote.String(), "\n")
+	} else {
+		content.Body = plainQuote.String() + "\n" + content.Body
+	}
+}
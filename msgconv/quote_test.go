@@ -0,0 +1,90 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type fakeReplyPortal struct {
+	PortalMethods
+	target *event.Event
+}
+
+func (frp *fakeReplyPortal) GetSignalReply(ctx context.Context, content *event.MessageEventContent) (*signalpb.DataMessage_Quote, *event.Event) {
+	return &signalpb.DataMessage_Quote{
+		Id:          proto.Uint64(1234),
+		AuthorAci:   proto.String("00000000-0000-0000-0000-000000000001"),
+		Attachments: make([]*signalpb.DataMessage_Quote_QuotedAttachment, 0),
+	}, frp.target
+}
+
+func TestConvertQuoteToSignal_Text(t *testing.T) {
+	target := &event.Event{
+		Type: event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    "> <@user:example.com> original\n\nreply text",
+			RelatesTo: &event.RelatesTo{
+				InReplyTo: &event.InReplyTo{EventID: "$original"},
+			},
+		}},
+	}
+	mc := &MessageConverter{PortalMethods: &fakeReplyPortal{target: target}}
+	quote := mc.convertQuoteToSignal(context.Background(), &event.MessageEventContent{})
+	assert.Equal(t, uint64(1234), quote.GetId())
+	assert.Equal(t, "reply text", quote.GetText())
+	assert.Empty(t, quote.GetAttachments())
+}
+
+func TestConvertQuoteToSignal_UnknownTarget(t *testing.T) {
+	mc := &MessageConverter{PortalMethods: &fakeReplyPortal{}}
+	quote := mc.convertQuoteToSignal(context.Background(), &event.MessageEventContent{})
+	assert.Nil(t, quote.Text)
+	assert.NotNil(t, quote.Attachments)
+}
+
+func TestAddUnknownQuoteToMatrix(t *testing.T) {
+	mc := &MessageConverter{}
+	part := &ConvertedMessagePart{Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}}
+	mc.addUnknownQuoteToMatrix(context.Background(), part, &signalpb.DataMessage_Quote{
+		Text: proto.String("first\nsecond"),
+	})
+	assert.Equal(t, "> Unknown user:\n> first\n> second\n\nhi", part.Content.Body)
+	assert.Equal(t, "<blockquote>Unknown user<br>first<br/>second</blockquote>hi", part.Content.FormattedBody)
+
+	emptyPart := &ConvertedMessagePart{Content: &event.MessageEventContent{MsgType: event.MsgText}}
+	mc.addUnknownQuoteToMatrix(context.Background(), emptyPart, &signalpb.DataMessage_Quote{
+		Attachments: []*signalpb.DataMessage_Quote_QuotedAttachment{{ContentType: proto.String("image/jpeg")}},
+	})
+	assert.Equal(t, "> Unknown user:\n> Photo", emptyPart.Content.Body)
+}
+
+func TestScaleDownImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	assert.Equal(t, image.Pt(256, 128), scaleDownImage(img, 256).Bounds().Size())
+	small := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	assert.Same(t, small, scaleDownImage(small, 256))
+}
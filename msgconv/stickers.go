@@ -0,0 +1,71 @@
+// mautrix-signal - A Matrix-Signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// SignalStickerInfo is the fi.mau.signal.sticker field in Matrix sticker events and image pack entries.
+type SignalStickerInfo struct {
+	ID    uint32                `json:"id"`
+	Emoji string                `json:"emoji"`
+	Pack  SignalStickerPackInfo `json:"pack"`
+}
+
+type SignalStickerPackInfo struct {
+	ID     []byte `json:"id"`
+	Key    []byte `json:"key"`
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+// getSignalSticker finds the Signal sticker pack and ID for a Matrix sticker event, either from the extra metadata
+// included in stickers bridged from Signal, or from the stickers in packs that have been bridged to Matrix.
+// If the sticker isn't from Signal, nil is returned.
+func (mc *MessageConverter) getSignalSticker(ctx context.Context, evt *event.Event, content *event.MessageEventContent) *signalpb.DataMessage_Sticker {
+	if rawInfo, ok := evt.Content.Raw["fi.mau.signal.sticker"]; ok {
+		var info SignalStickerInfo
+		if data, err := json.Marshal(rawInfo); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to marshal Signal sticker info")
+		} else if err = json.Unmarshal(data, &info); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse Signal sticker info")
+		} else if len(info.Pack.ID) == signalmeow.StickerPackIDLength && len(info.Pack.Key) == signalmeow.StickerPackKeyLength {
+			sticker := &signalpb.DataMessage_Sticker{
+				PackId:    info.Pack.ID,
+				PackKey:   info.Pack.Key,
+				StickerId: proto.Uint32(info.ID),
+			}
+			if info.Emoji != "" {
+				sticker.Emoji = proto.String(info.Emoji)
+			}
+			return sticker
+		}
+	}
+	if content.URL != "" {
+		return mc.GetSignalSticker(ctx, content.URL)
+	}
+	return nil
+}
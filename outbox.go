@@ -0,0 +1,244 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	outboxMinBackoff = 2 * time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+// shouldUseOutbox returns true if a message should be queued in the outbox instead of sending it directly,
+// either because the user isn't connected, or because there are older queued messages in the same chat
+// (e.g. ones that were paused by a rate limit challenge).
+func (portal *Portal) shouldUseOutbox(ctx context.Context, sender *User) bool {
+	if portal.bridge.Config.Bridge.Outbox.MaxAge > 0 && !sender.Client.IsConnected() {
+		return true
+	}
+	hasPending, err := portal.bridge.DB.OutgoingMessage.HasPendingForPortal(ctx, sender.MXID, portal.PortalKey)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to check if portal has queued outgoing messages")
+		return false
+	}
+	return hasPending
+}
+
+func (portal *Portal) queueOutgoingMessage(ctx context.Context, sender *User, evt *event.Event, content *signalpb.Content, timestamp uint64) error {
+	contentBytes, err := proto.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("failed to marshal content: %w", err)
+	}
+	msg := portal.bridge.DB.OutgoingMessage.New()
+	msg.MXID = evt.ID
+	msg.RoomID = portal.MXID
+	msg.Sender = evt.Sender
+	msg.UserMXID = sender.MXID
+	msg.SignalChatID = portal.ChatID
+	msg.SignalReceiver = portal.Receiver
+	msg.Timestamp = timestamp
+	msg.Content = contentBytes
+	msg.CreatedAt = time.UnixMilli(evt.Timestamp)
+	err = msg.Insert(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert outgoing message: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Msg("Queued message in outbox")
+	sender.wakeOutbox()
+	return nil
+}
+
+// sendOutgoingMessage tries to send a message from the outbox. The message is deleted from the outbox
+// if it was sent successfully or failed permanently. An error is only returned if it should be retried.
+func (portal *Portal) sendOutgoingMessage(ctx context.Context, sender *User, msg *database.OutgoingMessage) error {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("event_id", msg.MXID).
+		Uint64("timestamp", msg.Timestamp).
+		Int("attempts", msg.Attempts).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	if maxAge := portal.bridge.Config.Bridge.Outbox.MaxAge; maxAge > 0 && time.Since(msg.CreatedAt) > maxAge {
+		log.Warn().Time("created_at", msg.CreatedAt).Msg("Queued message is too old, dropping it")
+		portal.sendOutgoingMessageStatus(ctx, msg, errOutboxMessageExpired)
+		portal.deleteOutgoingMessage(ctx, msg)
+		return nil
+	}
+	var content signalpb.Content
+	err := proto.Unmarshal(msg.Content, &content)
+	if err != nil {
+		log.Err(err).Msg("Failed to unmarshal queued message")
+		portal.sendOutgoingMessageStatus(ctx, msg, err)
+		portal.deleteOutgoingMessage(ctx, msg)
+		return nil
+	}
+	err = portal.sendSignalMessage(ctx, &content, sender, msg.MXID)
+	if err != nil && !isTransientSendError(sender, err) {
+		log.Err(err).Msg("Failed to send queued message, dropping it")
+		portal.sendOutgoingMessageStatus(ctx, msg, err)
+		portal.deleteOutgoingMessage(ctx, msg)
+		return nil
+	} else if err != nil {
+		log.Err(err).Msg("Failed to send queued message")
+		if dbErr := msg.SetAttempts(ctx, msg.Attempts+1); dbErr != nil {
+			log.Err(dbErr).Msg("Failed to update queued message attempt count")
+		}
+		return err
+	}
+	log.Debug().Msg("Sent queued message")
+	if editMsg := content.GetEditMessage(); editMsg != nil {
+		editTarget, err := portal.bridge.DB.Message.GetLastPartBySignalID(ctx, sender.SignalID, editMsg.GetTargetSentTimestamp(), portal.Receiver)
+		if err != nil {
+			log.Err(err).Msg("Failed to get edit target message")
+		} else if editTarget != nil {
+			err = editTarget.SetTimestamp(ctx, msg.Timestamp)
+			if err != nil {
+				log.Err(err).Msg("Failed to update message timestamp in database after editing")
+			}
+		}
+	} else {
+		portal.storeMessageInDB(ctx, msg.MXID, sender.SignalID, msg.Timestamp, 0)
+		if portal.ExpirationTime > 0 {
+			portal.addDisappearingMessage(ctx, msg.MXID, uint32(portal.ExpirationTime), true)
+		}
+	}
+	portal.sendOutgoingMessageStatus(ctx, msg, nil)
+	portal.deleteOutgoingMessage(ctx, msg)
+	return nil
+}
+
+// isTransientSendError returns true if sending a message failed in a way that is likely to succeed when retried,
+// like network errors or rate limits. Other errors (e.g. invalid content or unknown recipients) are final.
+func isTransientSendError(sender *User, err error) bool {
+	var challengeErr *signalmeow.RateLimitChallengeError
+	var netErr net.Error
+	return errors.As(err, &challengeErr) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled) ||
+		// Errors caused by the connection dropping mid-send don't have a specific type
+		!sender.Client.IsConnected()
+}
+
+func (portal *Portal) deleteOutgoingMessage(ctx context.Context, msg *database.OutgoingMessage) {
+	err := msg.Delete(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to delete message from outbox")
+	}
+}
+
+func (portal *Portal) sendOutgoingMessageStatus(ctx context.Context, msg *database.OutgoingMessage, err error) {
+	// The original event isn't stored, but the metadata is enough for status events and checkpoints
+	evt := &event.Event{
+		ID:        msg.MXID,
+		RoomID:    msg.RoomID,
+		Sender:    msg.Sender,
+		Type:      event.EventMessage,
+		Timestamp: msg.CreatedAt.UnixMilli(),
+	}
+	portal.sendMessageMetrics(ctx, evt, err, "Error sending", nil)
+}
+
+func (user *User) wakeOutbox() {
+	user.outboxLoopOnce.Do(func() {
+		user.outboxWake = make(chan struct{}, 1)
+		go user.outboxLoop()
+	})
+	select {
+	case user.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (user *User) outboxLoop() {
+	log := user.log.With().Str("action", "outbox loop").Logger()
+	ctx := log.WithContext(context.TODO())
+	for range user.outboxWake {
+		backoff := outboxMinBackoff
+		for user.flushOutbox(ctx) {
+			log.Debug().Dur("backoff", backoff).Msg("Some queued messages failed, retrying after backoff")
+			select {
+			case <-time.After(backoff):
+			case <-user.outboxWake:
+			}
+			backoff *= 2
+			if backoff > outboxMaxBackoff {
+				backoff = outboxMaxBackoff
+			}
+		}
+	}
+}
+
+// flushOutbox tries to send all queued messages of the user. Messages in each chat are sent in order,
+// so if one fails, the rest of that chat is skipped. Returns true if the flush should be retried later.
+func (user *User) flushOutbox(ctx context.Context) (retry bool) {
+	log := zerolog.Ctx(ctx)
+	msgs, err := user.bridge.DB.OutgoingMessage.GetAllForUser(ctx, user.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get queued messages")
+		return true
+	} else if len(msgs) == 0 {
+		return false
+	}
+	log.Debug().Int("message_count", len(msgs)).Msg("Sending queued messages")
+	failedPortals := make(map[database.PortalKey]struct{})
+	for _, msg := range msgs {
+		if !user.IsLoggedIn() || !user.Client.IsConnected() {
+			log.Debug().Msg("Not connected to Signal, pausing outbox until reconnect")
+			return false
+		} else if user.Client.PendingRateLimitChallenge() != nil {
+			log.Debug().Msg("Rate limit challenge is pending, pausing outbox until it's solved")
+			return false
+		}
+		key := msg.PortalKey()
+		if _, failed := failedPortals[key]; failed {
+			continue
+		}
+		portal := user.bridge.GetPortalByChatID(key)
+		if portal == nil {
+			// The portal won't come back by retrying, so drop the message instead of blocking the outbox
+			log.Warn().
+				Str("chat_id", key.ChatID).
+				Stringer("event_id", msg.MXID).
+				Msg("Portal of queued message not found, dropping message")
+			if err = msg.Delete(ctx); err != nil {
+				log.Err(err).Msg("Failed to delete message from outbox")
+			}
+			continue
+		}
+		err = portal.sendOutgoingMessage(ctx, user, msg)
+		if err != nil {
+			failedPortals[key] = struct{}{}
+			retry = true
+		}
+	}
+	return retry
+}
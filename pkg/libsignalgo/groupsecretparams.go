@@ -157,3 +157,64 @@ func (gsp *GroupSecretParams) DecryptProfileKey(ciphertextProfileKey ProfileKeyC
 	copy(result[:], C.GoBytes(unsafe.Pointer(&profileKey), C.int(C.SignalPROFILE_KEY_LEN)))
 	return &result, nil
 }
+
+func (gsp *GroupSecretParams) EncryptUUID(u uuid.UUID) (*UUIDCiphertext, error) {
+	var ciphertext [C.SignalUUID_CIPHERTEXT_LEN]C.uchar
+	serviceID, err := SignalServiceIDFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	signalFfiError := C.signal_group_secret_params_encrypt_service_id(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		serviceID,
+	)
+	runtime.KeepAlive(gsp)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result UUIDCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&ciphertext), C.int(C.SignalUUID_CIPHERTEXT_LEN)))
+	return &result, nil
+}
+
+func (gsp *GroupSecretParams) EncryptProfileKey(profileKey ProfileKey, u uuid.UUID) (*ProfileKeyCiphertext, error) {
+	var ciphertext [C.SignalPROFILE_KEY_CIPHERTEXT_LEN]C.uchar
+	serviceID, err := SignalServiceIDFromUUID(u)
+	if err != nil {
+		return nil, err
+	}
+	signalFfiError := C.signal_group_secret_params_encrypt_profile_key(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalPROFILE_KEY_LEN]C.uint8_t)(unsafe.Pointer(&profileKey)),
+		serviceID,
+	)
+	runtime.KeepAlive(gsp)
+	runtime.KeepAlive(profileKey)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ProfileKeyCiphertext
+	copy(result[:], C.GoBytes(unsafe.Pointer(&ciphertext), C.int(C.SignalPROFILE_KEY_CIPHERTEXT_LEN)))
+	return &result, nil
+}
+
+func (gsp *GroupSecretParams) EncryptBlobWithPadding(blob []byte, paddingLen uint32) ([]byte, error) {
+	var ciphertext C.SignalOwnedBuffer = C.SignalOwnedBuffer{}
+	randomness := GenerateRandomness()
+	signalFfiError := C.signal_group_secret_params_encrypt_blob_with_padding_deterministic(
+		&ciphertext,
+		(*[C.SignalGROUP_SECRET_PARAMS_LEN]C.uint8_t)(unsafe.Pointer(gsp)),
+		(*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)),
+		BytesToBuffer(blob),
+		C.uint32_t(paddingLen),
+	)
+	runtime.KeepAlive(gsp)
+	runtime.KeepAlive(blob)
+	runtime.KeepAlive(randomness)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	return CopySignalOwnedBufferToBytes(ciphertext), nil
+}
@@ -0,0 +1,87 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package libsignalgo
+
+/*
+#cgo LDFLAGS: -lsignal_ffi -ldl -lm
+#include "./libsignal-ffi.h"
+*/
+import "C"
+import (
+	"runtime"
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+// ServerSecretParams are the server half of the zkgroup parameters.
+// Real clients never have these, they're only used for running fake servers in tests.
+type ServerSecretParams [C.SignalSERVER_SECRET_PARAMS_LEN]byte
+
+func GenerateServerSecretParams() (*ServerSecretParams, error) {
+	var params [C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar
+	randomness := GenerateRandomness()
+	signalFfiError := C.signal_server_secret_params_generate_deterministic(&params, (*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)))
+	runtime.KeepAlive(randomness)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ServerSecretParams
+	copy(result[:], C.GoBytes(unsafe.Pointer(&params), C.int(C.SignalSERVER_SECRET_PARAMS_LEN)))
+	return &result, nil
+}
+
+func (ssp *ServerSecretParams) GetPublicParams() (*ServerPublicParams, error) {
+	var params [C.SignalSERVER_PUBLIC_PARAMS_LEN]C.uchar
+	signalFfiError := C.signal_server_secret_params_get_public_params(&params, (*[C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar)(unsafe.Pointer(ssp)))
+	runtime.KeepAlive(ssp)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result ServerPublicParams
+	copy(result[:], C.GoBytes(unsafe.Pointer(&params), C.int(C.SignalSERVER_PUBLIC_PARAMS_LEN)))
+	return &result, nil
+}
+
+func (ssp *ServerSecretParams) IssueAuthCredentialWithPni(aci, pni uuid.UUID, redemptionTime uint64) (*AuthCredentialWithPniResponse, error) {
+	var response [C.SignalAUTH_CREDENTIAL_WITH_PNI_RESPONSE_LEN]C.uchar
+	c_aci, err := SignalServiceIDFromUUID(aci)
+	if err != nil {
+		return nil, err
+	}
+	c_pni, err := SignalPNIServiceIDFromUUID(pni)
+	if err != nil {
+		return nil, err
+	}
+	randomness := GenerateRandomness()
+	signalFfiError := C.signal_server_secret_params_issue_auth_credential_with_pni_as_aci_deterministic(
+		&response,
+		(*[C.SignalSERVER_SECRET_PARAMS_LEN]C.uchar)(unsafe.Pointer(ssp)),
+		(*[C.SignalRANDOMNESS_LEN]C.uint8_t)(unsafe.Pointer(&randomness)),
+		c_aci,
+		c_pni,
+		C.uint64_t(redemptionTime),
+	)
+	runtime.KeepAlive(ssp)
+	runtime.KeepAlive(randomness)
+	if signalFfiError != nil {
+		return nil, wrapError(signalFfiError)
+	}
+	var result AuthCredentialWithPniResponse
+	copy(result[:], C.GoBytes(unsafe.Pointer(&response), C.int(C.SignalAUTH_CREDENTIAL_WITH_PNI_RESPONSE_LEN)))
+	return &result, nil
+}
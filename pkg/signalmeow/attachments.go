@@ -52,12 +52,12 @@ func getAttachmentPath(id uint64, key string, cdnNumber uint32) (string, error)
 var ErrInvalidMACForAttachment = errors.New("invalid MAC for attachment")
 var ErrInvalidDigestForAttachment = errors.New("invalid digest for attachment")
 
-func DownloadAttachment(ctx context.Context, a *signalpb.AttachmentPointer) ([]byte, error) {
+func (cli *Client) DownloadAttachment(ctx context.Context, a *signalpb.AttachmentPointer) ([]byte, error) {
 	path, err := getAttachmentPath(a.GetCdnId(), a.GetCdnKey(), a.GetCdnNumber())
 	if err != nil {
 		return nil, err
 	}
-	resp, err := web.GetAttachment(ctx, path, a.GetCdnNumber(), nil)
+	resp, err := cli.Server.Transport.GetAttachment(ctx, path, a.GetCdnNumber(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -139,7 +139,7 @@ func (cli *Client) UploadAttachment(ctx context.Context, body []byte) (*signalpb
 	attributesPath := "/v3/attachments/form/upload"
 	username, password := cli.Store.BasicAuthCreds()
 	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, attributesPath, opts)
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, attributesPath, opts)
 	if err != nil {
 		log.Err(err).Msg("Error sending request fetching upload attributes")
 		return nil, err
@@ -152,7 +152,7 @@ func (cli *Client) UploadAttachment(ctx context.Context, body []byte) (*signalpb
 	}
 
 	// Allocate attachment on CDN
-	resp, err = web.SendHTTPRequest(ctx, http.MethodPost, "", &web.HTTPReqOpt{
+	resp, err = cli.Server.Transport.SendHTTPRequest(ctx, http.MethodPost, "", &web.HTTPReqOpt{
 		OverrideURL: uploadAttributes.SignedUploadLocation,
 		ContentType: web.ContentTypeOctetStream,
 		Headers:     uploadAttributes.Headers,
@@ -169,7 +169,7 @@ func (cli *Client) UploadAttachment(ctx context.Context, body []byte) (*signalpb
 	}
 
 	// Upload attachment to CDN
-	resp, err = web.SendHTTPRequest(ctx, http.MethodPut, "", &web.HTTPReqOpt{
+	resp, err = cli.Server.Transport.SendHTTPRequest(ctx, http.MethodPut, "", &web.HTTPReqOpt{
 		OverrideURL: resp.Header.Get("Location"),
 		Body:        encryptedWithMAC,
 		ContentType: web.ContentTypeOctetStream,
@@ -0,0 +1,156 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+const (
+	ChallengeOptionRecaptcha     = "recaptcha"
+	ChallengeOptionPushChallenge = "pushChallenge"
+)
+
+// CaptchaURL is the page where users can solve captchas for rate limit challenges.
+const CaptchaURL = "https://signalcaptchas.org/challenge/generate.html"
+
+const captchaPrefix = "signalcaptcha://"
+
+// RateLimitChallengeError is returned when the server rejects a message with 428 Precondition Required.
+// All outgoing messages are paused until the challenge is solved with Client.SubmitRateLimitChallenge,
+// or until the retry-after time passes.
+type RateLimitChallengeError struct {
+	Token      string        `json:"token"`
+	Options    []string      `json:"options"`
+	RetryAfter time.Duration `json:"-"`
+
+	receivedAt time.Time
+}
+
+func (e *RateLimitChallengeError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by server, solve a captcha or wait %s before sending again", e.RetryAfter)
+	}
+	return "rate limited by server, solve a captcha before sending again"
+}
+
+func (e *RateLimitChallengeError) expired() bool {
+	return e.RetryAfter > 0 && time.Since(e.receivedAt) > e.RetryAfter
+}
+
+func parseRateLimitChallenge(response *signalpb.WebSocketResponseMessage) (*RateLimitChallengeError, error) {
+	var challenge RateLimitChallengeError
+	err := json.Unmarshal(response.GetBody(), &challenge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse challenge: %w", err)
+	}
+	challenge.receivedAt = time.Now()
+	for _, header := range response.GetHeaders() {
+		key, value, _ := strings.Cut(header, ":")
+		if strings.EqualFold(strings.TrimSpace(key), "Retry-After") {
+			retryAfterSeconds, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse retry-after header: %w", err)
+			}
+			challenge.RetryAfter = time.Duration(retryAfterSeconds) * time.Second
+		}
+	}
+	return &challenge, nil
+}
+
+// PendingRateLimitChallenge returns the challenge that is currently blocking outgoing messages, or nil if
+// messages can be sent normally.
+func (cli *Client) PendingRateLimitChallenge() *RateLimitChallengeError {
+	cli.challengeLock.Lock()
+	defer cli.challengeLock.Unlock()
+	if cli.challenge != nil && cli.challenge.expired() {
+		cli.challenge = nil
+	}
+	return cli.challenge
+}
+
+func (cli *Client) setRateLimitChallenge(ctx context.Context, challenge *RateLimitChallengeError) {
+	cli.challengeLock.Lock()
+	isNew := cli.challenge == nil || cli.challenge.Token != challenge.Token
+	cli.challenge = challenge
+	cli.challengeLock.Unlock()
+	if isNew {
+		zerolog.Ctx(ctx).Warn().
+			Str("token", challenge.Token).
+			Strs("options", challenge.Options).
+			Dur("retry_after", challenge.RetryAfter).
+			Msg("Got rate limit challenge, pausing outgoing messages")
+		cli.handleEvent(&events.RateLimitChallenge{
+			Token:      challenge.Token,
+			Options:    challenge.Options,
+			RetryAfter: challenge.RetryAfter,
+		})
+	}
+}
+
+type challengeResponse struct {
+	Type    string `json:"type"`
+	Token   string `json:"token"`
+	Captcha string `json:"captcha"`
+}
+
+// SubmitRateLimitChallenge submits a solved captcha for a rate limit challenge. The captcha may include
+// the signalcaptcha:// prefix that the captcha page redirects to. Outgoing messages are resumed after
+// the server accepts the captcha.
+func (cli *Client) SubmitRateLimitChallenge(ctx context.Context, token, captcha string) error {
+	if cli.AuthedWS == nil || !cli.AuthedWS.IsConnected() {
+		return errors.New("not connected to Signal")
+	}
+	captcha = strings.TrimPrefix(strings.TrimSpace(captcha), captchaPrefix)
+	jsonBytes, err := json.Marshal(&challengeResponse{
+		Type:    ChallengeOptionRecaptcha,
+		Token:   token,
+		Captcha: captcha,
+	})
+	if err != nil {
+		return err
+	}
+	request := web.CreateWSRequest(http.MethodPut, "/v1/challenge", jsonBytes, nil, nil)
+	resp, err := cli.AuthedWS.SendRequest(ctx, request)
+	if err != nil {
+		return fmt.Errorf("failed to send challenge response: %w", err)
+	} else if resp.GetStatus() == 428 {
+		return fmt.Errorf("server rejected captcha")
+	} else if resp.GetStatus() < 200 || resp.GetStatus() >= 300 {
+		return fmt.Errorf("unexpected status code submitting challenge: %d", resp.GetStatus())
+	}
+	cli.challengeLock.Lock()
+	if cli.challenge != nil && cli.challenge.Token == token {
+		cli.challenge = nil
+	}
+	cli.challengeLock.Unlock()
+	zerolog.Ctx(ctx).Info().Str("token", token).Msg("Rate limit challenge solved, resuming outgoing messages")
+	return nil
+}
@@ -21,17 +21,23 @@ import (
 	"errors"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
 
 type Client struct {
-	Store *store.Device
+	Store  *store.Device
+	Server *Server
 
 	SenderCertificate      *libsignalgo.SenderCertificate
 	GroupCredentials       *GroupCredentials
@@ -40,13 +46,47 @@ type Client struct {
 	GroupCallCache         *map[string]bool
 	LastContactRequestTime *int64
 
-	encryptionLock sync.Mutex
+	// GroupSendConcurrency is the maximum number of group members that messages are sent to in parallel.
+	// If zero, DefaultGroupSendConcurrency is used.
+	GroupSendConcurrency int
+
+	// sendLocks ensures that only one message is encrypted and sent to each recipient at a time.
+	// This keeps session ratchets consistent and messages to a single recipient in order.
+	sendLocks      recipientLocks
+	senderCertLock sync.Mutex
+	// ReceiveConcurrency is the maximum number of senders whose incoming envelopes are decrypted in parallel.
+	// If zero, DefaultReceiveConcurrency is used.
+	ReceiveConcurrency int
+	// SignedPreKeyRotationInterval is how old the signed prekey and the last resort kyber prekey can get
+	// before they're replaced. If zero, DefaultSignedPreKeyRotationInterval is used.
+	SignedPreKeyRotationInterval time.Duration
+	// ReplacedPreKeyGracePeriod is how long prekeys are kept after they've been replaced on the server.
+	// If zero, DefaultReplacedPreKeyGracePeriod is used.
+	ReplacedPreKeyGracePeriod time.Duration
+
+	inboxLock           sync.Mutex
+	queueEmptyChan      chan struct{}
+	envelopeQueue       *envelopeQueue
+	envelopeQueueOnce   sync.Once
+	envelopesSincePrune atomic.Int32
+
+	challengeLock sync.Mutex
+	challenge     *RateLimitChallengeError
 
 	AuthedWS   *web.SignalWebsocket
 	UnauthedWS *web.SignalWebsocket
 	WSCancel   context.CancelFunc
 
 	EventHandler func(events.SignalEvent)
+	// TrackDuplicateEnvelope is called when an envelope is dropped because it was already processed.
+	TrackDuplicateEnvelope func(envelopeType signalpb.Envelope_Type)
+	// TrackEnvelopeQueue is called with the change in the number of incoming envelopes waiting to be handled.
+	TrackEnvelopeQueue func(delta int)
+	// TrackEnvelopeStage is called with the time an incoming envelope spent in each stage of handling.
+	// See the EnvelopeStage constants for the possible stages.
+	TrackEnvelopeStage func(stage string, duration time.Duration)
+	// TrackPreKeyCounts is called with the number of one-time prekeys left on the server whenever they're checked.
+	TrackPreKeyCounts func(aci uuid.UUID, uuidKind types.UUIDKind, preKeyCount, kyberPreKeyCount int)
 
 	storageAuthLock sync.Mutex
 	storageAuth     *basicExpiringCredentials
@@ -84,7 +124,7 @@ func (cli *Client) ConnectAuthedWS(ctx context.Context, requestHandler web.Reque
 	path := web.WebsocketPath +
 		"?login=" + username +
 		"&password=" + password
-	authedWS := web.NewSignalWebsocket(path, &username, &password)
+	authedWS := web.NewSignalWebsocket(cli.Server.Transport, path, &username, &password)
 	statusChan := authedWS.Connect(ctx, &requestHandler)
 	cli.AuthedWS = authedWS
 	return statusChan, nil
@@ -99,7 +139,7 @@ func (cli *Client) ConnectUnauthedWS(ctx context.Context) (chan web.SignalWebsoc
 		Str("websocket_type", "unauthed").
 		Logger()
 	ctx = log.WithContext(ctx)
-	unauthedWS := web.NewSignalWebsocket(web.WebsocketPath, nil, nil)
+	unauthedWS := web.NewSignalWebsocket(cli.Server.Transport, web.WebsocketPath, nil, nil)
 	statusChan := unauthedWS.Connect(ctx, nil)
 	cli.UnauthedWS = unauthedWS
 	return statusChan, nil
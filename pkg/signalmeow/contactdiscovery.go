@@ -19,7 +19,6 @@ package signalmeow
 import (
 	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/url"
@@ -30,23 +29,17 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
-	"go.mau.fi/util/exerrors"
 	"google.golang.org/protobuf/proto"
 	"nhooyr.io/websocket"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
-	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
 
-const ProdContactDiscoveryServer = "cdsi.signal.org"
-const ProdContactDiscoveryMrenclave = "0f6fd79cdfdaa5b2e6337f534d3baf999318b0c462a7ac1f41297a3e4b424a57"
 const ContactDiscoveryAuthTTL = 23 * time.Hour
 
 const rateLimitCloseCode = websocket.StatusCode(4008)
 
-var prodContactDiscoveryMrenclaveBytes = exerrors.Must(hex.DecodeString(ProdContactDiscoveryMrenclave))
-
 type ContactDiscoveryRateLimitError struct {
 	RetryAfter time.Duration
 }
@@ -59,6 +52,8 @@ type ContactDiscoveryClient struct {
 	CDS *libsignalgo.SGXClientState
 	WS  *websocket.Conn
 
+	mrenclave []byte
+
 	Token     []byte
 	Response  ContactDiscoveryResponse
 	stateLock sync.Mutex
@@ -108,12 +103,12 @@ func (cli *Client) doContactDiscovery(ctx context.Context, req *signalpb.CDSClie
 	ctx = log.WithContext(ctx)
 	addr := (&url.URL{
 		Scheme: "wss",
-		Host:   ProdContactDiscoveryServer,
+		Host:   cli.Server.Transport.Hosts.ContactDiscovery,
 		User:   url.UserPassword(creds.Username, creds.Password),
-		Path:   path.Join("v1", ProdContactDiscoveryMrenclave, "discovery"),
+		Path:   path.Join("v1", cli.Server.Env.ContactDiscoveryMrenclave, "discovery"),
 	}).String()
 	log.Trace().Msg("Connecting to contact discovery websocket")
-	ws, _, err := web.OpenWebsocketURL(ctx, addr)
+	ws, _, err := cli.Server.Transport.OpenWebsocketURL(ctx, addr)
 	if err != nil {
 		var closeErr websocket.CloseError
 		if errors.As(err, &closeErr) && closeErr.Code == rateLimitCloseCode {
@@ -129,7 +124,8 @@ func (cli *Client) doContactDiscovery(ctx context.Context, req *signalpb.CDSClie
 		_ = ws.CloseNow()
 	}()
 	cdc := &ContactDiscoveryClient{
-		WS: ws,
+		WS:        ws,
+		mrenclave: cli.Server.contactDiscoveryMrenclave,
 	}
 	log.Trace().Msg("Doing contact discovery websocket handshake")
 	err = cdc.Handshake(ctx)
@@ -161,7 +157,7 @@ func (cdc *ContactDiscoveryClient) Handshake(ctx context.Context) error {
 	} else if msgType != websocket.MessageBinary {
 		return fmt.Errorf("expected binary message, got %s", msgType.String())
 	}
-	cdsClient, err := libsignalgo.NewCDS2ClientState(prodContactDiscoveryMrenclaveBytes, attestationMsg, time.Now())
+	cdsClient, err := libsignalgo.NewCDS2ClientState(cdc.mrenclave, attestationMsg, time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to initialize CDS2 client state: %w", err)
 	}
@@ -64,7 +64,7 @@ func (cli *Client) updateDeviceName(ctx context.Context, encryptedName []byte) e
 		return fmt.Errorf("failed to marshal device name update request: %w", err)
 	}
 	username, password := cli.Store.BasicAuthCreds()
-	resp, err := web.SendHTTPRequest(ctx, http.MethodPut, "/v1/accounts/name", &web.HTTPReqOpt{
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodPut, "/v1/accounts/name", &web.HTTPReqOpt{
 		Body:     reqData,
 		Username: &username,
 		Password: &password,
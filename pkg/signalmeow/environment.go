@@ -0,0 +1,144 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Environment describes a Signal server deployment.
+type Environment struct {
+	Name  string
+	Hosts web.Hosts
+
+	// ServerPublicParams are the zkgroup parameters used for profile and group credentials.
+	ServerPublicParams []byte
+	// TrustRoot is the base64-encoded public key that signs sealed sender certificates.
+	TrustRoot string
+	// ContactDiscoveryMrenclave is the hex-encoded enclave ID of the contact discovery service.
+	ContactDiscoveryMrenclave string
+}
+
+//go:embed prod-server-public-params.dat
+var prodServerPublicParams []byte
+
+var ProductionEnvironment = Environment{
+	Name:                      "production",
+	Hosts:                     web.ProductionHosts,
+	ServerPublicParams:        prodServerPublicParams,
+	TrustRoot:                 "BXu6QIKVz5MA8gstzfOgRQGqyLqOwNKHL6INkv3IHWMF",
+	ContactDiscoveryMrenclave: "0f6fd79cdfdaa5b2e6337f534d3baf999318b0c462a7ac1f41297a3e4b424a57",
+}
+
+// StagingEnvironment points at Signal's staging servers. The staging zkgroup params and enclave ID change
+// more often than the production ones, so they're not bundled and must be filled in before connecting.
+var StagingEnvironment = Environment{
+	Name:      "staging",
+	Hosts:     web.StagingHosts,
+	TrustRoot: "BbqY1DzohE4NUZoVF+L18oUPrK3kILllLEJh2UnPSsEx",
+}
+
+// EnvironmentByName returns a copy of the preset with the given name, or nil if there's no such preset.
+func EnvironmentByName(name string) *Environment {
+	var env Environment
+	switch name {
+	case "", ProductionEnvironment.Name:
+		env = ProductionEnvironment
+	case StagingEnvironment.Name:
+		env = StagingEnvironment
+	default:
+		return nil
+	}
+	cdnHosts := env.Hosts.CDN
+	env.Hosts.CDN = make(map[uint32]string, len(cdnHosts))
+	for num, host := range cdnHosts {
+		env.Hosts.CDN[num] = host
+	}
+	return &env
+}
+
+// Server is a connection configuration for a specific Environment.
+// All HTTP requests and websockets made by signalmeow go through the Transport of a Server.
+type Server struct {
+	Env       *Environment
+	Transport *web.Transport
+
+	serverPublicParams        libsignalgo.ServerPublicParams
+	trustRoot                 *libsignalgo.PublicKey
+	contactDiscoveryMrenclave []byte
+}
+
+// Connect validates the environment and creates a Server that uses a transport with the given proxy and CA settings.
+func (env *Environment) Connect(proxyURL string, extraCACertPaths []string) (*Server, error) {
+	transport, err := web.NewTransport(web.TransportConfig{
+		Hosts:            env.Hosts,
+		ProxyURL:         proxyURL,
+		ExtraCACertPaths: extraCACertPaths,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return env.NewServer(transport)
+}
+
+// Validate checks that all the parameters which aren't bundled for every environment are set.
+func (env *Environment) Validate() error {
+	if len(env.ServerPublicParams) == 0 {
+		return fmt.Errorf("server public params not set (required for the %s environment)", env.Name)
+	} else if len(env.ServerPublicParams) != len(libsignalgo.ServerPublicParams{}) {
+		return fmt.Errorf("server public params have wrong length %d", len(env.ServerPublicParams))
+	} else if env.TrustRoot == "" {
+		return fmt.Errorf("trust root not set (required for the %s environment)", env.Name)
+	} else if env.ContactDiscoveryMrenclave == "" {
+		return fmt.Errorf("contact discovery mrenclave not set (required for the %s environment)", env.Name)
+	}
+	return nil
+}
+
+// NewServer creates a Server for the environment with a custom transport.
+func (env *Environment) NewServer(transport *web.Transport) (*Server, error) {
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+	trustRootBytes, err := base64.StdEncoding.DecodeString(env.TrustRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode trust root: %w", err)
+	}
+	trustRoot, err := libsignalgo.DeserializePublicKey(trustRootBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trust root: %w", err)
+	}
+	// The server config lives as long as the program, so the key is never going to be freed anyway
+	trustRoot.CancelFinalizer()
+	mrenclave, err := hex.DecodeString(env.ContactDiscoveryMrenclave)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode contact discovery mrenclave: %w", err)
+	}
+	return &Server{
+		Env:                       env,
+		Transport:                 transport,
+		serverPublicParams:        libsignalgo.ServerPublicParams(env.ServerPublicParams),
+		trustRoot:                 trustRoot,
+		contactDiscoveryMrenclave: mrenclave,
+	}, nil
+}
@@ -17,6 +17,8 @@
 package events
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
@@ -27,17 +29,24 @@ type SignalEvent interface {
 	isSignalEvent()
 }
 
-func (*ChatEvent) isSignalEvent()   {}
-func (*Receipt) isSignalEvent()     {}
-func (*ReadSelf) isSignalEvent()    {}
-func (*Call) isSignalEvent()        {}
-func (*ContactList) isSignalEvent() {}
+func (*ChatEvent) isSignalEvent()            {}
+func (*Receipt) isSignalEvent()              {}
+func (*ReadSelf) isSignalEvent()             {}
+func (*Call) isSignalEvent()                 {}
+func (*ContactList) isSignalEvent()          {}
+func (*QueueEmpty) isSignalEvent()           {}
+func (*RateLimitChallenge) isSignalEvent()   {}
+func (*SessionReset) isSignalEvent()         {}
+func (*StickerPackOperation) isSignalEvent() {}
 
 type MessageInfo struct {
 	Sender uuid.UUID
 	ChatID string
 
 	GroupRevision uint32
+	// ServerGUID is the ID of the persistent inbox entry this event came from. If it's set,
+	// Client.MarkInboxEntryHandled must be called after the event has been handled.
+	ServerGUID string
 }
 
 type ChatEvent struct {
@@ -63,3 +72,25 @@ type Call struct {
 type ContactList struct {
 	Contacts []*types.Contact
 }
+
+// QueueEmpty is emitted when the server has sent all messages that were queued while the client was offline.
+type QueueEmpty struct{}
+
+// RateLimitChallenge is emitted when the server starts requiring a challenge to be solved before
+// sending more messages. Sending is paused until Client.SubmitRateLimitChallenge is called with the token.
+type RateLimitChallenge struct {
+	Token      string
+	Options    []string
+	RetryAfter time.Duration
+}
+
+// SessionReset is emitted when a contact resets the secure session with us, either explicitly with an
+// END_SESSION message or by starting a new session while the old one was still active.
+type SessionReset struct {
+	Info MessageInfo
+}
+
+// StickerPackOperation is emitted when the user installs or removes sticker packs on another device.
+type StickerPackOperation struct {
+	Operations []*signalpb.SyncMessage_StickerPackOperation
+}
@@ -155,7 +155,7 @@ func (cli *Client) GetAuthorizationForToday(ctx context.Context, masterKey libsi
 
 	// Receive the auth credential
 	authCredential, err := libsignalgo.ReceiveAuthCredentialWithPni(
-		prodServerPublicParams,
+		cli.Server.serverPublicParams,
 		cli.Store.ACI,
 		cli.Store.PNI,
 		redemptionTime,
@@ -173,7 +173,7 @@ func (cli *Client) GetAuthorizationForToday(ctx context.Context, masterKey libsi
 		return nil, err
 	}
 	authCredentialPresentation, err := libsignalgo.CreateAuthCredentialWithPniPresentation(
-		prodServerPublicParams,
+		cli.Server.serverPublicParams,
 		libsignalgo.GenerateRandomness(),
 		groupSecretParams,
 		*authCredential,
@@ -367,9 +367,9 @@ func (cli *Client) fetchGroupByID(ctx context.Context, gid types.GroupIdentifier
 		Username:    &groupAuth.Username,
 		Password:    &groupAuth.Password,
 		ContentType: web.ContentTypeProtobuf,
-		Host:        web.StorageHostname,
+		Host:        cli.Server.Transport.Hosts.Storage,
 	}
-	response, err := web.SendHTTPRequest(ctx, http.MethodGet, "/v1/groups", opts)
+	response, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, "/v1/groups", opts)
 	if err != nil {
 		return nil, err
 	}
@@ -404,11 +404,11 @@ func (cli *Client) fetchGroupByID(ctx context.Context, gid types.GroupIdentifier
 func (cli *Client) DownloadGroupAvatar(ctx context.Context, group *Group) ([]byte, error) {
 	username, password := cli.Store.BasicAuthCreds()
 	opts := &web.HTTPReqOpt{
-		Host:     web.CDN1Hostname,
+		Host:     cli.Server.Transport.Hosts.CDNHost(0),
 		Username: &username,
 		Password: &password,
 	}
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, group.AvatarPath, opts)
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, group.AvatarPath, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -0,0 +1,129 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// replayInbox dispatches events for all inbox entries that weren't marked as handled before the last shutdown.
+func (cli *Client) replayInbox(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("action", "replay inbox").Logger()
+	entries, err := cli.Store.InboxStore.AllInboxEntries(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get unhandled inbox entries")
+		return
+	} else if len(entries) == 0 {
+		return
+	}
+	log.Info().Int("entry_count", len(entries)).Msg("Replaying unhandled inbox entries")
+	for _, entry := range entries {
+		entryLog := log.With().
+			Str("server_guid", entry.ServerGUID).
+			Stringer("sender_uuid", entry.SenderACI).
+			Uint64("server_ts", entry.ServerTimestamp).
+			Logger()
+		var content signalpb.Content
+		err = proto.Unmarshal(entry.Content, &content)
+		if err != nil {
+			entryLog.Err(err).Msg("Failed to unmarshal inbox entry, dropping it")
+			err = cli.Store.InboxStore.DeleteInboxEntry(ctx, entry.ServerGUID)
+			if err != nil {
+				entryLog.Err(err).Msg("Failed to delete broken inbox entry")
+			}
+			continue
+		}
+		cli.handleInboxEntry(entryLog.WithContext(ctx), entry, &content)
+	}
+}
+
+// InboxEntryResult describes the outcome of handling an event from the persistent inbox.
+type InboxEntryResult int
+
+const (
+	// InboxEntryIgnored means the event was handled, but it wasn't a message that should be acknowledged
+	// with a delivery receipt (e.g. a reaction or a typing notification).
+	InboxEntryIgnored InboxEntryResult = iota
+	// InboxEntryBridged means the message was bridged and a delivery receipt should be sent to the sender.
+	InboxEntryBridged
+	// InboxEntryFailed means handling the event failed and it should be retried later.
+	InboxEntryFailed
+)
+
+// MaxInboxEntryAttempts is the number of times handling an inbox entry may fail before it's dropped.
+const MaxInboxEntryAttempts = 5
+
+// MarkInboxEntryHandled updates the entry with the given server GUID (from events.MessageInfo) in the persistent inbox.
+// Ignored and bridged entries are removed, and a delivery receipt is sent for bridged messages. Failed entries are kept,
+// so that they're replayed on the next connection, until they've failed MaxInboxEntryAttempts times.
+func (cli *Client) MarkInboxEntryHandled(ctx context.Context, serverGUID string, result InboxEntryResult) error {
+	if serverGUID == "" {
+		return nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("server_guid", serverGUID).Logger()
+	switch result {
+	case InboxEntryBridged:
+		err := cli.sendDeliveryReceiptForEntry(ctx, serverGUID)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to send delivery receipt")
+		}
+	case InboxEntryFailed:
+		attempts, err := cli.Store.InboxStore.IncrementInboxEntryAttempts(ctx, serverGUID)
+		if err != nil {
+			return fmt.Errorf("failed to count failed inbox entry attempt: %w", err)
+		} else if attempts < MaxInboxEntryAttempts {
+			log.Debug().Int("attempts", attempts).Msg("Keeping failed inbox entry to retry it later")
+			return nil
+		}
+		log.Warn().Int("attempts", attempts).Msg("Handling inbox entry failed too many times, dropping it")
+	}
+	err := cli.Store.InboxStore.DeleteInboxEntry(ctx, serverGUID)
+	if err != nil {
+		return fmt.Errorf("failed to delete inbox entry: %w", err)
+	}
+	return nil
+}
+
+func (cli *Client) sendDeliveryReceiptForEntry(ctx context.Context, serverGUID string) error {
+	entry, err := cli.Store.InboxStore.GetInboxEntry(ctx, serverGUID)
+	if err != nil {
+		return fmt.Errorf("failed to get inbox entry: %w", err)
+	} else if entry == nil || entry.SenderACI == cli.Store.ACI {
+		return nil
+	}
+	var content signalpb.Content
+	err = proto.Unmarshal(entry.Content, &content)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal inbox entry: %w", err)
+	}
+	var timestamp uint64
+	if content.DataMessage != nil {
+		timestamp = content.DataMessage.GetTimestamp()
+	} else if content.EditMessage != nil {
+		timestamp = content.EditMessage.GetDataMessage().GetTimestamp()
+	}
+	if timestamp == 0 {
+		return nil
+	}
+	return cli.sendDeliveryReceipts(ctx, []uint64{timestamp}, entry.SenderACI)
+}
@@ -0,0 +1,174 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+const (
+	// DefaultSignedPreKeyRotationInterval is how often the signed prekey and the last resort kyber prekey
+	// are replaced if Client.SignedPreKeyRotationInterval isn't set.
+	DefaultSignedPreKeyRotationInterval = 2 * 24 * time.Hour
+	// DefaultReplacedPreKeyGracePeriod is how long replaced prekeys are kept around for messages that were
+	// encrypted before the replacement if Client.ReplacedPreKeyGracePeriod isn't set.
+	DefaultReplacedPreKeyGracePeriod = 30 * 24 * time.Hour
+)
+
+func (cli *Client) signedPreKeyRotationInterval() time.Duration {
+	if cli.SignedPreKeyRotationInterval > 0 {
+		return cli.SignedPreKeyRotationInterval
+	}
+	return DefaultSignedPreKeyRotationInterval
+}
+
+func (cli *Client) replacedPreKeyGracePeriod() time.Duration {
+	if cli.ReplacedPreKeyGracePeriod > 0 {
+		return cli.ReplacedPreKeyGracePeriod
+	}
+	return DefaultReplacedPreKeyGracePeriod
+}
+
+func (cli *Client) trackPreKeyCounts(uuidKind types.UUIDKind, preKeyCount, kyberPreKeyCount int) {
+	if cli.TrackPreKeyCounts != nil {
+		cli.TrackPreKeyCounts(cli.Store.ACI, uuidKind, preKeyCount, kyberPreKeyCount)
+	}
+}
+
+type timestampedKey interface {
+	GetTimestamp() (time.Time, error)
+}
+
+func keyExpired(key timestampedKey, interval time.Duration) bool {
+	ts, err := key.GetTimestamp()
+	return err != nil || time.Since(ts) > interval
+}
+
+// RotateSignedPreKeysIfNeeded replaces the signed prekey and the last resort kyber prekey of the given identity
+// if they're older than the rotation interval. The old keys are kept until the grace period has passed,
+// so that messages encrypted with them can still be decrypted.
+func (cli *Client) RotateSignedPreKeysIfNeeded(ctx context.Context, uuidKind types.UUIDKind) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "rotate signed prekeys").
+		Str("uuid_kind", string(uuidKind)).
+		Logger()
+	interval := cli.signedPreKeyRotationInterval()
+	currentSignedPreKey, err := cli.Store.PreKeyStoreExtras.CurrentSignedPreKey(ctx, uuidKind)
+	if err != nil {
+		return fmt.Errorf("failed to get current signed prekey: %w", err)
+	}
+	currentLastResortKey, err := cli.Store.PreKeyStoreExtras.CurrentLastResortKyberPreKey(ctx, uuidKind)
+	if err != nil {
+		return fmt.Errorf("failed to get current last resort kyber prekey: %w", err)
+	}
+	rotateSigned := currentSignedPreKey == nil || keyExpired(currentSignedPreKey, interval)
+	rotateLastResort := currentLastResortKey == nil || keyExpired(currentLastResortKey, interval)
+	if !rotateSigned && !rotateLastResort {
+		log.Debug().Msg("Signed prekeys don't need to be rotated yet")
+		return nil
+	}
+
+	identityKeyPair := cli.identityKeyPair(uuidKind)
+	var newKeys GeneratedPreKeys
+	if rotateSigned {
+		nextID, err := cli.Store.PreKeyStoreExtras.GetSignedNextPreKeyID(ctx, uuidKind)
+		if err != nil {
+			return fmt.Errorf("failed to get next signed prekey ID: %w", err)
+		}
+		newKeys.SignedPreKey = GenerateSignedPreKey(uint32(nextID), uuidKind, identityKeyPair)
+		err = cli.Store.PreKeyStoreExtras.SaveSignedPreKey(ctx, uuidKind, newKeys.SignedPreKey, true)
+		if err != nil {
+			return fmt.Errorf("failed to save new signed prekey: %w", err)
+		}
+	}
+	if rotateLastResort {
+		nextID, err := cli.Store.PreKeyStoreExtras.GetNextKyberPreKeyID(ctx, uuidKind)
+		if err != nil {
+			cli.deleteUnusedRotatedKeys(ctx, uuidKind, &newKeys)
+			return fmt.Errorf("failed to get next kyber prekey ID: %w", err)
+		}
+		newKeys.LastResortKyberPreKey = GenerateKyberPreKeys(nextID, 1, uuidKind, identityKeyPair)[0]
+		err = cli.Store.PreKeyStoreExtras.SaveKyberPreKey(ctx, uuidKind, newKeys.LastResortKyberPreKey, true)
+		if err != nil {
+			cli.deleteUnusedRotatedKeys(ctx, uuidKind, &newKeys)
+			return fmt.Errorf("failed to save new last resort kyber prekey: %w", err)
+		}
+	}
+
+	log.Info().
+		Bool("signed_prekey", rotateSigned).
+		Bool("last_resort_kyber_prekey", rotateLastResort).
+		Msg("Uploading rotated signed prekeys")
+	err = cli.registerPreKeysForIdentity(ctx, uuidKind, &newKeys)
+	if err != nil {
+		cli.deleteUnusedRotatedKeys(ctx, uuidKind, &newKeys)
+		return fmt.Errorf("failed to upload rotated signed prekeys: %w", err)
+	}
+
+	now := time.Now()
+	if newKeys.SignedPreKey != nil {
+		newID, _ := newKeys.SignedPreKey.GetID()
+		err = cli.Store.PreKeyStoreExtras.MarkSignedPreKeysReplaced(ctx, uuidKind, newID, now)
+		if err != nil {
+			log.Err(err).Msg("Failed to mark old signed prekeys as replaced")
+		}
+	}
+	if newKeys.LastResortKyberPreKey != nil {
+		newID, _ := newKeys.LastResortKyberPreKey.GetID()
+		err = cli.Store.PreKeyStoreExtras.MarkLastResortKyberPreKeysReplaced(ctx, uuidKind, newID, now)
+		if err != nil {
+			log.Err(err).Msg("Failed to mark old last resort kyber prekeys as replaced")
+		}
+	}
+	return nil
+}
+
+// deleteUnusedRotatedKeys deletes newly generated keys that never made it to the server.
+func (cli *Client) deleteUnusedRotatedKeys(ctx context.Context, uuidKind types.UUIDKind, keys *GeneratedPreKeys) {
+	log := zerolog.Ctx(ctx)
+	if keys.SignedPreKey != nil {
+		id, _ := keys.SignedPreKey.GetID()
+		err := cli.Store.PreKeyStoreExtras.DeleteSignedPreKey(ctx, uuidKind, int(id))
+		if err != nil {
+			log.Err(err).Uint("key_id", id).Msg("Failed to delete unused signed prekey")
+		}
+	}
+	if keys.LastResortKyberPreKey != nil {
+		id, _ := keys.LastResortKyberPreKey.GetID()
+		err := cli.Store.PreKeyStoreExtras.DeleteKyberPreKey(ctx, uuidKind, int(id))
+		if err != nil {
+			log.Err(err).Uint("key_id", id).Msg("Failed to delete unused last resort kyber prekey")
+		}
+	}
+}
+
+// PruneReplacedPreKeys deletes prekeys of all identities that were replaced longer ago than the grace period.
+func (cli *Client) PruneReplacedPreKeys(ctx context.Context) error {
+	deleted, err := cli.Store.PreKeyStoreExtras.DeleteReplacedPreKeys(ctx, time.Now().Add(-cli.replacedPreKeyGracePeriod()))
+	if err != nil {
+		return fmt.Errorf("failed to delete replaced prekeys: %w", err)
+	} else if deleted > 0 {
+		zerolog.Ctx(ctx).Debug().Int64("deleted_count", deleted).Msg("Deleted replaced prekeys")
+	}
+	return nil
+}
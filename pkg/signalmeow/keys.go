@@ -40,6 +40,10 @@ type GeneratedPreKeys struct {
 	PreKeys      []*libsignalgo.PreKeyRecord
 	KyberPreKeys []*libsignalgo.KyberPreKeyRecord
 	IdentityKey  []uint8
+
+	// SignedPreKey and LastResortKyberPreKey replace the current ones on the server if set
+	SignedPreKey          *libsignalgo.SignedPreKeyRecord
+	LastResortKyberPreKey *libsignalgo.KyberPreKeyRecord
 }
 
 func (cli *Client) GenerateAndRegisterPreKeys(ctx context.Context, uuidKind types.UUIDKind) error {
@@ -61,14 +65,29 @@ func (cli *Client) GenerateAndRegisterPreKeys(ctx context.Context, uuidKind type
 	return err
 }
 
-func (cli *Client) RegisterAllPreKeys(ctx context.Context, uuidKind types.UUIDKind) error {
-	var identityKeyPair *libsignalgo.IdentityKeyPair
+func (cli *Client) identityKeyPair(uuidKind types.UUIDKind) *libsignalgo.IdentityKeyPair {
 	if uuidKind == types.UUIDKindPNI {
-		identityKeyPair = cli.Store.PNIIdentityKeyPair
-	} else {
-		identityKeyPair = cli.Store.ACIIdentityKeyPair
+		return cli.Store.PNIIdentityKeyPair
 	}
+	return cli.Store.ACIIdentityKeyPair
+}
 
+// registerPreKeysForIdentity uploads the given keys for the given identity of this device.
+func (cli *Client) registerPreKeysForIdentity(ctx context.Context, uuidKind types.UUIDKind, generatedPreKeys *GeneratedPreKeys) error {
+	identityKey, err := cli.identityKeyPair(uuidKind).GetPublicKey().Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize identity key: %w", err)
+	}
+	generatedPreKeys.IdentityKey = identityKey
+	preKeyUsername := cli.Store.Number
+	if cli.Store.ACI != uuid.Nil {
+		preKeyUsername = cli.Store.ACI.String()
+	}
+	preKeyUsername = fmt.Sprintf("%s.%d", preKeyUsername, cli.Store.DeviceID)
+	return cli.RegisterPreKeys(ctx, generatedPreKeys, uuidKind, preKeyUsername, cli.Store.Password)
+}
+
+func (cli *Client) RegisterAllPreKeys(ctx context.Context, uuidKind types.UUIDKind) error {
 	// Get all prekeys and kyber prekeys from the database
 	preKeys, err := cli.Store.PreKeyStoreExtras.AllPreKeys(ctx, uuidKind)
 	if err != nil {
@@ -84,24 +103,13 @@ func (cli *Client) RegisterAllPreKeys(ctx context.Context, uuidKind types.UUIDKi
 		return fmt.Errorf("no prekeys to upload")
 	}
 
-	identityKey, err := identityKeyPair.GetPublicKey().Serialize()
-	if err != nil {
-		return fmt.Errorf("failed to serialize identity key: %w", err)
-	}
-
 	generatedPreKeys := GeneratedPreKeys{
 		PreKeys:      preKeys,
 		KyberPreKeys: kyberPreKeys,
-		IdentityKey:  identityKey,
 	}
-	preKeyUsername := cli.Store.Number
-	if cli.Store.ACI != uuid.Nil {
-		preKeyUsername = cli.Store.ACI.String()
-	}
-	preKeyUsername = fmt.Sprintf("%s.%d", preKeyUsername, cli.Store.DeviceID)
 	log := zerolog.Ctx(ctx).With().Str("action", "register prekeys").Logger()
 	log.Debug().Int("num_prekeys", len(preKeys)).Int("num_kyber_prekeys", len(kyberPreKeys)).Msg("Registering prekeys")
-	err = RegisterPreKeys(ctx, &generatedPreKeys, uuidKind, preKeyUsername, cli.Store.Password)
+	err = cli.registerPreKeysForIdentity(ctx, uuidKind, &generatedPreKeys)
 	if err != nil {
 		return fmt.Errorf("failed to register prekeys: %w", err)
 	}
@@ -138,17 +146,11 @@ func (cli *Client) GenerateAndSaveNextPreKeyBatch(ctx context.Context, uuidKind
 }
 
 func (cli *Client) GenerateAndSaveNextKyberPreKeyBatch(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.KyberPreKeyRecord, error) {
-	var identityKeyPair *libsignalgo.IdentityKeyPair
-	if uuidKind == types.UUIDKindPNI {
-		identityKeyPair = cli.Store.PNIIdentityKeyPair
-	} else {
-		identityKeyPair = cli.Store.ACIIdentityKeyPair
-	}
 	nextKyberPreKeyID, err := cli.Store.PreKeyStoreExtras.GetNextKyberPreKeyID(ctx, uuidKind)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get next kyber prekey ID: %w", err)
 	}
-	kyberPreKeys := GenerateKyberPreKeys(nextKyberPreKeyID, PREKEY_BATCH_SIZE, uuidKind, identityKeyPair)
+	kyberPreKeys := GenerateKyberPreKeys(nextKyberPreKeyID, PREKEY_BATCH_SIZE, uuidKind, cli.identityKeyPair(uuidKind))
 	for _, kyberPreKey := range kyberPreKeys {
 		err = cli.Store.PreKeyStoreExtras.SaveKyberPreKey(ctx, uuidKind, kyberPreKey, false)
 		if err != nil {
@@ -267,7 +269,7 @@ func KyberPreKeyToJSON(kyberPreKey *libsignalgo.KyberPreKeyRecord) map[string]in
 	return kyberPreKeyJson
 }
 
-func RegisterPreKeys(ctx context.Context, generatedPreKeys *GeneratedPreKeys, uuidKind types.UUIDKind, username string, password string) error {
+func (cli *Client) RegisterPreKeys(ctx context.Context, generatedPreKeys *GeneratedPreKeys, uuidKind types.UUIDKind, username string, password string) error {
 	log := zerolog.Ctx(ctx).With().Str("action", "register prekeys").Logger()
 	// Convert generated prekeys to JSON
 	preKeysJson := []map[string]interface{}{}
@@ -287,6 +289,12 @@ func RegisterPreKeys(ctx context.Context, generatedPreKeys *GeneratedPreKeys, uu
 		"pqPreKeys":   kyberPreKeysJson,
 		"identityKey": base64.StdEncoding.EncodeToString(identityKey),
 	}
+	if generatedPreKeys.SignedPreKey != nil {
+		register_json["signedPreKey"] = SignedPreKeyToJSON(generatedPreKeys.SignedPreKey)
+	}
+	if generatedPreKeys.LastResortKyberPreKey != nil {
+		register_json["pqLastResortPreKey"] = KyberPreKeyToJSON(generatedPreKeys.LastResortKyberPreKey)
+	}
 
 	// Send request
 	keysPath := "/v2/keys?identity=" + string(uuidKind)
@@ -296,7 +304,7 @@ func RegisterPreKeys(ctx context.Context, generatedPreKeys *GeneratedPreKeys, uu
 		return err
 	}
 	opts := &web.HTTPReqOpt{Body: jsonBytes, Username: &username, Password: &password}
-	resp, err := web.SendHTTPRequest(ctx, http.MethodPut, keysPath, opts)
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodPut, keysPath, opts)
 	if err != nil {
 		log.Err(err).Msg("Error sending request")
 		return err
@@ -349,7 +357,7 @@ func (cli *Client) FetchAndProcessPreKey(ctx context.Context, theirUUID uuid.UUI
 	}
 	path := "/v2/keys/" + theirUUID.String() + deviceIDPath + "?pq=true"
 	username, password := cli.Store.BasicAuthCreds()
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, path, &web.HTTPReqOpt{Username: &username, Password: &password})
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, path, &web.HTTPReqOpt{Username: &username, Password: &password})
 	if err != nil {
 		return fmt.Errorf("error sending request: %w", err)
 	}
@@ -459,7 +467,7 @@ func (cli *Client) GetMyKeyCounts(ctx context.Context, uuidKind types.UUIDKind)
 	log := zerolog.Ctx(ctx).With().Str("action", "get my key counts").Logger()
 	username, password := cli.Store.BasicAuthCreds()
 	path := "/v2/keys?identity=" + string(uuidKind)
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, path, &web.HTTPReqOpt{Username: &username, Password: &password})
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, path, &web.HTTPReqOpt{Username: &username, Password: &password})
 	if err != nil {
 		log.Err(err).Msg("Error sending request")
 		return 0, 0, err
@@ -482,6 +490,7 @@ func (cli *Client) CheckAndUploadNewPreKeys(ctx context.Context, uuidKind types.
 		return err
 	}
 	log.Debug().Int("preKeyCount", preKeyCount).Int("kyberPreKeyCount", kyberPreKeyCount).Msg("Checking prekey counts")
+	cli.trackPreKeyCounts(uuidKind, preKeyCount, kyberPreKeyCount)
 
 	var preKeys []*libsignalgo.PreKeyRecord
 	var kyberPreKeys []*libsignalgo.KyberPreKeyRecord
@@ -505,16 +514,47 @@ func (cli *Client) CheckAndUploadNewPreKeys(ctx context.Context, uuidKind types.
 		log.Debug().Msg("No new prekeys to upload")
 		return nil
 	}
-	err = cli.RegisterAllPreKeys(ctx, uuidKind)
+	// The server replaces the whole list of one-time keys when new ones are uploaded,
+	// so only the new batch is uploaded and the older keys are marked as replaced.
+	err = cli.registerPreKeysForIdentity(ctx, uuidKind, &GeneratedPreKeys{
+		PreKeys:      preKeys,
+		KyberPreKeys: kyberPreKeys,
+	})
 	if err != nil {
 		log.Err(err).Msg("Error registering prekey batches")
 		return err
 	}
+	now := time.Now()
+	if len(preKeys) > 0 {
+		firstID, _ := preKeys[0].GetID()
+		lastID, _ := preKeys[len(preKeys)-1].GetID()
+		err = cli.Store.PreKeyStoreExtras.MarkPreKeysAsUploaded(ctx, uuidKind, lastID)
+		if err != nil {
+			log.Err(err).Msg("Failed to mark prekeys as uploaded")
+		}
+		err = cli.Store.PreKeyStoreExtras.MarkPreKeysReplaced(ctx, uuidKind, firstID, now)
+		if err != nil {
+			log.Err(err).Msg("Failed to mark old prekeys as replaced")
+		}
+		preKeyCount = len(preKeys)
+	}
+	if len(kyberPreKeys) > 0 {
+		firstID, _ := kyberPreKeys[0].GetID()
+		err = cli.Store.PreKeyStoreExtras.MarkKyberPreKeysReplaced(ctx, uuidKind, firstID, now)
+		if err != nil {
+			log.Err(err).Msg("Failed to mark old kyber prekeys as replaced")
+		}
+		kyberPreKeyCount = len(kyberPreKeys)
+	}
+	cli.trackPreKeyCounts(uuidKind, preKeyCount, kyberPreKeyCount)
 	return nil
 }
 
 func (cli *Client) StartKeyCheckLoop(ctx context.Context, uuidKind types.UUIDKind) {
-	log := zerolog.Ctx(ctx).With().Str("action", "start key check loop").Logger()
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "start key check loop").
+		Str("uuid_kind", string(uuidKind)).
+		Logger()
 	go func() {
 		// Do the initial check within an hour of starting the loop
 		window_start := 0
@@ -529,6 +569,9 @@ func (cli *Client) StartKeyCheckLoop(ctx context.Context, uuidKind types.UUIDKin
 				return
 			case <-time.After(check_time):
 				err := cli.CheckAndUploadNewPreKeys(ctx, uuidKind)
+				if err == nil {
+					err = cli.RotateSignedPreKeysIfNeeded(ctx, uuidKind)
+				}
 				if err != nil {
 					log.Err(err).Msg("Error checking and uploading new prekeys")
 					// Retry within half an hour
@@ -536,6 +579,10 @@ func (cli *Client) StartKeyCheckLoop(ctx context.Context, uuidKind types.UUIDKin
 					window_size = 25
 					continue
 				}
+				err = cli.PruneReplacedPreKeys(ctx)
+				if err != nil {
+					log.Err(err).Msg("Error pruning replaced prekeys")
+				}
 				// After a successful check, check again in 36 to 60 hours
 				window_start = 36 * 60
 				window_size = 24 * 60
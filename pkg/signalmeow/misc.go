@@ -17,8 +17,6 @@
 package signalmeow
 
 import (
-	_ "embed"
-
 	"github.com/rs/zerolog"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
@@ -70,11 +68,3 @@ func (FFILogger) Flush() {}
 
 // Ensure FFILogger implements the Logger interface
 var _ libsignalgo.Logger = FFILogger{}
-
-//go:embed prod-server-public-params.dat
-var prodServerPublicParamsSlice []byte
-var prodServerPublicParams libsignalgo.ServerPublicParams
-
-func init() {
-	prodServerPublicParams = libsignalgo.ServerPublicParams(prodServerPublicParamsSlice)
-}
@@ -90,7 +90,7 @@ func (cli *Client) ProfileKeyCredentialRequest(ctx context.Context, signalACI uu
 		return nil, fmt.Errorf("error getting profile key for ACI: %w", err)
 	}
 	requestContext, err := libsignalgo.CreateProfileKeyCredentialRequestContext(
-		prodServerPublicParams,
+		cli.Server.serverPublicParams,
 		signalACI,
 		*profileKey,
 	)
@@ -250,11 +250,11 @@ func (cli *Client) fetchProfileByID(ctx context.Context, signalID uuid.UUID) (*P
 func (cli *Client) DownloadUserAvatar(ctx context.Context, avatarPath string, profileKey *libsignalgo.ProfileKey) ([]byte, error) {
 	username, password := cli.Store.BasicAuthCreds()
 	opts := &web.HTTPReqOpt{
-		Host:     web.CDN1Hostname,
+		Host:     cli.Server.Transport.Hosts.CDNHost(0),
 		Username: &username,
 		Password: &password,
 	}
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, avatarPath, opts)
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, avatarPath, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
@@ -79,7 +79,7 @@ type ProvisioningResponse struct {
 	Err              error
 }
 
-func PerformProvisioning(ctx context.Context, deviceStore store.DeviceStore, deviceName string) chan ProvisioningResponse {
+func PerformProvisioning(ctx context.Context, server *Server, deviceStore store.DeviceStore, deviceName string) chan ProvisioningResponse {
 	log := zerolog.Ctx(ctx).With().Str("action", "perform provisioning").Logger()
 	c := make(chan ProvisioningResponse)
 	go func() {
@@ -87,7 +87,7 @@ func PerformProvisioning(ctx context.Context, deviceStore store.DeviceStore, dev
 
 		ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 		defer cancel()
-		ws, resp, err := web.OpenWebsocket(ctx, web.WebsocketProvisioningPath)
+		ws, resp, err := server.Transport.OpenWebsocket(ctx, web.WebsocketProvisioningPath)
 		if err != nil {
 			log.Err(err).Any("resp", resp).Msg("error opening provisioning websocket")
 			c <- ProvisioningResponse{State: StateProvisioningError, Err: err}
@@ -133,6 +133,7 @@ func PerformProvisioning(ctx context.Context, deviceStore store.DeviceStore, dev
 		pniPQLastResortPreKey := pniPQLastResortPreKeys[0]
 		deviceResponse, err := confirmDevice(
 			ctx,
+			server,
 			username,
 			password,
 			*code,
@@ -225,7 +226,7 @@ func PerformProvisioning(ctx context.Context, deviceStore store.DeviceStore, dev
 
 		// Generate, store, and register prekeys
 		// TODO hacky client construction
-		cli := &Client{Store: device}
+		cli := &Client{Store: device, Server: server}
 		err = cli.GenerateAndRegisterPreKeys(ctx, types.UUIDKindACI)
 		if err != nil {
 			c <- ProvisioningResponse{
@@ -327,6 +328,7 @@ func continueProvisioning(ctx context.Context, ws *websocket.Conn, provisioningC
 
 func confirmDevice(
 	ctx context.Context,
+	server *Server,
 	username string,
 	password string,
 	code string,
@@ -346,7 +348,7 @@ func confirmDevice(
 		return nil, fmt.Errorf("failed to encrypt device name: %w", err)
 	}
 
-	ws, resp, err := web.OpenWebsocket(ctx, web.WebsocketPath)
+	ws, resp, err := server.Transport.OpenWebsocket(ctx, web.WebsocketPath)
 	if err != nil {
 		log.Err(err).Any("resp", resp).Msg("error opening websocket")
 		return nil, err
@@ -0,0 +1,209 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// DefaultReceiveConcurrency is the default number of senders whose envelopes are decrypted in parallel.
+const DefaultReceiveConcurrency = 8
+
+// Stages of handling an incoming envelope, as passed to Client.TrackEnvelopeStage
+const (
+	// EnvelopeStageQueue is the time between receiving an envelope and starting to decrypt it.
+	EnvelopeStageQueue = "queue"
+	// EnvelopeStageDecrypt is the time spent decrypting an envelope.
+	EnvelopeStageDecrypt = "decrypt"
+	// EnvelopeStageHandle is the time spent handling the decrypted content, including emitting events.
+	EnvelopeStageHandle = "handle"
+)
+
+type queuedEnvelope struct {
+	ctx      context.Context
+	ws       *web.SignalWebsocket
+	request  *signalpb.WebSocketRequestMessage
+	envelope *signalpb.Envelope
+	// usmc is the already unwrapped sealed sender content, or nil for other envelope types
+	usmc     *libsignalgo.UnidentifiedSenderMessageContent
+	queuedAt time.Time
+	// drained is set for markers that are put at the end of lanes to find out when they've been handled
+	drained func()
+}
+
+// envelopeQueue distributes incoming envelopes into per-sender lanes. Envelopes from the same sender are
+// decrypted and handled one at a time in the order they were received, which keeps session ratchets
+// consistent and events in order, while envelopes from different senders are handled in parallel.
+type envelopeQueue struct {
+	lock  sync.Mutex
+	lanes map[string][]*queuedEnvelope
+	sem   chan struct{}
+}
+
+func (cli *Client) getEnvelopeQueue() *envelopeQueue {
+	cli.envelopeQueueOnce.Do(func() {
+		concurrency := cli.ReceiveConcurrency
+		if concurrency <= 0 {
+			concurrency = DefaultReceiveConcurrency
+		}
+		cli.envelopeQueue = &envelopeQueue{
+			lanes: make(map[string][]*queuedEnvelope),
+			sem:   make(chan struct{}, concurrency),
+		}
+	})
+	return cli.envelopeQueue
+}
+
+func (cli *Client) trackEnvelopeStage(stage string, duration time.Duration) {
+	if cli.TrackEnvelopeStage != nil {
+		cli.TrackEnvelopeStage(stage, duration)
+	}
+}
+
+func (cli *Client) trackEnvelopeQueue(delta int) {
+	if cli.TrackEnvelopeQueue != nil {
+		cli.TrackEnvelopeQueue(delta)
+	}
+}
+
+// envelopeSender finds the sender of an envelope to decide which lane it goes into. Sealed sender envelopes
+// only reveal the sender after unwrapping the outer layer, so the unwrapped content is returned to avoid
+// doing it twice. Envelopes without a known sender all go into the same lane.
+func (cli *Client) envelopeSender(ctx context.Context, envelope *signalpb.Envelope) (string, *libsignalgo.UnidentifiedSenderMessageContent, error) {
+	if envelope.GetType() != signalpb.Envelope_UNIDENTIFIED_SENDER {
+		return envelope.GetSourceServiceId(), nil, nil
+	}
+	usmc, err := libsignalgo.SealedSenderDecryptToUSMC(ctx, envelope.GetContent(), cli.Store.IdentityStore)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to unwrap sealed sender envelope: %w", err)
+	} else if usmc == nil {
+		return "", nil, fmt.Errorf("usmc is nil")
+	}
+	senderCertificate, err := usmc.GetSenderCertificate()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get sender certificate: %w", err)
+	}
+	senderUUID, err := senderCertificate.GetSenderUUID()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get sender UUID: %w", err)
+	}
+	return senderUUID.String(), usmc, nil
+}
+
+// queueEnvelope adds an envelope to the lane of its sender. The request is acknowledged
+// through the websocket it came from once the envelope has been handled, unless the
+// connection was replaced in the meantime, in which case the server will redeliver it.
+func (cli *Client) queueEnvelope(ctx context.Context, req *signalpb.WebSocketRequestMessage, envelope *signalpb.Envelope) error {
+	sender, usmc, err := cli.envelopeSender(ctx, envelope)
+	if err != nil {
+		return err
+	}
+	queue := cli.getEnvelopeQueue()
+	item := &queuedEnvelope{
+		ctx:      ctx,
+		ws:       cli.AuthedWS,
+		request:  req,
+		envelope: envelope,
+		usmc:     usmc,
+		queuedAt: time.Now(),
+	}
+	cli.trackEnvelopeQueue(1)
+	queue.lock.Lock()
+	lane, laneExists := queue.lanes[sender]
+	queue.lanes[sender] = append(lane, item)
+	queue.lock.Unlock()
+	if !laneExists {
+		go cli.runEnvelopeLane(queue, sender)
+	}
+	return nil
+}
+
+// queuedEnvelopesDrained returns a channel that is closed once all envelopes queued so far have been handled.
+// Envelopes queued after calling this aren't waited for.
+func (cli *Client) queuedEnvelopesDrained() <-chan struct{} {
+	queue := cli.getEnvelopeQueue()
+	var wg sync.WaitGroup
+	queue.lock.Lock()
+	for sender, lane := range queue.lanes {
+		// Lanes are only removed from the map once they're empty, so the marker is guaranteed to be reached
+		wg.Add(1)
+		queue.lanes[sender] = append(lane, &queuedEnvelope{drained: wg.Done})
+	}
+	queue.lock.Unlock()
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+func (cli *Client) runEnvelopeLane(queue *envelopeQueue, sender string) {
+	queue.sem <- struct{}{}
+	defer func() {
+		<-queue.sem
+	}()
+	for {
+		queue.lock.Lock()
+		lane := queue.lanes[sender]
+		if len(lane) == 0 {
+			delete(queue.lanes, sender)
+			queue.lock.Unlock()
+			return
+		}
+		item := lane[0]
+		lane[0] = nil
+		queue.lanes[sender] = lane[1:]
+		queue.lock.Unlock()
+
+		if item.drained != nil {
+			item.drained()
+			continue
+		}
+		cli.trackEnvelopeQueue(-1)
+		cli.trackEnvelopeStage(EnvelopeStageQueue, time.Since(item.queuedAt))
+		cli.handleQueuedEnvelope(item)
+	}
+}
+
+func (cli *Client) handleQueuedEnvelope(item *queuedEnvelope) {
+	log := zerolog.Ctx(item.ctx)
+	resp, err := cli.incomingEnvelopeHandler(item.ctx, item.envelope, item.usmc)
+	if err != nil {
+		// Not acknowledging the envelope makes the server redeliver it after reconnecting
+		log.Err(err).Msg("Error handling envelope")
+		return
+	} else if resp == nil {
+		return
+	}
+	err = item.ws.SendResponse(item.ctx, item.request, resp)
+	if errors.Is(err, web.ErrConnectionChanged) {
+		log.Debug().Msg("Connection changed before envelope was acknowledged, server will redeliver it")
+	} else if err != nil {
+		log.Err(err).Msg("Failed to acknowledge envelope")
+	}
+}
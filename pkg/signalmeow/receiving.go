@@ -26,13 +26,13 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
-	"go.mau.fi/util/exerrors"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
 )
@@ -46,6 +46,7 @@ const (
 	SignalConnectionEventLoggedOut
 	SignalConnectionEventError
 	SignalConnectionCleanShutdown
+	SignalConnectionEventQueueEmpty
 )
 
 // mapping from SignalConnectionEvent to its string representation
@@ -56,6 +57,7 @@ var signalConnectionEventNames = map[SignalConnectionEvent]string{
 	SignalConnectionEventLoggedOut:    "SignalConnectionEventLoggedOut",
 	SignalConnectionEventError:        "SignalConnectionEventError",
 	SignalConnectionCleanShutdown:     "SignalConnectionCleanShutdown",
+	SignalConnectionEventQueueEmpty:   "SignalConnectionEventQueueEmpty",
 }
 
 // Implement the fmt.Stringer interface
@@ -72,18 +74,29 @@ func (cli *Client) StartReceiveLoops(ctx context.Context) (chan SignalConnection
 	log := zerolog.Ctx(ctx).With().Str("action", "start receive loops").Logger()
 	ctx, cancel := context.WithCancel(log.WithContext(ctx))
 	cli.WSCancel = cancel
+	queueEmptyChan := make(chan struct{}, 1)
+	cli.queueEmptyChan = queueEmptyChan
+	// Hold the inbox lock until unfinished inbox entries have been replayed,
+	// so that new envelopes from the websocket are handled after them.
+	cli.inboxLock.Lock()
 	authChan, err := cli.ConnectAuthedWS(ctx, cli.incomingRequestHandler)
 	if err != nil {
+		cli.inboxLock.Unlock()
 		cancel()
 		return nil, err
 	}
 	log.Info().Msg("Authed websocket connecting")
 	unauthChan, err := cli.ConnectUnauthedWS(ctx)
 	if err != nil {
+		cli.inboxLock.Unlock()
 		cancel()
 		return nil, err
 	}
 	log.Info().Msg("Unauthed websocket connecting")
+	go func() {
+		defer cli.inboxLock.Unlock()
+		cli.replayInbox(ctx)
+	}()
 	statusChan := make(chan SignalConnectionStatus, 10000)
 
 	initialConnectChan := make(chan struct{})
@@ -94,11 +107,20 @@ func (cli *Client) StartReceiveLoops(ctx context.Context) (chan SignalConnection
 		defer cancel()
 		var currentStatus, lastAuthStatus, lastUnauthStatus web.SignalWebsocketConnectionStatus
 		var lastSentStatus SignalConnectionStatus
+		// queueEmpty is reset every time the authed websocket reconnects, as the server will send the queue again
+		var queueEmpty bool
 		for {
 			select {
 			case <-ctx.Done():
 				log.Info().Msg("Context done, exiting websocket status loop")
 				return
+			case <-queueEmptyChan:
+				queueEmpty = true
+				if lastSentStatus.Event == SignalConnectionEventConnected {
+					log.Info().Msg("Sending queue empty status")
+					statusChan <- SignalConnectionStatus{Event: SignalConnectionEventQueueEmpty}
+				}
+				continue
 			case status := <-authChan:
 				lastAuthStatus = status
 				currentStatus = status
@@ -108,6 +130,7 @@ func (cli *Client) StartReceiveLoops(ctx context.Context) (chan SignalConnection
 					// do nothing?
 				case web.SignalWebsocketConnectionEventConnected:
 					log.Info().Msg("Authed websocket connected")
+					queueEmpty = false
 				case web.SignalWebsocketConnectionEventDisconnected:
 					log.Err(status.Err).Msg("Authed websocket disconnected")
 				case web.SignalWebsocketConnectionEventLoggedOut:
@@ -176,6 +199,11 @@ func (cli *Client) StartReceiveLoops(ctx context.Context) (chan SignalConnection
 				log.Info().Any("status_to_send", statusToSend).Msg("Sending connection status")
 				statusChan <- statusToSend
 				lastSentStatus = statusToSend
+				// If the queue was already emptied before the unauthed websocket connected, send the status now
+				if statusToSend.Event == SignalConnectionEventConnected && queueEmpty {
+					log.Info().Msg("Sending queue empty status")
+					statusChan <- SignalConnectionStatus{Event: SignalConnectionEventQueueEmpty}
+				}
 			}
 		}
 	}()
@@ -195,8 +223,9 @@ func (cli *Client) StartReceiveLoops(ctx context.Context) (chan SignalConnection
 		}
 	}()
 
-	// Start loop to check for and upload more prekeys
+	// Start loops to check for and upload more prekeys and to rotate signed prekeys
 	cli.StartKeyCheckLoop(ctx, types.UUIDKindACI)
+	cli.StartKeyCheckLoop(ctx, types.UUIDKindPNI)
 
 	return statusChan, nil
 }
@@ -261,11 +290,26 @@ func (cli *Client) incomingRequestHandler(ctx context.Context, req *signalpb.Web
 		Str("path", *req.Path).
 		Logger()
 	ctx = log.WithContext(ctx)
-	if *req.Verb == http.MethodPut && *req.Path == "/api/v1/message" {
+	// Both requests below must wait for the inbox to be replayed after connecting
+	switch {
+	case *req.Verb == http.MethodPut && *req.Path == "/api/v1/message":
+		cli.inboxLock.Lock()
+		defer cli.inboxLock.Unlock()
 		return cli.incomingAPIMessageHandler(ctx, req)
-	} else if *req.Verb == http.MethodPut && *req.Path == "/api/v1/queue/empty" {
-		log.Trace().Msg("Received queue empty")
-	} else {
+	case *req.Verb == http.MethodPut && *req.Path == "/api/v1/queue/empty":
+		cli.inboxLock.Lock()
+		drained := cli.queuedEnvelopesDrained()
+		cli.inboxLock.Unlock()
+		// The queue is only empty once all envelopes before this request have been handled,
+		// but waiting for that mustn't block the request loop.
+		go func() {
+			select {
+			case <-drained:
+				cli.handleQueueEmpty(ctx)
+			case <-ctx.Done():
+			}
+		}()
+	default:
 		log.Warn().Any("req", req).Msg("Unknown websocket request message")
 	}
 	return &web.SimpleResponse{
@@ -273,32 +317,111 @@ func (cli *Client) incomingRequestHandler(ctx context.Context, req *signalpb.Web
 	}, nil
 }
 
-// TODO: we should split this up into multiple functions
+func (cli *Client) handleQueueEmpty(ctx context.Context) {
+	zerolog.Ctx(ctx).Debug().Msg("Received queue empty")
+	cli.handleEvent(&events.QueueEmpty{})
+	select {
+	case cli.queueEmptyChan <- struct{}{}:
+	default:
+		// The status loop hasn't handled the previous queue empty yet
+	}
+}
+
+// MaxProcessedEnvelopes is the number of processed envelope IDs to remember for deduplication.
+const MaxProcessedEnvelopes = 10000
+
+// pruneProcessedEnvelopesInterval is the number of envelopes between pruning the processed envelope table.
+const pruneProcessedEnvelopesInterval = 1000
+
 func (cli *Client) incomingAPIMessageHandler(ctx context.Context, req *signalpb.WebSocketRequestMessage) (*web.SimpleResponse, error) {
 	log := zerolog.Ctx(ctx).With().Str("handler_type", "incoming API message handler").Logger()
-	responseCode := 200
 	envelope := &signalpb.Envelope{}
 	err := proto.Unmarshal(req.Body, envelope)
 	if err != nil {
 		log.Err(err).Msg("Unmarshal error")
 		return nil, err
 	}
+	log = log.With().
+		Str("server_guid", envelope.GetServerGuid()).
+		Uint64("server_ts", envelope.GetServerTimestamp()).
+		Logger()
+	ctx = log.WithContext(ctx)
+	// The envelope is handled in the background and acknowledged after it's done
+	err = cli.queueEnvelope(ctx, req, envelope)
+	if err != nil {
+		log.Err(err).Msg("Failed to queue envelope")
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (cli *Client) incomingEnvelopeHandler(ctx context.Context, envelope *signalpb.Envelope, usmc *libsignalgo.UnidentifiedSenderMessageContent) (*web.SimpleResponse, error) {
+	log := zerolog.Ctx(ctx)
+	serverGUID := envelope.GetServerGuid()
+	// The server may redeliver envelopes after reconnecting, which must be dropped before trying to decrypt them.
+	// This works for sealed sender envelopes too, as the GUID is assigned by the server.
+	// The check is done here rather than when queueing, as an earlier copy may still be in the same sender's lane.
+	if serverGUID != "" {
+		processed, err := cli.Store.EnvelopeStore.IsEnvelopeProcessed(ctx, serverGUID)
+		if err != nil {
+			log.Err(err).Msg("Failed to check if envelope was already processed")
+			return nil, err
+		} else if processed {
+			log.Debug().Stringer("envelope_type", envelope.GetType()).Msg("Dropping duplicate envelope")
+			if cli.TrackDuplicateEnvelope != nil {
+				cli.TrackDuplicateEnvelope(envelope.GetType())
+			}
+			return &web.SimpleResponse{
+				Status: 200,
+			}, nil
+		}
+	}
+	resp, err := cli.handleEnvelope(ctx, envelope, usmc)
+	if err == nil && resp != nil && resp.Status == 200 && serverGUID != "" {
+		cli.markEnvelopeProcessed(ctx, serverGUID, envelope.GetServerTimestamp())
+	}
+	return resp, err
+}
+
+func (cli *Client) markEnvelopeProcessed(ctx context.Context, serverGUID string, serverTimestamp uint64) {
+	log := zerolog.Ctx(ctx)
+	err := cli.Store.EnvelopeStore.PutProcessedEnvelope(ctx, serverGUID, serverTimestamp)
+	if err != nil {
+		log.Err(err).Msg("Failed to mark envelope as processed")
+		return
+	}
+	if cli.envelopesSincePrune.Add(1)%pruneProcessedEnvelopesInterval == 0 {
+		err = cli.Store.EnvelopeStore.PruneProcessedEnvelopes(ctx, MaxProcessedEnvelopes)
+		if err != nil {
+			log.Err(err).Msg("Failed to prune processed envelopes")
+		}
+	}
+}
+
+// TODO: we should split this up into multiple functions
+func (cli *Client) handleEnvelope(ctx context.Context, envelope *signalpb.Envelope, usmc *libsignalgo.UnidentifiedSenderMessageContent) (*web.SimpleResponse, error) {
+	log := zerolog.Ctx(ctx).With().Logger()
+	responseCode := 200
 	var result *DecryptionResult
+	decryptStart := time.Now()
 
 	switch *envelope.Type {
 	case signalpb.Envelope_UNIDENTIFIED_SENDER:
 		log.Trace().Msg("Received envelope type UNIDENTIFIED_SENDER")
-		usmc, err := libsignalgo.SealedSenderDecryptToUSMC(
-			ctx,
-			envelope.GetContent(),
-			cli.Store.IdentityStore,
-		)
-		if err != nil || usmc == nil {
-			if err == nil {
-				err = fmt.Errorf("usmc is nil")
+		if usmc == nil {
+			var err error
+			usmc, err = libsignalgo.SealedSenderDecryptToUSMC(
+				ctx,
+				envelope.GetContent(),
+				cli.Store.IdentityStore,
+			)
+			if err != nil || usmc == nil {
+				if err == nil {
+					err = fmt.Errorf("usmc is nil")
+				}
+				log.Err(err).Msg("SealedSenderDecryptToUSMC error")
+				return nil, err
 			}
-			log.Err(err).Msg("SealedSenderDecryptToUSMC error")
-			return nil, err
 		}
 
 		messageType, err := usmc.GetMessageType()
@@ -547,8 +670,14 @@ func (cli *Client) incomingAPIMessageHandler(ctx context.Context, req *signalpb.
 		responseCode = 400
 	}
 
+	cli.trackEnvelopeStage(EnvelopeStageDecrypt, time.Since(decryptStart))
+
 	// Handle content that is now decrypted
 	if result != nil && result.Content != nil {
+		handleStart := time.Now()
+		defer func() {
+			cli.trackEnvelopeStage(EnvelopeStageHandle, time.Since(handleStart))
+		}()
 		content := result.Content
 		log.Trace().Any("raw_data", content).Msg("Raw event data")
 
@@ -587,128 +716,168 @@ func (cli *Client) incomingAPIMessageHandler(ctx context.Context, req *signalpb.
 			log.Err(err).Msg("Name error")
 			return nil, err
 		}
+		// Our own END_SESSION messages come back as sync messages, which must not archive our own sessions
+		if theirUUID != cli.Store.ACI && content.GetDataMessage() != nil && isEndSession(content.GetDataMessage()) {
+			cli.handleEndSession(ctx, theirUUID)
+		}
+		entry := &store.InboxEntry{
+			ServerGUID:      envelope.GetServerGuid(),
+			SenderACI:       theirUUID,
+			SenderDeviceID:  int(deviceId),
+			ServerTimestamp: envelope.GetServerTimestamp(),
+			SealedSender:    result.SealedSender,
+		}
+		if entry.ServerGUID == "" {
+			entry.ServerGUID = uuid.NewString()
+		}
+		entry.Content, err = proto.Marshal(content)
+		if err != nil {
+			log.Err(err).Msg("Failed to marshal decrypted content")
+			return nil, err
+		}
+		// The envelope must be stored before it's acknowledged, as it can't be decrypted again after that
+		err = cli.Store.InboxStore.PutInboxEntry(ctx, entry)
+		if err != nil {
+			log.Err(err).Msg("Failed to store decrypted envelope in inbox")
+			return nil, err
+		}
+		cli.handleInboxEntry(ctx, entry, content)
+	}
+	return &web.SimpleResponse{
+		Status: responseCode,
+	}, nil
+}
 
-		// TODO: handle more sync messages
-		if content.SyncMessage != nil {
-			syncSent := content.SyncMessage.GetSent()
-			if syncSent.GetMessage() != nil || syncSent.GetEditMessage() != nil {
-				destination := syncSent.DestinationServiceId
-				var destinationUUID uuid.UUID
-				if destination != nil {
-					destinationUUID, err = uuid.Parse(*destination)
-					if err != nil {
-						log.Err(err).Msg("Sync message destination parse error")
-						return nil, err
-					}
-				}
-				if destination == nil && syncSent.GetMessage().GetGroupV2() == nil && syncSent.GetEditMessage().GetDataMessage().GetGroupV2() == nil {
-					log.Warn().Msg("sync message sent destination is nil")
-				} else if content.SyncMessage.Sent.Message != nil {
-					// TODO handle expiration start ts, and maybe the sync message ts?
-					cli.incomingDataMessage(ctx, content.SyncMessage.Sent.Message, cli.Store.ACI, destinationUUID)
-				} else if content.SyncMessage.Sent.EditMessage != nil {
-					cli.incomingEditMessage(ctx, content.SyncMessage.Sent.EditMessage, cli.Store.ACI, destinationUUID)
+// handleInboxEntry dispatches events for decrypted content. Entries that don't produce any events that need to be
+// bridged are removed from the inbox immediately, others are removed when the event handler calls
+// MarkInboxEntryHandled.
+func (cli *Client) handleInboxEntry(ctx context.Context, entry *store.InboxEntry, content *signalpb.Content) {
+	log := zerolog.Ctx(ctx)
+	theirUUID := entry.SenderACI
+	var err error
+	var pendingBridge bool
+	defer func() {
+		if !pendingBridge {
+			err := cli.Store.InboxStore.DeleteInboxEntry(ctx, entry.ServerGUID)
+			if err != nil {
+				log.Err(err).Msg("Failed to delete handled inbox entry")
+			}
+		}
+	}()
+
+	// TODO: handle more sync messages
+	if content.SyncMessage != nil {
+		syncSent := content.SyncMessage.GetSent()
+		if syncSent.GetMessage() != nil || syncSent.GetEditMessage() != nil {
+			destination := syncSent.DestinationServiceId
+			var destinationUUID uuid.UUID
+			if destination != nil {
+				destinationUUID, err = uuid.Parse(*destination)
+				if err != nil {
+					log.Err(err).Msg("Sync message destination parse error")
+					return
 				}
 			}
-			if content.SyncMessage.Contacts != nil {
-				log.Debug().Msg("Recieved sync message contacts")
-				blob := content.SyncMessage.Contacts.Blob
-				if blob != nil {
-					contactsBytes, err := DownloadAttachment(ctx, blob)
-					if err != nil {
-						log.Err(err).Msg("Contacts Sync DownloadAttachment error")
+			if destination == nil && syncSent.GetMessage().GetGroupV2() == nil && syncSent.GetEditMessage().GetDataMessage().GetGroupV2() == nil {
+				log.Warn().Msg("sync message sent destination is nil")
+			} else if content.SyncMessage.Sent.Message != nil {
+				// TODO handle expiration start ts, and maybe the sync message ts?
+				pendingBridge = cli.incomingDataMessage(ctx, content.SyncMessage.Sent.Message, cli.Store.ACI, destinationUUID, entry.ServerGUID)
+			} else if content.SyncMessage.Sent.EditMessage != nil {
+				pendingBridge = cli.incomingEditMessage(ctx, content.SyncMessage.Sent.EditMessage, cli.Store.ACI, destinationUUID, entry.ServerGUID)
+			}
+		}
+		if content.SyncMessage.Contacts != nil {
+			log.Debug().Msg("Recieved sync message contacts")
+			blob := content.SyncMessage.Contacts.Blob
+			if blob != nil {
+				contactsBytes, err := cli.DownloadAttachment(ctx, blob)
+				if err != nil {
+					log.Err(err).Msg("Contacts Sync DownloadAttachment error")
+				}
+				// unmarshall contacts
+				contacts, avatars, err := unmarshalContactDetailsMessages(contactsBytes)
+				if err != nil {
+					log.Err(err).Msg("Contacts Sync unmarshalContactDetailsMessages error")
+				}
+				log.Debug().Int("contact_count", len(contacts)).Msg("Contacts Sync received contacts")
+				convertedContacts := make([]*types.Contact, 0, len(contacts))
+				for i, signalContact := range contacts {
+					if signalContact.Aci == nil || *signalContact.Aci == "" {
+						log.Info().
+							Any("contact", signalContact).
+							Msg("Signal Contact UUID is nil, skipping")
+						continue
 					}
-					// unmarshall contacts
-					contacts, avatars, err := unmarshalContactDetailsMessages(contactsBytes)
+					contact, err := cli.StoreContactDetailsAsContact(ctx, signalContact, &avatars[i])
 					if err != nil {
-						log.Err(err).Msg("Contacts Sync unmarshalContactDetailsMessages error")
-					}
-					log.Debug().Int("contact_count", len(contacts)).Msg("Contacts Sync received contacts")
-					convertedContacts := make([]*types.Contact, 0, len(contacts))
-					for i, signalContact := range contacts {
-						if signalContact.Aci == nil || *signalContact.Aci == "" {
-							log.Info().
-								Any("contact", signalContact).
-								Msg("Signal Contact UUID is nil, skipping")
-							continue
-						}
-						contact, err := cli.StoreContactDetailsAsContact(ctx, signalContact, &avatars[i])
-						if err != nil {
-							log.Err(err).Msg("StoreContactDetailsAsContact error")
-							continue
-						}
-						convertedContacts = append(convertedContacts, contact)
+						log.Err(err).Msg("StoreContactDetailsAsContact error")
+						continue
 					}
-					cli.handleEvent(&events.ContactList{
-						Contacts: convertedContacts,
-					})
+					convertedContacts = append(convertedContacts, contact)
 				}
-			}
-			if content.SyncMessage.Read != nil {
-				cli.handleEvent(&events.ReadSelf{
-					Messages: content.SyncMessage.GetRead(),
+				cli.handleEvent(&events.ContactList{
+					Contacts: convertedContacts,
 				})
 			}
-
 		}
-
-		var sendDeliveryReceipt bool
-		if content.DataMessage != nil {
-			sendDeliveryReceipt = cli.incomingDataMessage(ctx, content.DataMessage, theirUUID, theirUUID)
-		} else if content.EditMessage != nil {
-			sendDeliveryReceipt = cli.incomingEditMessage(ctx, content.EditMessage, theirUUID, theirUUID)
-		}
-		if sendDeliveryReceipt {
-			// TODO send delivery receipts after actually bridging instead of here
-			err = cli.sendDeliveryReceipts(ctx, []uint64{content.DataMessage.GetTimestamp()}, theirUUID)
-			if err != nil {
-				log.Err(err).Msg("sendDeliveryReceipts error")
-			}
+		if content.SyncMessage.Read != nil {
+			cli.handleEvent(&events.ReadSelf{
+				Messages: content.SyncMessage.GetRead(),
+			})
 		}
-
-		if content.TypingMessage != nil {
-			var groupID types.GroupIdentifier
-			if content.TypingMessage.GetGroupId() != nil {
-				gidBytes := content.TypingMessage.GetGroupId()
-				groupID = types.GroupIdentifier(base64.StdEncoding.EncodeToString(gidBytes))
-			}
-			cli.handleEvent(&events.ChatEvent{
-				Info: events.MessageInfo{
-					Sender: theirUUID,
-					ChatID: groupOrUserID(groupID, theirUUID),
-				},
-				Event: content.TypingMessage,
+		if len(content.SyncMessage.StickerPackOperation) > 0 {
+			cli.handleEvent(&events.StickerPackOperation{
+				Operations: content.SyncMessage.GetStickerPackOperation(),
 			})
 		}
 
-		// DM call message (group call is an opaque callMessage and a groupCallUpdate in a dataMessage)
-		if content.CallMessage != nil && (content.CallMessage.Offer != nil || content.CallMessage.Hangup != nil) {
-			cli.handleEvent(&events.Call{
-				Info: events.MessageInfo{
-					Sender: theirUUID,
-					ChatID: theirUUID.String(),
-				},
-				IsRinging: content.CallMessage.Offer != nil,
-			})
+	}
+
+	// Delivery receipts for these are sent in MarkInboxEntryHandled after the event is bridged
+	if content.DataMessage != nil {
+		pendingBridge = cli.incomingDataMessage(ctx, content.DataMessage, theirUUID, theirUUID, entry.ServerGUID)
+	} else if content.EditMessage != nil {
+		pendingBridge = cli.incomingEditMessage(ctx, content.EditMessage, theirUUID, theirUUID, entry.ServerGUID)
+	}
+
+	if content.TypingMessage != nil {
+		var groupID types.GroupIdentifier
+		if content.TypingMessage.GetGroupId() != nil {
+			gidBytes := content.TypingMessage.GetGroupId()
+			groupID = types.GroupIdentifier(base64.StdEncoding.EncodeToString(gidBytes))
 		}
+		cli.handleEvent(&events.ChatEvent{
+			Info: events.MessageInfo{
+				Sender: theirUUID,
+				ChatID: groupOrUserID(groupID, theirUUID),
+			},
+			Event: content.TypingMessage,
+		})
+	}
 
-		// Read and delivery receipts
-		if content.ReceiptMessage != nil {
-			if content.GetReceiptMessage().GetType() == signalpb.ReceiptMessage_DELIVERY && theirUUID == cli.Store.ACI {
-				// Ignore delivery receipts from other own devices
-				return &web.SimpleResponse{
-					Status: responseCode,
-				}, nil
-			}
-			cli.handleEvent(&events.Receipt{
-				Sender:  theirUUID,
-				Content: content.ReceiptMessage,
-			})
+	// DM call message (group call is an opaque callMessage and a groupCallUpdate in a dataMessage)
+	if content.CallMessage != nil && (content.CallMessage.Offer != nil || content.CallMessage.Hangup != nil) {
+		cli.handleEvent(&events.Call{
+			Info: events.MessageInfo{
+				Sender: theirUUID,
+				ChatID: theirUUID.String(),
+			},
+			IsRinging: content.CallMessage.Offer != nil,
+		})
+	}
+
+	// Read and delivery receipts
+	if content.ReceiptMessage != nil {
+		if content.GetReceiptMessage().GetType() == signalpb.ReceiptMessage_DELIVERY && theirUUID == cli.Store.ACI {
+			// Ignore delivery receipts from other own devices
+			return
 		}
+		cli.handleEvent(&events.Receipt{
+			Sender:  theirUUID,
+			Content: content.ReceiptMessage,
+		})
 	}
-	return &web.SimpleResponse{
-		Status: responseCode,
-	}, nil
 }
 
 func printStructFields(message protoreflect.Message, parent string, builder *strings.Builder) {
@@ -769,7 +938,7 @@ func groupOrUserID(groupID types.GroupIdentifier, userID uuid.UUID) string {
 	return string(groupID)
 }
 
-func (cli *Client) incomingEditMessage(ctx context.Context, editMessage *signalpb.EditMessage, messageSender, chatRecipient uuid.UUID) bool {
+func (cli *Client) incomingEditMessage(ctx context.Context, editMessage *signalpb.EditMessage, messageSender, chatRecipient uuid.UUID, serverGUID string) bool {
 	// If it's a group message, get the ID and invalidate cache if necessary
 	var groupID types.GroupIdentifier
 	var groupRevision uint32
@@ -790,13 +959,14 @@ func (cli *Client) incomingEditMessage(ctx context.Context, editMessage *signalp
 			Sender:        messageSender,
 			ChatID:        groupOrUserID(groupID, chatRecipient),
 			GroupRevision: groupRevision,
+			ServerGUID:    serverGUID,
 		},
 		Event: editMessage,
 	})
 	return true
 }
 
-func (cli *Client) incomingDataMessage(ctx context.Context, dataMessage *signalpb.DataMessage, messageSender, chatRecipient uuid.UUID) bool {
+func (cli *Client) incomingDataMessage(ctx context.Context, dataMessage *signalpb.DataMessage, messageSender, chatRecipient uuid.UUID, serverGUID string) bool {
 	// If there's a profile key, save it
 	if dataMessage.ProfileKey != nil {
 		profileKey := libsignalgo.ProfileKey(dataMessage.ProfileKey)
@@ -807,6 +977,15 @@ func (cli *Client) incomingDataMessage(ctx context.Context, dataMessage *signalp
 		}
 	}
 
+	if isEndSession(dataMessage) {
+		if messageSender == cli.Store.ACI {
+			// Our other devices resetting their sessions doesn't affect the sessions of this device
+			return false
+		}
+		cli.emitSessionReset(messageSender, serverGUID)
+		return true
+	}
+
 	// If it's a group message, get the ID and invalidate cache if necessary
 	var groupID types.GroupIdentifier
 	var groupRevision uint32
@@ -827,6 +1006,7 @@ func (cli *Client) incomingDataMessage(ctx context.Context, dataMessage *signalp
 		Sender:        messageSender,
 		ChatID:        groupOrUserID(groupID, chatRecipient),
 		GroupRevision: groupRevision,
+		ServerGUID:    serverGUID,
 	}
 	// Hacky special case for group calls to cache the state
 	if dataMessage.GroupCallUpdate != nil {
@@ -864,16 +1044,6 @@ type DecryptionResult struct {
 	SealedSender  bool
 }
 
-const prodServerTrustRootStr = "BXu6QIKVz5MA8gstzfOgRQGqyLqOwNKHL6INkv3IHWMF"
-
-var prodServerTrustRootBytes = exerrors.Must(base64.StdEncoding.DecodeString(prodServerTrustRootStr))
-var prodServerTrustRootKey = exerrors.Must(libsignalgo.DeserializePublicKey(prodServerTrustRootBytes))
-
-func init() {
-	// It's never going to be freed anyway
-	prodServerTrustRootKey.CancelFinalizer()
-}
-
 func (cli *Client) sealedSenderDecrypt(ctx context.Context, envelope *signalpb.Envelope) (*DecryptionResult, error) {
 	localAddress := libsignalgo.NewSealedSenderAddress(
 		cli.Store.Number,
@@ -885,7 +1055,7 @@ func (cli *Client) sealedSenderDecrypt(ctx context.Context, envelope *signalpb.E
 		ctx,
 		envelope.Content,
 		localAddress,
-		prodServerTrustRootKey,
+		cli.Server.trustRoot,
 		timestamp,
 		cli.Store.SessionStore,
 		cli.Store.IdentityStore,
@@ -931,6 +1101,7 @@ func (cli *Client) prekeyDecrypt(ctx context.Context, sender *libsignalgo.Addres
 		return nil, err
 	}
 
+	isSessionReset := cli.isPeerSessionReset(ctx, sender, preKeyMessage)
 	data, err := libsignalgo.DecryptPreKey(
 		ctx,
 		preKeyMessage,
@@ -956,6 +1127,12 @@ func (cli *Client) prekeyDecrypt(ctx context.Context, sender *libsignalgo.Addres
 		err = fmt.Errorf("Unmarshal error: %v", err)
 		return nil, err
 	}
+	if isSessionReset {
+		if senderUUID, err := sender.NameUUID(); err == nil && senderUUID != cli.Store.ACI {
+			zerolog.Ctx(ctx).Info().Msg("Sender started a new session while the old one was active")
+			cli.emitSessionReset(senderUUID, "")
+		}
+	}
 	DecryptionResult := &DecryptionResult{
 		SenderAddress: sender,
 		Content:       content,
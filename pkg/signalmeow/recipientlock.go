@@ -0,0 +1,62 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type recipientLock struct {
+	sync.Mutex
+	refs int
+}
+
+// recipientLocks holds one mutex per recipient service ID. Sessions of all devices of a recipient
+// are encrypted together, so the lock covers every device address of the recipient.
+type recipientLocks struct {
+	lock  sync.Mutex
+	locks map[uuid.UUID]*recipientLock
+}
+
+// acquire locks the given recipient and returns a function that unlocks it.
+// The mutex is removed from the map once nobody is holding or waiting for it.
+func (rl *recipientLocks) acquire(recipient uuid.UUID) (release func()) {
+	rl.lock.Lock()
+	if rl.locks == nil {
+		rl.locks = make(map[uuid.UUID]*recipientLock)
+	}
+	lock, ok := rl.locks[recipient]
+	if !ok {
+		lock = &recipientLock{}
+		rl.locks[recipient] = lock
+	}
+	lock.refs++
+	rl.lock.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		rl.lock.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(rl.locks, recipient)
+		}
+		rl.lock.Unlock()
+	}
+}
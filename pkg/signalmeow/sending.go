@@ -23,8 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -41,6 +40,8 @@ import (
 // Sending
 
 func (cli *Client) senderCertificate(ctx context.Context) (*libsignalgo.SenderCertificate, error) {
+	cli.senderCertLock.Lock()
+	defer cli.senderCertLock.Unlock()
 	if cli.SenderCertificate != nil {
 		expiry, err := cli.SenderCertificate.GetExpiration()
 		if err != nil {
@@ -60,7 +61,7 @@ func (cli *Client) senderCertificate(ctx context.Context) (*libsignalgo.SenderCe
 
 	username, password := cli.Store.BasicAuthCreds()
 	opts := &web.HTTPReqOpt{Username: &username, Password: &password}
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, "/v1/certificate/delivery", opts)
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, "/v1/certificate/delivery", opts)
 	if err != nil {
 		return nil, err
 	}
@@ -163,11 +164,9 @@ func (cli *Client) howManyOtherDevicesDoWeHave(ctx context.Context) int {
 	return otherDevices
 }
 
+// buildMessagesToSend encrypts the content for all devices of the recipient.
+// The caller must hold the send lock of the recipient, or else ratchets can race.
 func (cli *Client) buildMessagesToSend(ctx context.Context, recipientUUID uuid.UUID, content *signalpb.Content, unauthenticated bool) ([]MyMessage, error) {
-	// We need to prevent multiple encryption operations from happening at once, or else ratchets can race
-	cli.encryptionLock.Lock()
-	defer cli.encryptionLock.Unlock()
-
 	messages := []MyMessage{}
 
 	addresses, sessionRecords, err := cli.Store.SessionStoreExtras.AllSessionsForUUID(ctx, recipientUUID)
@@ -178,6 +177,15 @@ func (cli *Client) buildMessagesToSend(ctx context.Context, recipientUUID uuid.U
 			return nil, err
 		}
 		addresses, sessionRecords, err = cli.Store.SessionStoreExtras.AllSessionsForUUID(ctx, recipientUUID)
+	} else if err == nil {
+		// Sessions that were archived (e.g. after the recipient reset them) need new prekeys
+		var refetched bool
+		refetched, err = cli.refreshArchivedSessions(ctx, recipientUUID, addresses, sessionRecords)
+		if err != nil {
+			return nil, err
+		} else if refetched {
+			addresses, sessionRecords, err = cli.Store.SessionStoreExtras.AllSessionsForUUID(ctx, recipientUUID)
+		}
 	}
 	err = checkForErrorWithSessions(err, addresses, sessionRecords)
 	if err != nil {
@@ -517,6 +525,9 @@ func (cli *Client) SendGroupMessage(ctx context.Context, gid types.GroupIdentifi
 		Stringer("group_id", gid).
 		Logger()
 	ctx = log.WithContext(ctx)
+	if challenge := cli.PendingRateLimitChallenge(); challenge != nil {
+		return nil, challenge
+	}
 	group, err := cli.RetrieveGroupByID(ctx, gid, 0)
 	if err != nil {
 		return nil, err
@@ -531,33 +542,19 @@ func (cli *Client) SendGroupMessage(ctx context.Context, gid types.GroupIdentifi
 		content.EditMessage.DataMessage.GroupV2 = groupMetadataForDataMessage(*group)
 	}
 
-	// Send to each member of the group
-	result := &GroupMessageSendResult{
-		SuccessfullySentTo: []SuccessfulSendResult{},
-		FailedToSendTo:     []FailedSendResult{},
-	}
+	// The content is shared between all workers, so it must not be modified after this point
+	cli.addProfileKeyToDataMessage(ctx, content)
+
+	// Send to each member of the group in parallel
+	recipients := make([]uuid.UUID, 0, len(group.Members))
 	for _, member := range group.Members {
 		if member.UserID == cli.Store.ACI {
 			// Don't send normal DataMessages to ourselves
 			continue
 		}
-		log := log.With().Stringer("member", member.UserID).Logger()
-		ctx := log.WithContext(ctx)
-		sentUnidentified, err := cli.sendContent(ctx, member.UserID, messageTimestamp, content, 0, true)
-		if err != nil {
-			result.FailedToSendTo = append(result.FailedToSendTo, FailedSendResult{
-				RecipientUUID: member.UserID,
-				Error:         err,
-			})
-			log.Err(err).Msg("Failed to send to user")
-		} else {
-			result.SuccessfullySentTo = append(result.SuccessfullySentTo, SuccessfulSendResult{
-				RecipientUUID: member.UserID,
-				Unidentified:  sentUnidentified,
-			})
-			log.Trace().Msg("Successfully sent to user")
-		}
+		recipients = append(recipients, member.UserID)
 	}
+	result := cli.sendToRecipients(ctx, recipients, messageTimestamp, content)
 
 	// No need to send to ourselves if we don't have any other devices
 	if cli.howManyOtherDevicesDoWeHave(ctx) > 0 {
@@ -584,6 +581,67 @@ func (cli *Client) SendGroupMessage(ctx context.Context, gid types.GroupIdentifi
 	return result, nil
 }
 
+// sendToRecipients sends the content to each recipient using a bounded pool of workers.
+// Each recipient only gets one job, so the order of messages to a single recipient is preserved
+// as long as the caller waits for the previous call to finish.
+func (cli *Client) sendToRecipients(ctx context.Context, recipients []uuid.UUID, messageTimestamp uint64, content *signalpb.Content) *GroupMessageSendResult {
+	concurrency := cli.GroupSendConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultGroupSendConcurrency
+	}
+	if concurrency > len(recipients) {
+		concurrency = len(recipients)
+	}
+	type sendResult struct {
+		unidentified bool
+		err          error
+	}
+	results := make([]sendResult, len(recipients))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				log := zerolog.Ctx(ctx).With().Stringer("member", recipients[idx]).Logger()
+				ctx := log.WithContext(ctx)
+				sentUnidentified, err := cli.sendContent(ctx, recipients[idx], messageTimestamp, content, 0, true)
+				if err != nil {
+					log.Err(err).Msg("Failed to send to user")
+				} else {
+					log.Trace().Msg("Successfully sent to user")
+				}
+				results[idx] = sendResult{unidentified: sentUnidentified, err: err}
+			}
+		}()
+	}
+	for idx := range recipients {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := &GroupMessageSendResult{
+		SuccessfullySentTo: []SuccessfulSendResult{},
+		FailedToSendTo:     []FailedSendResult{},
+	}
+	for idx, res := range results {
+		if res.err != nil {
+			result.FailedToSendTo = append(result.FailedToSendTo, FailedSendResult{
+				RecipientUUID: recipients[idx],
+				Error:         res.err,
+			})
+		} else {
+			result.SuccessfullySentTo = append(result.SuccessfullySentTo, SuccessfulSendResult{
+				RecipientUUID: recipients[idx],
+				Unidentified:  res.unidentified,
+			})
+		}
+	}
+	return result
+}
+
 func (cli *Client) sendSyncCopy(ctx context.Context, content *signalpb.Content, messageTS uint64, result *SuccessfulSendResult) bool {
 	// If we have other devices, send Sync messages to them too
 	if cli.howManyOtherDevicesDoWeHave(ctx) > 0 {
@@ -617,6 +675,7 @@ func (cli *Client) SendMessage(ctx context.Context, recipientID uuid.UUID, conte
 	} else {
 		messageTimestamp = currentMessageTimestamp()
 	}
+	cli.addProfileKeyToDataMessage(ctx, content)
 
 	isDeliveryReceipt := content.ReceiptMessage != nil && content.GetReceiptMessage().GetType() == signalpb.ReceiptMessage_DELIVERY
 	if recipientID == cli.Store.ACI && !isDeliveryReceipt {
@@ -655,6 +714,10 @@ func (cli *Client) SendMessage(ctx context.Context, recipientID uuid.UUID, conte
 	return result
 }
 
+// DefaultGroupSendConcurrency is the number of group members messages are sent to in parallel
+// if Client.GroupSendConcurrency isn't set.
+const DefaultGroupSendConcurrency = 8
+
 func currentMessageTimestamp() uint64 {
 	return uint64(time.Now().UnixMilli())
 }
@@ -666,6 +729,32 @@ func (cli *Client) sendContent(
 	content *signalpb.Content,
 	retryCount int,
 	useUnidentifiedSender bool,
+) (sentUnidentified bool, err error) {
+	release := cli.sendLocks.acquire(recipientUUID)
+	defer release()
+	return cli.sendContentLocked(ctx, recipientUUID, messageTimestamp, content, retryCount, useUnidentifiedSender)
+}
+
+func (cli *Client) addProfileKeyToDataMessage(ctx context.Context, content *signalpb.Content) {
+	if content.DataMessage == nil {
+		return
+	}
+	profileKey, err := cli.ProfileKeyForSignalID(ctx, cli.Store.ACI)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Error getting profile key, not adding to outgoing message")
+	} else {
+		content.DataMessage.ProfileKey = profileKey.Slice()
+	}
+}
+
+// sendContentLocked is the implementation of sendContent. The send lock of the recipient must be held.
+func (cli *Client) sendContentLocked(
+	ctx context.Context,
+	recipientUUID uuid.UUID,
+	messageTimestamp uint64,
+	content *signalpb.Content,
+	retryCount int,
+	useUnidentifiedSender bool,
 ) (sentUnidentified bool, err error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("action", "send content").
@@ -676,14 +765,8 @@ func (cli *Client) sendContent(
 	printContentFieldString(ctx, content, "Outgoing message")
 	log.Trace().Any("raw_content", content).Msg("Raw data of outgoing message")
 
-	// If it's a data message, add our profile key
-	if content.DataMessage != nil {
-		profileKey, err := cli.ProfileKeyForSignalID(ctx, cli.Store.ACI)
-		if err != nil {
-			log.Err(err).Msg("Error getting profile key, not adding to outgoing message")
-		} else {
-			content.DataMessage.ProfileKey = profileKey.Slice()
-		}
+	if challenge := cli.PendingRateLimitChallenge(); challenge != nil {
+		return false, challenge
 	}
 
 	if retryCount > 3 {
@@ -755,7 +838,7 @@ func (cli *Client) sendContent(
 	}
 	log.Trace().Msg("Received a response to a message send")
 
-	retryableStatuses := []uint32{409, 410, 428, 500, 503}
+	retryableStatuses := []uint32{409, 410, 500, 503}
 
 	// Check to see if our status is retryable
 	needToRetry := false
@@ -772,22 +855,22 @@ func (cli *Client) sendContent(
 			err = cli.handle409(ctx, recipientUUID, response)
 		} else if *response.Status == 410 {
 			err = cli.handle410(ctx, recipientUUID, response)
-		} else if *response.Status == 428 {
-			err = cli.handle428(ctx, recipientUUID, response)
 		}
 		if err != nil {
 			return false, err
 		}
 		// Try to send again (**RECURSIVELY**)
-		sentUnidentified, err = cli.sendContent(ctx, recipientUUID, messageTimestamp, content, retryCount+1, sentUnidentified)
+		sentUnidentified, err = cli.sendContentLocked(ctx, recipientUUID, messageTimestamp, content, retryCount+1, sentUnidentified)
 		if err != nil {
 			log.Err(err).Msg("2nd try sendMessage error")
 			return sentUnidentified, err
 		}
+	} else if *response.Status == 428 {
+		return sentUnidentified, cli.handle428(ctx, response)
 	} else if *response.Status == 401 && useUnidentifiedSender {
 		log.Debug().Msg("Retrying send without sealed sender")
 		// Try to send again (**RECURSIVELY**)
-		sentUnidentified, err = cli.sendContent(ctx, recipientUUID, messageTimestamp, content, retryCount+1, false)
+		sentUnidentified, err = cli.sendContentLocked(ctx, recipientUUID, messageTimestamp, content, retryCount+1, false)
 		if err != nil {
 			log.Err(err).Msg("2nd try sendMessage error")
 			return sentUnidentified, err
@@ -883,66 +966,14 @@ func (cli *Client) handle410(ctx context.Context, recipientUUID uuid.UUID, respo
 	return err
 }
 
-// We got rate limited.
-// We ~~will~~ could try sending a "pushChallenge" response, but if that doesn't work we just gotta wait.
-// TODO: explore captcha response
-func (cli *Client) handle428(ctx context.Context, recipientUUID uuid.UUID, response *signalpb.WebSocketResponseMessage) error {
-	log := zerolog.Ctx(ctx)
-	// Decode json body
-	// TODO use an actual struct
-	var body map[string]interface{}
-	err := json.Unmarshal(response.Body, &body)
+// We got rate limited. The server wants us to solve a challenge before sending more messages.
+// Responding to pushChallenges doesn't work for linked devices, so the user needs to solve a captcha.
+func (cli *Client) handle428(ctx context.Context, response *signalpb.WebSocketResponseMessage) error {
+	challenge, err := parseRateLimitChallenge(response)
 	if err != nil {
-		log.Err(err).Msg("Unmarshal error")
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to parse rate limit challenge")
 		return err
 	}
-
-	// Sample response:
-	//id:25 status:428 message:"Precondition Required" headers:"Retry-After:86400"
-	//headers:"Content-Type:application/json" headers:"Content-Length:88"
-	//body:"{\"token\":\"07af0d73-e05d-42c3-9634-634922061966\",\"options\":[\"recaptcha\",\"pushChallenge\"]}"
-	var retryAfterSeconds uint64 = 0
-	// Find retry after header
-	for _, header := range response.Headers {
-		key, value := strings.Split(header, ":")[0], strings.Split(header, ":")[1]
-		if key == "Retry-After" {
-			retryAfterSeconds, err = strconv.ParseUint(value, 10, 64)
-			if err != nil {
-				log.Err(err).Msg("ParseUint error")
-			}
-		}
-	}
-	if retryAfterSeconds > 0 {
-		log.Warn().Uint64("retry_after_seconds", retryAfterSeconds).Msg("Got rate limited")
-	}
-	// TODO: responding to a pushChallenge this way doesn't work, server just returns 422
-	// Luckily challenges seem rare when sending with sealed sender
-	//if body["options"] != nil {
-	//	options := body["options"].([]interface{})
-	//	for _, option := range options {
-	//		if option == "pushChallenge" {
-	//			zlog.Info().Msg("Got pushChallenge, sending response")
-	//			token := body["token"].(string)
-	//			username, password := device.Data.BasicAuthCreds()
-	//			response, err := web.SendHTTPRequest(
-	//				http.MethodPut,
-	//				"/v1/challenge",
-	//				&web.HTTPReqOpt{
-	//					Body:     []byte(fmt.Sprintf("{\"token\":\"%v\",\"type\":\"pushChallenge\"}", token)),
-	//					Username: &username,
-	//					Password: &password,
-	//				},
-	//			)
-	//			if err != nil {
-	//				zlog.Err(err).Msg("SendHTTPRequest error")
-	//				return err
-	//			}
-	//			if response.StatusCode != 200 {
-	//				zlog.Info().Msg("Unexpected status code: %v", response.StatusCode)
-	//				return fmt.Errorf("Unexpected status code: %v", response.StatusCode)
-	//			}
-	//		}
-	//	}
-	//}
-	return nil
+	cli.setRateLimitChallenge(ctx, challenge)
+	return challenge
 }
@@ -59,7 +59,7 @@ func (cli *Client) getCredentialsWithCache(ctx context.Context, cache **basicExp
 
 func (cli *Client) getCredentialsFromServer(ctx context.Context, path string) (*basicExpiringCredentials, error) {
 	username, password := cli.Store.BasicAuthCreds()
-	resp, err := web.SendHTTPRequest(ctx, http.MethodGet, path, &web.HTTPReqOpt{
+	resp, err := cli.Server.Transport.SendHTTPRequest(ctx, http.MethodGet, path, &web.HTTPReqOpt{
 		Username: &username,
 		Password: &password,
 	})
@@ -0,0 +1,148 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// ResetSession archives all sessions with the given user and starts new ones from fresh prekey bundles.
+// A null message is sent through the new sessions, so the other side switches to them too.
+func (cli *Client) ResetSession(ctx context.Context, theirUUID uuid.UUID) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "reset session").
+		Stringer("their_uuid", theirUUID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	release := cli.sendLocks.acquire(theirUUID)
+	defer release()
+
+	err := cli.Store.SessionStoreExtras.ArchiveSessions(ctx, theirUUID)
+	if err != nil {
+		return fmt.Errorf("failed to archive sessions: %w", err)
+	}
+	err = cli.FetchAndProcessPreKey(ctx, theirUUID, -1)
+	if err != nil {
+		return fmt.Errorf("failed to fetch prekeys: %w", err)
+	}
+	// Devices that didn't return a prekey bundle no longer exist, so drop their archived sessions
+	addresses, records, err := cli.Store.SessionStoreExtras.AllSessionsForUUID(ctx, theirUUID)
+	if err != nil {
+		return fmt.Errorf("failed to get new sessions: %w", err)
+	}
+	for i, record := range records {
+		if hasCurrentState, err := record.HasCurrentState(); err != nil {
+			return fmt.Errorf("failed to check session state: %w", err)
+		} else if !hasCurrentState {
+			err = cli.Store.SessionStoreExtras.RemoveSession(ctx, addresses[i])
+			if err != nil {
+				return fmt.Errorf("failed to remove stale session: %w", err)
+			}
+		}
+	}
+	log.Debug().Int("session_count", len(records)).Msg("Started new sessions, sending null message")
+
+	padding := make([]byte, mrand.Intn(140)+1)
+	_, err = rand.Read(padding)
+	if err != nil {
+		return fmt.Errorf("failed to generate padding: %w", err)
+	}
+	content := &signalpb.Content{
+		NullMessage: &signalpb.NullMessage{Padding: padding},
+	}
+	_, err = cli.sendContentLocked(ctx, theirUUID, currentMessageTimestamp(), content, 0, true)
+	if err != nil {
+		return fmt.Errorf("failed to send null message: %w", err)
+	}
+	return nil
+}
+
+// refreshArchivedSessions fetches new prekey bundles for devices whose sessions have no current state.
+func (cli *Client) refreshArchivedSessions(ctx context.Context, theirUUID uuid.UUID, addresses []*libsignalgo.Address, records []*libsignalgo.SessionRecord) (refetched bool, err error) {
+	for i, record := range records {
+		hasCurrentState, err := record.HasCurrentState()
+		if err != nil {
+			return refetched, fmt.Errorf("failed to check session state: %w", err)
+		} else if hasCurrentState {
+			continue
+		}
+		deviceID, err := addresses[i].DeviceID()
+		if err != nil {
+			return refetched, err
+		}
+		err = cli.FetchAndProcessPreKey(ctx, theirUUID, int(deviceID))
+		if err != nil {
+			return refetched, fmt.Errorf("failed to fetch prekeys for archived session: %w", err)
+		}
+		refetched = true
+	}
+	return refetched, nil
+}
+
+func isEndSession(dataMessage *signalpb.DataMessage) bool {
+	return dataMessage.GetFlags()&uint32(signalpb.DataMessage_END_SESSION) != 0
+}
+
+// handleEndSession archives the sessions with the sender of an END_SESSION message. The sender will start
+// new sessions for their next messages. This must only be called once per message, as it's done before
+// the message is stored in the inbox, and archiving again later would also archive the new sessions.
+func (cli *Client) handleEndSession(ctx context.Context, sender uuid.UUID) {
+	zerolog.Ctx(ctx).Info().Msg("Received END_SESSION, archiving sessions with sender")
+	err := cli.Store.SessionStoreExtras.ArchiveSessions(ctx, sender)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to archive sessions after END_SESSION")
+	}
+}
+
+// isPeerSessionReset checks if a prekey message starts a new session while we still have an active one,
+// which means the sender archived their side of the session. Prekey messages are repeated until the
+// sender gets a reply, but the repeats reuse the one-time prekey that was removed by the first message,
+// so only messages using an unconsumed one-time prekey are treated as resets.
+func (cli *Client) isPeerSessionReset(ctx context.Context, sender *libsignalgo.Address, preKeyMessage *libsignalgo.PreKeyMessage) bool {
+	preKeyID, err := preKeyMessage.GetPreKeyID()
+	if err != nil || preKeyID == nil {
+		return false
+	}
+	existing, err := cli.Store.SessionStore.LoadSession(ctx, sender)
+	if err != nil || existing == nil {
+		return false
+	} else if hasCurrentState, err := existing.HasCurrentState(); err != nil || !hasCurrentState {
+		return false
+	}
+	preKey, err := cli.Store.PreKeyStore.LoadPreKey(ctx, *preKeyID)
+	return err == nil && preKey != nil
+}
+
+func (cli *Client) emitSessionReset(sender uuid.UUID, serverGUID string) {
+	cli.handleEvent(&events.SessionReset{
+		Info: events.MessageInfo{
+			Sender:     sender,
+			ChatID:     sender.String(),
+			ServerGUID: serverGUID,
+		},
+	})
+}
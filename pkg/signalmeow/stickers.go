@@ -0,0 +1,114 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package signalmeow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const (
+	stickerManifestPath = "/stickers/%s/manifest.proto"
+	stickerPath         = "/stickers/%s/full/%d"
+
+	// Sticker packs are always stored on CDN 0
+	stickerCDN = 0
+
+	StickerPackIDLength  = 16
+	StickerPackKeyLength = 32
+)
+
+var (
+	ErrInvalidStickerPackID  = errors.New("invalid sticker pack ID")
+	ErrInvalidStickerPackKey = errors.New("invalid sticker pack key")
+	ErrInvalidMACForSticker  = errors.New("invalid MAC for sticker")
+)
+
+func deriveStickerPackKeys(packKey []byte) ([]byte, error) {
+	keys := make([]byte, 64)
+	_, err := io.ReadFull(hkdf.New(sha256.New, packKey, nil, []byte("Sticker Pack")), keys)
+	return keys, err
+}
+
+// decryptStickerData decrypts a sticker pack manifest or a single sticker.
+// The data is the IV and AES-CBC ciphertext followed by a HMAC-SHA256, both keyed with keys derived from the pack key.
+func decryptStickerData(packKey, data []byte) ([]byte, error) {
+	if len(packKey) != StickerPackKeyLength {
+		return nil, ErrInvalidStickerPackKey
+	} else if len(data) < 32+16 {
+		return nil, fmt.Errorf("sticker data too short (%d bytes)", len(data))
+	}
+	keys, err := deriveStickerPackKeys(packKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keys: %w", err)
+	}
+	l := len(data) - 32
+	if !verifyMAC(keys[32:], data[:l], data[l:]) {
+		return nil, ErrInvalidMACForSticker
+	}
+	return aesDecrypt(keys[:32], data[:l])
+}
+
+func (cli *Client) downloadStickerData(ctx context.Context, path string, packKey []byte) ([]byte, error) {
+	resp, err := cli.Server.Transport.GetAttachment(ctx, path, stickerCDN, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return decryptStickerData(packKey, body)
+}
+
+// FetchStickerPack downloads and decrypts the manifest of the sticker pack with the given ID and key.
+func (cli *Client) FetchStickerPack(ctx context.Context, packID, packKey []byte) (*signalpb.Pack, error) {
+	if len(packID) != StickerPackIDLength {
+		return nil, ErrInvalidStickerPackID
+	}
+	data, err := cli.downloadStickerData(ctx, fmt.Sprintf(stickerManifestPath, hex.EncodeToString(packID)), packKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifest: %w", err)
+	}
+	var pack signalpb.Pack
+	err = proto.Unmarshal(data, &pack)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	return &pack, nil
+}
+
+// DownloadSticker downloads and decrypts a single sticker image from a sticker pack.
+func (cli *Client) DownloadSticker(ctx context.Context, packID, packKey []byte, stickerID uint32) ([]byte, error) {
+	if len(packID) != StickerPackIDLength {
+		return nil, ErrInvalidStickerPackID
+	}
+	return cli.downloadStickerData(ctx, fmt.Sprintf(stickerPath, hex.EncodeToString(packID), stickerID), packKey)
+}
@@ -102,7 +102,7 @@ const (
 	`
 )
 
-func scanContact(row dbutil.Scannable) (*types.Contact, error) {
+func (s *SQLStore) scanContact(row dbutil.Scannable) (*types.Contact, error) {
 	var contact types.Contact
 	var profileKey []byte
 	err := row.Scan(
@@ -122,6 +122,10 @@ func scanContact(row dbutil.Scannable) (*types.Contact, error) {
 	} else if err != nil {
 		return nil, err
 	}
+	profileKey, err = s.decrypt(contactProfileKeyColumn, rowKey{s.ACI, contact.UUID}, profileKey)
+	if err != nil {
+		return nil, err
+	}
 	if len(profileKey) != 0 {
 		profileKeyConverted := libsignalgo.ProfileKey(profileKey)
 		contact.ProfileKey = &profileKeyConverted
@@ -130,11 +134,11 @@ func scanContact(row dbutil.Scannable) (*types.Contact, error) {
 }
 
 func (s *SQLStore) LoadContact(ctx context.Context, theirUUID uuid.UUID) (*types.Contact, error) {
-	return scanContact(s.db.QueryRow(ctx, getContactByUUIDQuery, s.ACI, theirUUID))
+	return s.scanContact(s.db.QueryRow(ctx, getContactByUUIDQuery, s.ACI, theirUUID))
 }
 
 func (s *SQLStore) LoadContactByE164(ctx context.Context, e164 string) (*types.Contact, error) {
-	return scanContact(s.db.QueryRow(ctx, getContactByPhoneQuery, s.ACI, e164))
+	return s.scanContact(s.db.QueryRow(ctx, getContactByPhoneQuery, s.ACI, e164))
 }
 
 func (s *SQLStore) AllContacts(ctx context.Context) ([]*types.Contact, error) {
@@ -142,11 +146,15 @@ func (s *SQLStore) AllContacts(ctx context.Context) ([]*types.Contact, error) {
 	if err != nil {
 		return nil, err
 	}
-	return dbutil.NewRowIter(rows, scanContact).AsList()
+	return dbutil.NewRowIter(rows, s.scanContact).AsList()
 }
 
 func (s *SQLStore) StoreContact(ctx context.Context, contact types.Contact) error {
-	_, err := s.db.Exec(
+	profileKey, err := s.encrypt(contactProfileKeyColumn, rowKey{s.ACI, contact.UUID}, contact.ProfileKey.Slice())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
 		ctx,
 		upsertContactQuery,
 		s.ACI,
@@ -154,7 +162,7 @@ func (s *SQLStore) StoreContact(ctx context.Context, contact types.Contact) erro
 		contact.E164,
 		contact.ContactName,
 		contact.ContactAvatar.Hash,
-		contact.ProfileKey.Slice(),
+		profileKey,
 		contact.ProfileName,
 		contact.ProfileAbout,
 		contact.ProfileAboutEmoji,
@@ -23,7 +23,8 @@ type DeviceStore interface {
 
 // StoreContainer is a wrapper for a SQL database that can contain multiple signalmeow sessions.
 type StoreContainer struct {
-	db *dbutil.Database
+	db         *dbutil.Database
+	encryption storeEncryption
 }
 
 func NewStore(db *dbutil.Database, log dbutil.DatabaseLogger) *StoreContainer {
@@ -56,6 +57,18 @@ func (c *StoreContainer) scanDevice(row dbutil.Scannable) (*Device, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan session: %w", err)
 	}
+	aciIdentityKeyPair, err = c.decrypt(aciIdentityKeyPairColumn, rowKey{device.ACI}, aciIdentityKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	pniIdentityKeyPair, err = c.decrypt(pniIdentityKeyPairColumn, rowKey{device.ACI}, pniIdentityKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	device.Password, err = c.decryptText(passwordColumn, rowKey{device.ACI}, device.Password)
+	if err != nil {
+		return nil, err
+	}
 	device.ACIIdentityKeyPair, err = libsignalgo.DeserializeIdentityKeyPair(aciIdentityKeyPair)
 	if err != nil {
 		return nil, fmt.Errorf("failed to deserialize ACI identity key pair: %w", err)
@@ -79,6 +92,8 @@ func (c *StoreContainer) scanDevice(row dbutil.Scannable) (*Device, error) {
 	device.GroupStore = innerStore
 	device.ContactStore = innerStore
 	device.DeviceStore = innerStore
+	device.InboxStore = innerStore
+	device.EnvelopeStore = innerStore
 
 	return &device, nil
 }
@@ -150,10 +165,22 @@ func (c *StoreContainer) PutDevice(ctx context.Context, device *DeviceData) erro
 		zerolog.Ctx(ctx).Err(err).Msg("failed to serialize pni identity key pair")
 		return err
 	}
+	aciIdentityKeyPair, err = c.encrypt(aciIdentityKeyPairColumn, rowKey{device.ACI}, aciIdentityKeyPair)
+	if err != nil {
+		return err
+	}
+	pniIdentityKeyPair, err = c.encrypt(pniIdentityKeyPairColumn, rowKey{device.ACI}, pniIdentityKeyPair)
+	if err != nil {
+		return err
+	}
+	password, err := c.encryptText(passwordColumn, rowKey{device.ACI}, device.Password)
+	if err != nil {
+		return err
+	}
 	_, err = c.db.Exec(ctx, insertDeviceQuery,
 		device.ACI, aciIdentityKeyPair, device.RegistrationID,
 		device.PNI, pniIdentityKeyPair, device.PNIRegistrationID,
-		device.DeviceID, device.Number, device.Password,
+		device.DeviceID, device.Number, password,
 	)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("failed to insert device")
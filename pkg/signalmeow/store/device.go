@@ -65,6 +65,8 @@ type Device struct {
 	GroupStore         GroupStore
 	ContactStore       ContactStore
 	DeviceStore        DeviceStore
+	InboxStore         InboxStore
+	EnvelopeStore      ProcessedEnvelopeStore
 }
 
 func (d *Device) ClearDeviceKeys(ctx context.Context) error {
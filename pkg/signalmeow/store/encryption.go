@@ -0,0 +1,435 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// EncryptionKeyLength is the length of keys accepted by StoreContainer.SetEncryptionKey.
+const EncryptionKeyLength = 32
+
+const (
+	encryptedMagic = "smenc"
+	// Version 1 only bound values to the owner's ACI, version 2 binds them to the whole primary key of the row.
+	encryptedVersionLegacy = 1
+	encryptedVersion       = 2
+	// encryptedVersionSuffix is appended to the key ID stored in the database to detect values in older formats.
+	encryptedVersionSuffix = "v2"
+	encryptionKeyIDLength  = 6
+	// The header length is a multiple of 3, so that the base64 prefix of encrypted text values doesn't
+	// depend on the rest of the data.
+	encryptedHeaderLength = len(encryptedMagic) + 1 + encryptionKeyIDLength
+)
+
+var (
+	ErrInvalidEncryptionKey  = fmt.Errorf("store encryption key must be %d bytes", EncryptionKeyLength)
+	ErrEncryptionKeyRequired = errors.New("store is encrypted, but no encryption key is set")
+	ErrUnknownEncryptionKey  = errors.New("store is encrypted with an unknown key")
+	ErrDecryptionFailed      = errors.New("failed to decrypt value from store")
+)
+
+type encryptionKeyID [encryptionKeyIDLength]byte
+
+func (id encryptionKeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type encryptionKey struct {
+	id   encryptionKeyID
+	aead cipher.AEAD
+}
+
+func newEncryptionKey(key []byte) (*encryptionKey, error) {
+	if len(key) != EncryptionKeyLength {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+	var id encryptionKeyID
+	copy(id[:], hash[:])
+	return &encryptionKey{id: id, aead: aead}, nil
+}
+
+// storeEncryption holds the keys used to encrypt private key material at rest.
+// The zero value stores everything in plaintext.
+type storeEncryption struct {
+	current *encryptionKey
+	keys    map[encryptionKeyID]*encryptionKey
+}
+
+func (se *storeEncryption) currentKeyID() string {
+	if se.current == nil {
+		return ""
+	}
+	return se.current.id.String()
+}
+
+func (se *storeEncryption) hasKey(id string) bool {
+	for keyID := range se.keys {
+		if keyID.String() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptedColumn is a column containing private key material, which is encrypted if a key is set.
+type encryptedColumn struct {
+	table  string
+	column string
+	// keyColumns is the primary key of the table. The first column is always the ACI of the owner.
+	keyColumns []string
+	text       bool
+}
+
+var (
+	deviceKeyColumns    = []string{"aci_uuid"}
+	sessionKeyColumns   = []string{"our_aci_uuid", "their_aci_uuid", "their_device_id"}
+	senderKeyKeyColumns = []string{"our_aci_uuid", "sender_uuid", "sender_device_id", "distribution_id"}
+	profileKeyKeyColumn = []string{"our_aci_uuid", "their_aci_uuid"}
+	contactKeyColumns   = []string{"our_aci_uuid", "aci_uuid"}
+	preKeyKeyColumns    = []string{"aci_uuid", "uuid_kind", "is_signed", "key_id"}
+	kyberKeyColumns     = []string{"aci_uuid", "uuid_kind", "key_id"}
+
+	aciIdentityKeyPairColumn = encryptedColumn{"signalmeow_device", "aci_identity_key_pair", deviceKeyColumns, false}
+	pniIdentityKeyPairColumn = encryptedColumn{"signalmeow_device", "pni_identity_key_pair", deviceKeyColumns, false}
+	passwordColumn           = encryptedColumn{"signalmeow_device", "password", deviceKeyColumns, true}
+	sessionRecordColumn      = encryptedColumn{"signalmeow_sessions", "record", sessionKeyColumns, false}
+	senderKeyRecordColumn    = encryptedColumn{"signalmeow_sender_keys", "key_record", senderKeyKeyColumns, false}
+	profileKeyColumn         = encryptedColumn{"signalmeow_profile_keys", "key", profileKeyKeyColumn, false}
+	contactProfileKeyColumn  = encryptedColumn{"signalmeow_contacts", "profile_key", contactKeyColumns, false}
+	preKeyPairColumn         = encryptedColumn{"signalmeow_pre_keys", "key_pair", preKeyKeyColumns, false}
+	kyberPreKeyPairColumn    = encryptedColumn{"signalmeow_kyber_pre_keys", "key_pair", kyberKeyColumns, false}
+)
+
+var encryptedColumns = []encryptedColumn{
+	aciIdentityKeyPairColumn,
+	pniIdentityKeyPairColumn,
+	passwordColumn,
+	sessionRecordColumn,
+	senderKeyRecordColumn,
+	profileKeyColumn,
+	contactProfileKeyColumn,
+	preKeyPairColumn,
+	kyberPreKeyPairColumn,
+}
+
+// rowKey is the primary key of a row containing an encrypted value, in the order of encryptedColumn.keyColumns.
+type rowKey []any
+
+func formatKeyValue(val any) string {
+	switch typedVal := val.(type) {
+	case []byte:
+		return string(typedVal)
+	case fmt.Stringer:
+		return typedVal.String()
+	default:
+		return fmt.Sprint(typedVal)
+	}
+}
+
+// additionalData binds encrypted values to their column and row, so they can't be moved around in the database.
+func (col encryptedColumn) additionalData(version byte, key rowKey) []byte {
+	if version == encryptedVersionLegacy {
+		return []byte(fmt.Sprintf("%s.%s/%s", col.table, col.column, formatKeyValue(key[0])))
+	}
+	var buf strings.Builder
+	buf.WriteString(col.table)
+	buf.WriteByte('.')
+	buf.WriteString(col.column)
+	for _, val := range key {
+		buf.WriteByte('/')
+		buf.WriteString(formatKeyValue(val))
+	}
+	return []byte(buf.String())
+}
+
+// SetEncryptionKey sets the key used to encrypt identity keys, prekeys, passwords, sessions, sender keys and
+// profile keys in the database. A nil key stores new values in plaintext. Old keys are only used to decrypt existing values.
+//
+// This must be called before the store is used. After changing keys, MigrateEncryption must be called to
+// re-encrypt existing values.
+func (c *StoreContainer) SetEncryptionKey(key []byte, oldKeys ...[]byte) error {
+	enc := storeEncryption{keys: make(map[encryptionKeyID]*encryptionKey)}
+	if key != nil {
+		parsed, err := newEncryptionKey(key)
+		if err != nil {
+			return err
+		}
+		enc.current = parsed
+		enc.keys[parsed.id] = parsed
+	}
+	for _, oldKey := range oldKeys {
+		parsed, err := newEncryptionKey(oldKey)
+		if err != nil {
+			return fmt.Errorf("invalid old key: %w", err)
+		}
+		enc.keys[parsed.id] = parsed
+	}
+	c.encryption = enc
+	return nil
+}
+
+func isEncrypted(data []byte) bool {
+	return len(data) >= encryptedHeaderLength &&
+		bytes.Equal(data[:len(encryptedMagic)], []byte(encryptedMagic)) &&
+		(data[len(encryptedMagic)] == encryptedVersion || data[len(encryptedMagic)] == encryptedVersionLegacy)
+}
+
+// encrypt encrypts a value of the given column with the current key.
+// The format is magic || version || key ID || nonce || ciphertext.
+func (c *StoreContainer) encrypt(col encryptedColumn, key rowKey, plaintext []byte) ([]byte, error) {
+	encKey := c.encryption.current
+	if encKey == nil || len(plaintext) == 0 {
+		return plaintext, nil
+	}
+	output := make([]byte, encryptedHeaderLength+encKey.aead.NonceSize(), encryptedHeaderLength+encKey.aead.NonceSize()+len(plaintext)+encKey.aead.Overhead())
+	copy(output, encryptedMagic)
+	output[len(encryptedMagic)] = encryptedVersion
+	copy(output[len(encryptedMagic)+1:], encKey.id[:])
+	nonce := output[encryptedHeaderLength:]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return encKey.aead.Seal(output, nonce, plaintext, col.additionalData(encryptedVersion, key)), nil
+}
+
+// decrypt decrypts a value of the given column. Plaintext values are returned as-is.
+func (c *StoreContainer) decrypt(col encryptedColumn, key rowKey, data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	} else if len(c.encryption.keys) == 0 {
+		return nil, ErrEncryptionKeyRequired
+	}
+	version := data[len(encryptedMagic)]
+	var keyID encryptionKeyID
+	copy(keyID[:], data[len(encryptedMagic)+1:encryptedHeaderLength])
+	encKey, ok := c.encryption.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownEncryptionKey, keyID)
+	}
+	data = data[encryptedHeaderLength:]
+	if len(data) < encKey.aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := encKey.aead.Open(nil, data[:encKey.aead.NonceSize()], data[encKey.aead.NonceSize():], col.additionalData(version, key))
+	if err != nil {
+		return nil, fmt.Errorf("%w from %s.%s", ErrDecryptionFailed, col.table, col.column)
+	}
+	return plaintext, nil
+}
+
+// encryptText is like encrypt, but encodes encrypted values as base64 for text columns.
+func (c *StoreContainer) encryptText(col encryptedColumn, key rowKey, plaintext string) (string, error) {
+	if c.encryption.current == nil || len(plaintext) == 0 {
+		return plaintext, nil
+	}
+	encrypted, err := c.encrypt(col, key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+func (c *StoreContainer) decryptText(col encryptedColumn, key rowKey, data string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || !isEncrypted(decoded) {
+		return data, nil
+	}
+	plaintext, err := c.decrypt(col, key, decoded)
+	return string(plaintext), err
+}
+
+const (
+	getEncryptionKeyIDQuery    = `SELECT key_id FROM signalmeow_encryption`
+	deleteEncryptionKeyIDQuery = `DELETE FROM signalmeow_encryption`
+	insertEncryptionKeyIDQuery = `INSERT INTO signalmeow_encryption (key_id) VALUES ($1)`
+)
+
+// MigrateEncryption re-encrypts all existing private key material with the current key, or decrypts it
+// if no key is set. Nothing is done if the database is already encrypted with the current key.
+//
+// If the database is encrypted with a key that wasn't passed to SetEncryptionKey, ErrUnknownEncryptionKey
+// or ErrEncryptionKeyRequired is returned.
+func (c *StoreContainer) MigrateEncryption(ctx context.Context) error {
+	return c.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		var storedKeyID string
+		err := c.db.QueryRow(ctx, getEncryptionKeyIDQuery).Scan(&storedKeyID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get current encryption key ID: %w", err)
+		}
+		// Databases encrypted with an older format are re-encrypted even if the key didn't change.
+		// Key IDs stored by version 1 don't have a version suffix.
+		storedKeyID, storedVersion, _ := strings.Cut(storedKeyID, "/")
+		currentKeyID := c.encryption.currentKeyID()
+		if storedKeyID == currentKeyID && (currentKeyID == "" || storedVersion == encryptedVersionSuffix) {
+			return nil
+		} else if storedKeyID != "" && len(c.encryption.keys) == 0 {
+			return ErrEncryptionKeyRequired
+		} else if storedKeyID != "" && !c.encryption.hasKey(storedKeyID) {
+			return fmt.Errorf("%w %s", ErrUnknownEncryptionKey, storedKeyID)
+		}
+		log := zerolog.Ctx(ctx).With().
+			Str("action", "migrate store encryption").
+			Str("old_key_id", storedKeyID).
+			Str("new_key_id", currentKeyID).
+			Logger()
+		log.Info().Msg("Re-encrypting private key material in database")
+		for _, col := range encryptedColumns {
+			var count int
+			if col.text {
+				count, err = c.reencryptTextColumn(ctx, col)
+			} else {
+				count, err = c.reencryptColumn(ctx, col)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to re-encrypt %s.%s: %w", col.table, col.column, err)
+			}
+			log.Debug().Str("table", col.table).Str("column", col.column).Int("count", count).Msg("Re-encrypted column")
+		}
+		_, err = c.db.Exec(ctx, deleteEncryptionKeyIDQuery)
+		if err != nil {
+			return fmt.Errorf("failed to clear old encryption key ID: %w", err)
+		}
+		if currentKeyID != "" {
+			_, err = c.db.Exec(ctx, insertEncryptionKeyIDQuery, currentKeyID+"/"+encryptedVersionSuffix)
+			if err != nil {
+				return fmt.Errorf("failed to save new encryption key ID: %w", err)
+			}
+		}
+		log.Info().Msg("Finished re-encrypting private key material")
+		return nil
+	})
+}
+
+type encryptedRow[T any] struct {
+	key   rowKey
+	value T
+}
+
+func readEncryptedColumn[T any](ctx context.Context, c *StoreContainer, col encryptedColumn) ([]encryptedRow[T], error) {
+	rows, err := c.db.Query(ctx, fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s IS NOT NULL",
+		strings.Join(col.keyColumns, ", "), col.column, col.table, col.column,
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []encryptedRow[T]
+	for rows.Next() {
+		row := encryptedRow[T]{key: make(rowKey, len(col.keyColumns))}
+		scanTargets := make([]any, len(col.keyColumns)+1)
+		for i := range row.key {
+			scanTargets[i] = &row.key[i]
+		}
+		scanTargets[len(col.keyColumns)] = &row.value
+		err = rows.Scan(scanTargets...)
+		if err != nil {
+			return nil, err
+		}
+		for i, val := range row.key {
+			// Drivers may return text columns as byte slices, which would be formatted incorrectly in the AD
+			if bytesVal, ok := val.([]byte); ok {
+				row.key[i] = string(bytesVal)
+			}
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
+
+func updateEncryptedColumn(ctx context.Context, c *StoreContainer, col encryptedColumn, key rowKey, newValue any) error {
+	conditions := make([]string, len(col.keyColumns))
+	for i, keyColumn := range col.keyColumns {
+		conditions[i] = fmt.Sprintf("%s=$%d", keyColumn, i+2)
+	}
+	args := make([]any, 0, len(key)+1)
+	args = append(args, newValue)
+	args = append(args, key...)
+	_, err := c.db.Exec(ctx, fmt.Sprintf(
+		"UPDATE %s SET %s=$1 WHERE %s",
+		col.table, col.column, strings.Join(conditions, " AND "),
+	), args...)
+	return err
+}
+
+func (c *StoreContainer) reencryptColumn(ctx context.Context, col encryptedColumn) (int, error) {
+	rows, err := readEncryptedColumn[[]byte](ctx, c, col)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		plaintext, err := c.decrypt(col, row.key, row.value)
+		if err != nil {
+			return 0, err
+		}
+		encrypted, err := c.encrypt(col, row.key, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		err = updateEncryptedColumn(ctx, c, col, row.key, encrypted)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+func (c *StoreContainer) reencryptTextColumn(ctx context.Context, col encryptedColumn) (int, error) {
+	rows, err := readEncryptedColumn[string](ctx, c, col)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		plaintext, err := c.decryptText(col, row.key, row.value)
+		if err != nil {
+			return 0, err
+		}
+		encrypted, err := c.encryptText(col, row.key, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		err = updateEncryptedColumn(ctx, c, col, row.key, encrypted)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
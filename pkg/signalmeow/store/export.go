@@ -0,0 +1,488 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/dbutil"
+	"golang.org/x/crypto/scrypt"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+// ExportFormatVersion is the version of the archives produced by ExportDevice.
+const ExportFormatVersion = 1
+
+const exportMagic = "signalmeow-export"
+
+const (
+	exportSaltLength = 16
+	exportScryptN    = 1 << 15
+	exportScryptR    = 8
+	exportScryptP    = 1
+)
+
+var (
+	ErrDeviceNotFound           = errors.New("device not found")
+	ErrInvalidExport            = errors.New("data is not a signalmeow device export")
+	ErrUnsupportedExportVersion = errors.New("unsupported device export version")
+	ErrWrongExportPassphrase    = errors.New("wrong passphrase or corrupted device export")
+)
+
+type exportedDevice struct {
+	Version int `json:"version"`
+
+	ACI                uuid.UUID `json:"aci"`
+	ACIIdentityKeyPair []byte    `json:"aci_identity_key_pair"`
+	RegistrationID     int       `json:"registration_id"`
+	PNI                uuid.UUID `json:"pni"`
+	PNIIdentityKeyPair []byte    `json:"pni_identity_key_pair"`
+	PNIRegistrationID  int       `json:"pni_registration_id"`
+	DeviceID           int       `json:"device_id"`
+	Number             string    `json:"number"`
+	Password           string    `json:"password"`
+
+	PreKeys      []*exportedPreKey      `json:"pre_keys"`
+	KyberPreKeys []*exportedKyberPreKey `json:"kyber_pre_keys"`
+	IdentityKeys []*exportedIdentityKey `json:"identity_keys"`
+	Sessions     []*exportedSession     `json:"sessions"`
+	ProfileKeys  []*exportedProfileKey  `json:"profile_keys"`
+	SenderKeys   []*exportedSenderKey   `json:"sender_keys"`
+	Groups       []*exportedGroup       `json:"groups"`
+}
+
+type exportedPreKey struct {
+	KeyID      int            `json:"key_id"`
+	UUIDKind   types.UUIDKind `json:"uuid_kind"`
+	IsSigned   bool           `json:"is_signed"`
+	KeyPair    []byte         `json:"key_pair"`
+	Uploaded   bool           `json:"uploaded"`
+	ReplacedAt *int64         `json:"replaced_at,omitempty"`
+}
+
+type exportedKyberPreKey struct {
+	KeyID        int            `json:"key_id"`
+	UUIDKind     types.UUIDKind `json:"uuid_kind"`
+	KeyPair      []byte         `json:"key_pair"`
+	IsLastResort bool           `json:"is_last_resort"`
+	ReplacedAt   *int64         `json:"replaced_at,omitempty"`
+}
+
+type exportedIdentityKey struct {
+	TheirACI   uuid.UUID `json:"their_aci"`
+	DeviceID   int       `json:"device_id"`
+	Key        []byte    `json:"key"`
+	TrustLevel string    `json:"trust_level"`
+}
+
+type exportedSession struct {
+	TheirACI uuid.UUID `json:"their_aci"`
+	DeviceID int       `json:"device_id"`
+	Record   []byte    `json:"record"`
+}
+
+type exportedProfileKey struct {
+	TheirACI uuid.UUID `json:"their_aci"`
+	Key      []byte    `json:"key"`
+}
+
+type exportedSenderKey struct {
+	SenderUUID     uuid.UUID `json:"sender_uuid"`
+	SenderDeviceID int       `json:"sender_device_id"`
+	DistributionID string    `json:"distribution_id"`
+	KeyRecord      []byte    `json:"key_record"`
+}
+
+type exportedGroup struct {
+	GroupIdentifier types.GroupIdentifier          `json:"group_identifier"`
+	MasterKey       types.SerializedGroupMasterKey `json:"master_key"`
+}
+
+const (
+	exportDeviceQuery = `
+		SELECT aci_uuid, aci_identity_key_pair, registration_id, pni_uuid, pni_identity_key_pair, pni_registration_id,
+		       device_id, number, password
+		FROM signalmeow_device WHERE aci_uuid=$1
+	`
+	exportPreKeysQuery      = `SELECT key_id, uuid_kind, is_signed, key_pair, uploaded, replaced_at FROM signalmeow_pre_keys WHERE aci_uuid=$1`
+	exportKyberPreKeysQuery = `SELECT key_id, uuid_kind, key_pair, is_last_resort, replaced_at FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1`
+	exportIdentityKeysQuery = `SELECT their_aci_uuid, their_device_id, key, trust_level FROM signalmeow_identity_keys WHERE our_aci_uuid=$1`
+	exportSessionsQuery     = `SELECT their_aci_uuid, their_device_id, record FROM signalmeow_sessions WHERE our_aci_uuid=$1`
+	exportProfileKeysQuery  = `SELECT their_aci_uuid, key FROM signalmeow_profile_keys WHERE our_aci_uuid=$1`
+	exportSenderKeysQuery   = `SELECT sender_uuid, sender_device_id, distribution_id, key_record FROM signalmeow_sender_keys WHERE our_aci_uuid=$1`
+	exportGroupsQuery       = `SELECT group_identifier, master_key FROM signalmeow_groups WHERE our_aci_uuid=$1`
+
+	importPreKeyQuery = `
+		INSERT INTO signalmeow_pre_keys (aci_uuid, key_id, uuid_kind, is_signed, key_pair, uploaded, replaced_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	importKyberPreKeyQuery = `
+		INSERT INTO signalmeow_kyber_pre_keys (aci_uuid, key_id, uuid_kind, key_pair, is_last_resort, replaced_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	importIdentityKeyQuery = `INSERT INTO signalmeow_identity_keys (our_aci_uuid, their_aci_uuid, their_device_id, key, trust_level) VALUES ($1, $2, $3, $4, $5)`
+	importSessionQuery     = `INSERT INTO signalmeow_sessions (our_aci_uuid, their_aci_uuid, their_device_id, record) VALUES ($1, $2, $3, $4)`
+	importProfileKeyQuery  = `INSERT INTO signalmeow_profile_keys (our_aci_uuid, their_aci_uuid, key) VALUES ($1, $2, $3)`
+	importSenderKeyQuery   = `INSERT INTO signalmeow_sender_keys (our_aci_uuid, sender_uuid, sender_device_id, distribution_id, key_record) VALUES ($1, $2, $3, $4, $5)`
+	importGroupQuery       = `INSERT INTO signalmeow_groups (our_aci_uuid, group_identifier, master_key) VALUES ($1, $2, $3)`
+)
+
+// deviceTables are the tables cleared before importing a device, children before the device table itself.
+// Contacts aren't exported, so they're kept as a cache until they're refreshed from Signal.
+var deviceTables = []struct {
+	name      string
+	aciColumn string
+}{
+	{"signalmeow_pre_keys", "aci_uuid"},
+	{"signalmeow_kyber_pre_keys", "aci_uuid"},
+	{"signalmeow_identity_keys", "our_aci_uuid"},
+	{"signalmeow_sessions", "our_aci_uuid"},
+	{"signalmeow_profile_keys", "our_aci_uuid"},
+	{"signalmeow_sender_keys", "our_aci_uuid"},
+	{"signalmeow_groups", "our_aci_uuid"},
+	{"signalmeow_inbox", "our_aci_uuid"},
+	{"signalmeow_processed_envelopes", "our_aci_uuid"},
+	{"signalmeow_device", "aci_uuid"},
+}
+
+func exportRows[T any](ctx context.Context, db *dbutil.Database, query string, aci uuid.UUID, scan func(row dbutil.Scannable, item *T) error) ([]*T, error) {
+	rows, err := db.Query(ctx, query, aci)
+	if err != nil {
+		return nil, err
+	}
+	return dbutil.NewRowIter(rows, func(row dbutil.Scannable) (*T, error) {
+		var item T
+		return &item, scan(row, &item)
+	}).AsList()
+}
+
+// ExportDevice exports the device with the given ACI along with its keys, sessions, profile keys and
+// group master keys. The returned archive is encrypted with the given passphrase and can be imported
+// into another database with ImportDevice.
+//
+// The device must not be used after exporting it, as the exported sessions would go out of sync.
+func (c *StoreContainer) ExportDevice(ctx context.Context, aci uuid.UUID, passphrase string) ([]byte, error) {
+	export := exportedDevice{Version: ExportFormatVersion}
+	err := c.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		err := c.db.QueryRow(ctx, exportDeviceQuery, aci).Scan(
+			&export.ACI, &export.ACIIdentityKeyPair, &export.RegistrationID,
+			&export.PNI, &export.PNIIdentityKeyPair, &export.PNIRegistrationID,
+			&export.DeviceID, &export.Number, &export.Password,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDeviceNotFound
+		} else if err != nil {
+			return fmt.Errorf("failed to get device: %w", err)
+		}
+		// Archives are encrypted with the passphrase, so values encrypted at rest are exported in plaintext
+		export.ACIIdentityKeyPair, err = c.decrypt(aciIdentityKeyPairColumn, rowKey{aci}, export.ACIIdentityKeyPair)
+		if err != nil {
+			return err
+		}
+		export.PNIIdentityKeyPair, err = c.decrypt(pniIdentityKeyPairColumn, rowKey{aci}, export.PNIIdentityKeyPair)
+		if err != nil {
+			return err
+		}
+		export.Password, err = c.decryptText(passwordColumn, rowKey{aci}, export.Password)
+		if err != nil {
+			return err
+		}
+		export.PreKeys, err = exportRows(ctx, c.db, exportPreKeysQuery, aci, func(row dbutil.Scannable, item *exportedPreKey) error {
+			err := row.Scan(&item.KeyID, &item.UUIDKind, &item.IsSigned, &item.KeyPair, &item.Uploaded, &item.ReplacedAt)
+			if err != nil {
+				return err
+			}
+			item.KeyPair, err = c.decrypt(preKeyPairColumn, rowKey{aci, item.UUIDKind, item.IsSigned, item.KeyID}, item.KeyPair)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get prekeys: %w", err)
+		}
+		export.KyberPreKeys, err = exportRows(ctx, c.db, exportKyberPreKeysQuery, aci, func(row dbutil.Scannable, item *exportedKyberPreKey) error {
+			err := row.Scan(&item.KeyID, &item.UUIDKind, &item.KeyPair, &item.IsLastResort, &item.ReplacedAt)
+			if err != nil {
+				return err
+			}
+			item.KeyPair, err = c.decrypt(kyberPreKeyPairColumn, rowKey{aci, item.UUIDKind, item.KeyID}, item.KeyPair)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get kyber prekeys: %w", err)
+		}
+		export.IdentityKeys, err = exportRows(ctx, c.db, exportIdentityKeysQuery, aci, func(row dbutil.Scannable, item *exportedIdentityKey) error {
+			return row.Scan(&item.TheirACI, &item.DeviceID, &item.Key, &item.TrustLevel)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get identity keys: %w", err)
+		}
+		export.Sessions, err = exportRows(ctx, c.db, exportSessionsQuery, aci, func(row dbutil.Scannable, item *exportedSession) error {
+			err := row.Scan(&item.TheirACI, &item.DeviceID, &item.Record)
+			if err != nil {
+				return err
+			}
+			item.Record, err = c.decrypt(sessionRecordColumn, rowKey{aci, item.TheirACI, item.DeviceID}, item.Record)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get sessions: %w", err)
+		}
+		export.ProfileKeys, err = exportRows(ctx, c.db, exportProfileKeysQuery, aci, func(row dbutil.Scannable, item *exportedProfileKey) error {
+			err := row.Scan(&item.TheirACI, &item.Key)
+			if err != nil {
+				return err
+			}
+			item.Key, err = c.decrypt(profileKeyColumn, rowKey{aci, item.TheirACI}, item.Key)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get profile keys: %w", err)
+		}
+		export.SenderKeys, err = exportRows(ctx, c.db, exportSenderKeysQuery, aci, func(row dbutil.Scannable, item *exportedSenderKey) error {
+			err := row.Scan(&item.SenderUUID, &item.SenderDeviceID, &item.DistributionID, &item.KeyRecord)
+			if err != nil {
+				return err
+			}
+			item.KeyRecord, err = c.decrypt(senderKeyRecordColumn, rowKey{aci, item.SenderUUID, item.SenderDeviceID, item.DistributionID}, item.KeyRecord)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get sender keys: %w", err)
+		}
+		export.Groups, err = exportRows(ctx, c.db, exportGroupsQuery, aci, func(row dbutil.Scannable, item *exportedGroup) error {
+			return row.Scan(&item.GroupIdentifier, &item.MasterKey)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get groups: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(&export)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal export: %w", err)
+	}
+	return encryptExport(plaintext, passphrase)
+}
+
+// DeviceExport is a decrypted device archive that can be imported with ImportDevice.
+type DeviceExport struct {
+	data exportedDevice
+}
+
+// ACI returns the ACI of the exported device.
+func (de *DeviceExport) ACI() uuid.UUID {
+	return de.data.ACI
+}
+
+// OpenDeviceExport decrypts and parses a device archive created by ExportDevice, so that it can be
+// inspected before it's imported.
+func OpenDeviceExport(archive []byte, passphrase string) (*DeviceExport, error) {
+	plaintext, err := decryptExport(archive, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var de DeviceExport
+	err = json.Unmarshal(plaintext, &de.data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal export: %w", err)
+	} else if de.data.Version != ExportFormatVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedExportVersion, de.data.Version)
+	} else if de.data.ACI == uuid.Nil {
+		return nil, ErrDeviceIDMustBeSet
+	}
+	return &de, nil
+}
+
+// ImportDevice imports a device archive opened with OpenDeviceExport. If the database already contains
+// a device with the same ACI, it's replaced along with all its data.
+func (c *StoreContainer) ImportDevice(ctx context.Context, de *DeviceExport) (*Device, error) {
+	export := &de.data
+	aci := export.ACI
+	err := c.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, table := range deviceTables {
+			_, err := c.db.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s=$1", table.name, table.aciColumn), aci)
+			if err != nil {
+				return fmt.Errorf("failed to clear %s: %w", table.name, err)
+			}
+		}
+		aciIdentityKeyPair, err := c.encrypt(aciIdentityKeyPairColumn, rowKey{aci}, export.ACIIdentityKeyPair)
+		if err != nil {
+			return err
+		}
+		pniIdentityKeyPair, err := c.encrypt(pniIdentityKeyPairColumn, rowKey{aci}, export.PNIIdentityKeyPair)
+		if err != nil {
+			return err
+		}
+		password, err := c.encryptText(passwordColumn, rowKey{aci}, export.Password)
+		if err != nil {
+			return err
+		}
+		_, err = c.db.Exec(ctx, insertDeviceQuery,
+			aci, aciIdentityKeyPair, export.RegistrationID,
+			export.PNI, pniIdentityKeyPair, export.PNIRegistrationID,
+			export.DeviceID, export.Number, password,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert device: %w", err)
+		}
+		for _, key := range export.PreKeys {
+			keyPair, err := c.encrypt(preKeyPairColumn, rowKey{aci, key.UUIDKind, key.IsSigned, key.KeyID}, key.KeyPair)
+			if err != nil {
+				return err
+			}
+			_, err = c.db.Exec(ctx, importPreKeyQuery, aci, key.KeyID, key.UUIDKind, key.IsSigned, keyPair, key.Uploaded, key.ReplacedAt)
+			if err != nil {
+				return fmt.Errorf("failed to insert prekey: %w", err)
+			}
+		}
+		for _, key := range export.KyberPreKeys {
+			keyPair, err := c.encrypt(kyberPreKeyPairColumn, rowKey{aci, key.UUIDKind, key.KeyID}, key.KeyPair)
+			if err != nil {
+				return err
+			}
+			_, err = c.db.Exec(ctx, importKyberPreKeyQuery, aci, key.KeyID, key.UUIDKind, keyPair, key.IsLastResort, key.ReplacedAt)
+			if err != nil {
+				return fmt.Errorf("failed to insert kyber prekey: %w", err)
+			}
+		}
+		for _, key := range export.IdentityKeys {
+			_, err = c.db.Exec(ctx, importIdentityKeyQuery, aci, key.TheirACI, key.DeviceID, key.Key, key.TrustLevel)
+			if err != nil {
+				return fmt.Errorf("failed to insert identity key: %w", err)
+			}
+		}
+		for _, session := range export.Sessions {
+			record, err := c.encrypt(sessionRecordColumn, rowKey{aci, session.TheirACI, session.DeviceID}, session.Record)
+			if err != nil {
+				return err
+			}
+			_, err = c.db.Exec(ctx, importSessionQuery, aci, session.TheirACI, session.DeviceID, record)
+			if err != nil {
+				return fmt.Errorf("failed to insert session: %w", err)
+			}
+		}
+		for _, key := range export.ProfileKeys {
+			profileKey, err := c.encrypt(profileKeyColumn, rowKey{aci, key.TheirACI}, key.Key)
+			if err != nil {
+				return err
+			}
+			_, err = c.db.Exec(ctx, importProfileKeyQuery, aci, key.TheirACI, profileKey)
+			if err != nil {
+				return fmt.Errorf("failed to insert profile key: %w", err)
+			}
+		}
+		for _, key := range export.SenderKeys {
+			keyRecord, err := c.encrypt(senderKeyRecordColumn, rowKey{aci, key.SenderUUID, key.SenderDeviceID, key.DistributionID}, key.KeyRecord)
+			if err != nil {
+				return err
+			}
+			_, err = c.db.Exec(ctx, importSenderKeyQuery, aci, key.SenderUUID, key.SenderDeviceID, key.DistributionID, keyRecord)
+			if err != nil {
+				return fmt.Errorf("failed to insert sender key: %w", err)
+			}
+		}
+		for _, group := range export.Groups {
+			_, err = c.db.Exec(ctx, importGroupQuery, aci, group.GroupIdentifier, group.MasterKey)
+			if err != nil {
+				return fmt.Errorf("failed to insert group: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.DeviceByACI(ctx, aci)
+}
+
+func exportHeader() []byte {
+	return append([]byte(exportMagic), ExportFormatVersion)
+}
+
+func exportCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, exportScryptN, exportScryptR, exportScryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptExport encrypts an export with a key derived from the passphrase.
+// The format is header || salt || nonce || ciphertext, where the header is also used as additional data.
+func encryptExport(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, exportSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := exportCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	header := exportHeader()
+	output := append(header, salt...)
+	output = append(output, nonce...)
+	return aead.Seal(output, nonce, plaintext, header), nil
+}
+
+func decryptExport(archive []byte, passphrase string) ([]byte, error) {
+	if len(archive) < len(exportMagic)+1 || !bytes.Equal(archive[:len(exportMagic)], []byte(exportMagic)) {
+		return nil, ErrInvalidExport
+	}
+	header := archive[:len(exportMagic)+1]
+	if version := header[len(exportMagic)]; version != ExportFormatVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedExportVersion, version)
+	}
+	rest := archive[len(header):]
+	if len(rest) < exportSaltLength {
+		return nil, ErrInvalidExport
+	}
+	aead, err := exportCipher(passphrase, rest[:exportSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[exportSaltLength:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrInvalidExport
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrWrongExportPassphrase
+	}
+	return plaintext, nil
+}
@@ -48,7 +48,7 @@ const (
 	`
 )
 
-func scanIdentityKeyPair(row dbutil.Scannable) (*libsignalgo.IdentityKeyPair, error) {
+func (s *SQLStore) scanIdentityKeyPair(row dbutil.Scannable) (*libsignalgo.IdentityKeyPair, error) {
 	var keyPair []byte
 	err := row.Scan(&keyPair)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -56,6 +56,10 @@ func scanIdentityKeyPair(row dbutil.Scannable) (*libsignalgo.IdentityKeyPair, er
 	} else if err != nil {
 		return nil, err
 	}
+	keyPair, err = s.decrypt(aciIdentityKeyPairColumn, rowKey{s.ACI}, keyPair)
+	if err != nil {
+		return nil, err
+	}
 	return libsignalgo.DeserializeIdentityKeyPair(keyPair)
 }
 
@@ -71,7 +75,7 @@ func scanIdentityKey(row dbutil.Scannable) (*libsignalgo.IdentityKey, error) {
 }
 
 func (s *SQLStore) GetIdentityKeyPair(ctx context.Context) (*libsignalgo.IdentityKeyPair, error) {
-	return scanIdentityKeyPair(s.db.QueryRow(ctx, getIdentityKeyPairQuery, s.ACI))
+	return s.scanIdentityKeyPair(s.db.QueryRow(ctx, getIdentityKeyPairQuery, s.ACI))
 }
 
 func (s *SQLStore) GetLocalRegistrationID(ctx context.Context) (uint32, error) {
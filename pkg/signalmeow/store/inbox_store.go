@@ -0,0 +1,125 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/dbutil"
+)
+
+var _ InboxStore = (*SQLStore)(nil)
+
+// InboxEntry is a decrypted envelope that hasn't been fully handled yet.
+type InboxEntry struct {
+	ServerGUID      string
+	SenderACI       uuid.UUID
+	SenderDeviceID  int
+	ServerTimestamp uint64
+	SealedSender    bool
+	// Content is the serialized signalpb.Content of the envelope.
+	Content []byte
+}
+
+type InboxStore interface {
+	// PutInboxEntry stores a decrypted envelope. It must be called before acknowledging the envelope to the server.
+	PutInboxEntry(ctx context.Context, entry *InboxEntry) error
+	// GetInboxEntry returns the inbox entry with the given server GUID, or nil if it doesn't exist.
+	GetInboxEntry(ctx context.Context, serverGUID string) (*InboxEntry, error)
+	// DeleteInboxEntry removes an entry after it has been handled.
+	DeleteInboxEntry(ctx context.Context, serverGUID string) error
+	// IncrementInboxEntryAttempts records a failed attempt to handle an entry and returns the total number of failures.
+	IncrementInboxEntryAttempts(ctx context.Context, serverGUID string) (int, error)
+	// AllInboxEntries returns all unhandled entries in the order they were received in.
+	AllInboxEntries(ctx context.Context) ([]*InboxEntry, error)
+}
+
+const (
+	getAllInboxEntriesQuery = `
+		SELECT server_guid, sender_aci_uuid, sender_device_id, server_timestamp, sealed_sender, content
+		FROM signalmeow_inbox
+		WHERE our_aci_uuid=$1
+	`
+	getInboxEntryQuery = getAllInboxEntriesQuery + `AND server_guid=$2`
+	putInboxEntryQuery = `
+		INSERT INTO signalmeow_inbox (
+			our_aci_uuid, server_guid, sender_aci_uuid, sender_device_id, server_timestamp, sealed_sender, content, received_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (our_aci_uuid, server_guid) DO NOTHING
+	`
+	deleteInboxEntryQuery            = `DELETE FROM signalmeow_inbox WHERE our_aci_uuid=$1 AND server_guid=$2`
+	incrementInboxEntryAttemptsQuery = `
+		UPDATE signalmeow_inbox SET attempts=attempts+1 WHERE our_aci_uuid=$1 AND server_guid=$2 RETURNING attempts
+	`
+)
+
+func scanInboxEntry(row dbutil.Scannable) (*InboxEntry, error) {
+	var entry InboxEntry
+	err := row.Scan(&entry.ServerGUID, &entry.SenderACI, &entry.SenderDeviceID, &entry.ServerTimestamp, &entry.SealedSender, &entry.Content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *SQLStore) PutInboxEntry(ctx context.Context, entry *InboxEntry) error {
+	_, err := s.db.Exec(ctx, putInboxEntryQuery,
+		s.ACI, entry.ServerGUID, entry.SenderACI, entry.SenderDeviceID, int64(entry.ServerTimestamp), entry.SealedSender, entry.Content, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+func (s *SQLStore) GetInboxEntry(ctx context.Context, serverGUID string) (*InboxEntry, error) {
+	return scanInboxEntry(s.db.QueryRow(ctx, getInboxEntryQuery, s.ACI, serverGUID))
+}
+
+func (s *SQLStore) DeleteInboxEntry(ctx context.Context, serverGUID string) error {
+	_, err := s.db.Exec(ctx, deleteInboxEntryQuery, s.ACI, serverGUID)
+	return err
+}
+
+func (s *SQLStore) IncrementInboxEntryAttempts(ctx context.Context, serverGUID string) (attempts int, err error) {
+	err = s.db.QueryRow(ctx, incrementInboxEntryAttemptsQuery, s.ACI, serverGUID).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (s *SQLStore) AllInboxEntries(ctx context.Context) ([]*InboxEntry, error) {
+	rows, err := s.db.Query(ctx, getAllInboxEntriesQuery+"ORDER BY server_timestamp, received_at", s.ACI)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*InboxEntry
+	for rows.Next() {
+		entry, err := scanInboxEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,145 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memstore
+
+import (
+	"context"
+	"sort"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+)
+
+var _ store.InboxStore = (*Store)(nil)
+var _ store.ProcessedEnvelopeStore = (*Store)(nil)
+
+type inboxItem struct {
+	entry    store.InboxEntry
+	attempts int
+	// received is an increasing counter used to order entries with the same server timestamp
+	received uint64
+}
+
+func copyInboxEntry(entry store.InboxEntry) *store.InboxEntry {
+	entry.Content = append([]byte(nil), entry.Content...)
+	return &entry
+}
+
+// store.InboxStore implementation
+
+func (s *Store) PutInboxEntry(ctx context.Context, entry *store.InboxEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.inbox[entry.ServerGUID]; exists {
+		return nil
+	}
+	s.inboxCounter++
+	s.inbox[entry.ServerGUID] = &inboxItem{
+		entry:    *copyInboxEntry(*entry),
+		received: s.inboxCounter,
+	}
+	return nil
+}
+
+func (s *Store) GetInboxEntry(ctx context.Context, serverGUID string) (*store.InboxEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	item, ok := s.inbox[serverGUID]
+	if !ok {
+		return nil, nil
+	}
+	return copyInboxEntry(item.entry), nil
+}
+
+func (s *Store) DeleteInboxEntry(ctx context.Context, serverGUID string) error {
+	s.lock.Lock()
+	delete(s.inbox, serverGUID)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) IncrementInboxEntryAttempts(ctx context.Context, serverGUID string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	item, ok := s.inbox[serverGUID]
+	if !ok {
+		return 0, nil
+	}
+	item.attempts++
+	return item.attempts, nil
+}
+
+func (s *Store) AllInboxEntries(ctx context.Context) ([]*store.InboxEntry, error) {
+	s.lock.RLock()
+	items := make([]*inboxItem, 0, len(s.inbox))
+	for _, item := range s.inbox {
+		items = append(items, item)
+	}
+	s.lock.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].entry.ServerTimestamp != items[j].entry.ServerTimestamp {
+			return items[i].entry.ServerTimestamp < items[j].entry.ServerTimestamp
+		}
+		return items[i].received < items[j].received
+	})
+	var entries []*store.InboxEntry
+	for _, item := range items {
+		entries = append(entries, copyInboxEntry(item.entry))
+	}
+	return entries, nil
+}
+
+// store.ProcessedEnvelopeStore implementation
+
+func (s *Store) IsEnvelopeProcessed(ctx context.Context, serverGUID string) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.envelopes[serverGUID]
+	return ok, nil
+}
+
+func (s *Store) PutProcessedEnvelope(ctx context.Context, serverGUID string, serverTimestamp uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.envelopes[serverGUID]; !exists {
+		s.envelopes[serverGUID] = serverTimestamp
+	}
+	return nil
+}
+
+// PruneProcessedEnvelopes works the same way as in the SQL store: envelopes older than the (keep+1)th newest one
+// are deleted, so at least keep envelopes are always left.
+func (s *Store) PruneProcessedEnvelopes(ctx context.Context, keep int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if keep < 0 || len(s.envelopes) <= keep {
+		return nil
+	}
+	timestamps := make([]uint64, 0, len(s.envelopes))
+	for _, ts := range s.envelopes {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] > timestamps[j]
+	})
+	cutoff := timestamps[keep]
+	for guid, ts := range s.envelopes {
+		if ts < cutoff {
+			delete(s.envelopes, guid)
+		}
+	}
+	return nil
+}
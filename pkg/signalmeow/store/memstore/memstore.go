@@ -0,0 +1,433 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package memstore contains an in-memory implementation of the signalmeow store interfaces.
+//
+// It's meant for short-lived tools and tests that don't need a database: everything is lost when the
+// process exits, so it must not be used for real logins that are expected to survive restarts.
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+var _ libsignalgo.IdentityKeyStore = (*Store)(nil)
+var _ libsignalgo.SessionStore = (*Store)(nil)
+var _ libsignalgo.SenderKeyStore = (*Store)(nil)
+var _ store.SessionStoreExtras = (*Store)(nil)
+var _ store.ProfileKeyStore = (*Store)(nil)
+var _ store.GroupStore = (*Store)(nil)
+var _ store.ContactStore = (*Store)(nil)
+var _ store.DeviceStore = (*Store)(nil)
+
+type addressKey struct {
+	name     string
+	deviceID uint
+}
+
+type senderKeyKey struct {
+	addressKey
+	distributionID uuid.UUID
+}
+
+// Store holds all the data of a single signalmeow device in memory.
+//
+// Records are kept in their serialized form and deserialized on every load, so that like with the SQL store,
+// mutating a loaded record doesn't affect the stored copy until it's stored again.
+type Store struct {
+	lock   sync.RWMutex
+	device *store.Device
+
+	preKeys       map[preKeyKey]*preKeyEntry
+	signedPreKeys map[preKeyKey]*preKeyEntry
+	kyberPreKeys  map[preKeyKey]*kyberPreKeyEntry
+	identityKeys  map[addressKey][]byte
+	sessions      map[addressKey][]byte
+	senderKeys    map[senderKeyKey][]byte
+	profileKeys   map[uuid.UUID]libsignalgo.ProfileKey
+	groups        map[types.GroupIdentifier]types.SerializedGroupMasterKey
+	contacts      map[uuid.UUID]types.Contact
+
+	inbox        map[string]*inboxItem
+	inboxCounter uint64
+	envelopes    map[string]uint64
+}
+
+// NewDevice creates a new in-memory store and returns a device with all of its store interfaces backed by it.
+func NewDevice(data store.DeviceData) *store.Device {
+	s := &Store{
+		preKeys:       make(map[preKeyKey]*preKeyEntry),
+		signedPreKeys: make(map[preKeyKey]*preKeyEntry),
+		kyberPreKeys:  make(map[preKeyKey]*kyberPreKeyEntry),
+		identityKeys:  make(map[addressKey][]byte),
+		sessions:      make(map[addressKey][]byte),
+		senderKeys:    make(map[senderKeyKey][]byte),
+		profileKeys:   make(map[uuid.UUID]libsignalgo.ProfileKey),
+		groups:        make(map[types.GroupIdentifier]types.SerializedGroupMasterKey),
+		contacts:      make(map[uuid.UUID]types.Contact),
+		inbox:         make(map[string]*inboxItem),
+		envelopes:     make(map[string]uint64),
+	}
+	s.device = &store.Device{
+		DeviceData: data,
+
+		PreKeyStore:       s,
+		SignedPreKeyStore: s,
+		KyberPreKeyStore:  s,
+		IdentityStore:     s,
+		SessionStore:      s,
+		SenderKeyStore:    s,
+
+		PreKeyStoreExtras:  s,
+		SessionStoreExtras: s,
+		ProfileKeyStore:    s,
+		GroupStore:         s,
+		ContactStore:       s,
+		DeviceStore:        s,
+		InboxStore:         s,
+		EnvelopeStore:      s,
+	}
+	return s.device
+}
+
+func getAddressKey(address *libsignalgo.Address) (addressKey, error) {
+	name, err := address.Name()
+	if err != nil {
+		return addressKey{}, fmt.Errorf("failed to get their uuid: %w", err)
+	}
+	deviceID, err := address.DeviceID()
+	if err != nil {
+		return addressKey{}, fmt.Errorf("failed to get device ID: %w", err)
+	}
+	return addressKey{name: name, deviceID: deviceID}, nil
+}
+
+// store.DeviceStore implementation
+
+// PutDevice replaces the data of the device. The store only holds a single device,
+// so this doesn't add new devices like the SQL store does.
+func (s *Store) PutDevice(ctx context.Context, dd *store.DeviceData) error {
+	if dd.ACI == uuid.Nil {
+		return store.ErrDeviceIDMustBeSet
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if dd != &s.device.DeviceData {
+		s.device.DeviceData = *dd
+	}
+	return nil
+}
+
+// DeviceByACI returns the device of this store if it has the given ACI, or nil otherwise.
+func (s *Store) DeviceByACI(ctx context.Context, aci uuid.UUID) (*store.Device, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if aci == uuid.Nil || s.device.ACI != aci {
+		return nil, nil
+	}
+	return s.device, nil
+}
+
+// libsignalgo.IdentityKeyStore implementation
+
+func (s *Store) GetIdentityKeyPair(ctx context.Context) (*libsignalgo.IdentityKeyPair, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.device.ACIIdentityKeyPair, nil
+}
+
+func (s *Store) GetLocalRegistrationID(ctx context.Context) (uint32, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return uint32(s.device.RegistrationID), nil
+}
+
+func (s *Store) SaveIdentityKey(ctx context.Context, address *libsignalgo.Address, identityKey *libsignalgo.IdentityKey) (bool, error) {
+	key, err := getAddressKey(address)
+	if err != nil {
+		return false, err
+	}
+	serialized, err := identityKey.Serialize()
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize identity key: %w", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var replacing bool
+	if oldKey, ok := s.identityKeys[key]; ok {
+		// We are replacing the old key if the old key exists, and it is not equal to the new key
+		replacing = string(oldKey) != string(serialized)
+	}
+	s.identityKeys[key] = serialized
+	return replacing, nil
+}
+
+// IsTrustedIdentity always returns true: like in the SQL store, new identities are trusted by default,
+// and saved identities are always stored as trusted.
+func (s *Store) IsTrustedIdentity(ctx context.Context, address *libsignalgo.Address, identityKey *libsignalgo.IdentityKey, direction libsignalgo.SignalDirection) (bool, error) {
+	_, err := getAddressKey(address)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) GetIdentityKey(ctx context.Context, address *libsignalgo.Address) (*libsignalgo.IdentityKey, error) {
+	key, err := getAddressKey(address)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	serialized, ok := s.identityKeys[key]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeIdentityKey(serialized)
+}
+
+// libsignalgo.SessionStore and store.SessionStoreExtras implementation
+
+func (s *Store) LoadSession(ctx context.Context, address *libsignalgo.Address) (*libsignalgo.SessionRecord, error) {
+	key, err := getAddressKey(address)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	serialized, ok := s.sessions[key]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSessionRecord(serialized)
+}
+
+func (s *Store) StoreSession(ctx context.Context, address *libsignalgo.Address, record *libsignalgo.SessionRecord) error {
+	key, err := getAddressKey(address)
+	if err != nil {
+		return err
+	}
+	serialized, err := record.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize session record: %w", err)
+	}
+	s.lock.Lock()
+	s.sessions[key] = serialized
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) AllSessionsForUUID(ctx context.Context, theirUUID uuid.UUID) ([]*libsignalgo.Address, []*libsignalgo.SessionRecord, error) {
+	name := theirUUID.String()
+	s.lock.RLock()
+	serializedRecords := make(map[uint][]byte)
+	for key, serialized := range s.sessions {
+		if key.name == name {
+			serializedRecords[key.deviceID] = serialized
+		}
+	}
+	s.lock.RUnlock()
+	var addresses []*libsignalgo.Address
+	var records []*libsignalgo.SessionRecord
+	for deviceID, serialized := range serializedRecords {
+		record, err := libsignalgo.DeserializeSessionRecord(serialized)
+		if err != nil {
+			return nil, nil, err
+		}
+		address, err := libsignalgo.NewUUIDAddress(theirUUID, deviceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, record)
+		addresses = append(addresses, address)
+	}
+	return addresses, records, nil
+}
+
+func (s *Store) RemoveSession(ctx context.Context, address *libsignalgo.Address) error {
+	key, err := getAddressKey(address)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	delete(s.sessions, key)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) RemoveAllSessions(ctx context.Context) error {
+	s.lock.Lock()
+	s.sessions = make(map[addressKey][]byte)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) ArchiveSessions(ctx context.Context, theirUUID uuid.UUID) error {
+	addresses, records, err := s.AllSessionsForUUID(ctx, theirUUID)
+	if err != nil {
+		return fmt.Errorf("failed to get sessions: %w", err)
+	}
+	for i, record := range records {
+		err = record.ArchiveCurrentState()
+		if err != nil {
+			return fmt.Errorf("failed to archive session: %w", err)
+		}
+		err = s.StoreSession(ctx, addresses[i], record)
+		if err != nil {
+			return fmt.Errorf("failed to store archived session: %w", err)
+		}
+	}
+	return nil
+}
+
+// libsignalgo.SenderKeyStore implementation
+
+func (s *Store) LoadSenderKey(ctx context.Context, sender *libsignalgo.Address, distributionID uuid.UUID) (*libsignalgo.SenderKeyRecord, error) {
+	key, err := getAddressKey(sender)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	serialized, ok := s.senderKeys[senderKeyKey{key, distributionID}]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSenderKeyRecord(serialized)
+}
+
+func (s *Store) StoreSenderKey(ctx context.Context, sender *libsignalgo.Address, distributionID uuid.UUID, record *libsignalgo.SenderKeyRecord) error {
+	key, err := getAddressKey(sender)
+	if err != nil {
+		return err
+	}
+	serialized, err := record.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize sender key: %w", err)
+	}
+	s.lock.Lock()
+	s.senderKeys[senderKeyKey{key, distributionID}] = serialized
+	s.lock.Unlock()
+	return nil
+}
+
+// store.ProfileKeyStore implementation
+
+func (s *Store) LoadProfileKey(ctx context.Context, theirACI uuid.UUID) (*libsignalgo.ProfileKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key, ok := s.profileKeys[theirACI]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (s *Store) MyProfileKey(ctx context.Context) (*libsignalgo.ProfileKey, error) {
+	return s.LoadProfileKey(ctx, s.device.ACI)
+}
+
+func (s *Store) StoreProfileKey(ctx context.Context, theirACI uuid.UUID, key libsignalgo.ProfileKey) error {
+	s.lock.Lock()
+	s.profileKeys[theirACI] = key
+	s.lock.Unlock()
+	return nil
+}
+
+// store.GroupStore implementation
+
+func (s *Store) MasterKeyFromGroupIdentifier(ctx context.Context, groupID types.GroupIdentifier) (types.SerializedGroupMasterKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.groups[groupID], nil
+}
+
+func (s *Store) StoreMasterKey(ctx context.Context, groupID types.GroupIdentifier, key types.SerializedGroupMasterKey) error {
+	s.lock.Lock()
+	s.groups[groupID] = key
+	s.lock.Unlock()
+	return nil
+}
+
+// store.ContactStore implementation
+
+// copyContact returns a copy of the contact with only the fields that the SQL store persists.
+func copyContact(contact types.Contact) *types.Contact {
+	contact.ContactAvatar = types.ContactAvatar{Hash: contact.ContactAvatar.Hash}
+	if contact.ProfileKey != nil {
+		profileKey := *contact.ProfileKey
+		contact.ProfileKey = &profileKey
+	}
+	return &contact
+}
+
+func (s *Store) LoadContact(ctx context.Context, theirUUID uuid.UUID) (*types.Contact, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	contact, ok := s.contacts[theirUUID]
+	if !ok {
+		return nil, nil
+	}
+	return copyContact(contact), nil
+}
+
+func (s *Store) LoadContactByE164(ctx context.Context, e164 string) (*types.Contact, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, contact := range s.contacts {
+		if contact.E164 == e164 {
+			return copyContact(contact), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Store) StoreContact(ctx context.Context, contact types.Contact) error {
+	s.lock.Lock()
+	s.contacts[contact.UUID] = *copyContact(contact)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) AllContacts(ctx context.Context) ([]*types.Contact, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	contacts := make([]*types.Contact, 0, len(s.contacts))
+	for _, contact := range s.contacts {
+		contacts = append(contacts, copyContact(contact))
+	}
+	return contacts, nil
+}
+
+func (s *Store) UpdatePhone(ctx context.Context, theirUUID uuid.UUID, newE164 string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contact, ok := s.contacts[theirUUID]
+	if !ok {
+		contact = types.Contact{UUID: theirUUID}
+	}
+	contact.E164 = newE164
+	s.contacts[theirUUID] = contact
+	return nil
+}
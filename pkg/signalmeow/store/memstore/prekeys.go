@@ -0,0 +1,402 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+var _ libsignalgo.PreKeyStore = (*Store)(nil)
+var _ libsignalgo.SignedPreKeyStore = (*Store)(nil)
+var _ libsignalgo.KyberPreKeyStore = (*Store)(nil)
+var _ store.PreKeyStoreExtras = (*Store)(nil)
+
+type preKeyKey struct {
+	uuidKind types.UUIDKind
+	id       uint
+}
+
+type preKeyEntry struct {
+	record   []byte
+	uploaded bool
+	// replacedAt is the unix millisecond timestamp of when the key was replaced, or zero if it's still in use
+	replacedAt int64
+}
+
+type kyberPreKeyEntry struct {
+	record     []byte
+	lastResort bool
+	replacedAt int64
+}
+
+// libsignalgo.PreKeyStore implementation
+
+func (s *Store) LoadPreKey(ctx context.Context, id uint32) (*libsignalgo.PreKeyRecord, error) {
+	return s.PreKey(ctx, types.UUIDKindACI, int(id))
+}
+func (s *Store) StorePreKey(ctx context.Context, id uint32, preKeyRecord *libsignalgo.PreKeyRecord) error {
+	return s.SavePreKey(ctx, types.UUIDKindACI, preKeyRecord, false)
+}
+func (s *Store) RemovePreKey(ctx context.Context, id uint32) error {
+	return s.DeletePreKey(ctx, types.UUIDKindACI, int(id))
+}
+
+// libsignalgo.SignedPreKeyStore implementation
+
+func (s *Store) LoadSignedPreKey(ctx context.Context, id uint32) (*libsignalgo.SignedPreKeyRecord, error) {
+	return s.SignedPreKey(ctx, types.UUIDKindACI, int(id))
+}
+func (s *Store) StoreSignedPreKey(ctx context.Context, id uint32, signedPreKeyRecord *libsignalgo.SignedPreKeyRecord) error {
+	return s.SaveSignedPreKey(ctx, types.UUIDKindACI, signedPreKeyRecord, false)
+}
+
+// libsignalgo.KyberPreKeyStore implementation
+
+func (s *Store) LoadKyberPreKey(ctx context.Context, id uint32) (*libsignalgo.KyberPreKeyRecord, error) {
+	return s.KyberPreKey(ctx, types.UUIDKindACI, int(id))
+}
+func (s *Store) StoreKyberPreKey(ctx context.Context, id uint32, kyberPreKeyRecord *libsignalgo.KyberPreKeyRecord) error {
+	return s.SaveKyberPreKey(ctx, types.UUIDKindACI, kyberPreKeyRecord, false)
+}
+func (s *Store) MarkKyberPreKeyUsed(ctx context.Context, id uint32) error {
+	isLastResort, err := s.IsKyberPreKeyLastResort(ctx, types.UUIDKindACI, int(id))
+	if err != nil {
+		return err
+	}
+	if !isLastResort {
+		return s.DeleteKyberPreKey(ctx, types.UUIDKindACI, int(id))
+	}
+	return nil
+}
+
+// store.PreKeyStoreExtras implementation
+
+func (s *Store) PreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) (*libsignalgo.PreKeyRecord, error) {
+	s.lock.RLock()
+	entry, ok := s.preKeys[preKeyKey{uuidKind, uint(preKeyID)}]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializePreKeyRecord(entry.record)
+}
+
+func (s *Store) SignedPreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) (*libsignalgo.SignedPreKeyRecord, error) {
+	s.lock.RLock()
+	entry, ok := s.signedPreKeys[preKeyKey{uuidKind, uint(preKeyID)}]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSignedPreKeyRecord(entry.record)
+}
+
+func (s *Store) KyberPreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) (*libsignalgo.KyberPreKeyRecord, error) {
+	s.lock.RLock()
+	entry, ok := s.kyberPreKeys[preKeyKey{uuidKind, uint(preKeyID)}]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeKyberPreKeyRecord(entry.record)
+}
+
+func (s *Store) SavePreKey(ctx context.Context, uuidKind types.UUIDKind, preKey *libsignalgo.PreKeyRecord, markUploaded bool) error {
+	id, err := preKey.GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get prekey ID: %w", err)
+	}
+	serialized, err := preKey.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize prekey: %w", err)
+	}
+	s.lock.Lock()
+	s.preKeys[preKeyKey{uuidKind, id}] = &preKeyEntry{record: serialized, uploaded: markUploaded}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) SaveSignedPreKey(ctx context.Context, uuidKind types.UUIDKind, preKey *libsignalgo.SignedPreKeyRecord, markUploaded bool) error {
+	id, err := preKey.GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get signed prekey ID: %w", err)
+	}
+	serialized, err := preKey.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize signed prekey: %w", err)
+	}
+	s.lock.Lock()
+	s.signedPreKeys[preKeyKey{uuidKind, id}] = &preKeyEntry{record: serialized, uploaded: markUploaded}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) SaveKyberPreKey(ctx context.Context, uuidKind types.UUIDKind, kyberPreKeyRecord *libsignalgo.KyberPreKeyRecord, lastResort bool) error {
+	id, err := kyberPreKeyRecord.GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get kyber prekey record ID: %w", err)
+	}
+	serialized, err := kyberPreKeyRecord.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize kyber prekey record: %w", err)
+	}
+	s.lock.Lock()
+	s.kyberPreKeys[preKeyKey{uuidKind, id}] = &kyberPreKeyEntry{record: serialized, lastResort: lastResort}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) DeletePreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) error {
+	s.lock.Lock()
+	delete(s.preKeys, preKeyKey{uuidKind, uint(preKeyID)})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) DeleteSignedPreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) error {
+	s.lock.Lock()
+	delete(s.signedPreKeys, preKeyKey{uuidKind, uint(preKeyID)})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) DeleteKyberPreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) error {
+	s.lock.Lock()
+	delete(s.kyberPreKeys, preKeyKey{uuidKind, uint(preKeyID)})
+	s.lock.Unlock()
+	return nil
+}
+
+// nextID returns one more than the highest ID of the given kind in the map, or 1 if there are no keys.
+func nextID[T any](keys map[preKeyKey]T, uuidKind types.UUIDKind) uint {
+	var lastID uint
+	for key := range keys {
+		if key.uuidKind == uuidKind && key.id > lastID {
+			lastID = key.id
+		}
+	}
+	return lastID + 1
+}
+
+func (s *Store) GetNextPreKeyID(ctx context.Context, uuidKind types.UUIDKind) (uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return nextID(s.preKeys, uuidKind), nil
+}
+
+func (s *Store) GetSignedNextPreKeyID(ctx context.Context, uuidKind types.UUIDKind) (uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return nextID(s.signedPreKeys, uuidKind), nil
+}
+
+func (s *Store) GetNextKyberPreKeyID(ctx context.Context, uuidKind types.UUIDKind) (uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return nextID(s.kyberPreKeys, uuidKind), nil
+}
+
+func setUploaded(keys map[preKeyKey]*preKeyEntry, uuidKind types.UUIDKind, upToID uint) {
+	for key, entry := range keys {
+		if key.uuidKind == uuidKind && key.id <= upToID {
+			entry.uploaded = true
+		}
+	}
+}
+
+func (s *Store) MarkPreKeysAsUploaded(ctx context.Context, uuidKind types.UUIDKind, upToID uint) error {
+	s.lock.Lock()
+	setUploaded(s.preKeys, uuidKind, upToID)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) MarkSignedPreKeysAsUploaded(ctx context.Context, uuidKind types.UUIDKind, upToID uint) error {
+	s.lock.Lock()
+	setUploaded(s.signedPreKeys, uuidKind, upToID)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Store) IsKyberPreKeyLastResort(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) (bool, error) {
+	s.lock.RLock()
+	entry, ok := s.kyberPreKeys[preKeyKey{uuidKind, uint(preKeyID)}]
+	s.lock.RUnlock()
+	if !ok {
+		return false, fmt.Errorf("kyber prekey %d not found", preKeyID)
+	}
+	return entry.lastResort, nil
+}
+
+func (s *Store) AllPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.PreKeyRecord, error) {
+	s.lock.RLock()
+	var serialized [][]byte
+	for key, entry := range s.preKeys {
+		if key.uuidKind == uuidKind && entry.replacedAt == 0 {
+			serialized = append(serialized, entry.record)
+		}
+	}
+	s.lock.RUnlock()
+	records := make([]*libsignalgo.PreKeyRecord, len(serialized))
+	for i, record := range serialized {
+		var err error
+		records[i], err = libsignalgo.DeserializePreKeyRecord(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (s *Store) AllNormalKyberPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.KyberPreKeyRecord, error) {
+	s.lock.RLock()
+	var serialized [][]byte
+	for key, entry := range s.kyberPreKeys {
+		if key.uuidKind == uuidKind && !entry.lastResort && entry.replacedAt == 0 {
+			serialized = append(serialized, entry.record)
+		}
+	}
+	s.lock.RUnlock()
+	records := make([]*libsignalgo.KyberPreKeyRecord, len(serialized))
+	for i, record := range serialized {
+		var err error
+		records[i], err = libsignalgo.DeserializeKyberPreKeyRecord(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (s *Store) DeleteAllPreKeys(ctx context.Context) error {
+	s.lock.Lock()
+	s.preKeys = make(map[preKeyKey]*preKeyEntry)
+	s.signedPreKeys = make(map[preKeyKey]*preKeyEntry)
+	s.kyberPreKeys = make(map[preKeyKey]*kyberPreKeyEntry)
+	s.lock.Unlock()
+	return nil
+}
+
+// currentKey finds the entry with the highest ID of the given kind that matches the filter and hasn't been replaced.
+func currentKey[T any](keys map[preKeyKey]T, uuidKind types.UUIDKind, filter func(T) bool) (current T, found bool) {
+	var currentID uint
+	for key, entry := range keys {
+		if key.uuidKind == uuidKind && filter(entry) && (!found || key.id > currentID) {
+			current, currentID, found = entry, key.id, true
+		}
+	}
+	return
+}
+
+func (s *Store) CurrentSignedPreKey(ctx context.Context, uuidKind types.UUIDKind) (*libsignalgo.SignedPreKeyRecord, error) {
+	s.lock.RLock()
+	entry, ok := currentKey(s.signedPreKeys, uuidKind, func(entry *preKeyEntry) bool {
+		return entry.replacedAt == 0
+	})
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeSignedPreKeyRecord(entry.record)
+}
+
+func (s *Store) CurrentLastResortKyberPreKey(ctx context.Context, uuidKind types.UUIDKind) (*libsignalgo.KyberPreKeyRecord, error) {
+	s.lock.RLock()
+	entry, ok := currentKey(s.kyberPreKeys, uuidKind, func(entry *kyberPreKeyEntry) bool {
+		return entry.lastResort && entry.replacedAt == 0
+	})
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return libsignalgo.DeserializeKyberPreKeyRecord(entry.record)
+}
+
+func (s *Store) MarkPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, beforeID uint, replacedAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, entry := range s.preKeys {
+		if key.uuidKind == uuidKind && key.id < beforeID && entry.replacedAt == 0 {
+			entry.replacedAt = replacedAt.UnixMilli()
+		}
+	}
+	return nil
+}
+
+func (s *Store) MarkKyberPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, beforeID uint, replacedAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, entry := range s.kyberPreKeys {
+		if key.uuidKind == uuidKind && key.id < beforeID && !entry.lastResort && entry.replacedAt == 0 {
+			entry.replacedAt = replacedAt.UnixMilli()
+		}
+	}
+	return nil
+}
+
+func (s *Store) MarkSignedPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, currentID uint, replacedAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, entry := range s.signedPreKeys {
+		if key.uuidKind == uuidKind && key.id != currentID && entry.replacedAt == 0 {
+			entry.replacedAt = replacedAt.UnixMilli()
+		}
+	}
+	return nil
+}
+
+func (s *Store) MarkLastResortKyberPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, currentID uint, replacedAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, entry := range s.kyberPreKeys {
+		if key.uuidKind == uuidKind && key.id != currentID && entry.lastResort && entry.replacedAt == 0 {
+			entry.replacedAt = replacedAt.UnixMilli()
+		}
+	}
+	return nil
+}
+
+func (s *Store) DeleteReplacedPreKeys(ctx context.Context, replacedBefore time.Time) (int64, error) {
+	cutoff := replacedBefore.UnixMilli()
+	isExpired := func(replacedAt int64) bool {
+		return replacedAt != 0 && replacedAt < cutoff
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var deleted int64
+	for _, keys := range []map[preKeyKey]*preKeyEntry{s.preKeys, s.signedPreKeys} {
+		for key, entry := range keys {
+			if isExpired(entry.replacedAt) {
+				delete(keys, key)
+				deleted++
+			}
+		}
+	}
+	for key, entry := range s.kyberPreKeys {
+		if isExpired(entry.replacedAt) {
+			delete(s.kyberPreKeys, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
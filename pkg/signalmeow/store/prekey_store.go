@@ -21,6 +21,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"go.mau.fi/util/dbutil"
 
@@ -54,6 +55,22 @@ type PreKeyStoreExtras interface {
 	AllPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.PreKeyRecord, error)
 	AllNormalKyberPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.KyberPreKeyRecord, error)
 	DeleteAllPreKeys(ctx context.Context) error
+
+	// CurrentSignedPreKey returns the newest signed prekey that hasn't been replaced, or nil if there are none.
+	CurrentSignedPreKey(ctx context.Context, uuidKind types.UUIDKind) (*libsignalgo.SignedPreKeyRecord, error)
+	// CurrentLastResortKyberPreKey returns the newest last resort kyber prekey that hasn't been replaced, or nil if there are none.
+	CurrentLastResortKyberPreKey(ctx context.Context, uuidKind types.UUIDKind) (*libsignalgo.KyberPreKeyRecord, error)
+	// MarkPreKeysReplaced marks one-time prekeys with an ID lower than beforeID as replaced.
+	MarkPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, beforeID uint, replacedAt time.Time) error
+	// MarkKyberPreKeysReplaced marks normal kyber prekeys with an ID lower than beforeID as replaced.
+	MarkKyberPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, beforeID uint, replacedAt time.Time) error
+	// MarkSignedPreKeysReplaced marks all signed prekeys except the one with the given ID as replaced.
+	MarkSignedPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, currentID uint, replacedAt time.Time) error
+	// MarkLastResortKyberPreKeysReplaced marks all last resort kyber prekeys except the one with the given ID as replaced.
+	MarkLastResortKyberPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, currentID uint, replacedAt time.Time) error
+	// DeleteReplacedPreKeys deletes all kinds of prekeys that were replaced before the given time,
+	// and returns the number of deleted keys.
+	DeleteReplacedPreKeys(ctx context.Context, replacedBefore time.Time) (int64, error)
 }
 
 // libsignalgo.PreKeyStore implementation
@@ -117,6 +134,10 @@ func (s *SQLStore) KyberPreKey(ctx context.Context, uuidKind types.UUIDKind, pre
 	if err != nil {
 		return nil, err
 	}
+	record, err = s.decrypt(kyberPreKeyPairColumn, rowKey{s.ACI, uuidKind, preKeyID}, record)
+	if err != nil {
+		return nil, err
+	}
 	return libsignalgo.DeserializeKyberPreKeyRecord(record)
 }
 
@@ -129,6 +150,10 @@ func (s *SQLStore) SaveKyberPreKey(ctx context.Context, uuidKind types.UUIDKind,
 	if err != nil {
 		return fmt.Errorf("failed to serialize kyber prekey record: %w", err)
 	}
+	serialized, err = s.encrypt(kyberPreKeyPairColumn, rowKey{s.ACI, uuidKind, id}, serialized)
+	if err != nil {
+		return err
+	}
 	_, err = s.db.Exec(ctx, insertKyberPreKeyQuery, s.ACI, id, uuidKind, serialized, lastResort)
 	return err
 }
@@ -166,7 +191,9 @@ const (
 	getUploadedPreKeyCountQuery = `SELECT COUNT(*) FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND uploaded=true`
 )
 
-func scanPreKey(row dbutil.Scannable) (*libsignalgo.PreKeyRecord, error) {
+// scanPreKeyPair scans the ID and key pair of a prekey row and decrypts the key pair.
+// It returns nil if there are no rows.
+func (s *SQLStore) scanPreKeyPair(row dbutil.Scannable, uuidKind types.UUIDKind, isSigned bool) ([]byte, error) {
 	var id uint
 	var record []byte
 	err := row.Scan(&id, &record)
@@ -175,27 +202,33 @@ func scanPreKey(row dbutil.Scannable) (*libsignalgo.PreKeyRecord, error) {
 	} else if err != nil {
 		return nil, err
 	}
-	return libsignalgo.DeserializePreKeyRecord(record)
+	return s.decrypt(preKeyPairColumn, rowKey{s.ACI, uuidKind, isSigned, id}, record)
 }
 
-func scanSignedPreKey(row dbutil.Scannable) (*libsignalgo.SignedPreKeyRecord, error) {
-	var id uint
-	var record []byte
-	err := row.Scan(&id, &record)
-	if errors.Is(err, sql.ErrNoRows) {
-		return nil, nil
-	} else if err != nil {
+func (s *SQLStore) scanPreKey(uuidKind types.UUIDKind) func(row dbutil.Scannable) (*libsignalgo.PreKeyRecord, error) {
+	return func(row dbutil.Scannable) (*libsignalgo.PreKeyRecord, error) {
+		record, err := s.scanPreKeyPair(row, uuidKind, false)
+		if err != nil || record == nil {
+			return nil, err
+		}
+		return libsignalgo.DeserializePreKeyRecord(record)
+	}
+}
+
+func (s *SQLStore) scanSignedPreKey(row dbutil.Scannable, uuidKind types.UUIDKind) (*libsignalgo.SignedPreKeyRecord, error) {
+	record, err := s.scanPreKeyPair(row, uuidKind, true)
+	if err != nil || record == nil {
 		return nil, err
 	}
 	return libsignalgo.DeserializeSignedPreKeyRecord(record)
 }
 
 func (s *SQLStore) PreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) (*libsignalgo.PreKeyRecord, error) {
-	return scanPreKey(s.db.QueryRow(ctx, getPreKeyQuery, s.ACI, preKeyID, uuidKind, false))
+	return s.scanPreKey(uuidKind)(s.db.QueryRow(ctx, getPreKeyQuery, s.ACI, preKeyID, uuidKind, false))
 }
 
 func (s *SQLStore) SignedPreKey(ctx context.Context, uuidKind types.UUIDKind, preKeyID int) (*libsignalgo.SignedPreKeyRecord, error) {
-	return scanSignedPreKey(s.db.QueryRow(ctx, getPreKeyQuery, s.ACI, preKeyID, uuidKind, true))
+	return s.scanSignedPreKey(s.db.QueryRow(ctx, getPreKeyQuery, s.ACI, preKeyID, uuidKind, true), uuidKind)
 }
 
 func (s *SQLStore) SavePreKey(ctx context.Context, uuidKind types.UUIDKind, preKey *libsignalgo.PreKeyRecord, markUploaded bool) error {
@@ -207,6 +240,10 @@ func (s *SQLStore) SavePreKey(ctx context.Context, uuidKind types.UUIDKind, preK
 	if err != nil {
 		return fmt.Errorf("failed to serialize prekey: %w", err)
 	}
+	serialized, err = s.encrypt(preKeyPairColumn, rowKey{s.ACI, uuidKind, false, id}, serialized)
+	if err != nil {
+		return err
+	}
 	_, err = s.db.Exec(ctx, insertPreKeyQuery, s.ACI, id, uuidKind, false, serialized, markUploaded)
 	return err
 }
@@ -220,6 +257,10 @@ func (s *SQLStore) SaveSignedPreKey(ctx context.Context, uuidKind types.UUIDKind
 	if err != nil {
 		return fmt.Errorf("failed to serialize signed prekey: %w", err)
 	}
+	serialized, err = s.encrypt(preKeyPairColumn, rowKey{s.ACI, uuidKind, true, id}, serialized)
+	if err != nil {
+		return err
+	}
 	_, err = s.db.Exec(ctx, insertPreKeyQuery, s.ACI, id, uuidKind, true, serialized, markUploaded)
 	return err
 }
@@ -274,7 +315,7 @@ func (s *SQLStore) DeleteAllPreKeys(ctx context.Context) error {
 }
 
 func (s *SQLStore) AllPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.PreKeyRecord, error) {
-	queryString := "SELECT key_id, key_pair FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3"
+	queryString := "SELECT key_id, key_pair FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND replaced_at IS NULL"
 	rows, err := s.db.Query(ctx, queryString, s.ACI, uuidKind, false)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
@@ -282,11 +323,11 @@ func (s *SQLStore) AllPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*
 	if err != nil {
 		return nil, err
 	}
-	return dbutil.NewRowIter(rows, scanPreKey).AsList()
+	return dbutil.NewRowIter(rows, s.scanPreKey(uuidKind)).AsList()
 }
 
 func (s *SQLStore) AllNormalKyberPreKeys(ctx context.Context, uuidKind types.UUIDKind) ([]*libsignalgo.KyberPreKeyRecord, error) {
-	queryString := "SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=false"
+	queryString := "SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=false AND replaced_at IS NULL"
 	rows, err := s.db.Query(ctx, queryString, s.ACI, uuidKind)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
@@ -300,6 +341,99 @@ func (s *SQLStore) AllNormalKyberPreKeys(ctx context.Context, uuidKind types.UUI
 		if err != nil {
 			return nil, err
 		}
+		record, err = s.decrypt(kyberPreKeyPairColumn, rowKey{s.ACI, uuidKind, id}, record)
+		if err != nil {
+			return nil, err
+		}
 		return libsignalgo.DeserializeKyberPreKeyRecord(record)
 	}).AsList()
 }
+
+const (
+	getCurrentSignedPreKeyQuery = `
+		SELECT key_id, key_pair FROM signalmeow_pre_keys
+		WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=true AND replaced_at IS NULL
+		ORDER BY key_id DESC LIMIT 1
+	`
+	getCurrentLastResortKyberPreKeyQuery = `
+		SELECT key_id, key_pair FROM signalmeow_kyber_pre_keys
+		WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=true AND replaced_at IS NULL
+		ORDER BY key_id DESC LIMIT 1
+	`
+	markPreKeysReplacedQuery = `
+		UPDATE signalmeow_pre_keys SET replaced_at=$5
+		WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=$3 AND key_id<$4 AND replaced_at IS NULL
+	`
+	markSignedPreKeysReplacedQuery = `
+		UPDATE signalmeow_pre_keys SET replaced_at=$4
+		WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_signed=true AND key_id<>$3 AND replaced_at IS NULL
+	`
+	markKyberPreKeysReplacedQuery = `
+		UPDATE signalmeow_kyber_pre_keys SET replaced_at=$4
+		WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=false AND key_id<$3 AND replaced_at IS NULL
+	`
+	markLastResortKyberPreKeysReplacedQuery = `
+		UPDATE signalmeow_kyber_pre_keys SET replaced_at=$4
+		WHERE aci_uuid=$1 AND uuid_kind=$2 AND is_last_resort=true AND key_id<>$3 AND replaced_at IS NULL
+	`
+	deleteReplacedPreKeysQuery      = `DELETE FROM signalmeow_pre_keys WHERE aci_uuid=$1 AND replaced_at<$2`
+	deleteReplacedKyberPreKeysQuery = `DELETE FROM signalmeow_kyber_pre_keys WHERE aci_uuid=$1 AND replaced_at<$2`
+)
+
+func (s *SQLStore) CurrentSignedPreKey(ctx context.Context, uuidKind types.UUIDKind) (*libsignalgo.SignedPreKeyRecord, error) {
+	return s.scanSignedPreKey(s.db.QueryRow(ctx, getCurrentSignedPreKeyQuery, s.ACI, uuidKind), uuidKind)
+}
+
+func (s *SQLStore) CurrentLastResortKyberPreKey(ctx context.Context, uuidKind types.UUIDKind) (*libsignalgo.KyberPreKeyRecord, error) {
+	var id uint
+	var record []byte
+	err := s.db.QueryRow(ctx, getCurrentLastResortKyberPreKeyQuery, s.ACI, uuidKind).Scan(&id, &record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	record, err = s.decrypt(kyberPreKeyPairColumn, rowKey{s.ACI, uuidKind, id}, record)
+	if err != nil {
+		return nil, err
+	}
+	return libsignalgo.DeserializeKyberPreKeyRecord(record)
+}
+
+func (s *SQLStore) MarkPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, beforeID uint, replacedAt time.Time) error {
+	_, err := s.db.Exec(ctx, markPreKeysReplacedQuery, s.ACI, uuidKind, false, beforeID, replacedAt.UnixMilli())
+	return err
+}
+
+func (s *SQLStore) MarkKyberPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, beforeID uint, replacedAt time.Time) error {
+	_, err := s.db.Exec(ctx, markKyberPreKeysReplacedQuery, s.ACI, uuidKind, beforeID, replacedAt.UnixMilli())
+	return err
+}
+
+func (s *SQLStore) MarkSignedPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, currentID uint, replacedAt time.Time) error {
+	_, err := s.db.Exec(ctx, markSignedPreKeysReplacedQuery, s.ACI, uuidKind, currentID, replacedAt.UnixMilli())
+	return err
+}
+
+func (s *SQLStore) MarkLastResortKyberPreKeysReplaced(ctx context.Context, uuidKind types.UUIDKind, currentID uint, replacedAt time.Time) error {
+	_, err := s.db.Exec(ctx, markLastResortKyberPreKeysReplacedQuery, s.ACI, uuidKind, currentID, replacedAt.UnixMilli())
+	return err
+}
+
+func (s *SQLStore) DeleteReplacedPreKeys(ctx context.Context, replacedBefore time.Time) (deleted int64, err error) {
+	err = s.db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, query := range []string{deleteReplacedPreKeysQuery, deleteReplacedKyberPreKeysQuery} {
+			res, err := s.db.Exec(ctx, query, s.ACI, replacedBefore.UnixMilli())
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += affected
+		}
+		return nil
+	})
+	return
+}
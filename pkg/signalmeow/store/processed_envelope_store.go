@@ -0,0 +1,71 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var _ ProcessedEnvelopeStore = (*SQLStore)(nil)
+
+type ProcessedEnvelopeStore interface {
+	// IsEnvelopeProcessed checks if an envelope with the given server GUID has already been handled.
+	IsEnvelopeProcessed(ctx context.Context, serverGUID string) (bool, error)
+	// PutProcessedEnvelope marks the envelope with the given server GUID as handled.
+	PutProcessedEnvelope(ctx context.Context, serverGUID string, serverTimestamp uint64) error
+	// PruneProcessedEnvelopes deletes everything except the newest keep envelopes (by server timestamp).
+	PruneProcessedEnvelopes(ctx context.Context, keep int) error
+}
+
+const (
+	isEnvelopeProcessedQuery  = `SELECT 1 FROM signalmeow_processed_envelopes WHERE our_aci_uuid=$1 AND server_guid=$2`
+	putProcessedEnvelopeQuery = `
+		INSERT INTO signalmeow_processed_envelopes (our_aci_uuid, server_guid, server_timestamp)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (our_aci_uuid, server_guid) DO NOTHING
+	`
+	pruneProcessedEnvelopesQuery = `
+		DELETE FROM signalmeow_processed_envelopes
+		WHERE our_aci_uuid=$1 AND server_timestamp < (
+			SELECT server_timestamp FROM signalmeow_processed_envelopes
+			WHERE our_aci_uuid=$1
+			ORDER BY server_timestamp DESC
+			LIMIT 1 OFFSET $2
+		)
+	`
+)
+
+func (s *SQLStore) IsEnvelopeProcessed(ctx context.Context, serverGUID string) (bool, error) {
+	var exists int
+	err := s.db.QueryRow(ctx, isEnvelopeProcessedQuery, s.ACI, serverGUID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLStore) PutProcessedEnvelope(ctx context.Context, serverGUID string, serverTimestamp uint64) error {
+	_, err := s.db.Exec(ctx, putProcessedEnvelopeQuery, s.ACI, serverGUID, int64(serverTimestamp))
+	return err
+}
+
+func (s *SQLStore) PruneProcessedEnvelopes(ctx context.Context, keep int) error {
+	_, err := s.db.Exec(ctx, pruneProcessedEnvelopesQuery, s.ACI, keep)
+	return err
+}
@@ -42,7 +42,7 @@ const (
 	storeProfileKeyQuery = `INSERT INTO signalmeow_profile_keys (our_aci_uuid, their_aci_uuid, key) VALUES ($1, $2, $3) ON CONFLICT (our_aci_uuid, their_aci_uuid) DO UPDATE SET key=excluded.key`
 )
 
-func scanProfileKey(row dbutil.Scannable) (*libsignalgo.ProfileKey, error) {
+func (s *SQLStore) scanProfileKey(row dbutil.Scannable, theirACI uuid.UUID) (*libsignalgo.ProfileKey, error) {
 	var record []byte
 	err := row.Scan(&record)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -50,19 +50,27 @@ func scanProfileKey(row dbutil.Scannable) (*libsignalgo.ProfileKey, error) {
 	} else if err != nil {
 		return nil, err
 	}
+	record, err = s.decrypt(profileKeyColumn, rowKey{s.ACI, theirACI}, record)
+	if err != nil {
+		return nil, err
+	}
 	profileKey := libsignalgo.ProfileKey(record)
 	return &profileKey, err
 }
 
 func (s *SQLStore) LoadProfileKey(ctx context.Context, theirACI uuid.UUID) (*libsignalgo.ProfileKey, error) {
-	return scanProfileKey(s.db.QueryRow(ctx, loadProfileKeyQuery, s.ACI, theirACI))
+	return s.scanProfileKey(s.db.QueryRow(ctx, loadProfileKeyQuery, s.ACI, theirACI), theirACI)
 }
 
 func (s *SQLStore) MyProfileKey(ctx context.Context) (*libsignalgo.ProfileKey, error) {
-	return scanProfileKey(s.db.QueryRow(ctx, loadProfileKeyQuery, s.ACI, s.ACI))
+	return s.scanProfileKey(s.db.QueryRow(ctx, loadProfileKeyQuery, s.ACI, s.ACI), s.ACI)
 }
 
 func (s *SQLStore) StoreProfileKey(ctx context.Context, theirACI uuid.UUID, key libsignalgo.ProfileKey) error {
-	_, err := s.db.Exec(ctx, storeProfileKeyQuery, s.ACI, theirACI, key.Slice())
+	encrypted, err := s.encrypt(profileKeyColumn, rowKey{s.ACI, theirACI}, key.Slice())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(ctx, storeProfileKeyQuery, s.ACI, theirACI, encrypted)
 	return err
 }
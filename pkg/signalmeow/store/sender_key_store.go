@@ -35,15 +35,19 @@ const (
 	storeSenderKeyQuery = `INSERT INTO signalmeow_sender_keys (our_aci_uuid, sender_uuid, sender_device_id, distribution_id, key_record) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (our_aci_uuid, sender_uuid, sender_device_id, distribution_id) DO UPDATE SET key_record=excluded.key_record`
 )
 
-func scanSenderKey(row dbutil.Scannable) (*libsignalgo.SenderKeyRecord, error) {
-	var key []byte
-	err := row.Scan(&key)
+func (s *SQLStore) scanSenderKey(row dbutil.Scannable, key rowKey) (*libsignalgo.SenderKeyRecord, error) {
+	var record []byte
+	err := row.Scan(&record)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-	return libsignalgo.DeserializeSenderKeyRecord(key)
+	record, err = s.decrypt(senderKeyRecordColumn, key, record)
+	if err != nil {
+		return nil, err
+	}
+	return libsignalgo.DeserializeSenderKeyRecord(record)
 }
 
 func (s *SQLStore) LoadSenderKey(ctx context.Context, sender *libsignalgo.Address, distributionID uuid.UUID) (*libsignalgo.SenderKeyRecord, error) {
@@ -55,7 +59,7 @@ func (s *SQLStore) LoadSenderKey(ctx context.Context, sender *libsignalgo.Addres
 	if err != nil {
 		return nil, fmt.Errorf("failed to get sender device ID: %w", err)
 	}
-	return scanSenderKey(s.db.QueryRow(ctx, loadSenderKeyQuery, s.ACI, senderUUID, deviceID, distributionID))
+	return s.scanSenderKey(s.db.QueryRow(ctx, loadSenderKeyQuery, s.ACI, senderUUID, deviceID, distributionID), rowKey{s.ACI, senderUUID, deviceID, distributionID})
 }
 
 func (s *SQLStore) StoreSenderKey(ctx context.Context, sender *libsignalgo.Address, distributionID uuid.UUID, record *libsignalgo.SenderKeyRecord) error {
@@ -71,6 +75,10 @@ func (s *SQLStore) StoreSenderKey(ctx context.Context, sender *libsignalgo.Addre
 	if err != nil {
 		return fmt.Errorf("failed to serialize sender key: %w", err)
 	}
+	serialized, err = s.encrypt(senderKeyRecordColumn, rowKey{s.ACI, senderUUID, deviceID, distributionID}, serialized)
+	if err != nil {
+		return err
+	}
 	_, err = s.db.Exec(ctx, storeSenderKeyQuery, s.ACI, senderUUID, deviceID, distributionID, serialized)
 	return err
 }
@@ -45,9 +45,12 @@ type SessionStoreExtras interface {
 	RemoveSession(ctx context.Context, address *libsignalgo.Address) error
 	// RemoveAllSessions removes all sessions for our ACI UUID
 	RemoveAllSessions(ctx context.Context) error
+	// ArchiveSessions archives the current state of all sessions with the given UUID,
+	// so that the next message has to start a new session.
+	ArchiveSessions(ctx context.Context, theirUUID uuid.UUID) error
 }
 
-func scanRecord(row dbutil.Scannable) (int, *libsignalgo.SessionRecord, error) {
+func (s *SQLStore) scanRecord(row dbutil.Scannable, theirUUID string) (int, *libsignalgo.SessionRecord, error) {
 	var record []byte
 	var deviceId int
 	err := row.Scan(&deviceId, &record)
@@ -56,6 +59,10 @@ func scanRecord(row dbutil.Scannable) (int, *libsignalgo.SessionRecord, error) {
 	} else if err != nil {
 		return 0, nil, err
 	}
+	record, err = s.decrypt(sessionRecordColumn, rowKey{s.ACI, theirUUID, deviceId}, record)
+	if err != nil {
+		return 0, nil, err
+	}
 	sessionRecord, err := libsignalgo.DeserializeSessionRecord(record)
 	return deviceId, sessionRecord, err
 }
@@ -82,7 +89,7 @@ func (s *SQLStore) AllSessionsForUUID(ctx context.Context, theirUUID uuid.UUID)
 	var records []*libsignalgo.SessionRecord
 	var addresses []*libsignalgo.Address
 	for rows.Next() {
-		deviceId, record, err := scanRecord(rows)
+		deviceId, record, err := s.scanRecord(rows, theirUUID.String())
 		if err != nil {
 			return nil, nil, err
 		}
@@ -105,7 +112,7 @@ func (s *SQLStore) LoadSession(ctx context.Context, address *libsignalgo.Address
 	if err != nil {
 		return nil, fmt.Errorf("failed to get their device ID: %w", err)
 	}
-	_, record, err := scanRecord(s.db.QueryRow(ctx, loadSessionQuery, s.ACI, theirUUID, deviceID))
+	_, record, err := s.scanRecord(s.db.QueryRow(ctx, loadSessionQuery, s.ACI, theirUUID, deviceID), theirUUID)
 	return record, err
 }
 
@@ -122,6 +129,10 @@ func (s *SQLStore) StoreSession(ctx context.Context, address *libsignalgo.Addres
 	if err != nil {
 		return fmt.Errorf("failed to serialize session record: %w", err)
 	}
+	serialized, err = s.encrypt(sessionRecordColumn, rowKey{s.ACI, theirUUID, deviceID}, serialized)
+	if err != nil {
+		return err
+	}
 	_, err = s.db.Exec(ctx, storeSessionQuery, s.ACI, theirUUID, deviceID, serialized)
 	return err
 }
@@ -130,3 +141,21 @@ func (s *SQLStore) RemoveAllSessions(ctx context.Context) error {
 	_, err := s.db.Exec(ctx, "DELETE FROM signalmeow_sessions WHERE our_aci_uuid=$1", s.ACI)
 	return err
 }
+
+func (s *SQLStore) ArchiveSessions(ctx context.Context, theirUUID uuid.UUID) error {
+	addresses, records, err := s.AllSessionsForUUID(ctx, theirUUID)
+	if err != nil {
+		return fmt.Errorf("failed to get sessions: %w", err)
+	}
+	for i, record := range records {
+		err = record.ArchiveCurrentState()
+		if err != nil {
+			return fmt.Errorf("failed to archive session: %w", err)
+		}
+		err = s.StoreSession(ctx, addresses[i], record)
+		if err != nil {
+			return fmt.Errorf("failed to store archived session: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store/storetest"
+)
+
+func newContainer(t *testing.T) (*store.StoreContainer, *dbutil.Database) {
+	db, err := dbutil.NewWithDialect("file:"+filepath.Join(t.TempDir(), "signalmeow.db")+"?_foreign_keys=on", "sqlite3")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	container := store.NewStore(db, dbutil.NoopLogger)
+	require.NoError(t, container.Upgrade(context.Background()))
+	return container, db
+}
+
+func newSQLDevice(t *testing.T, container *store.StoreContainer, data store.DeviceData) *store.Device {
+	ctx := context.Background()
+	require.NoError(t, container.PutDevice(ctx, &data))
+	device, err := container.DeviceByACI(ctx, data.ACI)
+	require.NoError(t, err)
+	require.NotNil(t, device)
+	return device
+}
+
+func TestSQLStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, data store.DeviceData) *store.Device {
+		container, _ := newContainer(t)
+		return newSQLDevice(t, container, data)
+	})
+}
+
+func TestEncryptedSQLStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, data store.DeviceData) *store.Device {
+		container, _ := newContainer(t)
+		require.NoError(t, container.SetEncryptionKey(random.Bytes(store.EncryptionKeyLength)))
+		require.NoError(t, container.MigrateEncryption(context.Background()))
+		return newSQLDevice(t, container, data)
+	})
+}
+
+func TestMigrateEncryption(t *testing.T) {
+	ctx := context.Background()
+	container, db := newContainer(t)
+	data := storetest.NewDeviceData(t)
+	device := newSQLDevice(t, container, data)
+	theirACI := uuid.New()
+	profileKey := libsignalgo.ProfileKey(random.Bytes(len(libsignalgo.ProfileKey{})))
+	require.NoError(t, device.ProfileKeyStore.StoreProfileKey(ctx, theirACI, profileKey))
+	getRawValues := func() (password string, rawProfileKey []byte) {
+		require.NoError(t, db.QueryRow(ctx, "SELECT password FROM signalmeow_device").Scan(&password))
+		require.NoError(t, db.QueryRow(ctx, "SELECT key FROM signalmeow_profile_keys").Scan(&rawProfileKey))
+		return
+	}
+	assertReadable := func() {
+		device, err := container.DeviceByACI(ctx, data.ACI)
+		require.NoError(t, err)
+		require.NotNil(t, device)
+		assert.Equal(t, data.Password, device.Password)
+		loadedKey, err := device.ProfileKeyStore.LoadProfileKey(ctx, theirACI)
+		require.NoError(t, err)
+		require.NotNil(t, loadedKey)
+		assert.Equal(t, profileKey, *loadedKey)
+	}
+
+	// Existing plaintext rows are encrypted
+	oldKey := random.Bytes(store.EncryptionKeyLength)
+	require.NoError(t, container.SetEncryptionKey(oldKey))
+	require.NoError(t, container.MigrateEncryption(ctx))
+	password, rawProfileKey := getRawValues()
+	assert.NotEqual(t, data.Password, password)
+	assert.NotEqual(t, profileKey.Slice(), rawProfileKey)
+	assertReadable()
+
+	// Encrypted values can't be moved to another row
+	otherACI := uuid.New()
+	_, err := db.Exec(ctx, "INSERT INTO signalmeow_profile_keys (our_aci_uuid, their_aci_uuid, key) VALUES ($1, $2, $3)", data.ACI, otherACI, rawProfileKey)
+	require.NoError(t, err)
+	_, err = device.ProfileKeyStore.LoadProfileKey(ctx, otherACI)
+	assert.ErrorIs(t, err, store.ErrDecryptionFailed)
+	_, err = db.Exec(ctx, "DELETE FROM signalmeow_profile_keys WHERE their_aci_uuid=$1", otherACI)
+	require.NoError(t, err)
+
+	// Rotating the key requires the old key once
+	newKey := random.Bytes(store.EncryptionKeyLength)
+	require.NoError(t, container.SetEncryptionKey(newKey, oldKey))
+	require.NoError(t, container.MigrateEncryption(ctx))
+	newPassword, _ := getRawValues()
+	assert.NotEqual(t, password, newPassword)
+	require.NoError(t, container.SetEncryptionKey(newKey))
+	require.NoError(t, container.MigrateEncryption(ctx))
+	assertReadable()
+
+	require.NoError(t, container.SetEncryptionKey(oldKey))
+	assert.ErrorIs(t, container.MigrateEncryption(ctx), store.ErrUnknownEncryptionKey)
+	_, err = container.DeviceByACI(ctx, data.ACI)
+	assert.ErrorIs(t, err, store.ErrUnknownEncryptionKey)
+	require.NoError(t, container.SetEncryptionKey(nil))
+	assert.ErrorIs(t, container.MigrateEncryption(ctx), store.ErrEncryptionKeyRequired)
+
+	// Encryption can be disabled by migrating without a current key
+	require.NoError(t, container.SetEncryptionKey(nil, newKey))
+	require.NoError(t, container.MigrateEncryption(ctx))
+	password, rawProfileKey = getRawValues()
+	assert.Equal(t, data.Password, password)
+	assert.Equal(t, profileKey.Slice(), rawProfileKey)
+	require.NoError(t, container.SetEncryptionKey(nil))
+	assertReadable()
+
+	assert.ErrorIs(t, container.SetEncryptionKey([]byte("too short")), store.ErrInvalidEncryptionKey)
+}
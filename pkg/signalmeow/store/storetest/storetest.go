@@ -0,0 +1,842 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package storetest contains a test suite for implementations of the signalmeow store interfaces.
+// Every implementation is expected to pass it, so that they can be used interchangeably.
+package storetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+// DeviceFactory creates a device with the given data, with all of its store interfaces backed by a fresh,
+// empty store. The device data must already be persisted, i.e. DeviceStore.DeviceByACI must return it.
+type DeviceFactory func(t *testing.T, data store.DeviceData) *store.Device
+
+// Run runs the full test suite against the store implementation created by newDevice.
+func Run(t *testing.T, newDevice DeviceFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, ctx context.Context, device *store.Device)
+	}{
+		{"Device", testDevice},
+		{"IdentityKeys", testIdentityKeys},
+		{"PreKeys", testPreKeys},
+		{"SignedPreKeys", testSignedPreKeys},
+		{"KyberPreKeys", testKyberPreKeys},
+		{"DeleteAllPreKeys", testDeleteAllPreKeys},
+		{"ReplacedPreKeys", testReplacedPreKeys},
+		{"Sessions", testSessions},
+		{"SenderKeys", testSenderKeys},
+		{"ProfileKeys", testProfileKeys},
+		{"Groups", testGroups},
+		{"Contacts", testContacts},
+		{"Inbox", testInbox},
+		{"ProcessedEnvelopes", testProcessedEnvelopes},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, context.Background(), newDevice(t, NewDeviceData(t)))
+		})
+	}
+}
+
+// NewDeviceData generates data for a new device with random identifiers and identity keys.
+func NewDeviceData(t *testing.T) store.DeviceData {
+	aciIdentityKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	require.NoError(t, err)
+	pniIdentityKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	require.NoError(t, err)
+	return store.DeviceData{
+		ACIIdentityKeyPair: aciIdentityKeyPair,
+		PNIIdentityKeyPair: pniIdentityKeyPair,
+		RegistrationID:     1234,
+		PNIRegistrationID:  5678,
+		ACI:                uuid.New(),
+		PNI:                uuid.New(),
+		DeviceID:           2,
+		Number:             "+15550000000",
+		Password:           "hunter2",
+	}
+}
+
+func serialize(t *testing.T, obj interface{ Serialize() ([]byte, error) }) []byte {
+	serialized, err := obj.Serialize()
+	require.NoError(t, err)
+	return serialized
+}
+
+func newAddress(t *testing.T, theirUUID uuid.UUID, deviceID uint) *libsignalgo.Address {
+	address, err := libsignalgo.NewUUIDAddress(theirUUID, deviceID)
+	require.NoError(t, err)
+	return address
+}
+
+func newPreKey(t *testing.T, id uint32) *libsignalgo.PreKeyRecord {
+	privateKey, err := libsignalgo.GeneratePrivateKey()
+	require.NoError(t, err)
+	record, err := libsignalgo.NewPreKeyRecordFromPrivateKey(id, privateKey)
+	require.NoError(t, err)
+	return record
+}
+
+func newSignedPreKey(t *testing.T, id uint32, identityKeyPair *libsignalgo.IdentityKeyPair) *libsignalgo.SignedPreKeyRecord {
+	privateKey, err := libsignalgo.GeneratePrivateKey()
+	require.NoError(t, err)
+	publicKey, err := privateKey.GetPublicKey()
+	require.NoError(t, err)
+	signature, err := identityKeyPair.GetPrivateKey().Sign(serialize(t, publicKey))
+	require.NoError(t, err)
+	record, err := libsignalgo.NewSignedPreKeyRecordFromPrivateKey(id, time.Now(), privateKey, signature)
+	require.NoError(t, err)
+	return record
+}
+
+func newKyberPreKey(t *testing.T, id uint32, identityKeyPair *libsignalgo.IdentityKeyPair) *libsignalgo.KyberPreKeyRecord {
+	keyPair, err := libsignalgo.KyberKeyPairGenerate()
+	require.NoError(t, err)
+	publicKey, err := keyPair.GetPublicKey()
+	require.NoError(t, err)
+	signature, err := identityKeyPair.GetPrivateKey().Sign(serialize(t, publicKey))
+	require.NoError(t, err)
+	record, err := libsignalgo.NewKyberPreKeyRecord(id, time.Now(), keyPair, signature)
+	require.NoError(t, err)
+	return record
+}
+
+// startSession processes a prekey bundle of a made-up remote device, which creates a session with it.
+func startSession(t *testing.T, ctx context.Context, device *store.Device, address *libsignalgo.Address) {
+	theirIdentityKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	require.NoError(t, err)
+	preKey := newPreKey(t, 1)
+	preKeyPublic, err := preKey.GetPublicKey()
+	require.NoError(t, err)
+	signedPreKey := newSignedPreKey(t, 2, theirIdentityKeyPair)
+	signedPreKeyPublic, err := signedPreKey.GetPublicKey()
+	require.NoError(t, err)
+	signedPreKeySignature, err := signedPreKey.GetSignature()
+	require.NoError(t, err)
+	kyberPreKey := newKyberPreKey(t, 3, theirIdentityKeyPair)
+	kyberPreKeyPublic, err := kyberPreKey.GetPublicKey()
+	require.NoError(t, err)
+	kyberPreKeySignature, err := kyberPreKey.GetSignature()
+	require.NoError(t, err)
+	deviceID, err := address.DeviceID()
+	require.NoError(t, err)
+
+	bundle, err := libsignalgo.NewPreKeyBundle(
+		4321, uint32(deviceID),
+		1, preKeyPublic,
+		2, signedPreKeyPublic, signedPreKeySignature,
+		3, kyberPreKeyPublic, kyberPreKeySignature,
+		theirIdentityKeyPair.GetIdentityKey(),
+	)
+	require.NoError(t, err)
+	err = libsignalgo.ProcessPreKeyBundle(ctx, bundle, address, device.SessionStore, device.IdentityStore)
+	require.NoError(t, err)
+}
+
+func testDevice(t *testing.T, ctx context.Context, device *store.Device) {
+	loaded, err := device.DeviceStore.DeviceByACI(ctx, device.ACI)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, device.ACI, loaded.ACI)
+	assert.Equal(t, device.PNI, loaded.PNI)
+	assert.Equal(t, device.DeviceID, loaded.DeviceID)
+	assert.Equal(t, device.Number, loaded.Number)
+	assert.Equal(t, device.Password, loaded.Password)
+	assert.Equal(t, serialize(t, device.ACIIdentityKeyPair), serialize(t, loaded.ACIIdentityKeyPair))
+	assert.Equal(t, serialize(t, device.PNIIdentityKeyPair), serialize(t, loaded.PNIIdentityKeyPair))
+
+	missing, err := device.DeviceStore.DeviceByACI(ctx, uuid.New())
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	err = device.DeviceStore.PutDevice(ctx, &store.DeviceData{})
+	assert.ErrorIs(t, err, store.ErrDeviceIDMustBeSet)
+
+	require.NoError(t, device.ClearPassword(ctx))
+	loaded, err = device.DeviceStore.DeviceByACI(ctx, device.ACI)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Empty(t, loaded.Password)
+	assert.False(t, loaded.IsDeviceLoggedIn())
+}
+
+func testIdentityKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	ownKeyPair, err := device.IdentityStore.GetIdentityKeyPair(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, ownKeyPair)
+	assert.Equal(t, serialize(t, device.ACIIdentityKeyPair), serialize(t, ownKeyPair))
+	registrationID, err := device.IdentityStore.GetLocalRegistrationID(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, device.RegistrationID, registrationID)
+
+	address := newAddress(t, uuid.New(), 1)
+	key, err := device.IdentityStore.GetIdentityKey(ctx, address)
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	firstKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	require.NoError(t, err)
+	firstKey := firstKeyPair.GetIdentityKey()
+	trusted, err := device.IdentityStore.IsTrustedIdentity(ctx, address, firstKey, libsignalgo.SignalDirectionReceiving)
+	require.NoError(t, err)
+	assert.True(t, trusted, "new identities should be trusted")
+
+	replaced, err := device.IdentityStore.SaveIdentityKey(ctx, address, firstKey)
+	require.NoError(t, err)
+	assert.False(t, replaced, "saving the first key shouldn't replace anything")
+	replaced, err = device.IdentityStore.SaveIdentityKey(ctx, address, firstKey)
+	require.NoError(t, err)
+	assert.False(t, replaced, "saving the same key again shouldn't replace it")
+	key, err = device.IdentityStore.GetIdentityKey(ctx, address)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, serialize(t, firstKey), serialize(t, key))
+
+	secondKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	require.NoError(t, err)
+	secondKey := secondKeyPair.GetIdentityKey()
+	replaced, err = device.IdentityStore.SaveIdentityKey(ctx, address, secondKey)
+	require.NoError(t, err)
+	assert.True(t, replaced, "saving a different key should replace the old one")
+	key, err = device.IdentityStore.GetIdentityKey(ctx, address)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, serialize(t, secondKey), serialize(t, key))
+	trusted, err = device.IdentityStore.IsTrustedIdentity(ctx, address, secondKey, libsignalgo.SignalDirectionSending)
+	require.NoError(t, err)
+	assert.True(t, trusted)
+
+	otherDevice, err := device.IdentityStore.GetIdentityKey(ctx, newAddress(t, uuid.New(), 2))
+	require.NoError(t, err)
+	assert.Nil(t, otherDevice)
+}
+
+func testPreKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	nextID, err := device.PreKeyStoreExtras.GetNextPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, nextID)
+
+	preKeys := []*libsignalgo.PreKeyRecord{newPreKey(t, 1), newPreKey(t, 2), newPreKey(t, 3)}
+	for _, preKey := range preKeys {
+		require.NoError(t, device.PreKeyStoreExtras.SavePreKey(ctx, types.UUIDKindACI, preKey, false))
+	}
+	require.NoError(t, device.PreKeyStoreExtras.MarkPreKeysAsUploaded(ctx, types.UUIDKindACI, 3))
+	pniPreKey := newPreKey(t, 10)
+	require.NoError(t, device.PreKeyStoreExtras.SavePreKey(ctx, types.UUIDKindPNI, pniPreKey, true))
+
+	nextID, err = device.PreKeyStoreExtras.GetNextPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, nextID)
+	nextID, err = device.PreKeyStoreExtras.GetNextPreKeyID(ctx, types.UUIDKindPNI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 11, nextID)
+
+	loaded, err := device.PreKeyStoreExtras.PreKey(ctx, types.UUIDKindACI, 2)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, serialize(t, preKeys[1]), serialize(t, loaded))
+	loaded, err = device.PreKeyStore.LoadPreKey(ctx, 3)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, serialize(t, preKeys[2]), serialize(t, loaded))
+	loaded, err = device.PreKeyStore.LoadPreKey(ctx, 10)
+	require.NoError(t, err)
+	assert.Nil(t, loaded, "libsignal prekey store should only return ACI prekeys")
+	loaded, err = device.PreKeyStoreExtras.PreKey(ctx, types.UUIDKindPNI, 10)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+
+	all, err := device.PreKeyStoreExtras.AllPreKeys(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	require.NoError(t, device.PreKeyStore.RemovePreKey(ctx, 2))
+	loaded, err = device.PreKeyStoreExtras.PreKey(ctx, types.UUIDKindACI, 2)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+	require.NoError(t, device.PreKeyStoreExtras.DeletePreKey(ctx, types.UUIDKindPNI, 10))
+	all, err = device.PreKeyStoreExtras.AllPreKeys(ctx, types.UUIDKindPNI)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+	all, err = device.PreKeyStoreExtras.AllPreKeys(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func testSignedPreKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	nextID, err := device.PreKeyStoreExtras.GetSignedNextPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, nextID)
+
+	aciKey := newSignedPreKey(t, 5, device.ACIIdentityKeyPair)
+	pniKey := newSignedPreKey(t, 7, device.PNIIdentityKeyPair)
+	require.NoError(t, device.PreKeyStoreExtras.SaveSignedPreKey(ctx, types.UUIDKindACI, aciKey, true))
+	require.NoError(t, device.PreKeyStoreExtras.SaveSignedPreKey(ctx, types.UUIDKindPNI, pniKey, true))
+	require.NoError(t, device.PreKeyStoreExtras.MarkSignedPreKeysAsUploaded(ctx, types.UUIDKindACI, 5))
+
+	nextID, err = device.PreKeyStoreExtras.GetSignedNextPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, nextID)
+	nextID, err = device.PreKeyStoreExtras.GetSignedNextPreKeyID(ctx, types.UUIDKindPNI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8, nextID)
+	// Signed prekeys and one-time prekeys have separate ID sequences
+	nextID, err = device.PreKeyStoreExtras.GetNextPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, nextID)
+
+	loaded, err := device.SignedPreKeyStore.LoadSignedPreKey(ctx, 5)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, serialize(t, aciKey), serialize(t, loaded))
+	loaded, err = device.SignedPreKeyStore.LoadSignedPreKey(ctx, 7)
+	require.NoError(t, err)
+	assert.Nil(t, loaded, "libsignal signed prekey store should only return ACI prekeys")
+	loaded, err = device.PreKeyStoreExtras.SignedPreKey(ctx, types.UUIDKindPNI, 7)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, serialize(t, pniKey), serialize(t, loaded))
+	preKey, err := device.PreKeyStoreExtras.PreKey(ctx, types.UUIDKindACI, 5)
+	require.NoError(t, err)
+	assert.Nil(t, preKey, "signed prekeys shouldn't be returned as one-time prekeys")
+
+	require.NoError(t, device.PreKeyStoreExtras.DeleteSignedPreKey(ctx, types.UUIDKindACI, 5))
+	loaded, err = device.PreKeyStoreExtras.SignedPreKey(ctx, types.UUIDKindACI, 5)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func testKyberPreKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	nextID, err := device.PreKeyStoreExtras.GetNextKyberPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, nextID)
+
+	normalKey := newKyberPreKey(t, 1, device.ACIIdentityKeyPair)
+	lastResortKey := newKyberPreKey(t, 2, device.ACIIdentityKeyPair)
+	pniKey := newKyberPreKey(t, 1, device.PNIIdentityKeyPair)
+	require.NoError(t, device.KyberPreKeyStore.StoreKyberPreKey(ctx, 1, normalKey))
+	require.NoError(t, device.PreKeyStoreExtras.SaveKyberPreKey(ctx, types.UUIDKindACI, lastResortKey, true))
+	require.NoError(t, device.PreKeyStoreExtras.SaveKyberPreKey(ctx, types.UUIDKindPNI, pniKey, false))
+
+	nextID, err = device.PreKeyStoreExtras.GetNextKyberPreKeyID(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, nextID)
+	nextID, err = device.PreKeyStoreExtras.GetNextKyberPreKeyID(ctx, types.UUIDKindPNI)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, nextID)
+
+	loaded, err := device.KyberPreKeyStore.LoadKyberPreKey(ctx, 2)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, serialize(t, lastResortKey), serialize(t, loaded))
+	loaded, err = device.PreKeyStoreExtras.KyberPreKey(ctx, types.UUIDKindPNI, 1)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, serialize(t, pniKey), serialize(t, loaded))
+
+	isLastResort, err := device.PreKeyStoreExtras.IsKyberPreKeyLastResort(ctx, types.UUIDKindACI, 1)
+	require.NoError(t, err)
+	assert.False(t, isLastResort)
+	isLastResort, err = device.PreKeyStoreExtras.IsKyberPreKeyLastResort(ctx, types.UUIDKindACI, 2)
+	require.NoError(t, err)
+	assert.True(t, isLastResort)
+	_, err = device.PreKeyStoreExtras.IsKyberPreKeyLastResort(ctx, types.UUIDKindACI, 100)
+	assert.Error(t, err)
+
+	normalKeys, err := device.PreKeyStoreExtras.AllNormalKyberPreKeys(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.Len(t, normalKeys, 1)
+	assert.Equal(t, serialize(t, normalKey), serialize(t, normalKeys[0]))
+
+	// Using a normal kyber prekey consumes it, while last resort keys stay until they're rotated
+	require.NoError(t, device.KyberPreKeyStore.MarkKyberPreKeyUsed(ctx, 1))
+	require.NoError(t, device.KyberPreKeyStore.MarkKyberPreKeyUsed(ctx, 2))
+	loaded, err = device.KyberPreKeyStore.LoadKyberPreKey(ctx, 1)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+	loaded, err = device.KyberPreKeyStore.LoadKyberPreKey(ctx, 2)
+	require.NoError(t, err)
+	assert.NotNil(t, loaded)
+	loaded, err = device.PreKeyStoreExtras.KyberPreKey(ctx, types.UUIDKindPNI, 1)
+	require.NoError(t, err)
+	assert.NotNil(t, loaded, "marking an ACI key as used shouldn't affect PNI keys")
+
+	require.NoError(t, device.PreKeyStoreExtras.DeleteKyberPreKey(ctx, types.UUIDKindACI, 2))
+	loaded, err = device.KyberPreKeyStore.LoadKyberPreKey(ctx, 2)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func testDeleteAllPreKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	require.NoError(t, device.PreKeyStoreExtras.SavePreKey(ctx, types.UUIDKindACI, newPreKey(t, 1), false))
+	require.NoError(t, device.PreKeyStoreExtras.SavePreKey(ctx, types.UUIDKindPNI, newPreKey(t, 1), false))
+	require.NoError(t, device.PreKeyStoreExtras.SaveSignedPreKey(ctx, types.UUIDKindACI, newSignedPreKey(t, 1, device.ACIIdentityKeyPair), false))
+	require.NoError(t, device.PreKeyStoreExtras.SaveKyberPreKey(ctx, types.UUIDKindACI, newKyberPreKey(t, 1, device.ACIIdentityKeyPair), true))
+	address := newAddress(t, uuid.New(), 1)
+	startSession(t, ctx, device, address)
+
+	require.NoError(t, device.ClearDeviceKeys(ctx))
+
+	preKey, err := device.PreKeyStoreExtras.PreKey(ctx, types.UUIDKindACI, 1)
+	require.NoError(t, err)
+	assert.Nil(t, preKey)
+	preKey, err = device.PreKeyStoreExtras.PreKey(ctx, types.UUIDKindPNI, 1)
+	require.NoError(t, err)
+	assert.Nil(t, preKey)
+	signedPreKey, err := device.PreKeyStoreExtras.SignedPreKey(ctx, types.UUIDKindACI, 1)
+	require.NoError(t, err)
+	assert.Nil(t, signedPreKey)
+	kyberPreKey, err := device.PreKeyStoreExtras.KyberPreKey(ctx, types.UUIDKindACI, 1)
+	require.NoError(t, err)
+	assert.Nil(t, kyberPreKey)
+	session, err := device.SessionStore.LoadSession(ctx, address)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+}
+
+func testReplacedPreKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	extras := device.PreKeyStoreExtras
+	signedKey, err := extras.CurrentSignedPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.Nil(t, signedKey)
+	kyberKey, err := extras.CurrentLastResortKyberPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.Nil(t, kyberKey)
+
+	for id := uint32(1); id <= 4; id++ {
+		require.NoError(t, extras.SavePreKey(ctx, types.UUIDKindACI, newPreKey(t, id), false))
+	}
+	require.NoError(t, extras.SavePreKey(ctx, types.UUIDKindPNI, newPreKey(t, 1), false))
+	require.NoError(t, extras.SaveKyberPreKey(ctx, types.UUIDKindACI, newKyberPreKey(t, 1, device.ACIIdentityKeyPair), false))
+	require.NoError(t, extras.SaveKyberPreKey(ctx, types.UUIDKindACI, newKyberPreKey(t, 2, device.ACIIdentityKeyPair), true))
+	require.NoError(t, extras.SaveKyberPreKey(ctx, types.UUIDKindACI, newKyberPreKey(t, 3, device.ACIIdentityKeyPair), false))
+	require.NoError(t, extras.SaveKyberPreKey(ctx, types.UUIDKindACI, newKyberPreKey(t, 4, device.ACIIdentityKeyPair), true))
+	require.NoError(t, extras.SaveSignedPreKey(ctx, types.UUIDKindACI, newSignedPreKey(t, 1, device.ACIIdentityKeyPair), true))
+	require.NoError(t, extras.SaveSignedPreKey(ctx, types.UUIDKindACI, newSignedPreKey(t, 2, device.ACIIdentityKeyPair), true))
+	require.NoError(t, extras.SaveSignedPreKey(ctx, types.UUIDKindPNI, newSignedPreKey(t, 1, device.PNIIdentityKeyPair), true))
+
+	signedKey, err = extras.CurrentSignedPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.NotNil(t, signedKey)
+	signedKeyID, err := signedKey.GetID()
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, signedKeyID)
+	kyberKey, err = extras.CurrentLastResortKyberPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.NotNil(t, kyberKey)
+	kyberKeyID, err := kyberKey.GetID()
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, kyberKeyID)
+
+	replacedAt := time.Now()
+	require.NoError(t, extras.MarkPreKeysReplaced(ctx, types.UUIDKindACI, 3, replacedAt))
+	require.NoError(t, extras.MarkKyberPreKeysReplaced(ctx, types.UUIDKindACI, 3, replacedAt))
+	require.NoError(t, extras.MarkSignedPreKeysReplaced(ctx, types.UUIDKindACI, 1, replacedAt))
+	require.NoError(t, extras.MarkLastResortKyberPreKeysReplaced(ctx, types.UUIDKindACI, 2, replacedAt))
+
+	// Replaced keys aren't uploaded again and aren't current, but they can still be used until they're deleted
+	preKeys, err := extras.AllPreKeys(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.Len(t, preKeys, 2)
+	kyberPreKeys, err := extras.AllNormalKyberPreKeys(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.Len(t, kyberPreKeys, 1)
+	kyberKeyID, err = kyberPreKeys[0].GetID()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, kyberKeyID)
+	signedKey, err = extras.CurrentSignedPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.NotNil(t, signedKey)
+	signedKeyID, err = signedKey.GetID()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, signedKeyID)
+	kyberKey, err = extras.CurrentLastResortKyberPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.NotNil(t, kyberKey)
+	kyberKeyID, err = kyberKey.GetID()
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, kyberKeyID)
+	preKey, err := extras.PreKey(ctx, types.UUIDKindACI, 1)
+	require.NoError(t, err)
+	assert.NotNil(t, preKey)
+
+	deleted, err := extras.DeleteReplacedPreKeys(ctx, replacedAt.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+	deleted, err = extras.DeleteReplacedPreKeys(ctx, replacedAt.Add(time.Minute))
+	require.NoError(t, err)
+	// 2 one-time prekeys, 1 normal kyber prekey, 1 signed prekey and 1 last resort kyber prekey
+	assert.EqualValues(t, 5, deleted)
+	preKey, err = extras.PreKey(ctx, types.UUIDKindACI, 1)
+	require.NoError(t, err)
+	assert.Nil(t, preKey)
+	preKey, err = extras.PreKey(ctx, types.UUIDKindPNI, 1)
+	require.NoError(t, err)
+	assert.NotNil(t, preKey, "PNI prekeys weren't replaced")
+	signedKey, err = extras.SignedPreKey(ctx, types.UUIDKindACI, 2)
+	require.NoError(t, err)
+	assert.Nil(t, signedKey)
+	signedKey, err = extras.SignedPreKey(ctx, types.UUIDKindPNI, 1)
+	require.NoError(t, err)
+	assert.NotNil(t, signedKey)
+	kyberKey, err = extras.KyberPreKey(ctx, types.UUIDKindACI, 4)
+	require.NoError(t, err)
+	assert.Nil(t, kyberKey)
+}
+
+func testSessions(t *testing.T, ctx context.Context, device *store.Device) {
+	theirUUID := uuid.New()
+	firstAddress := newAddress(t, theirUUID, 1)
+	secondAddress := newAddress(t, theirUUID, 2)
+	otherAddress := newAddress(t, uuid.New(), 1)
+
+	session, err := device.SessionStore.LoadSession(ctx, firstAddress)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+
+	startSession(t, ctx, device, firstAddress)
+	startSession(t, ctx, device, secondAddress)
+	startSession(t, ctx, device, otherAddress)
+
+	session, err = device.SessionStore.LoadSession(ctx, firstAddress)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	hasCurrentState, err := session.HasCurrentState()
+	require.NoError(t, err)
+	assert.True(t, hasCurrentState)
+	remoteRegistrationID, err := session.GetRemoteRegistrationID()
+	require.NoError(t, err)
+	assert.EqualValues(t, 4321, remoteRegistrationID)
+
+	// Modifying a loaded record must not change the stored one until it's stored again
+	require.NoError(t, session.ArchiveCurrentState())
+	session, err = device.SessionStore.LoadSession(ctx, firstAddress)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	hasCurrentState, err = session.HasCurrentState()
+	require.NoError(t, err)
+	assert.True(t, hasCurrentState)
+
+	addresses, records, err := device.SessionStoreExtras.AllSessionsForUUID(ctx, theirUUID)
+	require.NoError(t, err)
+	require.Len(t, addresses, 2)
+	require.Len(t, records, 2)
+	deviceIDs := make([]uint, len(addresses))
+	for i, address := range addresses {
+		name, err := address.Name()
+		require.NoError(t, err)
+		assert.Equal(t, theirUUID.String(), name)
+		deviceIDs[i], err = address.DeviceID()
+		require.NoError(t, err)
+	}
+	assert.ElementsMatch(t, []uint{1, 2}, deviceIDs)
+
+	require.NoError(t, device.SessionStoreExtras.ArchiveSessions(ctx, theirUUID))
+	for _, address := range []*libsignalgo.Address{firstAddress, secondAddress} {
+		session, err = device.SessionStore.LoadSession(ctx, address)
+		require.NoError(t, err)
+		require.NotNil(t, session, "archived sessions should still exist")
+		hasCurrentState, err = session.HasCurrentState()
+		require.NoError(t, err)
+		assert.False(t, hasCurrentState)
+	}
+	session, err = device.SessionStore.LoadSession(ctx, otherAddress)
+	require.NoError(t, err)
+	require.NotNil(t, session)
+	hasCurrentState, err = session.HasCurrentState()
+	require.NoError(t, err)
+	assert.True(t, hasCurrentState, "archiving shouldn't affect sessions with other users")
+
+	require.NoError(t, device.SessionStoreExtras.RemoveSession(ctx, firstAddress))
+	session, err = device.SessionStore.LoadSession(ctx, firstAddress)
+	require.NoError(t, err)
+	assert.Nil(t, session)
+	addresses, _, err = device.SessionStoreExtras.AllSessionsForUUID(ctx, theirUUID)
+	require.NoError(t, err)
+	assert.Len(t, addresses, 1)
+
+	require.NoError(t, device.SessionStoreExtras.RemoveAllSessions(ctx))
+	for _, address := range []*libsignalgo.Address{secondAddress, otherAddress} {
+		session, err = device.SessionStore.LoadSession(ctx, address)
+		require.NoError(t, err)
+		assert.Nil(t, session)
+	}
+}
+
+func testSenderKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	sender := newAddress(t, device.ACI, uint(device.DeviceID))
+	distributionID := uuid.New()
+
+	record, err := device.SenderKeyStore.LoadSenderKey(ctx, sender, distributionID)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	// Creating a distribution message generates and stores a new sender key
+	_, err = libsignalgo.NewSenderKeyDistributionMessage(ctx, sender, distributionID, device.SenderKeyStore)
+	require.NoError(t, err)
+	record, err = device.SenderKeyStore.LoadSenderKey(ctx, sender, distributionID)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	serialized := serialize(t, record)
+
+	require.NoError(t, device.SenderKeyStore.StoreSenderKey(ctx, sender, distributionID, record))
+	record, err = device.SenderKeyStore.LoadSenderKey(ctx, sender, distributionID)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, serialized, serialize(t, record))
+
+	record, err = device.SenderKeyStore.LoadSenderKey(ctx, sender, uuid.New())
+	require.NoError(t, err)
+	assert.Nil(t, record)
+	record, err = device.SenderKeyStore.LoadSenderKey(ctx, newAddress(t, device.ACI, 99), distributionID)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func testProfileKeys(t *testing.T, ctx context.Context, device *store.Device) {
+	theirACI := uuid.New()
+	key, err := device.ProfileKeyStore.LoadProfileKey(ctx, theirACI)
+	require.NoError(t, err)
+	assert.Nil(t, key)
+	key, err = device.ProfileKeyStore.MyProfileKey(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	var theirKey, newKey, myKey libsignalgo.ProfileKey
+	theirKey[0], newKey[0], myKey[0] = 1, 2, 3
+	require.NoError(t, device.ProfileKeyStore.StoreProfileKey(ctx, theirACI, theirKey))
+	require.NoError(t, device.ProfileKeyStore.StoreProfileKey(ctx, device.ACI, myKey))
+
+	key, err = device.ProfileKeyStore.LoadProfileKey(ctx, theirACI)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, theirKey, *key)
+	key, err = device.ProfileKeyStore.MyProfileKey(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, myKey, *key)
+
+	require.NoError(t, device.ProfileKeyStore.StoreProfileKey(ctx, theirACI, newKey))
+	key, err = device.ProfileKeyStore.LoadProfileKey(ctx, theirACI)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	assert.Equal(t, newKey, *key)
+}
+
+func testGroups(t *testing.T, ctx context.Context, device *store.Device) {
+	groupID := types.GroupIdentifier("group")
+	masterKey, err := device.GroupStore.MasterKeyFromGroupIdentifier(ctx, groupID)
+	require.NoError(t, err)
+	assert.Empty(t, masterKey)
+
+	require.NoError(t, device.GroupStore.StoreMasterKey(ctx, groupID, "first"))
+	require.NoError(t, device.GroupStore.StoreMasterKey(ctx, "other", "other"))
+	masterKey, err = device.GroupStore.MasterKeyFromGroupIdentifier(ctx, groupID)
+	require.NoError(t, err)
+	assert.EqualValues(t, "first", masterKey)
+
+	require.NoError(t, device.GroupStore.StoreMasterKey(ctx, groupID, "second"))
+	masterKey, err = device.GroupStore.MasterKeyFromGroupIdentifier(ctx, groupID)
+	require.NoError(t, err)
+	assert.EqualValues(t, "second", masterKey)
+}
+
+func testContacts(t *testing.T, ctx context.Context, device *store.Device) {
+	var profileKey libsignalgo.ProfileKey
+	profileKey[0] = 42
+	contact := types.Contact{
+		UUID:              uuid.New(),
+		E164:              "+15551234567",
+		ContactName:       "Contact Name",
+		ContactAvatar:     types.ContactAvatar{Hash: "hash"},
+		ProfileKey:        &profileKey,
+		ProfileName:       "Profile Name",
+		ProfileAbout:      "About",
+		ProfileAboutEmoji: "🐈",
+		ProfileAvatarPath: "profiles/avatar",
+		ProfileAvatarHash: "avatarhash",
+	}
+	other := types.Contact{UUID: uuid.New(), E164: "+15557654321"}
+
+	loaded, err := device.ContactStore.LoadContact(ctx, contact.UUID)
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+	all, err := device.ContactStore.AllContacts(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+
+	require.NoError(t, device.ContactStore.StoreContact(ctx, contact))
+	require.NoError(t, device.ContactStore.StoreContact(ctx, other))
+
+	loaded, err = device.ContactStore.LoadContact(ctx, contact.UUID)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, contact, *loaded)
+	loaded, err = device.ContactStore.LoadContactByE164(ctx, other.E164)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, other.UUID, loaded.UUID)
+	assert.Nil(t, loaded.ProfileKey)
+	loaded, err = device.ContactStore.LoadContactByE164(ctx, "+15550001111")
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+	all, err = device.ContactStore.AllContacts(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	contact.ProfileName = "New Name"
+	require.NoError(t, device.ContactStore.StoreContact(ctx, contact))
+	loaded, err = device.ContactStore.LoadContact(ctx, contact.UUID)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, "New Name", loaded.ProfileName)
+
+	// Updating the phone number only changes the number of existing contacts
+	require.NoError(t, device.ContactStore.UpdatePhone(ctx, contact.UUID, "+15559999999"))
+	loaded, err = device.ContactStore.LoadContactByE164(ctx, "+15559999999")
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	contact.E164 = "+15559999999"
+	assert.Equal(t, contact, *loaded)
+
+	// and creates new contacts that don't exist yet
+	newUUID := uuid.New()
+	require.NoError(t, device.ContactStore.UpdatePhone(ctx, newUUID, "+15558888888"))
+	loaded, err = device.ContactStore.LoadContact(ctx, newUUID)
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.Equal(t, "+15558888888", loaded.E164)
+	assert.Empty(t, loaded.ContactName)
+	assert.Nil(t, loaded.ProfileKey)
+	all, err = device.ContactStore.AllContacts(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+}
+
+func testInbox(t *testing.T, ctx context.Context, device *store.Device) {
+	entries, err := device.InboxStore.AllInboxEntries(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	sender := uuid.New()
+	newEntry := func(guid string, ts uint64) *store.InboxEntry {
+		return &store.InboxEntry{
+			ServerGUID:      guid,
+			SenderACI:       sender,
+			SenderDeviceID:  1,
+			ServerTimestamp: ts,
+			SealedSender:    true,
+			Content:         []byte(guid),
+		}
+	}
+	// Entries with the same timestamp are returned in the order they were stored in
+	for _, entry := range []*store.InboxEntry{newEntry("c", 300), newEntry("a", 100), newEntry("b2", 200), newEntry("b1", 200)} {
+		require.NoError(t, device.InboxStore.PutInboxEntry(ctx, entry))
+	}
+
+	entry, err := device.InboxStore.GetInboxEntry(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, newEntry("a", 100), entry)
+	entry, err = device.InboxStore.GetInboxEntry(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// Storing an entry again doesn't overwrite it
+	duplicate := newEntry("a", 100)
+	duplicate.Content = []byte("changed")
+	require.NoError(t, device.InboxStore.PutInboxEntry(ctx, duplicate))
+	entry, err = device.InboxStore.GetInboxEntry(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, []byte("a"), entry.Content)
+
+	entries, err = device.InboxStore.AllInboxEntries(ctx)
+	require.NoError(t, err)
+	guids := make([]string, len(entries))
+	for i, entry := range entries {
+		guids[i] = entry.ServerGUID
+	}
+	assert.Equal(t, []string{"a", "b2", "b1", "c"}, guids)
+
+	attempts, err := device.InboxStore.IncrementInboxEntryAttempts(ctx, "b1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+	attempts, err = device.InboxStore.IncrementInboxEntryAttempts(ctx, "b1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	attempts, err = device.InboxStore.IncrementInboxEntryAttempts(ctx, "missing")
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts)
+
+	require.NoError(t, device.InboxStore.DeleteInboxEntry(ctx, "b2"))
+	require.NoError(t, device.InboxStore.DeleteInboxEntry(ctx, "missing"))
+	entry, err = device.InboxStore.GetInboxEntry(ctx, "b2")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	entries, err = device.InboxStore.AllInboxEntries(ctx)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func testProcessedEnvelopes(t *testing.T, ctx context.Context, device *store.Device) {
+	processed, err := device.EnvelopeStore.IsEnvelopeProcessed(ctx, "1")
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	guids := []string{"1", "2", "3", "4", "5"}
+	for i, guid := range guids {
+		require.NoError(t, device.EnvelopeStore.PutProcessedEnvelope(ctx, guid, uint64(i+1)*1000))
+	}
+	// Marking an envelope as processed twice is fine
+	require.NoError(t, device.EnvelopeStore.PutProcessedEnvelope(ctx, "1", 1000))
+	for _, guid := range guids {
+		processed, err = device.EnvelopeStore.IsEnvelopeProcessed(ctx, guid)
+		require.NoError(t, err)
+		assert.True(t, processed, guid)
+	}
+
+	require.NoError(t, device.EnvelopeStore.PruneProcessedEnvelopes(ctx, 10))
+	processed, err = device.EnvelopeStore.IsEnvelopeProcessed(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, processed, "pruning shouldn't delete anything when there are less envelopes than the limit")
+
+	require.NoError(t, device.EnvelopeStore.PruneProcessedEnvelopes(ctx, 2))
+	for _, guid := range []string{"1", "2"} {
+		processed, err = device.EnvelopeStore.IsEnvelopeProcessed(ctx, guid)
+		require.NoError(t, err)
+		assert.False(t, processed, "old envelope %s should've been pruned", guid)
+	}
+	for _, guid := range []string{"4", "5"} {
+		processed, err = device.EnvelopeStore.IsEnvelopeProcessed(ctx, guid)
+		require.NoError(t, err)
+		assert.True(t, processed, "new envelope %s shouldn't have been pruned", guid)
+	}
+}
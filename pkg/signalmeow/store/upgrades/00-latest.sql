@@ -1,4 +1,4 @@
--- v0 -> v6: Latest revision
+-- v0 -> v11: Latest revision
 CREATE TABLE signalmeow_device (
     aci_uuid              TEXT PRIMARY KEY,
 
@@ -15,12 +15,13 @@ CREATE TABLE signalmeow_device (
 );
 
 CREATE TABLE signalmeow_pre_keys (
-    aci_uuid  TEXT    NOT NULL,
-    key_id    INTEGER NOT NULL,
-    uuid_kind TEXT    NOT NULL,
-    is_signed BOOLEAN NOT NULL,
-    key_pair  bytea   NOT NULL,
-    uploaded  BOOLEAN NOT NULL,
+    aci_uuid    TEXT    NOT NULL,
+    key_id      INTEGER NOT NULL,
+    uuid_kind   TEXT    NOT NULL,
+    is_signed   BOOLEAN NOT NULL,
+    key_pair    bytea   NOT NULL,
+    uploaded    BOOLEAN NOT NULL,
+    replaced_at BIGINT,
 
     PRIMARY KEY (aci_uuid, uuid_kind, is_signed, key_id),
     FOREIGN KEY (aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
@@ -99,7 +100,38 @@ CREATE TABLE signalmeow_kyber_pre_keys (
     uuid_kind      TEXT    NOT NULL,
     key_pair       bytea   NOT NULL,
     is_last_resort BOOLEAN NOT NULL,
+    replaced_at    BIGINT,
 
     PRIMARY KEY (aci_uuid, uuid_kind, key_id),
     FOREIGN KEY (aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
 );
+
+CREATE TABLE signalmeow_inbox (
+    our_aci_uuid     TEXT    NOT NULL,
+    server_guid      TEXT    NOT NULL,
+    sender_aci_uuid  TEXT    NOT NULL,
+    sender_device_id INTEGER NOT NULL,
+    server_timestamp BIGINT  NOT NULL,
+    sealed_sender    BOOLEAN NOT NULL,
+    content          bytea   NOT NULL,
+    received_at      BIGINT  NOT NULL,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (our_aci_uuid, server_guid),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE signalmeow_processed_envelopes (
+    our_aci_uuid     TEXT   NOT NULL,
+    server_guid      TEXT   NOT NULL,
+    server_timestamp BIGINT NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, server_guid),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX signalmeow_processed_envelopes_ts_idx ON signalmeow_processed_envelopes (our_aci_uuid, server_timestamp);
+
+CREATE TABLE signalmeow_encryption (
+    key_id TEXT NOT NULL
+);
@@ -0,0 +1,14 @@
+-- v7 (compatible with v5+): Add persistent inbox for decrypted envelopes
+CREATE TABLE signalmeow_inbox (
+    our_aci_uuid     TEXT    NOT NULL,
+    server_guid      TEXT    NOT NULL,
+    sender_aci_uuid  TEXT    NOT NULL,
+    sender_device_id INTEGER NOT NULL,
+    server_timestamp BIGINT  NOT NULL,
+    sealed_sender    BOOLEAN NOT NULL,
+    content          bytea   NOT NULL,
+    received_at      BIGINT  NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, server_guid),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,11 @@
+-- v8 (compatible with v5+): Store IDs of processed envelopes for deduplication
+CREATE TABLE signalmeow_processed_envelopes (
+    our_aci_uuid     TEXT   NOT NULL,
+    server_guid      TEXT   NOT NULL,
+    server_timestamp BIGINT NOT NULL,
+
+    PRIMARY KEY (our_aci_uuid, server_guid),
+    FOREIGN KEY (our_aci_uuid) REFERENCES signalmeow_device (aci_uuid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX signalmeow_processed_envelopes_ts_idx ON signalmeow_processed_envelopes (our_aci_uuid, server_timestamp);
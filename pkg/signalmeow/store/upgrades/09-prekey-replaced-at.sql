@@ -0,0 +1,3 @@
+-- v9 (compatible with v5+): Track when prekeys were replaced on the server
+ALTER TABLE signalmeow_pre_keys ADD COLUMN replaced_at BIGINT;
+ALTER TABLE signalmeow_kyber_pre_keys ADD COLUMN replaced_at BIGINT;
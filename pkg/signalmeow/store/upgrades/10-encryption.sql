@@ -0,0 +1,4 @@
+-- v10 (compatible with v5+): Track the key used to encrypt private key material
+CREATE TABLE signalmeow_encryption (
+    key_id TEXT NOT NULL
+);
@@ -0,0 +1,2 @@
+-- v11 (compatible with v5+): Count failed attempts to bridge inbox entries
+ALTER TABLE signalmeow_inbox ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,203 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+// Account is a Signal account. The primary device of the account only exists implicitly:
+// it never receives messages, but it can link new devices with Server.LinkDevice.
+type Account struct {
+	ACI    uuid.UUID
+	PNI    uuid.UUID
+	Number string
+
+	ACIIdentityKeyPair *libsignalgo.IdentityKeyPair
+	PNIIdentityKeyPair *libsignalgo.IdentityKeyPair
+	ProfileKey         libsignalgo.ProfileKey
+
+	profile           *profile
+	devices           map[int]*Device
+	nextDeviceID      int
+	provisioningCodes map[string]struct{}
+	challenge         *challenge
+}
+
+// Device is a linked device of an Account.
+type Device struct {
+	Account *Account
+	ID      int
+
+	Password          string
+	RegistrationID    int
+	PNIRegistrationID int
+	Name              []byte
+
+	keys   map[types.UUIDKind]*deviceKeys
+	queue  []*signalpb.Envelope
+	acked  []*signalpb.Envelope
+	notify chan struct{}
+}
+
+type keyJSON struct {
+	KeyID     int    `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type deviceKeys struct {
+	IdentityKey     string
+	SignedPreKey    *keyJSON
+	KyberLastResort *keyJSON
+	PreKeys         []*keyJSON
+	KyberPreKeys    []*keyJSON
+}
+
+// CreateAccount registers a new account with random identity keys and profile key.
+func (s *Server) CreateAccount(number string) (*Account, error) {
+	aciIdentityKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACI identity key pair: %w", err)
+	}
+	pniIdentityKeyPair, err := libsignalgo.GenerateIdentityKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PNI identity key pair: %w", err)
+	}
+	account := &Account{
+		ACI:    uuid.New(),
+		PNI:    uuid.New(),
+		Number: number,
+
+		ACIIdentityKeyPair: aciIdentityKeyPair,
+		PNIIdentityKeyPair: pniIdentityKeyPair,
+		ProfileKey:         libsignalgo.ProfileKey(random.Bytes(len(libsignalgo.ProfileKey{}))),
+
+		profile:           &profile{},
+		devices:           make(map[int]*Device),
+		nextDeviceID:      2,
+		provisioningCodes: make(map[string]struct{}),
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, alreadyExists := s.accountsByNumber[number]; alreadyExists {
+		return nil, fmt.Errorf("account with number %s already exists", number)
+	}
+	s.accounts[account.ACI] = account
+	s.accounts[account.PNI] = account
+	s.accountsByNumber[number] = account
+	return account, nil
+}
+
+// Account returns the account with the given ACI or PNI.
+func (s *Server) Account(serviceID uuid.UUID) *Account {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accounts[serviceID]
+}
+
+// Devices returns the IDs of the linked devices of the account.
+func (s *Server) Devices(account *Account) []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]int, 0, len(account.devices))
+	for id := range account.devices {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// QueueLength returns the number of messages that haven't been acknowledged by the given device yet.
+func (s *Server) QueueLength(account *Account, deviceID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	device, ok := account.devices[deviceID]
+	if !ok {
+		return 0
+	}
+	return len(device.queue)
+}
+
+// SignedPreKeyIDs returns the IDs of the signed prekey and the last resort kyber prekey the given device
+// has uploaded for the given identity.
+func (s *Server) SignedPreKeyIDs(account *Account, deviceID int, uuidKind types.UUIDKind) (signedPreKeyID, lastResortKeyID int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	device, ok := account.devices[deviceID]
+	if !ok {
+		return 0, 0
+	}
+	keys := device.keys[uuidKind]
+	if keys.SignedPreKey != nil {
+		signedPreKeyID = keys.SignedPreKey.KeyID
+	}
+	if keys.KyberLastResort != nil {
+		lastResortKeyID = keys.KyberLastResort.KeyID
+	}
+	return
+}
+
+// RedeliverAcked puts all envelopes the device has already acknowledged back into its queue,
+// like the real server sometimes does after reconnects. Envelopes are only sent once per connection,
+// so the device has to reconnect to receive them. Returns the number of envelopes requeued.
+func (s *Server) RedeliverAcked(account *Account, deviceID int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	device, ok := account.devices[deviceID]
+	if !ok {
+		return 0
+	}
+	n := len(device.acked)
+	device.queue = append(device.queue, device.acked...)
+	device.acked = nil
+	return n
+}
+
+func (acc *Account) identityKeyPair(kind types.UUIDKind) *libsignalgo.IdentityKeyPair {
+	if kind == types.UUIDKindPNI {
+		return acc.PNIIdentityKeyPair
+	}
+	return acc.ACIIdentityKeyPair
+}
+
+func (acc *Account) serviceID(kind types.UUIDKind) uuid.UUID {
+	if kind == types.UUIDKindPNI {
+		return acc.PNI
+	}
+	return acc.ACI
+}
+
+func (dev *Device) registrationID(kind types.UUIDKind) int {
+	if kind == types.UUIDKindPNI {
+		return dev.PNIRegistrationID
+	}
+	return dev.RegistrationID
+}
+
+func (dev *Device) wake() {
+	select {
+	case dev.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,90 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/util/random"
+)
+
+// uploadCDN is the CDN number returned in upload forms. All CDNs point at the same server anyway.
+const uploadCDN = 3
+
+type uploadFormResponse struct {
+	CDN                  uint32            `json:"cdn"`
+	Key                  string            `json:"key"`
+	Headers              map[string]string `json:"headers"`
+	SignedUploadLocation string            `json:"signedUploadLocation"`
+}
+
+func (s *Server) handleGetUploadForm(w http.ResponseWriter, r *http.Request) {
+	if s.requireAuth(w, r) == nil {
+		return
+	}
+	key := random.String(24)
+	writeJSON(w, http.StatusOK, &uploadFormResponse{
+		CDN:                  uploadCDN,
+		Key:                  key,
+		Headers:              map[string]string{},
+		SignedUploadLocation: s.url("/upload/" + key),
+	})
+}
+
+func (s *Server) handleAllocateUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", s.url("/upload/"+mux.Vars(r)["key"]))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	s.PutCDNFile("attachments/"+mux.Vars(r)["key"], data)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.GetCDNFile(mux.Vars(r)["path"])
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// PutCDNFile stores a file that clients can download from any CDN with the given path.
+func (s *Server) PutCDNFile(path string, data []byte) {
+	s.lock.Lock()
+	s.cdn[path] = data
+	s.lock.Unlock()
+}
+
+// GetCDNFile returns a file stored with PutCDNFile or uploaded by a client.
+// Uploaded attachments are stored at attachments/<cdn key>.
+func (s *Server) GetCDNFile(path string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, ok := s.cdn[path]
+	return data, ok
+}
@@ -0,0 +1,90 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type challenge struct {
+	Token      string
+	Captcha    string
+	RetryAfter time.Duration
+}
+
+type challengeJSON struct {
+	Token   string   `json:"token"`
+	Options []string `json:"options"`
+}
+
+type challengeResponseJSON struct {
+	Type    string `json:"type"`
+	Token   string `json:"token"`
+	Captcha string `json:"captcha"`
+}
+
+// RequireChallenge makes the server reject authenticated message sends from the account with
+// 428 Precondition Required until the returned captcha is submitted for the returned token.
+func (s *Server) RequireChallenge(account *Account, retryAfter time.Duration) (token, captcha string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account.challenge = &challenge{
+		Token:      uuid.NewString(),
+		Captcha:    uuid.NewString(),
+		RetryAfter: retryAfter,
+	}
+	return account.challenge.Token, account.challenge.Captcha
+}
+
+// writeChallenge must be called while holding the server lock.
+func writeChallenge(w http.ResponseWriter, account *Account) bool {
+	if account.challenge == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(account.challenge.RetryAfter.Seconds())))
+	writeJSON(w, http.StatusPreconditionRequired, &challengeJSON{
+		Token:   account.challenge.Token,
+		Options: []string{"recaptcha"},
+	})
+	return true
+}
+
+func (s *Server) handleSubmitChallenge(w http.ResponseWriter, r *http.Request) {
+	device := s.requireAuth(w, r)
+	if device == nil {
+		return
+	}
+	var req challengeResponseJSON
+	if !readJSON(w, r, &req) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch := device.Account.challenge
+	if req.Type != "recaptcha" {
+		writeError(w, http.StatusBadRequest)
+	} else if ch == nil || ch.Token != req.Token || ch.Captcha != req.Captcha {
+		writeError(w, http.StatusPreconditionRequired)
+	} else {
+		device.Account.challenge = nil
+		w.WriteHeader(http.StatusOK)
+	}
+}
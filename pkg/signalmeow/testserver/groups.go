@@ -0,0 +1,148 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/random"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+type groupCredential struct {
+	Credential     []byte `json:"credential"`
+	RedemptionTime int64  `json:"redemptionTime"`
+}
+
+type groupCredentialsResponse struct {
+	Credentials []groupCredential `json:"credentials"`
+	PNI         uuid.UUID         `json:"pni"`
+}
+
+func (s *Server) handleGetGroupCredentials(w http.ResponseWriter, r *http.Request) {
+	device := s.requireAuth(w, r)
+	if device == nil {
+		return
+	}
+	start, err := strconv.ParseInt(r.URL.Query().Get("redemptionStartSeconds"), 10, 64)
+	if err != nil || start%secondsPerDay != 0 {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	end, err := strconv.ParseInt(r.URL.Query().Get("redemptionEndSeconds"), 10, 64)
+	if err != nil || end < start || end-start > 7*secondsPerDay {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	resp := &groupCredentialsResponse{PNI: device.Account.PNI}
+	for redemptionTime := start; redemptionTime <= end; redemptionTime += secondsPerDay {
+		credential, err := s.zkParams.IssueAuthCredentialWithPni(device.Account.ACI, device.Account.PNI, uint64(redemptionTime))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError)
+			return
+		}
+		resp.Credentials = append(resp.Credentials, groupCredential{
+			Credential:     credential[:],
+			RedemptionTime: redemptionTime,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	// The password is an auth credential presentation, which isn't verified here.
+	publicParams, _, ok := r.BasicAuth()
+	if !ok {
+		writeError(w, http.StatusUnauthorized)
+		return
+	}
+	s.lock.Lock()
+	group, ok := s.groups[publicParams]
+	s.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+	data, err := proto.Marshal(group)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// CreateGroup creates a new group with the given members and returns the master key. The first member is an admin.
+func (s *Server) CreateGroup(title string, members ...*Account) (libsignalgo.GroupMasterKey, error) {
+	masterKey := libsignalgo.GroupMasterKey(random.Bytes(len(libsignalgo.GroupMasterKey{})))
+	secretParams, err := libsignalgo.DeriveGroupSecretParamsFromMasterKey(masterKey)
+	if err != nil {
+		return masterKey, fmt.Errorf("failed to derive group secret params: %w", err)
+	}
+	publicParams, err := secretParams.GetPublicParams()
+	if err != nil {
+		return masterKey, fmt.Errorf("failed to get group public params: %w", err)
+	}
+	titleBlob, err := proto.Marshal(&signalpb.GroupAttributeBlob{
+		Content: &signalpb.GroupAttributeBlob_Title{Title: title},
+	})
+	if err != nil {
+		return masterKey, err
+	}
+	encryptedTitle, err := secretParams.EncryptBlobWithPadding(titleBlob, 0)
+	if err != nil {
+		return masterKey, fmt.Errorf("failed to encrypt title: %w", err)
+	}
+	group := &signalpb.Group{
+		PublicKey: publicParams[:],
+		Title:     encryptedTitle,
+		Members:   make([]*signalpb.Member, len(members)),
+	}
+	for i, member := range members {
+		userID, err := secretParams.EncryptUUID(member.ACI)
+		if err != nil {
+			return masterKey, fmt.Errorf("failed to encrypt member ID: %w", err)
+		}
+		profileKey, err := secretParams.EncryptProfileKey(member.ProfileKey, member.ACI)
+		if err != nil {
+			return masterKey, fmt.Errorf("failed to encrypt member profile key: %w", err)
+		}
+		role := signalpb.Member_DEFAULT
+		if i == 0 {
+			role = signalpb.Member_ADMINISTRATOR
+		}
+		group.Members[i] = &signalpb.Member{
+			UserId:     userID[:],
+			Role:       role,
+			ProfileKey: profileKey[:],
+		}
+	}
+	s.lock.Lock()
+	s.groups[hex.EncodeToString(publicParams[:])] = group
+	s.lock.Unlock()
+	return masterKey, nil
+}
@@ -0,0 +1,186 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+type setKeysRequest struct {
+	IdentityKey        string     `json:"identityKey"`
+	PreKeys            []*keyJSON `json:"preKeys"`
+	PQPreKeys          []*keyJSON `json:"pqPreKeys"`
+	SignedPreKey       *keyJSON   `json:"signedPreKey"`
+	PQLastResortPreKey *keyJSON   `json:"pqLastResortPreKey"`
+}
+
+type keyCountResponse struct {
+	Count   int `json:"count"`
+	PQCount int `json:"pqCount"`
+}
+
+type deviceKeyResponse struct {
+	DeviceID       int      `json:"deviceId"`
+	RegistrationID int      `json:"registrationId"`
+	SignedPreKey   *keyJSON `json:"signedPreKey"`
+	PreKey         *keyJSON `json:"preKey,omitempty"`
+	PQPreKey       *keyJSON `json:"pqPreKey,omitempty"`
+}
+
+type keysResponse struct {
+	IdentityKey string               `json:"identityKey"`
+	Devices     []*deviceKeyResponse `json:"devices"`
+}
+
+func getIdentityParam(r *http.Request) types.UUIDKind {
+	if types.UUIDKind(r.URL.Query().Get("identity")) == types.UUIDKindPNI {
+		return types.UUIDKindPNI
+	}
+	return types.UUIDKindACI
+}
+
+func (s *Server) handleSetKeys(w http.ResponseWriter, r *http.Request) {
+	device := s.requireAuth(w, r)
+	if device == nil {
+		return
+	}
+	var req setKeysRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := device.keys[getIdentityParam(r)]
+	keys.IdentityKey = req.IdentityKey
+	// Like the real server, uploading one-time keys replaces all the previous ones
+	if len(req.PreKeys) > 0 {
+		keys.PreKeys = req.PreKeys
+	}
+	if len(req.PQPreKeys) > 0 {
+		keys.KyberPreKeys = req.PQPreKeys
+	}
+	if req.SignedPreKey != nil {
+		keys.SignedPreKey = req.SignedPreKey
+	}
+	if req.PQLastResortPreKey != nil {
+		keys.KyberLastResort = req.PQLastResortPreKey
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetKeyCounts(w http.ResponseWriter, r *http.Request) {
+	device := s.requireAuth(w, r)
+	if device == nil {
+		return
+	}
+	s.lock.Lock()
+	keys := device.keys[getIdentityParam(r)]
+	resp := &keyCountResponse{
+		Count:   len(keys.PreKeys),
+		PQCount: len(keys.KyberPreKeys),
+	}
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func parseServiceID(serviceID string) (uuid.UUID, types.UUIDKind, error) {
+	kind := types.UUIDKindACI
+	if strings.HasPrefix(serviceID, "PNI:") {
+		kind = types.UUIDKindPNI
+		serviceID = strings.TrimPrefix(serviceID, "PNI:")
+	}
+	parsed, err := uuid.Parse(serviceID)
+	return parsed, kind, err
+}
+
+func (s *Server) handleGetKeys(w http.ResponseWriter, r *http.Request) {
+	if s.requireAuth(w, r) == nil {
+		return
+	}
+	vars := mux.Vars(r)
+	serviceID, _, err := parseServiceID(vars["serviceID"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[serviceID]
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+	kind := types.UUIDKindACI
+	if account.PNI == serviceID {
+		kind = types.UUIDKindPNI
+	}
+	identityKey, err := account.identityKeyPair(kind).GetPublicKey().Serialize()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError)
+		return
+	}
+	var devices []*Device
+	if vars["deviceID"] == "*" {
+		for _, device := range account.devices {
+			devices = append(devices, device)
+		}
+		sort.Slice(devices, func(i, j int) bool {
+			return devices[i].ID < devices[j].ID
+		})
+	} else if deviceID, err := strconv.Atoi(vars["deviceID"]); err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	} else if device, ok := account.devices[deviceID]; ok {
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+	resp := &keysResponse{
+		IdentityKey: base64.StdEncoding.EncodeToString(identityKey),
+		Devices:     make([]*deviceKeyResponse, len(devices)),
+	}
+	for i, device := range devices {
+		keys := device.keys[kind]
+		deviceResp := &deviceKeyResponse{
+			DeviceID:       device.ID,
+			RegistrationID: device.registrationID(kind),
+			SignedPreKey:   keys.SignedPreKey,
+			PQPreKey:       keys.KyberLastResort,
+		}
+		if len(keys.PreKeys) > 0 {
+			deviceResp.PreKey = keys.PreKeys[0]
+			keys.PreKeys = keys.PreKeys[1:]
+		}
+		if len(keys.KyberPreKeys) > 0 {
+			deviceResp.PQPreKey = keys.KyberPreKeys[0]
+			keys.KyberPreKeys = keys.KyberPreKeys[1:]
+		}
+		resp.Devices[i] = deviceResp
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
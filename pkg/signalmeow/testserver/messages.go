@@ -0,0 +1,261 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+type outgoingMessage struct {
+	Type                      int    `json:"type"`
+	DestinationDeviceID       int    `json:"destinationDeviceId"`
+	DestinationRegistrationID int    `json:"destinationRegistrationId"`
+	Content                   string `json:"content"`
+}
+
+type outgoingMessages struct {
+	Timestamp uint64             `json:"timestamp"`
+	Online    bool               `json:"online"`
+	Urgent    bool               `json:"urgent"`
+	Messages  []*outgoingMessage `json:"messages"`
+}
+
+type mismatchedDevicesResponse struct {
+	MissingDevices []int `json:"missingDevices,omitempty"`
+	ExtraDevices   []int `json:"extraDevices,omitempty"`
+}
+
+type staleDevicesResponse struct {
+	StaleDevices []int `json:"staleDevices"`
+}
+
+type sendMessageResponse struct {
+	NeedsSync bool `json:"needsSync"`
+}
+
+// checkAccessKey checks the unidentified-access-key header of a sealed sender request against the
+// profile key of the target account.
+func checkAccessKey(r *http.Request, target *Account) bool {
+	rawAccessKey, err := base64.StdEncoding.DecodeString(r.Header.Get("unidentified-access-key"))
+	if err != nil || len(rawAccessKey) == 0 {
+		return false
+	}
+	accessKey, err := target.ProfileKey.DeriveAccessKey()
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(rawAccessKey, accessKey[:]) == 1
+}
+
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	sender, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	destinationID, _, err := parseServiceID(mux.Vars(r)["destination"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	var req outgoingMessages
+	if !readJSON(w, r, &req) {
+		return
+	}
+	time.Sleep(s.SendLatency)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	destination, ok := s.accounts[destinationID]
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	} else if sender == nil && !checkAccessKey(r, destination) {
+		writeError(w, http.StatusUnauthorized)
+		return
+	} else if sender != nil && writeChallenge(w, sender.Account) {
+		return
+	}
+
+	expectedDevices := make(map[int]*Device, len(destination.devices))
+	for id, device := range destination.devices {
+		if sender == nil || sender != device {
+			expectedDevices[id] = device
+		}
+	}
+	var mismatched mismatchedDevicesResponse
+	var stale staleDevicesResponse
+	gotDevices := make(map[int]struct{}, len(req.Messages))
+	for _, msg := range req.Messages {
+		gotDevices[msg.DestinationDeviceID] = struct{}{}
+		device, ok := expectedDevices[msg.DestinationDeviceID]
+		if !ok {
+			mismatched.ExtraDevices = append(mismatched.ExtraDevices, msg.DestinationDeviceID)
+		} else if device.RegistrationID != msg.DestinationRegistrationID {
+			stale.StaleDevices = append(stale.StaleDevices, msg.DestinationDeviceID)
+		}
+	}
+	for id := range expectedDevices {
+		if _, ok = gotDevices[id]; !ok {
+			mismatched.MissingDevices = append(mismatched.MissingDevices, id)
+		}
+	}
+	if len(mismatched.MissingDevices) > 0 || len(mismatched.ExtraDevices) > 0 {
+		sort.Ints(mismatched.MissingDevices)
+		sort.Ints(mismatched.ExtraDevices)
+		writeJSON(w, http.StatusConflict, &mismatched)
+		return
+	} else if len(stale.StaleDevices) > 0 {
+		writeJSON(w, http.StatusGone, &stale)
+		return
+	}
+
+	envelopes := make([]*signalpb.Envelope, len(req.Messages))
+	for i, msg := range req.Messages {
+		content, err := base64.StdEncoding.DecodeString(msg.Content)
+		if err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+		envelope := &signalpb.Envelope{
+			Type:                 signalpb.Envelope_Type(msg.Type).Enum(),
+			DestinationServiceId: proto.String(destinationID.String()),
+			Timestamp:            proto.Uint64(req.Timestamp),
+			Content:              content,
+			ServerGuid:           proto.String(uuid.NewString()),
+			ServerTimestamp:      proto.Uint64(nowMilli()),
+			Urgent:               proto.Bool(req.Urgent),
+		}
+		if envelope.GetType() != signalpb.Envelope_UNIDENTIFIED_SENDER {
+			if sender == nil {
+				writeError(w, http.StatusUnauthorized)
+				return
+			}
+			envelope.SourceServiceId = proto.String(sender.Account.ACI.String())
+			envelope.SourceDevice = proto.Uint32(uint32(sender.ID))
+		}
+		envelopes[i] = envelope
+	}
+	for i, msg := range req.Messages {
+		device := expectedDevices[msg.DestinationDeviceID]
+		device.queue = append(device.queue, envelopes[i])
+		device.wake()
+	}
+	writeJSON(w, http.StatusOK, &sendMessageResponse{})
+}
+
+func (s *Server) ackEnvelope(device *Device, serverGUID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, envelope := range device.queue {
+		if envelope.GetServerGuid() == serverGUID {
+			device.queue = append(device.queue[:i], device.queue[i+1:]...)
+			device.acked = append(device.acked, envelope)
+			return
+		}
+	}
+}
+
+// deliveryLoop pushes queued envelopes to a connected device. Envelopes stay in the queue until the
+// client acknowledges them, and unacknowledged envelopes are redelivered when the device reconnects.
+func (s *Server) deliveryLoop(ctx context.Context, device *Device, conn *wsConn) {
+	log := zerolog.Ctx(ctx)
+	sent := make(map[string]struct{})
+	queueEmptySent := false
+	for {
+		s.lock.Lock()
+		var toSend []*signalpb.Envelope
+		for _, envelope := range device.queue {
+			if _, alreadySent := sent[envelope.GetServerGuid()]; !alreadySent {
+				sent[envelope.GetServerGuid()] = struct{}{}
+				toSend = append(toSend, envelope)
+			}
+		}
+		s.lock.Unlock()
+		for _, envelope := range toSend {
+			body, err := proto.Marshal(envelope)
+			if err != nil {
+				log.Err(err).Msg("Failed to marshal envelope")
+				continue
+			}
+			serverGUID := envelope.GetServerGuid()
+			err = conn.sendRequest(ctx, http.MethodPut, "/api/v1/message", body, func(resp *signalpb.WebSocketResponseMessage) {
+				if resp.GetStatus() == http.StatusOK {
+					s.ackEnvelope(device, serverGUID)
+				} else {
+					log.Warn().Uint32("status", resp.GetStatus()).Str("server_guid", serverGUID).Msg("Client didn't accept envelope")
+				}
+			})
+			if err != nil {
+				return
+			}
+		}
+		if !queueEmptySent {
+			err := conn.sendRequest(ctx, http.MethodPut, "/api/v1/queue/empty", nil, nil)
+			if err != nil {
+				return
+			}
+			queueEmptySent = true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-device.notify:
+		}
+	}
+}
+
+type senderCertificateResponse struct {
+	Certificate []byte `json:"certificate"`
+}
+
+func (s *Server) handleGetSenderCertificate(w http.ResponseWriter, r *http.Request) {
+	device := s.requireAuth(w, r)
+	if device == nil {
+		return
+	}
+	address := libsignalgo.NewSealedSenderAddress(device.Account.Number, device.Account.ACI, uint32(device.ID))
+	cert, err := libsignalgo.NewSenderCertificate(
+		address,
+		device.Account.ACIIdentityKeyPair.GetPublicKey(),
+		time.Now().Add(7*24*time.Hour),
+		s.serverCert,
+		s.certKey,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError)
+		return
+	}
+	serialized, err := cert.Serialize()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, &senderCertificateResponse{Certificate: serialized})
+}
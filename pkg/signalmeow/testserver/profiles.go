@@ -0,0 +1,156 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.mau.fi/util/random"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+)
+
+// These match the padding the official clients use for short values.
+const (
+	namePaddedLength       = 53
+	aboutPaddedLength      = 128
+	aboutEmojiPaddedLength = 32
+)
+
+type profile struct {
+	name       []byte
+	about      []byte
+	aboutEmoji []byte
+	avatarPath string
+}
+
+type profileResponse struct {
+	UUID        uuid.UUID `json:"uuid"`
+	IdentityKey []byte    `json:"identityKey"`
+	Name        []byte    `json:"name,omitempty"`
+	About       []byte    `json:"about,omitempty"`
+	AboutEmoji  []byte    `json:"aboutEmoji,omitempty"`
+	Avatar      string    `json:"avatar,omitempty"`
+
+	UnidentifiedAccess             []byte          `json:"unidentifiedAccess,omitempty"`
+	UnrestrictedUnidentifiedAccess bool            `json:"unrestrictedUnidentifiedAccess"`
+	Capabilities                   map[string]bool `json:"capabilities"`
+}
+
+func encryptProfileField(key libsignalgo.ProfileKey, plaintext []byte, paddedLength int) ([]byte, error) {
+	if len(plaintext) > paddedLength {
+		paddedLength = len(plaintext)
+	}
+	padded := make([]byte, paddedLength)
+	copy(padded, plaintext)
+	nonce := random.Bytes(signalmeow.NONCE_LENGTH)
+	ciphertext, err := signalmeow.AesgcmEncrypt(key[:], nonce, padded)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+// SetProfile encrypts the given profile info with the account's profile key and stores it.
+// If avatar is non-empty, it's uploaded to the CDN and the path is included in the profile.
+func (s *Server) SetProfile(account *Account, name, about, aboutEmoji string, avatar []byte) error {
+	var newProfile profile
+	var err error
+	if name != "" {
+		newProfile.name, err = encryptProfileField(account.ProfileKey, []byte(name), namePaddedLength)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt name: %w", err)
+		}
+	}
+	if about != "" {
+		newProfile.about, err = encryptProfileField(account.ProfileKey, []byte(about), aboutPaddedLength)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt about: %w", err)
+		}
+	}
+	if aboutEmoji != "" {
+		newProfile.aboutEmoji, err = encryptProfileField(account.ProfileKey, []byte(aboutEmoji), aboutEmojiPaddedLength)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt about emoji: %w", err)
+		}
+	}
+	if len(avatar) > 0 {
+		encryptedAvatar, err := encryptProfileField(account.ProfileKey, avatar, 0)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt avatar: %w", err)
+		}
+		newProfile.avatarPath = "profiles/" + random.String(24)
+		s.PutCDNFile(newProfile.avatarPath, encryptedAvatar)
+	}
+	s.lock.Lock()
+	account.profile = &newProfile
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Server) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	requester, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	serviceID, _, err := parseServiceID(vars["serviceID"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[serviceID]
+	if !ok || account.ACI != serviceID {
+		writeError(w, http.StatusNotFound)
+		return
+	} else if requester == nil && !checkAccessKey(r, account) {
+		writeError(w, http.StatusUnauthorized)
+		return
+	}
+	identityKey, err := account.ACIIdentityKeyPair.GetPublicKey().Serialize()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError)
+		return
+	}
+	resp := &profileResponse{
+		UUID:         account.ACI,
+		IdentityKey:  identityKey,
+		Capabilities: map[string]bool{"pni": true},
+	}
+	if version := vars["version"]; version != "" {
+		// Encrypted fields are only returned if the requester knows the current profile key
+		currentVersion, err := account.ProfileKey.GetProfileKeyVersion(account.ACI)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError)
+			return
+		} else if currentVersion.String() != version {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		resp.Name = account.profile.name
+		resp.About = account.profile.about
+		resp.AboutEmoji = account.profile.aboutEmoji
+		resp.Avatar = account.profile.avatarPath
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
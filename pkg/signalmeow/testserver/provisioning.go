@@ -0,0 +1,268 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/random"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+	"nhooyr.io/websocket"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+func (s *Server) handleProvisioningWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close(websocket.StatusInternalError, "")
+	conn := newWSConn(ws)
+	ctx := s.Log.With().Str("websocket_type", "provisioning").Logger().WithContext(r.Context())
+
+	provisioningID := uuid.NewString()
+	s.lock.Lock()
+	s.provisioning[provisioningID] = conn
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.provisioning, provisioningID)
+		s.lock.Unlock()
+	}()
+
+	body, err := proto.Marshal(&signalpb.ProvisioningUuid{Uuid: proto.String(provisioningID)})
+	if err != nil {
+		return
+	}
+	err = conn.sendRequest(ctx, http.MethodPut, "/v1/address", body, nil)
+	if err != nil {
+		return
+	}
+	_ = conn.readLoop(ctx, nil)
+}
+
+// LinkDevice acts as the primary device of the account and sends the account keys to the client
+// that's waiting on the given sgnl://linkdevice URL. The client will then call the link device
+// endpoint and upload prekeys, after which it's a normal linked device of the account.
+func (s *Server) LinkDevice(ctx context.Context, account *Account, provisioningURL string) error {
+	parsedURL, err := url.Parse(provisioningURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse provisioning URL: %w", err)
+	}
+	provisioningID := parsedURL.Query().Get("uuid")
+	rawPublicKey, err := base64.StdEncoding.DecodeString(parsedURL.Query().Get("pub_key"))
+	if err != nil {
+		return fmt.Errorf("failed to decode provisioning public key: %w", err)
+	}
+	publicKey, err := libsignalgo.DeserializePublicKey(rawPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse provisioning public key: %w", err)
+	}
+
+	code := random.String(12)
+	s.lock.Lock()
+	conn, ok := s.provisioning[provisioningID]
+	account.provisioningCodes[code] = struct{}{}
+	s.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no provisioning websocket with ID %s", provisioningID)
+	}
+
+	message := &signalpb.ProvisionMessage{
+		Aci:                 proto.String(account.ACI.String()),
+		Pni:                 proto.String(account.PNI.String()),
+		Number:              proto.String(account.Number),
+		ProvisioningCode:    proto.String(code),
+		ProfileKey:          account.ProfileKey[:],
+		ProvisioningVersion: proto.Uint32(uint32(signalpb.ProvisioningVersion_CURRENT)),
+	}
+	message.AciIdentityKeyPublic, err = account.ACIIdentityKeyPair.GetPublicKey().Serialize()
+	if err != nil {
+		return err
+	}
+	message.AciIdentityKeyPrivate, err = account.ACIIdentityKeyPair.GetPrivateKey().Serialize()
+	if err != nil {
+		return err
+	}
+	message.PniIdentityKeyPublic, err = account.PNIIdentityKeyPair.GetPublicKey().Serialize()
+	if err != nil {
+		return err
+	}
+	message.PniIdentityKeyPrivate, err = account.PNIIdentityKeyPair.GetPrivateKey().Serialize()
+	if err != nil {
+		return err
+	}
+	envelope, err := encryptProvisionMessage(publicKey, message)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt provisioning message: %w", err)
+	}
+	body, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	respChan := make(chan uint32, 1)
+	err = conn.sendRequest(ctx, http.MethodPut, "/v1/message", body, func(resp *signalpb.WebSocketResponseMessage) {
+		respChan <- resp.GetStatus()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send provisioning message: %w", err)
+	}
+	select {
+	case status := <-respChan:
+		if status != http.StatusOK {
+			return fmt.Errorf("unexpected status %d for provisioning message", status)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// encryptProvisionMessage is the inverse of signalmeow.ProvisioningCipher.Decrypt
+func encryptProvisionMessage(theirPublicKey *libsignalgo.PublicKey, message *signalpb.ProvisionMessage) (*signalpb.ProvisionEnvelope, error) {
+	plaintext, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	ourPrivateKey, err := libsignalgo.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	ourPublicKey, err := ourPrivateKey.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	ourPublicKeyBytes, err := ourPublicKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	agreement, err := ourPrivateKey.Agree(theirPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecrets := make([]byte, 64)
+	_, err = io.ReadFull(hkdf.New(sha256.New, agreement, nil, []byte("TextSecure Provisioning Message")), sharedSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sharedSecrets[:32])
+	if err != nil {
+		return nil, err
+	}
+	paddingLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(paddingLen)}, paddingLen)...)
+	iv := random.Bytes(aes.BlockSize)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	body := append([]byte{1}, iv...)
+	body = append(body, ciphertext...)
+	mac := hmac.New(sha256.New, sharedSecrets[32:])
+	mac.Write(body)
+	body = mac.Sum(body)
+	return &signalpb.ProvisionEnvelope{
+		PublicKey: ourPublicKeyBytes,
+		Body:      body,
+	}, nil
+}
+
+type linkDeviceRequest struct {
+	VerificationCode  string `json:"verificationCode"`
+	AccountAttributes struct {
+		Name              []byte `json:"name"`
+		RegistrationID    int    `json:"registrationId"`
+		PNIRegistrationID int    `json:"pniRegistrationId"`
+	} `json:"accountAttributes"`
+	ACISignedPreKey       *keyJSON `json:"aciSignedPreKey"`
+	PNISignedPreKey       *keyJSON `json:"pniSignedPreKey"`
+	ACIPQLastResortPreKey *keyJSON `json:"aciPqLastResortPreKey"`
+	PNIPQLastResortPreKey *keyJSON `json:"pniPqLastResortPreKey"`
+}
+
+type linkDeviceResponse struct {
+	ACI      uuid.UUID `json:"uuid"`
+	PNI      uuid.UUID `json:"pni"`
+	DeviceID int       `json:"deviceId"`
+}
+
+func (s *Server) handleLinkDevice(w http.ResponseWriter, r *http.Request) {
+	number, password, ok := r.BasicAuth()
+	if !ok {
+		writeError(w, http.StatusUnauthorized)
+		return
+	}
+	var req linkDeviceRequest
+	if !readJSON(w, r, &req) {
+		return
+	} else if req.ACISignedPreKey == nil || req.PNISignedPreKey == nil || req.ACIPQLastResortPreKey == nil || req.PNIPQLastResortPreKey == nil {
+		writeError(w, http.StatusUnprocessableEntity)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accountsByNumber[number]
+	if !ok {
+		writeError(w, http.StatusForbidden)
+		return
+	} else if _, ok = account.provisioningCodes[req.VerificationCode]; !ok {
+		writeError(w, http.StatusForbidden)
+		return
+	}
+	delete(account.provisioningCodes, req.VerificationCode)
+	device := &Device{
+		Account:           account,
+		ID:                account.nextDeviceID,
+		Password:          password,
+		RegistrationID:    req.AccountAttributes.RegistrationID,
+		PNIRegistrationID: req.AccountAttributes.PNIRegistrationID,
+		Name:              req.AccountAttributes.Name,
+		keys: map[types.UUIDKind]*deviceKeys{
+			types.UUIDKindACI: {
+				SignedPreKey:    req.ACISignedPreKey,
+				KyberLastResort: req.ACIPQLastResortPreKey,
+			},
+			types.UUIDKindPNI: {
+				SignedPreKey:    req.PNISignedPreKey,
+				KyberLastResort: req.PNIPQLastResortPreKey,
+			},
+		},
+		notify: make(chan struct{}, 1),
+	}
+	account.nextDeviceID++
+	account.devices[device.ID] = device
+	writeJSON(w, http.StatusOK, &linkDeviceResponse{
+		ACI:      account.ACI,
+		PNI:      account.PNI,
+		DeviceID: device.ID,
+	})
+}
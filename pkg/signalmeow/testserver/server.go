@@ -0,0 +1,263 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package testserver implements an in-process fake of the Signal chat, storage and CDN servers.
+//
+// It only implements the subset of the API that signalmeow uses, and it doesn't validate most things
+// a real server would (e.g. zkgroup presentations), so it's only meant for end-to-end tests of the client.
+package testserver
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/web"
+)
+
+// Server is a fake Signal server listening on a random local port.
+type Server struct {
+	HTTP *httptest.Server
+	// Env is the environment pointing at this server. All hosts (chat, storage, CDNs) are the same.
+	Env *signalmeow.Environment
+	// Signal is the server config that should be passed to signalmeow clients.
+	Signal *signalmeow.Server
+	Log    zerolog.Logger
+	// SendLatency is added to every message send request to simulate the round trip to a real server.
+	SendLatency time.Duration
+
+	router *mux.Router
+
+	zkParams   *libsignalgo.ServerSecretParams
+	trustRoot  *libsignalgo.PrivateKey
+	certKey    *libsignalgo.PrivateKey
+	serverCert *libsignalgo.ServerCertificate
+
+	lock             sync.Mutex
+	accounts         map[uuid.UUID]*Account
+	accountsByNumber map[string]*Account
+	provisioning     map[string]*wsConn
+	cdn              map[string][]byte
+	groups           map[string]*signalpb.Group
+}
+
+// New starts a new fake server. The returned server must be closed with Close after use.
+func New(log zerolog.Logger) (*Server, error) {
+	zkParams, err := libsignalgo.GenerateServerSecretParams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate zkgroup params: %w", err)
+	}
+	publicParams, err := zkParams.GetPublicParams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zkgroup public params: %w", err)
+	}
+	trustRoot, err := libsignalgo.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate trust root: %w", err)
+	}
+	trustRootPublic, err := trustRoot.GetPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trust root public key: %w", err)
+	}
+	trustRootBytes, err := trustRootPublic.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize trust root: %w", err)
+	}
+	certKey, err := libsignalgo.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate server certificate key: %w", err)
+	}
+	certPublicKey, err := certKey.GetPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server certificate public key: %w", err)
+	}
+	serverCert, err := libsignalgo.NewServerCertificate(1, certPublicKey, trustRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server certificate: %w", err)
+	}
+
+	s := &Server{
+		Log:              log,
+		router:           mux.NewRouter(),
+		zkParams:         zkParams,
+		trustRoot:        trustRoot,
+		certKey:          certKey,
+		serverCert:       serverCert,
+		accounts:         make(map[uuid.UUID]*Account),
+		accountsByNumber: make(map[string]*Account),
+		provisioning:     make(map[string]*wsConn),
+		cdn:              make(map[string][]byte),
+		groups:           make(map[string]*signalpb.Group),
+	}
+	s.registerRoutes()
+	s.HTTP = httptest.NewUnstartedServer(s.router)
+	s.HTTP.StartTLS()
+
+	host := s.HTTP.Listener.Addr().String()
+	hosts := web.Hosts{
+		API:              host,
+		Storage:          host,
+		ContactDiscovery: host,
+		CDN: map[uint32]string{
+			0: host,
+			2: host,
+			3: host,
+		},
+	}
+	s.Env = &signalmeow.Environment{
+		Name:               "test",
+		Hosts:              hosts,
+		ServerPublicParams: publicParams[:],
+		TrustRoot:          base64.StdEncoding.EncodeToString(trustRootBytes),
+		// Contact discovery isn't implemented, but the environment requires some enclave ID
+		ContactDiscoveryMrenclave: hex.EncodeToString(make([]byte, 32)),
+	}
+	s.Signal, err = s.Env.NewServer(&web.Transport{Hosts: hosts, Client: s.HTTP.Client()})
+	if err != nil {
+		s.HTTP.Close()
+		return nil, fmt.Errorf("failed to create signalmeow server config: %w", err)
+	}
+	return s, nil
+}
+
+// Close stops the server and disconnects all websockets.
+func (s *Server) Close() {
+	s.HTTP.CloseClientConnections()
+	s.HTTP.Close()
+}
+
+func (s *Server) registerRoutes() {
+	r := s.router
+	r.HandleFunc(web.WebsocketPath, s.handleWebsocket).Methods(http.MethodGet)
+	r.HandleFunc(web.WebsocketProvisioningPath, s.handleProvisioningWebsocket).Methods(http.MethodGet)
+	r.HandleFunc("/v1/devices/link", s.handleLinkDevice).Methods(http.MethodPut)
+
+	r.HandleFunc("/v2/keys", s.handleSetKeys).Methods(http.MethodPut)
+	r.HandleFunc("/v2/keys", s.handleGetKeyCounts).Methods(http.MethodGet)
+	r.HandleFunc("/v2/keys/{serviceID}/{deviceID}", s.handleGetKeys).Methods(http.MethodGet)
+
+	r.HandleFunc("/v1/certificate/delivery", s.handleGetSenderCertificate).Methods(http.MethodGet)
+	r.HandleFunc("/v1/certificate/auth/group", s.handleGetGroupCredentials).Methods(http.MethodGet)
+	r.HandleFunc("/v1/messages/{destination}", s.handleSendMessage).Methods(http.MethodPut)
+	r.HandleFunc("/v1/challenge", s.handleSubmitChallenge).Methods(http.MethodPut)
+
+	r.HandleFunc("/v1/profile/{serviceID}", s.handleGetProfile).Methods(http.MethodGet)
+	r.HandleFunc("/v1/profile/{serviceID}/{version}", s.handleGetProfile).Methods(http.MethodGet)
+	r.HandleFunc("/v1/profile/{serviceID}/{version}/{credentialRequest}", s.handleGetProfile).Methods(http.MethodGet)
+
+	r.HandleFunc("/v1/groups", s.handleGetGroup).Methods(http.MethodGet)
+
+	r.HandleFunc("/v3/attachments/form/upload", s.handleGetUploadForm).Methods(http.MethodGet)
+	r.HandleFunc("/upload/{key}", s.handleAllocateUpload).Methods(http.MethodPost)
+	r.HandleFunc("/upload/{key}", s.handleUpload).Methods(http.MethodPut)
+	r.HandleFunc("/{path:(?:attachments|profiles|groups|stickers)/.+}", s.handleDownload).Methods(http.MethodGet)
+}
+
+func (s *Server) url(path string) string {
+	return "https://" + s.HTTP.Listener.Addr().String() + path
+}
+
+type contextKey int
+
+const contextKeyDevice contextKey = iota
+
+// authenticate returns the device that made the request, either based on the websocket the request
+// came through, or the basic auth header. Requests with invalid credentials are rejected with 401 and
+// a nil device is returned. Unauthenticated requests return a nil device without writing anything.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (device *Device, ok bool) {
+	if device, ok = r.Context().Value(contextKeyDevice).(*Device); ok {
+		return device, true
+	}
+	username, password, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		return nil, true
+	}
+	device = s.deviceByLogin(username)
+	if device == nil || device.Password != password {
+		writeError(w, http.StatusUnauthorized)
+		return nil, false
+	}
+	return device, true
+}
+
+// requireAuth is like authenticate, but also rejects unauthenticated requests.
+func (s *Server) requireAuth(w http.ResponseWriter, r *http.Request) *Device {
+	device, ok := s.authenticate(w, r)
+	if ok && device == nil {
+		writeError(w, http.StatusUnauthorized)
+	}
+	return device
+}
+
+func (s *Server) deviceByLogin(username string) *Device {
+	rawACI, rawDeviceID, hasDeviceID := strings.Cut(username, ".")
+	deviceID := 1
+	if hasDeviceID {
+		var err error
+		deviceID, err = strconv.Atoi(rawDeviceID)
+		if err != nil {
+			return nil
+		}
+	}
+	aci, err := uuid.Parse(rawACI)
+	if err != nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	account, ok := s.accounts[aci]
+	if !ok || account.ACI != aci {
+		return nil
+	}
+	return account.devices[deviceID]
+}
+
+func writeError(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, into any) bool {
+	err := json.NewDecoder(r.Body).Decode(into)
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func nowMilli() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
@@ -0,0 +1,80 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"go.mau.fi/util/random"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+func encryptStickerData(packKey, data []byte) ([]byte, error) {
+	keys := make([]byte, 64)
+	_, err := io.ReadFull(hkdf.New(sha256.New, packKey, nil, []byte("Sticker Pack")), keys)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	plaintext := append(bytes.Clone(data), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	iv := random.Bytes(aes.BlockSize)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+	mac := hmac.New(sha256.New, keys[32:])
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	return mac.Sum(append(iv, ciphertext...)), nil
+}
+
+// PutStickerPack encrypts a sticker pack manifest and the sticker images with a new random pack key and stores them
+// on the CDN. The images map is keyed by sticker ID.
+func (s *Server) PutStickerPack(pack *signalpb.Pack, images map[uint32][]byte) (packID, packKey []byte, err error) {
+	packID = random.Bytes(16)
+	packKey = random.Bytes(32)
+	manifest, err := proto.Marshal(pack)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	encryptedManifest, err := encryptStickerData(packKey, manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt manifest: %w", err)
+	}
+	hexID := hex.EncodeToString(packID)
+	s.PutCDNFile(fmt.Sprintf("stickers/%s/manifest.proto", hexID), encryptedManifest)
+	for stickerID, image := range images {
+		encryptedImage, err := encryptStickerData(packKey, image)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt sticker %d: %w", stickerID, err)
+		}
+		s.PutCDNFile(fmt.Sprintf("stickers/%s/full/%d", hexID, stickerID), encryptedImage)
+	}
+	return packID, packKey, nil
+}
@@ -0,0 +1,648 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"google.golang.org/protobuf/proto"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/store"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/testserver"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
+)
+
+const eventTimeout = 10 * time.Second
+
+type testClient struct {
+	*signalmeow.Client
+	Account   *testserver.Account
+	Container *store.StoreContainer
+	Events    chan events.SignalEvent
+}
+
+func newTestServer(t testing.TB) (context.Context, *testserver.Server) {
+	log := zerolog.New(zerolog.NewTestWriter(t)).Level(zerolog.DebugLevel)
+	srv, err := testserver.New(log)
+	require.NoError(t, err)
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithTimeout(log.WithContext(context.Background()), time.Minute)
+	t.Cleanup(cancel)
+	return ctx, srv
+}
+
+func newStore(t testing.TB, ctx context.Context) *store.StoreContainer {
+	path := filepath.Join(t.TempDir(), "signalmeow.db")
+	db, err := dbutil.NewWithDialect("file:"+path+"?_foreign_keys=on&_busy_timeout=5000", "sqlite3")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	container := store.NewStore(db, dbutil.ZeroLogger(*zerolog.Ctx(ctx)))
+	require.NoError(t, container.Upgrade(ctx))
+	return container
+}
+
+// linkClient creates a new account on the server, links a signalmeow client to it and connects the client.
+func linkClient(t testing.TB, ctx context.Context, srv *testserver.Server, number string) *testClient {
+	account, err := srv.CreateAccount(number)
+	require.NoError(t, err)
+	container := newStore(t, ctx)
+
+	provChan := signalmeow.PerformProvisioning(ctx, srv.Signal, container, "signalmeow test")
+	resp := <-provChan
+	require.NoError(t, resp.Err)
+	require.Equal(t, signalmeow.StateProvisioningURLReceived, resp.State)
+	require.NoError(t, srv.LinkDevice(ctx, account, resp.ProvisioningURL))
+	resp = <-provChan
+	require.NoError(t, resp.Err)
+	require.Equal(t, signalmeow.StateProvisioningDataReceived, resp.State)
+	data := resp.ProvisioningData
+	assert.Equal(t, account.ACI, data.ACI)
+	assert.Equal(t, account.PNI, data.PNI)
+	assert.Equal(t, number, data.Number)
+	resp = <-provChan
+	require.NoError(t, resp.Err)
+	require.Equal(t, signalmeow.StateProvisioningPreKeysRegistered, resp.State)
+
+	device, err := container.DeviceByACI(ctx, data.ACI)
+	require.NoError(t, err)
+	require.NotNil(t, device)
+	tc := &testClient{
+		Account:   account,
+		Container: container,
+		Events:    make(chan events.SignalEvent, 100),
+	}
+	tc.Client = &signalmeow.Client{
+		Store:  device,
+		Server: srv.Signal,
+		EventHandler: func(evt events.SignalEvent) {
+			tc.Events <- evt
+		},
+	}
+	connect(t, ctx, tc)
+	t.Cleanup(func() {
+		_ = tc.StopReceiveLoops()
+	})
+	return tc
+}
+
+func connect(t testing.TB, ctx context.Context, tc *testClient) {
+	statusChan, err := tc.StartReceiveLoops(ctx)
+	require.NoError(t, err)
+	for {
+		select {
+		case status := <-statusChan:
+			require.NoError(t, status.Err)
+			if status.Event == signalmeow.SignalConnectionEventConnected {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for client to connect")
+		}
+	}
+}
+
+func waitForEvent[T events.SignalEvent](t testing.TB, tc *testClient) T {
+	timeout := time.After(eventTimeout)
+	for {
+		select {
+		case evt := <-tc.Events:
+			if typedEvt, ok := evt.(T); ok {
+				return typedEvt
+			}
+		case <-timeout:
+			var zero T
+			t.Fatalf("timed out waiting for %T", zero)
+			return zero
+		}
+	}
+}
+
+func textMessage(text string) *signalpb.Content {
+	return &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{
+			Body:      proto.String(text),
+			Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		},
+	}
+}
+
+func TestLinkDevice(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	waitForEvent[*events.QueueEmpty](t, alice)
+
+	assert.Equal(t, []int{alice.Store.DeviceID}, srv.Devices(alice.Account))
+	count, pqCount, err := alice.GetMyKeyCounts(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	assert.NotZero(t, count)
+	assert.NotZero(t, pqCount)
+}
+
+func TestSendMessage(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	// The first message is sent without sealed sender, because alice doesn't know bob's profile key yet
+	result := alice.SendMessage(ctx, bob.Account.ACI, textMessage("Hello Bob"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	assert.False(t, result.SuccessfulSendResult.Unidentified)
+	evt := waitForEvent[*events.ChatEvent](t, bob)
+	assert.Equal(t, alice.Account.ACI, evt.Info.Sender)
+	assert.Equal(t, "Hello Bob", evt.Event.(*signalpb.DataMessage).GetBody())
+
+	// The message included alice's profile key, so bob can reply with sealed sender
+	result = bob.SendMessage(ctx, alice.Account.ACI, textMessage("Hello Alice"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	assert.True(t, result.SuccessfulSendResult.Unidentified)
+	evt = waitForEvent[*events.ChatEvent](t, alice)
+	assert.Equal(t, bob.Account.ACI, evt.Info.Sender)
+	assert.Equal(t, "Hello Alice", evt.Event.(*signalpb.DataMessage).GetBody())
+
+	require.Eventually(t, func() bool {
+		return srv.QueueLength(alice.Account, alice.Store.DeviceID) == 0 &&
+			srv.QueueLength(bob.Account, bob.Store.DeviceID) == 0
+	}, eventTimeout, 50*time.Millisecond, "messages weren't acknowledged")
+}
+
+func TestRateLimitChallenge(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	token, captcha := srv.RequireChallenge(alice.Account, time.Hour)
+	result := alice.SendMessage(ctx, bob.Account.ACI, textMessage("Hello Bob"))
+	require.False(t, result.WasSuccessful)
+	var challengeErr *signalmeow.RateLimitChallengeError
+	require.ErrorAs(t, result.Error, &challengeErr)
+	assert.Equal(t, token, challengeErr.Token)
+	assert.Equal(t, time.Hour, challengeErr.RetryAfter)
+	challengeEvt := waitForEvent[*events.RateLimitChallenge](t, alice)
+	assert.Equal(t, token, challengeEvt.Token)
+	assert.Equal(t, alice.PendingRateLimitChallenge(), challengeErr)
+
+	assert.Error(t, alice.SubmitRateLimitChallenge(ctx, token, "wrong"))
+	require.NotNil(t, alice.PendingRateLimitChallenge())
+	require.NoError(t, alice.SubmitRateLimitChallenge(ctx, token, "signalcaptcha://"+captcha))
+	assert.Nil(t, alice.PendingRateLimitChallenge())
+
+	result = alice.SendMessage(ctx, bob.Account.ACI, textMessage("Hello Bob"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt := waitForEvent[*events.ChatEvent](t, bob)
+	assert.Equal(t, "Hello Bob", evt.Event.(*signalpb.DataMessage).GetBody())
+}
+
+func TestConcurrentSends(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	// Sends to the same recipient from different goroutines must not race on the session
+	const count = 10
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			result := alice.SendMessage(ctx, bob.Account.ACI, textMessage(fmt.Sprintf("Message #%d", i)))
+			assert.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+		}(i)
+	}
+	wg.Wait()
+	received := make(map[string]struct{}, count)
+	for len(received) < count {
+		evt := waitForEvent[*events.ChatEvent](t, bob)
+		received[evt.Event.(*signalpb.DataMessage).GetBody()] = struct{}{}
+	}
+}
+
+func TestReceiveOrder(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+	carol := linkClient(t, ctx, srv, "+15550000003")
+	require.NoError(t, bob.StopReceiveLoops())
+	var stages sync.Map
+	bob.TrackEnvelopeStage = func(stage string, duration time.Duration) {
+		stages.Store(stage, struct{}{})
+	}
+
+	// Envelopes from different senders may be handled in parallel, but each sender's messages must stay in order
+	const count = 10
+	for i := 0; i < count; i++ {
+		for _, sender := range []*testClient{alice, carol} {
+			result := sender.SendMessage(ctx, bob.Account.ACI, textMessage(fmt.Sprintf("Message #%d", i)))
+			require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+		}
+	}
+	connect(t, ctx, bob)
+	next := map[uuid.UUID]int{alice.Account.ACI: 0, carol.Account.ACI: 0}
+	for received := 0; received < count*2; received++ {
+		evt := waitForEvent[*events.ChatEvent](t, bob)
+		sender := evt.Info.Sender
+		assert.Equal(t, fmt.Sprintf("Message #%d", next[sender]), evt.Event.(*signalpb.DataMessage).GetBody())
+		next[sender]++
+	}
+	waitForEvent[*events.QueueEmpty](t, bob)
+	for _, stage := range []string{signalmeow.EnvelopeStageQueue, signalmeow.EnvelopeStageDecrypt, signalmeow.EnvelopeStageHandle} {
+		_, ok := stages.Load(stage)
+		assert.True(t, ok, "stage %s wasn't tracked", stage)
+	}
+}
+
+func TestResetSession(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	result := alice.SendMessage(ctx, bob.Account.ACI, textMessage("Before reset"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	waitForEvent[*events.ChatEvent](t, bob)
+
+	// Bob should notice that Alice started a new session while the old one was active
+	require.NoError(t, alice.ResetSession(ctx, bob.Account.ACI))
+	reset := waitForEvent[*events.SessionReset](t, bob)
+	assert.Equal(t, alice.Account.ACI, reset.Info.Sender)
+	assert.Equal(t, alice.Account.ACI.String(), reset.Info.ChatID)
+	result = alice.SendMessage(ctx, bob.Account.ACI, textMessage("After reset"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt := waitForEvent[*events.ChatEvent](t, bob)
+	assert.Equal(t, "After reset", evt.Event.(*signalpb.DataMessage).GetBody())
+
+	// Explicit END_SESSION messages are emitted through the inbox
+	result = bob.SendMessage(ctx, alice.Account.ACI, &signalpb.Content{
+		DataMessage: &signalpb.DataMessage{
+			Flags:     proto.Uint32(uint32(signalpb.DataMessage_END_SESSION)),
+			Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		},
+	})
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	reset = waitForEvent[*events.SessionReset](t, alice)
+	assert.Equal(t, bob.Account.ACI, reset.Info.Sender)
+	assert.NotEmpty(t, reset.Info.ServerGUID)
+}
+
+func TestExportImportDevice(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+	result := alice.SendMessage(ctx, bob.Account.ACI, textMessage("Before export"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	waitForEvent[*events.ChatEvent](t, bob)
+	require.NoError(t, bob.StopReceiveLoops())
+
+	archive, err := bob.Container.ExportDevice(ctx, bob.Account.ACI, "hunter2")
+	require.NoError(t, err)
+	newContainer := newStore(t, ctx)
+	_, err = store.OpenDeviceExport(archive, "wrong")
+	assert.ErrorIs(t, err, store.ErrWrongExportPassphrase)
+	export, err := store.OpenDeviceExport(archive, "hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, bob.Account.ACI, export.ACI())
+	device, err := newContainer.ImportDevice(ctx, export)
+	require.NoError(t, err)
+	assert.Equal(t, bob.Store.DeviceData, device.DeviceData)
+
+	// The imported device should continue the existing sessions
+	movedBob := &testClient{
+		Account:   bob.Account,
+		Container: newContainer,
+		Events:    make(chan events.SignalEvent, 100),
+	}
+	movedBob.Client = &signalmeow.Client{
+		Store:  device,
+		Server: srv.Signal,
+		EventHandler: func(evt events.SignalEvent) {
+			movedBob.Events <- evt
+		},
+	}
+	connect(t, ctx, movedBob)
+	t.Cleanup(func() {
+		_ = movedBob.StopReceiveLoops()
+	})
+	result = alice.SendMessage(ctx, bob.Account.ACI, textMessage("After import"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt := waitForEvent[*events.ChatEvent](t, movedBob)
+	assert.Equal(t, "After import", evt.Event.(*signalpb.DataMessage).GetBody())
+	result = movedBob.SendMessage(ctx, alice.Account.ACI, textMessage("Reply"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt = waitForEvent[*events.ChatEvent](t, alice)
+	assert.Equal(t, "Reply", evt.Event.(*signalpb.DataMessage).GetBody())
+}
+
+func TestAttachments(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	data := []byte("this is definitely a cat picture")
+	pointer, err := alice.UploadAttachment(ctx, data)
+	require.NoError(t, err)
+	downloaded, err := bob.DownloadAttachment(ctx, pointer)
+	require.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+}
+
+func TestStickerPack(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+
+	image := []byte("not really a webp")
+	packID, packKey, err := srv.PutStickerPack(&signalpb.Pack{
+		Title:  proto.String("Cats"),
+		Author: proto.String("Alice"),
+		Cover:  &signalpb.Pack_Sticker{Id: proto.Uint32(0), Emoji: proto.String("🐈")},
+		Stickers: []*signalpb.Pack_Sticker{
+			{Id: proto.Uint32(0), Emoji: proto.String("🐈"), ContentType: proto.String("image/webp")},
+		},
+	}, map[uint32][]byte{0: image})
+	require.NoError(t, err)
+
+	pack, err := alice.FetchStickerPack(ctx, packID, packKey)
+	require.NoError(t, err)
+	assert.Equal(t, "Cats", pack.GetTitle())
+	assert.Equal(t, "Alice", pack.GetAuthor())
+	require.Len(t, pack.GetStickers(), 1)
+	assert.Equal(t, "🐈", pack.GetStickers()[0].GetEmoji())
+	downloaded, err := alice.DownloadSticker(ctx, packID, packKey, 0)
+	require.NoError(t, err)
+	assert.Equal(t, image, downloaded)
+
+	_, err = alice.DownloadSticker(ctx, packID, make([]byte, 32), 0)
+	assert.ErrorIs(t, err, signalmeow.ErrInvalidMACForSticker)
+}
+
+func TestProfile(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	avatar := []byte("not really a png")
+	require.NoError(t, srv.SetProfile(alice.Account, "Alice", "Testing things", "🐈", avatar))
+	require.NoError(t, bob.Store.ProfileKeyStore.StoreProfileKey(ctx, alice.Account.ACI, alice.Account.ProfileKey))
+
+	profile, err := bob.RetrieveProfileByID(ctx, alice.Account.ACI)
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", profile.Name)
+	assert.Equal(t, "Testing things", profile.About)
+	assert.Equal(t, "🐈", profile.AboutEmoji)
+	require.NotEmpty(t, profile.AvatarPath)
+	downloadedAvatar, err := bob.DownloadUserAvatar(ctx, profile.AvatarPath, &profile.Key)
+	require.NoError(t, err)
+	assert.Equal(t, avatar, downloadedAvatar)
+}
+
+func TestGroup(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	masterKey, err := srv.CreateGroup("Test group", alice.Account, bob.Account)
+	require.NoError(t, err)
+	gid, err := alice.StoreMasterKey(ctx, types.SerializedGroupMasterKey(base64.StdEncoding.EncodeToString(masterKey[:])))
+	require.NoError(t, err)
+	group, err := alice.RetrieveGroupByID(ctx, gid, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "Test group", group.Title)
+	require.Len(t, group.Members, 2)
+	assert.Equal(t, alice.Account.ACI, group.Members[0].UserID)
+	assert.Equal(t, signalmeow.GroupMember_ADMINISTRATOR, group.Members[0].Role)
+	assert.Equal(t, bob.Account.ACI, group.Members[1].UserID)
+	assert.Equal(t, bob.Account.ProfileKey, group.Members[1].ProfileKey)
+
+	// Fetching the group stored bob's profile key, so this is sent with sealed sender
+	result, err := alice.SendGroupMessage(ctx, gid, textMessage("Hello group"))
+	require.NoError(t, err)
+	require.Len(t, result.SuccessfullySentTo, 1)
+	assert.True(t, result.SuccessfullySentTo[0].Unidentified)
+	evt := waitForEvent[*events.ChatEvent](t, bob)
+	assert.Equal(t, alice.Account.ACI, evt.Info.Sender)
+	assert.Equal(t, string(gid), evt.Info.ChatID)
+	assert.Equal(t, "Hello group", evt.Event.(*signalpb.DataMessage).GetBody())
+}
+
+func TestGroupSendOrder(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+	carol := linkClient(t, ctx, srv, "+15550000003")
+
+	masterKey, err := srv.CreateGroup("Test group", alice.Account, bob.Account, carol.Account)
+	require.NoError(t, err)
+	gid, err := alice.StoreMasterKey(ctx, types.SerializedGroupMasterKey(base64.StdEncoding.EncodeToString(masterKey[:])))
+	require.NoError(t, err)
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		result, err := alice.SendGroupMessage(ctx, gid, textMessage(fmt.Sprintf("Message #%d", i)))
+		require.NoError(t, err)
+		require.Len(t, result.SuccessfullySentTo, 2)
+	}
+	for _, member := range []*testClient{bob, carol} {
+		for i := 0; i < count; i++ {
+			evt := waitForEvent[*events.ChatEvent](t, member)
+			assert.Equal(t, fmt.Sprintf("Message #%d", i), evt.Event.(*signalpb.DataMessage).GetBody())
+		}
+	}
+}
+
+func TestInboxReplay(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+
+	msg := textMessage("Hello Bob")
+	result := alice.SendMessage(ctx, bob.Account.ACI, msg)
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt := waitForEvent[*events.ChatEvent](t, bob)
+	require.NotEmpty(t, evt.Info.ServerGUID)
+	entry, err := bob.Store.InboxStore.GetInboxEntry(ctx, evt.Info.ServerGUID)
+	require.NoError(t, err)
+	require.NotNil(t, entry, "message wasn't stored in inbox")
+
+	// The envelope was acknowledged, but the event wasn't marked as handled, so it should be replayed after reconnecting
+	require.Eventually(t, func() bool {
+		return srv.QueueLength(bob.Account, bob.Store.DeviceID) == 0
+	}, eventTimeout, 50*time.Millisecond, "message wasn't acknowledged")
+	require.NoError(t, bob.StopReceiveLoops())
+	connect(t, ctx, bob)
+	replayedEvt := waitForEvent[*events.ChatEvent](t, bob)
+	assert.Equal(t, evt.Info.ServerGUID, replayedEvt.Info.ServerGUID)
+	assert.Equal(t, msg.DataMessage.GetTimestamp(), replayedEvt.Event.(*signalpb.DataMessage).GetTimestamp())
+
+	// Failed entries are kept so they can be retried
+	require.NoError(t, bob.MarkInboxEntryHandled(ctx, evt.Info.ServerGUID, signalmeow.InboxEntryFailed))
+	entry, err = bob.Store.InboxStore.GetInboxEntry(ctx, evt.Info.ServerGUID)
+	require.NoError(t, err)
+	assert.NotNil(t, entry)
+
+	require.NoError(t, bob.MarkInboxEntryHandled(ctx, evt.Info.ServerGUID, signalmeow.InboxEntryBridged))
+	entry, err = bob.Store.InboxStore.GetInboxEntry(ctx, evt.Info.ServerGUID)
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+	receipt := waitForEvent[*events.Receipt](t, alice)
+	assert.Equal(t, bob.Account.ACI, receipt.Sender)
+	assert.Equal(t, signalpb.ReceiptMessage_DELIVERY, receipt.Content.GetType())
+	assert.Equal(t, []uint64{msg.DataMessage.GetTimestamp()}, receipt.Content.GetTimestamp())
+}
+
+func TestDuplicateEnvelope(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+	var duplicates []signalpb.Envelope_Type
+	var duplicatesLock sync.Mutex
+	bob.TrackDuplicateEnvelope = func(envelopeType signalpb.Envelope_Type) {
+		duplicatesLock.Lock()
+		duplicates = append(duplicates, envelopeType)
+		duplicatesLock.Unlock()
+	}
+
+	// Send one normal message and one sealed sender group message
+	result := alice.SendMessage(ctx, bob.Account.ACI, textMessage("Hello Bob"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt := waitForEvent[*events.ChatEvent](t, bob)
+	require.NoError(t, bob.MarkInboxEntryHandled(ctx, evt.Info.ServerGUID, signalmeow.InboxEntryIgnored))
+	masterKey, err := srv.CreateGroup("Test group", alice.Account, bob.Account)
+	require.NoError(t, err)
+	gid, err := alice.StoreMasterKey(ctx, types.SerializedGroupMasterKey(base64.StdEncoding.EncodeToString(masterKey[:])))
+	require.NoError(t, err)
+	groupResult, err := alice.SendGroupMessage(ctx, gid, textMessage("Hello group"))
+	require.NoError(t, err)
+	require.Len(t, groupResult.SuccessfullySentTo, 1)
+	require.True(t, groupResult.SuccessfullySentTo[0].Unidentified)
+	evt = waitForEvent[*events.ChatEvent](t, bob)
+	require.NoError(t, bob.MarkInboxEntryHandled(ctx, evt.Info.ServerGUID, signalmeow.InboxEntryIgnored))
+	require.Eventually(t, func() bool {
+		return srv.QueueLength(bob.Account, bob.Store.DeviceID) == 0
+	}, eventTimeout, 50*time.Millisecond, "messages weren't acknowledged")
+
+	// Redeliver everything after a reconnect: all envelopes should be acknowledged without emitting events
+	requeued := srv.RedeliverAcked(bob.Account, bob.Store.DeviceID)
+	require.NoError(t, bob.StopReceiveLoops())
+	connect(t, ctx, bob)
+	waitForEvent[*events.QueueEmpty](t, bob)
+	assert.Zero(t, srv.QueueLength(bob.Account, bob.Store.DeviceID))
+	duplicatesLock.Lock()
+	defer duplicatesLock.Unlock()
+	assert.Len(t, duplicates, requeued)
+	assert.Contains(t, duplicates, signalpb.Envelope_UNIDENTIFIED_SENDER)
+	for len(bob.Events) > 0 {
+		_, isChatEvent := (<-bob.Events).(*events.ChatEvent)
+		assert.False(t, isChatEvent, "duplicate envelope emitted a chat event")
+	}
+}
+
+func TestRotateSignedPreKeys(t *testing.T) {
+	ctx, srv := newTestServer(t)
+	alice := linkClient(t, ctx, srv, "+15550000001")
+	bob := linkClient(t, ctx, srv, "+15550000002")
+	waitForEvent[*events.QueueEmpty](t, alice)
+	oldSignedID, oldLastResortID := srv.SignedPreKeyIDs(alice.Account, alice.Store.DeviceID, types.UUIDKindACI)
+	require.NotZero(t, oldSignedID)
+	require.NotZero(t, oldLastResortID)
+
+	// Use a separate client for the same device, so the key check loop of alice doesn't interfere
+	rotator := &signalmeow.Client{
+		Store:                        alice.Store,
+		Server:                       srv.Signal,
+		SignedPreKeyRotationInterval: time.Nanosecond,
+		ReplacedPreKeyGracePeriod:    time.Hour,
+	}
+	require.NoError(t, rotator.RotateSignedPreKeysIfNeeded(ctx, types.UUIDKindACI))
+	newSignedID, newLastResortID := srv.SignedPreKeyIDs(alice.Account, alice.Store.DeviceID, types.UUIDKindACI)
+	assert.NotEqual(t, oldSignedID, newSignedID)
+	assert.NotEqual(t, oldLastResortID, newLastResortID)
+
+	// Bob fetches the new keys to start a session
+	result := bob.SendMessage(ctx, alice.Account.ACI, textMessage("After rotation"))
+	require.True(t, result.WasSuccessful, "send failed: %+v", result.FailedSendResult)
+	evt := waitForEvent[*events.ChatEvent](t, alice)
+	assert.Equal(t, "After rotation", evt.Event.(*signalpb.DataMessage).GetBody())
+
+	// The old keys are kept until the grace period has passed
+	extras := alice.Store.PreKeyStoreExtras
+	require.NoError(t, rotator.PruneReplacedPreKeys(ctx))
+	oldSigned, err := extras.SignedPreKey(ctx, types.UUIDKindACI, oldSignedID)
+	require.NoError(t, err)
+	assert.NotNil(t, oldSigned)
+	rotator.ReplacedPreKeyGracePeriod = time.Nanosecond
+	require.NoError(t, rotator.PruneReplacedPreKeys(ctx))
+	oldSigned, err = extras.SignedPreKey(ctx, types.UUIDKindACI, oldSignedID)
+	require.NoError(t, err)
+	assert.Nil(t, oldSigned)
+	oldLastResort, err := extras.KyberPreKey(ctx, types.UUIDKindACI, oldLastResortID)
+	require.NoError(t, err)
+	assert.Nil(t, oldLastResort)
+	current, err := extras.CurrentSignedPreKey(ctx, types.UUIDKindACI)
+	require.NoError(t, err)
+	require.NotNil(t, current)
+	currentID, err := current.GetID()
+	require.NoError(t, err)
+	assert.EqualValues(t, newSignedID, currentID)
+}
+
+func BenchmarkSendGroupMessage(b *testing.B) {
+	const memberCount = 10
+	for _, concurrency := range []int{1, signalmeow.DefaultGroupSendConcurrency} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			ctx, srv := newTestServer(b)
+			srv.SendLatency = 5 * time.Millisecond
+			alice := linkClient(b, ctx, srv, "+15550000000")
+			alice.GroupSendConcurrency = concurrency
+			members := []*testserver.Account{alice.Account}
+			for i := 1; i <= memberCount; i++ {
+				member := linkClient(b, ctx, srv, fmt.Sprintf("+1555000%04d", i))
+				// The messages just pile up on the server, there's no need to receive them
+				require.NoError(b, member.StopReceiveLoops())
+				members = append(members, member.Account)
+			}
+			masterKey, err := srv.CreateGroup("Benchmark group", members...)
+			require.NoError(b, err)
+			gid, err := alice.StoreMasterKey(ctx, types.SerializedGroupMasterKey(base64.StdEncoding.EncodeToString(masterKey[:])))
+			require.NoError(b, err)
+			// Establish sessions with all members before measuring
+			_, err = alice.SendGroupMessage(ctx, gid, textMessage("Warmup"))
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				result, err := alice.SendGroupMessage(ctx, gid, textMessage("Hello group"))
+				require.NoError(b, err)
+				require.Len(b, result.SuccessfullySentTo, memberCount)
+			}
+			b.ReportMetric(float64(b.N*memberCount)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
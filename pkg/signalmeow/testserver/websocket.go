@@ -0,0 +1,184 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package testserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"nhooyr.io/websocket"
+
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/wspb"
+)
+
+type responseHandler func(*signalpb.WebSocketResponseMessage)
+
+// wsConn is the server side of a Signal websocket.
+type wsConn struct {
+	ws *websocket.Conn
+
+	writeLock sync.Mutex
+	pending   map[uint64]responseHandler
+	nextID    uint64
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{
+		ws:      ws,
+		pending: make(map[uint64]responseHandler),
+		nextID:  1,
+	}
+}
+
+func (c *wsConn) write(ctx context.Context, msg *signalpb.WebSocketMessage) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return wspb.Write(ctx, c.ws, msg)
+}
+
+// sendRequest sends a request to the client. The handler is called from the read loop when a response is received.
+func (c *wsConn) sendRequest(ctx context.Context, verb, path string, body []byte, handler responseHandler) error {
+	c.writeLock.Lock()
+	id := c.nextID
+	c.nextID++
+	if handler != nil {
+		c.pending[id] = handler
+	}
+	c.writeLock.Unlock()
+	return c.write(ctx, &signalpb.WebSocketMessage{
+		Type: signalpb.WebSocketMessage_REQUEST.Enum(),
+		Request: &signalpb.WebSocketRequestMessage{
+			Verb: proto.String(verb),
+			Path: proto.String(path),
+			Body: body,
+			Id:   proto.Uint64(id),
+		},
+	})
+}
+
+// readLoop reads messages until the connection dies. Requests are passed to handleRequest and
+// the returned response is written back, responses are passed to the handler given to sendRequest.
+func (c *wsConn) readLoop(ctx context.Context, handleRequest func(context.Context, *signalpb.WebSocketRequestMessage) *signalpb.WebSocketResponseMessage) error {
+	for {
+		var msg signalpb.WebSocketMessage
+		err := wspb.Read(ctx, c.ws, &msg)
+		if err != nil {
+			return err
+		}
+		switch msg.GetType() {
+		case signalpb.WebSocketMessage_REQUEST:
+			if handleRequest == nil {
+				return errors.New("unexpected request from client")
+			}
+			resp := handleRequest(ctx, msg.GetRequest())
+			err = c.write(ctx, &signalpb.WebSocketMessage{
+				Type:     signalpb.WebSocketMessage_RESPONSE.Enum(),
+				Response: resp,
+			})
+			if err != nil {
+				return err
+			}
+		case signalpb.WebSocketMessage_RESPONSE:
+			c.writeLock.Lock()
+			handler, ok := c.pending[msg.GetResponse().GetId()]
+			delete(c.pending, msg.GetResponse().GetId())
+			c.writeLock.Unlock()
+			if ok {
+				handler(msg.GetResponse())
+			}
+		default:
+			return fmt.Errorf("unexpected message type %s", msg.GetType())
+		}
+	}
+}
+
+// serveRequest passes a websocket request through the normal HTTP router.
+func (s *Server) serveRequest(ctx context.Context, device *Device, req *signalpb.WebSocketRequestMessage) *signalpb.WebSocketResponseMessage {
+	if device != nil {
+		ctx = context.WithValue(ctx, contextKeyDevice, device)
+	}
+	var status int
+	var body []byte
+	var headers []string
+	httpReq, err := http.NewRequestWithContext(ctx, req.GetVerb(), s.url(req.GetPath()), bytes.NewReader(req.GetBody()))
+	if err != nil {
+		status = http.StatusBadRequest
+	} else {
+		for _, header := range req.GetHeaders() {
+			name, value, _ := strings.Cut(header, ":")
+			httpReq.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httpReq)
+		status = rec.Code
+		body = rec.Body.Bytes()
+		for name, values := range rec.Header() {
+			for _, value := range values {
+				headers = append(headers, strings.ToLower(name)+":"+value)
+			}
+		}
+	}
+	return &signalpb.WebSocketResponseMessage{
+		Id:      req.Id,
+		Status:  proto.Uint32(uint32(status)),
+		Message: proto.String(http.StatusText(status)),
+		Headers: headers,
+		Body:    body,
+	}
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	var device *Device
+	if login := r.URL.Query().Get("login"); login != "" {
+		device = s.deviceByLogin(login)
+		if device == nil || device.Password != r.URL.Query().Get("password") {
+			writeError(w, http.StatusForbidden)
+			return
+		}
+	}
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	ws.SetReadLimit(-1)
+	defer ws.Close(websocket.StatusInternalError, "")
+	conn := newWSConn(ws)
+	log := s.Log.With().Str("websocket_type", "chat").Logger()
+	if device != nil {
+		log = log.With().Stringer("aci", device.Account.ACI).Int("device_id", device.ID).Logger()
+	}
+	ctx, cancel := context.WithCancel(log.WithContext(r.Context()))
+	defer cancel()
+	if device != nil {
+		go s.deliveryLoop(ctx, device, conn)
+	}
+	err = conn.readLoop(ctx, func(ctx context.Context, req *signalpb.WebSocketRequestMessage) *signalpb.WebSocketResponseMessage {
+		return s.serveRequest(ctx, device, req)
+	})
+	if err != nil && websocket.CloseStatus(err) != websocket.StatusNormalClosure && ctx.Err() == nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Websocket read loop exited")
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -41,20 +43,36 @@ type SimpleResponse struct {
 type RequestHandlerFunc func(context.Context, *signalpb.WebSocketRequestMessage) (*SimpleResponse, error)
 
 type SignalWebsocket struct {
+	transport     *Transport
 	ws            *websocket.Conn
 	path          string
 	basicAuth     *string
 	sendChannel   chan SignalWebsocketSendMessage
 	statusChannel chan SignalWebsocketConnectionStatus
+	// sendLock protects sendChannel from being closed while asynchronous responses are being sent
+	sendLock sync.RWMutex
+	// generation is incremented every time the websocket (re)connects
+	generation atomic.Uint64
 }
 
-func NewSignalWebsocket(path string, username *string, password *string) *SignalWebsocket {
+type contextKey int
+
+const generationContextKey contextKey = iota
+
+// incomingRequest is a request received from the server along with the connection generation it arrived on.
+type incomingRequest struct {
+	request    *signalpb.WebSocketRequestMessage
+	generation uint64
+}
+
+func NewSignalWebsocket(transport *Transport, path string, username *string, password *string) *SignalWebsocket {
 	var basicAuth *string
 	if username != nil && password != nil {
 		b := base64.StdEncoding.EncodeToString([]byte(*username + ":" + *password))
 		basicAuth = &b
 	}
 	return &SignalWebsocket{
+		transport:     transport,
 		path:          path,
 		basicAuth:     basicAuth,
 		sendChannel:   make(chan SignalWebsocketSendMessage),
@@ -123,15 +141,18 @@ func (s *SignalWebsocket) connectLoop(
 		Logger()
 	ctx, cancel := context.WithCancel(ctx)
 
-	incomingRequestChan := make(chan *signalpb.WebSocketRequestMessage, 10000)
+	incomingRequestChan := make(chan incomingRequest, 10000)
 	defer func() {
+		// Cancel first to unblock any asynchronous responses waiting for the send lock
+		cancel()
 		close(incomingRequestChan)
 		close(s.statusChannel)
+		s.sendLock.Lock()
 		close(s.sendChannel)
+		s.sendChannel = nil
+		s.sendLock.Unlock()
 		incomingRequestChan = nil
 		s.statusChannel = nil
-		s.sendChannel = nil
-		cancel()
 	}()
 
 	const backoffIncrement = 5 * time.Second
@@ -149,12 +170,13 @@ func (s *SignalWebsocket) connectLoop(
 			case <-ctx.Done():
 				log.Info().Msg("ctx done, stopping request loop")
 				return
-			case request, ok := <-incomingRequestChan:
+			case incoming, ok := <-incomingRequestChan:
 				if !ok {
 					// Main connection loop must have closed, so we should stop
 					log.Info().Msg("incomingRequestChan closed, stopping request loop")
 					return
 				}
+				request := incoming.request
 				if request == nil {
 					log.Fatal().Msg("Received nil request")
 				}
@@ -162,17 +184,20 @@ func (s *SignalWebsocket) connectLoop(
 					log.Fatal().Msg("Received request but no handler")
 				}
 
-				// Handle the request with the request handler function
-				response, err := (*requestHandler)(ctx, request)
+				// Handle the request with the request handler function.
+				// The generation is stored in the context so that asynchronous responses
+				// aren't sent to a different connection than the one the request came from.
+				requestCtx := context.WithValue(ctx, generationContextKey, incoming.generation)
+				response, err := (*requestHandler)(requestCtx, request)
 
 				if err != nil {
 					log.Err(err).Msg("Error handling request")
 					continue
 				}
-				if response != nil && s.sendChannel != nil {
-					s.sendChannel <- SignalWebsocketSendMessage{
-						RequestMessage:  request,
-						ResponseMessage: response,
+				if response != nil {
+					err = s.SendResponse(requestCtx, request, response)
+					if err != nil {
+						log.Err(err).Uint64("request_id", request.GetId()).Msg("Failed to send response")
 					}
 				}
 			}
@@ -198,7 +223,7 @@ func (s *SignalWebsocket) connectLoop(
 			return
 		}
 
-		ws, resp, err := OpenWebsocket(ctx, s.path)
+		ws, resp, err := s.transport.OpenWebsocket(ctx, s.path)
 		if resp != nil {
 			if resp.StatusCode != 101 {
 				// Server didn't want to open websocket
@@ -256,6 +281,7 @@ func (s *SignalWebsocket) connectLoop(
 			Event: SignalWebsocketConnectionEventConnected,
 		}
 		s.ws = ws
+		generation := s.generation.Add(1)
 		retrying = false
 		backoff = backoffIncrement
 
@@ -264,7 +290,7 @@ func (s *SignalWebsocket) connectLoop(
 
 		// Read loop (for reading incoming reqeusts and responses to outgoing requests)
 		go func() {
-			err := readLoop(loopCtx, ws, incomingRequestChan, &responseChannels)
+			err := readLoop(loopCtx, ws, incomingRequestChan, generation, &responseChannels)
 			// Don't want to put an err into loopCancel if we don't have one
 			if err != nil {
 				err = fmt.Errorf("error in readLoop: %w", err)
@@ -275,7 +301,7 @@ func (s *SignalWebsocket) connectLoop(
 
 		// Write loop (for sending outgoing requests and responses to incoming requests)
 		go func() {
-			err := writeLoop(loopCtx, ws, s.sendChannel, &responseChannels)
+			err := writeLoop(loopCtx, ws, s.sendChannel, generation, &responseChannels)
 			// Don't want to put an err into loopCancel if we don't have one
 			if err != nil {
 				err = fmt.Errorf("error in writeLoop: %w", err)
@@ -361,7 +387,8 @@ func (s *SignalWebsocket) connectLoop(
 func readLoop(
 	ctx context.Context,
 	ws *websocket.Conn,
-	incomingRequestChan chan *signalpb.WebSocketRequestMessage,
+	incomingRequestChan chan incomingRequest,
+	generation uint64,
 	responseChannels *(map[uint64]chan *signalpb.WebSocketResponseMessage),
 ) error {
 	log := zerolog.Ctx(ctx).With().
@@ -395,7 +422,7 @@ func readLoop(
 				Str("request_verb", *msg.Request.Verb).
 				Str("request_path", *msg.Request.Path).
 				Msg("Received WS request")
-			incomingRequestChan <- msg.Request
+			incomingRequestChan <- incomingRequest{request: msg.Request, generation: generation}
 		} else if *msg.Type == signalpb.WebSocketMessage_RESPONSE {
 			if msg.Response == nil {
 				log.Fatal().Msg("Received response with no response")
@@ -434,6 +461,8 @@ type SignalWebsocketSendMessage struct {
 	ResponseChannel chan *signalpb.WebSocketResponseMessage
 	// Populate if we're sending a response:
 	ResponseMessage *SimpleResponse
+	// The connection generation the request being responded to came from
+	Generation uint64
 	// Populate this for request AND response
 	RequestMessage *signalpb.WebSocketRequestMessage
 }
@@ -442,6 +471,7 @@ func writeLoop(
 	ctx context.Context,
 	ws *websocket.Conn,
 	sendChannel chan SignalWebsocketSendMessage,
+	generation uint64,
 	responseChannels *(map[uint64]chan *signalpb.WebSocketResponseMessage),
 ) error {
 	log := zerolog.Ctx(ctx).With().
@@ -498,6 +528,13 @@ func writeLoop(
 					return fmt.Errorf("error writing request message: %w", err)
 				}
 			} else if request.RequestMessage != nil && request.ResponseMessage != nil {
+				if request.Generation != generation {
+					// Request IDs are per connection, so responses to requests from an old connection must be dropped
+					log.Debug().
+						Uint64("request_id", *request.RequestMessage.Id).
+						Msg("Dropping response to request from previous connection")
+					continue
+				}
 				message := CreateWSResponse(ctx, *request.RequestMessage.Id, request.ResponseMessage.Status)
 				log.Debug().
 					Uint64("request_id", *request.RequestMessage.Id).
@@ -522,6 +559,34 @@ func (s *SignalWebsocket) SendRequest(
 	return s.sendRequestInternal(ctx, request, startTime, 0)
 }
 
+// ErrConnectionChanged is returned by SendResponse if the connection the request came from is gone.
+var ErrConnectionChanged = errors.New("connection was closed before the response could be sent")
+
+// SendResponse sends a response to a request received from the server. It's used to respond to requests
+// whose handler returned a nil response because they're handled asynchronously. The context must be
+// (derived from) the one passed to the request handler, as it identifies the connection the request came from.
+func (s *SignalWebsocket) SendResponse(ctx context.Context, request *signalpb.WebSocketRequestMessage, response *SimpleResponse) error {
+	generation, _ := ctx.Value(generationContextKey).(uint64)
+	if generation == 0 || generation != s.generation.Load() {
+		return ErrConnectionChanged
+	}
+	s.sendLock.RLock()
+	defer s.sendLock.RUnlock()
+	if s.sendChannel == nil {
+		return ErrConnectionChanged
+	}
+	select {
+	case s.sendChannel <- SignalWebsocketSendMessage{
+		RequestMessage:  request,
+		ResponseMessage: response,
+		Generation:      generation,
+	}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s *SignalWebsocket) sendRequestInternal(
 	ctx context.Context,
 	request *signalpb.WebSocketRequestMessage,
@@ -564,13 +629,13 @@ func (s *SignalWebsocket) sendRequestInternal(
 	return response, nil
 }
 
-func OpenWebsocket(ctx context.Context, path string) (*websocket.Conn, *http.Response, error) {
-	return OpenWebsocketURL(ctx, "wss://"+APIHostname+path)
+func (t *Transport) OpenWebsocket(ctx context.Context, path string) (*websocket.Conn, *http.Response, error) {
+	return t.OpenWebsocketURL(ctx, "wss://"+t.Hosts.API+path)
 }
 
-func OpenWebsocketURL(ctx context.Context, url string) (*websocket.Conn, *http.Response, error) {
+func (t *Transport) OpenWebsocketURL(ctx context.Context, url string) (*websocket.Conn, *http.Response, error) {
 	opt := &websocket.DialOptions{
-		HTTPClient: SignalHTTPClient,
+		HTTPClient: t.Client,
 		HTTPHeader: make(http.Header, 2),
 	}
 	opt.HTTPHeader.Set("User-Agent", UserAgent)
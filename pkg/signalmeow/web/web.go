@@ -36,60 +36,100 @@ import (
 	"go.mau.fi/mautrix-signal/pkg/libsignalgo"
 )
 
-const proxyUrlStr = "" // Set this to proxy requests
-const caCertPath = ""  // Set this to trust a self-signed cert (ie. for mitmproxy)
-
 var UserAgent = "signalmeow/0.1.0 libsignal/" + libsignalgo.Version + " go/" + strings.TrimPrefix(runtime.Version(), "go")
 var SignalAgent = "MAU"
 
-const (
-	APIHostname     = "chat.signal.org"
-	StorageHostname = "storage.signal.org"
-	CDN1Hostname    = "cdn.signal.org"
-	CDN2Hostname    = "cdn2.signal.org"
-	CDN3Hostname    = "cdn3.signal.org"
-)
+// Hosts contains the hostnames of the different Signal services.
+type Hosts struct {
+	API              string
+	Storage          string
+	ContactDiscovery string
+	// CDN maps CDN numbers (as found in attachment pointers) to hostnames. Number 0 is used as the fallback.
+	CDN map[uint32]string
+}
 
-var CDNHosts = []string{
-	CDN1Hostname,
-	CDN1Hostname,
-	CDN2Hostname,
-	CDN3Hostname,
+var ProductionHosts = Hosts{
+	API:              "chat.signal.org",
+	Storage:          "storage.signal.org",
+	ContactDiscovery: "cdsi.signal.org",
+	CDN: map[uint32]string{
+		0: "cdn.signal.org",
+		1: "cdn.signal.org",
+		2: "cdn2.signal.org",
+		3: "cdn3.signal.org",
+	},
 }
 
-//go:embed signal-root.crt.der
-var signalRootCertBytes []byte
-var signalTransport = &http.Transport{
-	ForceAttemptHTTP2: true,
-	TLSClientConfig: &tls.Config{
-		RootCAs: x509.NewCertPool(),
+var StagingHosts = Hosts{
+	API:              "chat.staging.signal.org",
+	Storage:          "storage-staging.signal.org",
+	ContactDiscovery: "cdsi.staging.signal.org",
+	CDN: map[uint32]string{
+		0: "cdn-staging.signal.org",
+		1: "cdn-staging.signal.org",
+		2: "cdn2-staging.signal.org",
+		3: "cdn3-staging.signal.org",
 	},
 }
-var SignalHTTPClient = &http.Client{
-	Transport: signalTransport,
+
+// CDNHost returns the hostname for the given CDN number, falling back to CDN 0 for unknown numbers.
+func (h *Hosts) CDNHost(cdnNumber uint32) string {
+	host, ok := h.CDN[cdnNumber]
+	if !ok {
+		host = h.CDN[0]
+	}
+	return host
+}
+
+type TransportConfig struct {
+	Hosts Hosts
+	// ProxyURL is an optional HTTP or SOCKS5 proxy that all requests and websockets are routed through.
+	ProxyURL string
+	// ExtraCACertPaths are paths to PEM files with additional trusted CAs (e.g. for mitmproxy).
+	ExtraCACertPaths []string
+}
+
+// Transport is used to make all HTTP requests and websocket connections to the Signal servers.
+type Transport struct {
+	Hosts  Hosts
+	Client *http.Client
 }
 
-func init() {
+//go:embed signal-root.crt.der
+var signalRootCertBytes []byte
+
+func NewTransport(cfg TransportConfig) (*Transport, error) {
 	cert, err := x509.ParseCertificate(signalRootCertBytes)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to parse Signal root certificate: %w", err)
 	}
-	signalTransport.TLSClientConfig.RootCAs.AddCert(cert)
-
-	if proxyUrlStr != "" {
-		proxyURL, err := url.Parse(proxyUrlStr)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(cert)
+	for _, path := range cfg.ExtraCACertPaths {
+		caCert, err := os.ReadFile(path)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to read CA certificate %s: %w", path, err)
+		} else if !rootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
 		}
-		signalTransport.Proxy = http.ProxyURL(proxyURL)
 	}
-	if caCertPath != "" {
-		caCert, err := os.ReadFile(caCertPath)
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig: &tls.Config{
+			RootCAs: rootCAs,
+		},
+	}
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to parse proxy URL: %w", err)
 		}
-		signalTransport.TLSClientConfig.RootCAs.AppendCertsFromPEM(caCert)
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
+	return &Transport{
+		Hosts:  cfg.Hosts,
+		Client: &http.Client{Transport: transport},
+	}, nil
 }
 
 type ContentType string
@@ -112,13 +152,13 @@ type HTTPReqOpt struct {
 
 var httpReqCounter = 0
 
-func SendHTTPRequest(ctx context.Context, method string, path string, opt *HTTPReqOpt) (*http.Response, error) {
+func (t *Transport) SendHTTPRequest(ctx context.Context, method string, path string, opt *HTTPReqOpt) (*http.Response, error) {
 	// Set defaults
 	if opt == nil {
 		opt = &HTTPReqOpt{}
 	}
 	if opt.Host == "" {
-		opt.Host = APIHostname
+		opt.Host = t.Hosts.API
 	}
 	if len(path) > 0 && path[0] != '/' {
 		path = "/" + path
@@ -159,7 +199,7 @@ func SendHTTPRequest(ctx context.Context, method string, path string, opt *HTTPR
 	httpReqCounter++
 	log = log.With().Int("request_number", httpReqCounter).Logger()
 	log.Trace().Msg("Sending HTTP request")
-	resp, err := SignalHTTPClient.Do(req)
+	resp, err := t.Client.Do(req)
 	if err != nil {
 		log.Err(err).Msg("Error sending request")
 		return nil, err
@@ -191,7 +231,7 @@ func DecodeHTTPResponseBody(ctx context.Context, out any, resp *http.Response) e
 	return nil
 }
 
-func GetAttachment(ctx context.Context, path string, cdnNumber uint32, opt *HTTPReqOpt) (*http.Response, error) {
+func (t *Transport) GetAttachment(ctx context.Context, path string, cdnNumber uint32, opt *HTTPReqOpt) (*http.Response, error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("action", "get_attachment").
 		Str("path", path).
@@ -201,24 +241,10 @@ func GetAttachment(ctx context.Context, path string, cdnNumber uint32, opt *HTTP
 		opt = &HTTPReqOpt{}
 	}
 	if opt.Host == "" {
-		if int(cdnNumber) > len(CDNHosts) {
-			log.Warn().Msg("Invalid CDN index")
-			opt.Host = CDN1Hostname
-		} else {
-			opt.Host = CDNHosts[cdnNumber]
-		}
-		if cdnNumber == 0 {
-			// This is basically a fallback if cdnNumber is not set
-			// but it also seems to be the right host if cdnNumber == 0
-			opt.Host = CDNHosts[0]
-		} else if cdnNumber > 0 && int(cdnNumber) <= len(CDNHosts) {
-			// Pull CDN hosts from array (cdnNumber is 1-indexed, but we have a placeholder host at index 0)
-			// (the 1-indexed is just an assumption, other clients seem to only explicitly handle cdnNumber == 0 and 2)
-			opt.Host = CDNHosts[cdnNumber]
-		} else {
-			opt.Host = CDNHosts[0]
+		if _, ok := t.Hosts.CDN[cdnNumber]; !ok {
 			log.Warn().Msg("Invalid CDN index")
 		}
+		opt.Host = t.Hosts.CDNHost(cdnNumber)
 	}
 	log.Debug().Str("host", opt.Host).Msg("getting attachment")
 	urlStr := "https://" + opt.Host + path
@@ -239,7 +265,7 @@ func GetAttachment(ctx context.Context, path string, cdnNumber uint32, opt *HTTP
 		Logger()
 
 	log.Debug().Msg("Sending Attachment HTTP request")
-	resp, err := SignalHTTPClient.Do(req)
+	resp, err := t.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
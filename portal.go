@@ -87,6 +87,22 @@ func (br *SignalBridge) GetPortalByChatID(key database.PortalKey) *Portal {
 	return portal
 }
 
+// waitForPortalSignalMessages blocks until all loaded portals have handled the Signal messages
+// that were queued for them before this was called.
+func (br *SignalBridge) waitForPortalSignalMessages() {
+	br.portalsLock.Lock()
+	portals := make([]*Portal, 0, len(br.portalsByID))
+	for _, portal := range br.portalsByID {
+		portals = append(portals, portal)
+	}
+	br.portalsLock.Unlock()
+	for _, portal := range portals {
+		drained := make(chan struct{})
+		portal.signalMessages <- portalSignalMessage{drained: drained}
+		<-drained
+	}
+}
+
 func (br *SignalBridge) GetAllPortalsWithMXID() []*Portal {
 	portals, err := br.dbPortalsToPortals(br.DB.Portal.GetAllWithMXID(context.TODO()))
 	if err != nil {
@@ -170,6 +186,8 @@ func (br *SignalBridge) dbPortalsToPortals(dbPortals []*database.Portal, err err
 type portalSignalMessage struct {
 	evt  *events.ChatEvent
 	user *User
+	// drained is closed by the message loop instead of handling an event. It's used to wait for earlier messages.
+	drained chan struct{}
 }
 
 type portalMatrixMessage struct {
@@ -194,6 +212,9 @@ type Portal struct {
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
 
+	// mediaBatch is only accessed from the message loop goroutine.
+	mediaBatch *pendingMediaBatch
+
 	relayUser *User
 }
 
@@ -215,11 +236,20 @@ func (br *SignalBridge) NewPortal(dbPortal *database.Portal) *Portal {
 		matrixMessages: make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
 	}
 	portal.MsgConv = &msgconv.MessageConverter{
-		PortalMethods:        portal,
-		SignalFmtParams:      signalFormatParams,
-		MatrixFmtParams:      matrixFormatParams,
+		PortalMethods:   portal,
+		SignalFmtParams: signalFormatParams,
+		MatrixFmtParams: matrixFormatParams,
+		LocationParams: &msgconv.LocationParams{
+			MapURL:  br.Config.Bridge.Location.MapURL,
+			TileURL: br.Config.Bridge.Location.StaticMapTileURL,
+			Zoom:    br.Config.Bridge.Location.StaticMapZoom,
+		},
 		ConvertVoiceMessages: true,
+		ConvertGIFToMP4:      true,
 		MaxFileSize:          br.MediaConfig.UploadSize,
+		AsyncFiles:           br.Config.Bridge.FileTransfers.Async,
+		SignalMediaCache:     br.DB.SignalMediaCache,
+		MatrixMediaCache:     br.DB.MatrixMediaCache,
 	}
 	go portal.messageLoop()
 
@@ -338,7 +368,13 @@ func (portal *Portal) messageLoop() {
 		case msg := <-portal.matrixMessages:
 			portal.handleMatrixMessages(msg)
 		case msg := <-portal.signalMessages:
-			portal.handleSignalMessage(msg)
+			if msg.drained != nil {
+				close(msg.drained)
+			} else {
+				portal.handleSignalMessage(msg)
+			}
+		case <-portal.mediaBatchTimeout():
+			portal.flushMediaBatch()
 		}
 	}
 }
@@ -355,8 +391,11 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 	case event.EventMessage, event.EventSticker:
 		portal.handleMatrixMessage(ctx, msg.user, msg.evt)
 	case event.EventRedaction:
+		// Redactions and reactions may target events in the pending media batch, so send it first
+		portal.flushMediaBatch()
 		portal.handleMatrixRedaction(ctx, msg.user, msg.evt)
 	case event.EventReaction:
+		portal.flushMediaBatch()
 		portal.handleMatrixReaction(ctx, msg.user, msg.evt)
 	default:
 		log.Warn().Str("type", msg.evt.Type.Type).Msg("Unhandled matrix message type")
@@ -382,6 +421,7 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 		Str("sender", evt.Sender.String()).
 		Dur("age", messageAge).
 		Msg("Received message")
+	origMsg := portalMatrixMessage{evt: evt, user: sender}
 
 	errorAfter := portal.bridge.Config.Bridge.MessageHandlingTimeout.ErrorAfter
 	deadline := portal.bridge.Config.Bridge.MessageHandlingTimeout.Deadline
@@ -441,6 +481,8 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 
 	var editTargetMsg *database.Message
 	if editTarget := content.RelatesTo.GetReplaceID(); editTarget != "" {
+		// The edit may target a message in the pending media batch, which is only stored after it's sent
+		portal.flushMediaBatch()
 		var err error
 		editTargetMsg, err = portal.bridge.DB.Message.GetByMXID(ctx, editTarget)
 		if err != nil {
@@ -490,7 +532,13 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 	timings.convert = time.Since(start)
 	start = time.Now()
 
-	err = portal.sendSignalMessage(ctx, wrappedMsg, sender, evt.ID)
+	if editTargetMsg == nil && !isRelay && portal.addToMediaBatch(ctx, sender, origMsg, msg, &ms) {
+		return
+	}
+	// Send any pending media batch first to keep the messages in order
+	portal.flushMediaBatch()
+
+	err = portal.sendConvertedMatrixMessage(ctx, sender, evt, wrappedMsg, msg.GetTimestamp())
 
 	timings.totalSend = time.Since(start)
 	go ms.sendMessageMetrics(evt, err, "Error sending", true)
@@ -509,6 +557,35 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 	}
 }
 
+// sendConvertedMatrixMessage sends a converted Matrix message to Signal, or queues it in the outbox if it can't be sent right now.
+func (portal *Portal) sendConvertedMatrixMessage(ctx context.Context, sender *User, evt *event.Event, wrappedMsg *signalpb.Content, timestamp uint64) (err error) {
+	var challengeErr *signalmeow.RateLimitChallengeError
+	if sender.Client.PendingRateLimitChallenge() != nil {
+		err = errMessageRateLimited
+	} else if portal.shouldUseOutbox(ctx, sender) {
+		err = errMessageQueued
+	} else {
+		err = portal.sendSignalMessage(ctx, wrappedMsg, sender, evt.ID)
+		if errors.As(err, &challengeErr) {
+			err = fmt.Errorf("%w: %w", errMessageRateLimited, err)
+		} else if err != nil && portal.bridge.Config.Bridge.Outbox.MaxAge > 0 && !sender.Client.IsConnected() {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Sending failed while disconnected from Signal, queueing message")
+			err = errMessageQueued
+		}
+	}
+	if errors.Is(err, errMessageQueued) || errors.Is(err, errMessageRateLimited) {
+		if queueErr := portal.queueOutgoingMessage(ctx, sender, evt, wrappedMsg, timestamp); queueErr != nil {
+			zerolog.Ctx(ctx).Err(queueErr).Msg("Failed to queue outgoing message")
+			if errors.Is(err, errMessageQueued) {
+				err = errUserNotConnected
+			} else {
+				err = fmt.Errorf("failed to queue rate limited message: %w", queueErr)
+			}
+		}
+	}
+	return
+}
+
 func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *User, evt *event.Event) {
 	log := zerolog.Ctx(ctx)
 	// Find the original signal message based on eventID
@@ -808,36 +885,89 @@ func (portal *Portal) GetMatrixReply(ctx context.Context, msg *signalpb.DataMess
 	return
 }
 
-func (portal *Portal) GetSignalReply(ctx context.Context, content *event.MessageEventContent) *signalpb.DataMessage_Quote {
-	replyToID := content.RelatesTo.GetReplyTo()
-	if len(replyToID) == 0 {
-		return nil
+// getReplyTargetMessage finds the message that a Matrix event replies to. Thread messages without an explicit reply
+// target the latest thread message that the client fell back to, or the thread root if that message isn't bridged.
+func (portal *Portal) getReplyTargetMessage(ctx context.Context, relatesTo *event.RelatesTo) *database.Message {
+	candidates := []id.EventID{relatesTo.GetReplyTo()}
+	if threadRoot := relatesTo.GetThreadParent(); threadRoot != "" && relatesTo.GetNonFallbackReplyTo() == "" {
+		candidates = append(candidates, threadRoot)
+	}
+	for _, replyToID := range candidates {
+		if replyToID == "" {
+			continue
+		}
+		replyToMsg, err := portal.bridge.DB.Message.GetByMXID(ctx, replyToID)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).
+				Str("reply_to_mxid", replyToID.String()).
+				Msg("Failed to get reply target message from database")
+		} else if replyToMsg == nil {
+			zerolog.Ctx(ctx).Warn().
+				Str("reply_to_mxid", replyToID.String()).
+				Msg("Reply target message not found")
+		} else {
+			return replyToMsg
+		}
 	}
-	replyToMsg, err := portal.bridge.DB.Message.GetByMXID(ctx, replyToID)
+	return nil
+}
+
+// getMatrixEvent fetches and decrypts an event in the portal room, so that its content can be included in Signal quotes.
+func (portal *Portal) getMatrixEvent(ctx context.Context, eventID id.EventID) (*event.Event, error) {
+	evt, err := portal.MainIntent().GetEvent(ctx, portal.MXID, eventID)
 	if err != nil {
-		zerolog.Ctx(ctx).Err(err).
-			Str("reply_to_mxid", replyToID.String()).
-			Msg("Failed to get reply target message from database")
-	} else if replyToMsg == nil {
-		zerolog.Ctx(ctx).Warn().
-			Str("reply_to_mxid", replyToID.String()).
-			Msg("Reply target message not found")
+		return nil, fmt.Errorf("failed to get event: %w", err)
+	}
+	evt.RoomID = portal.MXID
+	if evt.Type == event.EventEncrypted {
+		if portal.bridge.Crypto == nil {
+			return nil, errors.New("event is encrypted, but encryption is not enabled")
+		}
+		err = evt.Content.ParseRaw(evt.Type)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse encrypted content: %w", err)
+		}
+		evt, err = portal.bridge.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt event: %w", err)
+		}
 	} else {
-		return &signalpb.DataMessage_Quote{
-			Id:        proto.Uint64(replyToMsg.Timestamp),
-			AuthorAci: proto.String(replyToMsg.Sender.String()),
-			Type:      signalpb.DataMessage_Quote_NORMAL.Enum(),
-
-			// This is a hack to make Signal iOS and desktop render replies to file messages.
-			// Unfortunately it also makes Signal Desktop show a file icon on replies to text messages.
-			// TODO store file or text flag in database and fill this field only when replying to file messages.
-			Attachments: make([]*signalpb.DataMessage_Quote_QuotedAttachment, 0),
+		err = evt.Content.ParseRaw(evt.Type)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse content: %w", err)
 		}
 	}
-	return nil
+	return evt, nil
+}
+
+func (portal *Portal) GetSignalReply(ctx context.Context, content *event.MessageEventContent) (*signalpb.DataMessage_Quote, *event.Event) {
+	replyToMsg := portal.getReplyTargetMessage(ctx, content.RelatesTo)
+	if replyToMsg == nil {
+		return nil, nil
+	}
+	quote := &signalpb.DataMessage_Quote{
+		Id:        proto.Uint64(replyToMsg.Timestamp),
+		AuthorAci: proto.String(replyToMsg.Sender.String()),
+		Type:      signalpb.DataMessage_Quote_NORMAL.Enum(),
+
+		// This is a hack to make Signal iOS and desktop render replies to file messages if the target event
+		// can't be fetched. Unfortunately it also makes Signal Desktop show a file icon on replies to text messages.
+		Attachments: make([]*signalpb.DataMessage_Quote_QuotedAttachment, 0),
+	}
+	target, err := portal.getMatrixEvent(ctx, replyToMsg.MXID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("reply_to_mxid", replyToMsg.MXID.String()).
+			Msg("Failed to get reply target event, quote won't include content")
+	}
+	return quote, target
 }
 
 func (portal *Portal) handleSignalMessage(portalMessage portalSignalMessage) {
+	result := signalmeow.InboxEntryIgnored
+	defer func() {
+		portalMessage.user.markInboxEntryHandled(portalMessage.evt.Info, result)
+	}()
 	sender := portal.bridge.GetPuppetBySignalID(portalMessage.evt.Info.Sender)
 	if sender == nil {
 		portal.log.Warn().
@@ -847,11 +977,11 @@ func (portal *Portal) handleSignalMessage(portalMessage portalSignalMessage) {
 	}
 	switch typedEvt := portalMessage.evt.Event.(type) {
 	case *signalpb.DataMessage:
-		portal.handleSignalDataMessage(portalMessage.user, sender, typedEvt)
+		result = portal.handleSignalDataMessage(portalMessage.user, sender, typedEvt)
 	case *signalpb.TypingMessage:
 		portal.handleSignalTypingMessage(sender, typedEvt)
 	case *signalpb.EditMessage:
-		portal.handleSignalEditMessage(sender, typedEvt.GetTargetSentTimestamp(), typedEvt.GetDataMessage())
+		result = portal.handleSignalEditMessage(portalMessage.user, sender, typedEvt.GetTargetSentTimestamp(), typedEvt.GetDataMessage())
 	default:
 		portal.log.Error().
 			Type("data_type", typedEvt).
@@ -859,7 +989,7 @@ func (portal *Portal) handleSignalMessage(portalMessage portalSignalMessage) {
 	}
 }
 
-func (portal *Portal) handleSignalDataMessage(source *User, sender *Puppet, msg *signalpb.DataMessage) {
+func (portal *Portal) handleSignalDataMessage(source *User, sender *Puppet, msg *signalpb.DataMessage) signalmeow.InboxEntryResult {
 	genericCtx := portal.log.With().
 		Str("action", "handle signal data message").
 		Uint64("msg_ts", msg.GetTimestamp()).
@@ -881,7 +1011,7 @@ func (portal *Portal) handleSignalDataMessage(source *User, sender *Puppet, msg
 
 	switch {
 	case msgconv.CanConvertSignal(msg):
-		portal.handleSignalNormalDataMessage(source, sender, msg)
+		return portal.handleSignalNormalDataMessage(source, sender, msg)
 	case msg.Reaction != nil:
 		portal.handleSignalReaction(sender, msg.Reaction, msg.GetTimestamp())
 	case msg.Delete != nil:
@@ -897,6 +1027,8 @@ func (portal *Portal) handleSignalDataMessage(source *User, sender *Puppet, msg
 			Uint64("msg_ts", msg.GetTimestamp()).
 			Msg("Unrecognized content in message")
 	}
+	// Reactions, deletions and group changes aren't acknowledged with delivery receipts
+	return signalmeow.InboxEntryIgnored
 }
 
 func (portal *Portal) handleSignalGroupChange(source *User, sender *Puppet, groupMeta *signalpb.GroupContextV2, ts uint64) {
@@ -1039,7 +1171,7 @@ func (portal *Portal) handleSignalDelete(sender *Puppet, delete *signalpb.DataMe
 	}
 }
 
-func (portal *Portal) handleSignalNormalDataMessage(source *User, sender *Puppet, msg *signalpb.DataMessage) {
+func (portal *Portal) handleSignalNormalDataMessage(source *User, sender *Puppet, msg *signalpb.DataMessage) signalmeow.InboxEntryResult {
 	log := portal.log.With().
 		Str("action", "handle signal message").
 		Str("sender_uuid", sender.SignalID.String()).
@@ -1050,41 +1182,65 @@ func (portal *Portal) handleSignalNormalDataMessage(source *User, sender *Puppet
 		log.Debug().Msg("Creating Matrix room from incoming message")
 		if err := portal.CreateMatrixRoom(ctx, source, msg.GetGroupV2().GetRevision()); err != nil {
 			log.Error().Err(err).Msg("Failed to create portal room")
-			return
+			return signalmeow.InboxEntryFailed
 		}
 	} else if !portal.ensureUserInvited(ctx, source) {
 		log.Warn().Stringer("user_id", source.MXID).Msg("Failed to ensure source user is joined to portal")
 	}
 
-	existingMessage, err := portal.bridge.DB.Message.GetBySignalID(ctx, sender.SignalID, msg.GetTimestamp(), 0, portal.Receiver)
+	// A previous attempt may have failed halfway through, so only the parts that weren't bridged yet are sent
+	existingParts, err := portal.bridge.DB.Message.GetAllPartsBySignalID(ctx, sender.SignalID, msg.GetTimestamp(), portal.Receiver)
 	if err != nil {
 		log.Err(err).Msg("Failed to check if message was already bridged")
-		return
-	} else if existingMessage != nil {
-		log.Debug().Msg("Ignoring duplicate message")
-		return
+		return signalmeow.InboxEntryFailed
+	}
+	bridgedParts := make(map[int]struct{}, len(existingParts))
+	for _, existingPart := range existingParts {
+		bridgedParts[existingPart.PartIndex] = struct{}{}
 	}
 
 	intent := sender.IntentFor(portal)
 	ctx = context.WithValue(ctx, msgconvContextKeyIntent, intent)
+	ctx = context.WithValue(ctx, msgconvContextKeyClient, source.Client)
 	converted := portal.MsgConv.ToMatrix(ctx, msg)
 	if portal.bridge.Config.Bridge.CaptionInMessage {
 		converted.MergeCaption()
 	}
+	if len(bridgedParts) >= len(converted.Parts) {
+		log.Debug().Msg("Ignoring duplicate message")
+		return signalmeow.InboxEntryBridged
+	} else if len(bridgedParts) > 0 {
+		log.Debug().
+			Int("bridged_parts", len(bridgedParts)).
+			Int("total_parts", len(converted.Parts)).
+			Msg("Sending remaining parts of partially bridged message")
+	}
+	result := signalmeow.InboxEntryBridged
 	for i, part := range converted.Parts {
+		if _, alreadyBridged := bridgedParts[i]; alreadyBridged {
+			continue
+		}
 		resp, err := portal.sendMatrixEvent(ctx, intent, part.Type, part.Content, part.Extra, int64(converted.Timestamp))
 		if err != nil {
 			log.Err(err).Int("part_index", i).Msg("Failed to send message to Matrix")
+			result = signalmeow.InboxEntryFailed
 			continue
 		}
 		portal.storeMessageInDB(ctx, resp.EventID, sender.SignalID, converted.Timestamp, i)
 		if converted.DisappearIn != 0 {
 			portal.addDisappearingMessage(ctx, resp.EventID, converted.DisappearIn, sender.SignalID == source.SignalID)
 		}
+		if part.PendingAttachment != nil {
+			err = portal.QueueFileTransfer(ctx, resp.EventID, sender.SignalID, converted.Timestamp, part.PendingAttachment)
+			if err != nil {
+				log.Err(err).Int("part_index", i).Msg("Failed to queue file transfer")
+			}
+		}
 	}
+	return result
 }
 
-func (portal *Portal) handleSignalEditMessage(sender *Puppet, timestamp uint64, msg *signalpb.DataMessage) {
+func (portal *Portal) handleSignalEditMessage(source *User, sender *Puppet, timestamp uint64, msg *signalpb.DataMessage) signalmeow.InboxEntryResult {
 	log := portal.log.With().
 		Str("action", "handle signal edit").
 		Str("sender_uuid", sender.SignalID.String()).
@@ -1093,20 +1249,21 @@ func (portal *Portal) handleSignalEditMessage(sender *Puppet, timestamp uint64,
 		Logger()
 	if portal.MXID == "" {
 		log.Debug().Msg("Dropping edit message in chat with no portal")
-		return
+		return signalmeow.InboxEntryIgnored
 	}
 	ctx := log.WithContext(context.TODO())
 	targetMessage, err := portal.bridge.DB.Message.GetAllPartsBySignalID(ctx, sender.SignalID, timestamp, portal.Receiver)
 	if err != nil {
 		log.Err(err).Msg("Failed to get target message")
-		return
+		return signalmeow.InboxEntryFailed
 	} else if len(targetMessage) == 0 {
 		log.Debug().Msg("Target message not found (edit may have been already handled)")
-		return
+		return signalmeow.InboxEntryIgnored
 	}
 
 	intent := sender.IntentFor(portal)
 	ctx = context.WithValue(ctx, msgconvContextKeyIntent, intent)
+	ctx = context.WithValue(ctx, msgconvContextKeyClient, source.Client)
 	converted := portal.MsgConv.ToMatrix(ctx, msg)
 	if portal.bridge.Config.Bridge.CaptionInMessage {
 		converted.MergeCaption()
@@ -1116,10 +1273,13 @@ func (portal *Portal) handleSignalEditMessage(sender *Puppet, timestamp uint64,
 			Int("target_parts", len(targetMessage)).
 			Int("new_parts", len(converted.Parts)).
 			Msg("Mismatched number of parts in edit")
-		return
+		return signalmeow.InboxEntryIgnored
 	}
+	result := signalmeow.InboxEntryBridged
 	for i, part := range converted.Parts {
 		part.Content.SetEdit(targetMessage[i].MXID)
+		// The new content keeps the mentions, but the edit itself shouldn't ping everyone again
+		part.Content.Mentions = &event.Mentions{}
 		if part.Extra != nil {
 			part.Extra = map[string]any{
 				"m.new_content": part.Extra,
@@ -1128,12 +1288,20 @@ func (portal *Portal) handleSignalEditMessage(sender *Puppet, timestamp uint64,
 		_, err = portal.sendMatrixEvent(ctx, intent, part.Type, part.Content, part.Extra, int64(converted.Timestamp))
 		if err != nil {
 			log.Err(err).Int("part_index", i).Msg("Failed to send edit to Matrix")
+			result = signalmeow.InboxEntryFailed
+		} else if part.PendingAttachment != nil {
+			// The edit replaced the attachment with a placeholder, so it needs to be transferred again
+			err = portal.QueueFileTransfer(ctx, targetMessage[i].MXID, sender.SignalID, msg.GetTimestamp(), part.PendingAttachment)
+			if err != nil {
+				log.Err(err).Int("part_index", i).Msg("Failed to queue file transfer")
+			}
 		}
 	}
 	err = targetMessage[0].SetTimestamp(ctx, msg.GetTimestamp())
 	if err != nil {
 		log.Err(err).Msg("Failed to update message edit timestamp in database")
 	}
+	return result
 }
 
 const SignalTypingTimeout = 15 * time.Second
@@ -259,7 +259,11 @@ func (puppet *Puppet) UpdateInfo(ctx context.Context, source *User, info *types.
 		update = true
 	}
 	update = puppet.updateName(ctx, info) || update
-	update = puppet.updateAvatar(ctx, source, info) || update
+	if source.deferAvatarUpdate(puppet.SignalID, info) {
+		log.Debug().Msg("Deferring avatar update until message queue is empty")
+	} else {
+		update = puppet.updateAvatar(ctx, source, info) || update
+	}
 	if update {
 		puppet.ContactInfoSet = false
 		puppet.UpdateContactInfo(ctx)
@@ -0,0 +1,65 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+)
+
+func (user *User) handleRateLimitChallenge(evt *events.RateLimitChallenge) {
+	log := user.log.With().Str("action", "handle rate limit challenge").Logger()
+	ctx := log.WithContext(context.TODO())
+	if evt.RetryAfter > 0 {
+		time.AfterFunc(evt.RetryAfter, func() {
+			if user.Client != nil && user.Client.PendingRateLimitChallenge() == nil {
+				user.retryRateLimitedMessages()
+			}
+		})
+	}
+	managementRoom := user.GetManagementRoomID()
+	if managementRoom == "" {
+		log.Warn().Msg("Got rate limit challenge, but user doesn't have a management room")
+		return
+	}
+	msg := fmt.Sprintf(
+		"Signal is rate limiting your messages. Sending is paused until you solve a captcha at %s, "+
+			"then copy the link from the \"Open Signal\" button and send `submit-captcha <link>` here.",
+		signalmeow.CaptchaURL,
+	)
+	if evt.RetryAfter > 0 {
+		msg += fmt.Sprintf(" Alternatively, messages will be retried automatically in %s.", evt.RetryAfter)
+	}
+	_, err := user.bridge.Bot.SendMessageEvent(ctx, managementRoom, event.EventMessage, format.RenderMarkdown(msg, true, false))
+	if err != nil {
+		log.Err(err).Msg("Failed to send rate limit challenge notice to management room")
+	}
+}
+
+// retryRateLimitedMessages resumes sending the messages that were queued in the outbox
+// while a rate limit challenge was pending.
+func (user *User) retryRateLimitedMessages() {
+	user.log.Info().Msg("Resuming messages that were paused by rate limit challenge")
+	user.wakeOutbox()
+}
@@ -0,0 +1,355 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exmime"
+	"google.golang.org/protobuf/proto"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-signal/database"
+	"go.mau.fi/mautrix-signal/msgconv"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
+	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+)
+
+// MSC2545 image pack event types
+var (
+	StateImagePack        = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+	AccountDataEmoteRooms = event.Type{Type: "im.ponies.emote_rooms", Class: event.AccountDataEventType}
+)
+
+type ImagePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []string            `json:"usage,omitempty"`
+
+	SignalSticker *msgconv.SignalStickerInfo `json:"fi.mau.signal.sticker,omitempty"`
+}
+
+type ImagePackMeta struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []string            `json:"usage,omitempty"`
+	Attribution string              `json:"attribution,omitempty"`
+}
+
+type ImagePackEventContent struct {
+	Images map[string]*ImagePackImage `json:"images"`
+	Pack   ImagePackMeta              `json:"pack"`
+}
+
+type EmoteRoomsEventContent struct {
+	Rooms map[id.RoomID]map[string]any `json:"rooms"`
+}
+
+func isPlaceholderStickerPack(packID []byte) bool {
+	return len(packID) != signalmeow.StickerPackIDLength || bytes.Equal(packID, make([]byte, signalmeow.StickerPackIDLength))
+}
+
+// getStickerPack returns the sticker pack with the given ID from the database,
+// or fetches the manifest from Signal and stores it if the pack isn't known yet.
+func (br *SignalBridge) getStickerPack(ctx context.Context, client *signalmeow.Client, packID, packKey []byte) (*database.StickerPack, error) {
+	pack, err := br.DB.StickerPack.GetByID(ctx, packID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sticker pack from database: %w", err)
+	} else if pack != nil {
+		return pack, nil
+	} else if client == nil {
+		return nil, fmt.Errorf("sticker pack not found")
+	}
+	manifest, err := client.FetchStickerPack(ctx, packID, packKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sticker pack: %w", err)
+	}
+	pack = br.DB.StickerPack.New()
+	pack.ID = packID
+	pack.Key = packKey
+	pack.Title = manifest.GetTitle()
+	pack.Author = manifest.GetAuthor()
+	pack.CoverID = manifest.GetCover().GetId()
+	err = pack.Upsert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save sticker pack: %w", err)
+	}
+	for _, manifestSticker := range manifest.GetStickers() {
+		sticker := br.DB.Sticker.New()
+		sticker.PackID = packID
+		sticker.ID = manifestSticker.GetId()
+		sticker.Emoji = manifestSticker.GetEmoji()
+		sticker.ContentType = manifestSticker.GetContentType()
+		err = sticker.Upsert(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save sticker %d: %w", sticker.ID, err)
+		}
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("pack_id", hex.EncodeToString(packID)).
+		Str("pack_title", pack.Title).
+		Int("sticker_count", len(manifest.GetStickers())).
+		Msg("Fetched sticker pack manifest")
+	return pack, nil
+}
+
+// reuploadStickerPack makes sure all stickers in the pack have been uploaded to Matrix.
+// Image packs can't use encrypted files, so the stickers are always uploaded unencrypted.
+func (br *SignalBridge) reuploadStickerPack(ctx context.Context, client *signalmeow.Client, pack *database.StickerPack) ([]*database.Sticker, error) {
+	stickers, err := br.DB.Sticker.GetAllByPack(ctx, pack.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stickers from database: %w", err)
+	}
+	for _, sticker := range stickers {
+		if sticker.MXC != "" {
+			continue
+		}
+		data, err := client.DownloadSticker(ctx, pack.ID, pack.Key, sticker.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download sticker %d: %w", sticker.ID, err)
+		}
+		if sticker.ContentType == "" {
+			sticker.ContentType = http.DetectContentType(data)
+		}
+		resp, err := br.Bot.UploadMedia(ctx, mautrix.ReqUploadMedia{
+			ContentBytes: data,
+			ContentType:  sticker.ContentType,
+			FileName:     fmt.Sprintf("sticker-%d%s", sticker.ID, exmime.ExtensionFromMimetype(sticker.ContentType)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload sticker %d: %w", sticker.ID, err)
+		}
+		sticker.MXC = resp.ContentURI.CUString()
+		err = sticker.Upsert(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save sticker %d: %w", sticker.ID, err)
+		}
+	}
+	return stickers, nil
+}
+
+func makeImagePackContent(pack *database.StickerPack, stickers []*database.Sticker) *ImagePackEventContent {
+	content := &ImagePackEventContent{
+		Images: make(map[string]*ImagePackImage, len(stickers)),
+		Pack: ImagePackMeta{
+			DisplayName: pack.Title,
+			Usage:       []string{"sticker"},
+			Attribution: pack.Author,
+		},
+	}
+	for _, sticker := range stickers {
+		if sticker.ID == pack.CoverID {
+			content.Pack.AvatarURL = sticker.MXC
+		}
+		content.Images[strconv.FormatUint(uint64(sticker.ID), 10)] = &ImagePackImage{
+			URL:  sticker.MXC,
+			Body: sticker.Emoji,
+			Info: &event.FileInfo{
+				MimeType: sticker.ContentType,
+				// Signal stickers are 512x512, so tell Matrix clients to render them as 256x256
+				Width:  256,
+				Height: 256,
+			},
+			Usage: []string{"sticker"},
+			SignalSticker: &msgconv.SignalStickerInfo{
+				ID:    sticker.ID,
+				Emoji: sticker.Emoji,
+				Pack: msgconv.SignalStickerPackInfo{
+					ID:     pack.ID,
+					Key:    pack.Key,
+					Title:  pack.Title,
+					Author: pack.Author,
+				},
+			},
+		}
+	}
+	return content
+}
+
+// getStickerPackRoom returns the room where the user's sticker packs are stored as image pack state events.
+func (user *User) getStickerPackRoom(ctx context.Context) id.RoomID {
+	if roomID := user.GetSpaceRoom(ctx); roomID != "" {
+		return roomID
+	}
+	return user.ManagementRoom
+}
+
+func (user *User) handleStickerPackOperation(evt *events.StickerPackOperation) {
+	if !user.bridge.Config.Bridge.StickerPacks {
+		return
+	}
+	log := user.log.With().Str("action", "handle sticker pack operation").Logger()
+	ctx := log.WithContext(context.TODO())
+	for _, op := range evt.Operations {
+		var err error
+		if op.GetType() == signalpb.SyncMessage_StickerPackOperation_REMOVE {
+			err = user.removeStickerPack(ctx, op.GetPackId())
+		} else {
+			err = user.installStickerPack(ctx, op.GetPackId(), op.GetPackKey())
+		}
+		if err != nil {
+			log.Err(err).
+				Str("pack_id", hex.EncodeToString(op.GetPackId())).
+				Stringer("operation", op.GetType()).
+				Msg("Failed to handle sticker pack operation")
+		}
+	}
+}
+
+func (user *User) installStickerPack(ctx context.Context, packID, packKey []byte) error {
+	client := user.Client
+	if client == nil {
+		return fmt.Errorf("not connected to Signal")
+	}
+	pack, err := user.bridge.getStickerPack(ctx, client, packID, packKey)
+	if err != nil {
+		return err
+	}
+	stickers, err := user.bridge.reuploadStickerPack(ctx, client, pack)
+	if err != nil {
+		return err
+	}
+	err = pack.AddToUser(ctx, user.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to mark sticker pack as installed: %w", err)
+	}
+	roomID := user.getStickerPackRoom(ctx)
+	if roomID == "" {
+		zerolog.Ctx(ctx).Debug().Msg("No room to store image pack in, not bridging installed sticker pack")
+		return nil
+	}
+	stateKey := hex.EncodeToString(pack.ID)
+	_, err = user.bridge.Bot.SendStateEvent(ctx, roomID, StateImagePack, stateKey, makeImagePackContent(pack, stickers))
+	if err != nil {
+		return fmt.Errorf("failed to send image pack state event: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("pack_id", stateKey).
+		Stringer("room_id", roomID).
+		Msg("Bridged installed sticker pack to Matrix")
+	user.updateEmoteRooms(ctx, roomID, stateKey, true)
+	return nil
+}
+
+func (user *User) removeStickerPack(ctx context.Context, packID []byte) error {
+	pack, err := user.bridge.DB.StickerPack.GetByID(ctx, packID)
+	if err != nil {
+		return fmt.Errorf("failed to get sticker pack from database: %w", err)
+	} else if pack == nil {
+		return nil
+	}
+	err = pack.RemoveFromUser(ctx, user.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to mark sticker pack as removed: %w", err)
+	}
+	roomID := user.getStickerPackRoom(ctx)
+	if roomID == "" {
+		return nil
+	}
+	stateKey := hex.EncodeToString(pack.ID)
+	_, err = user.bridge.Bot.SendStateEvent(ctx, roomID, StateImagePack, stateKey, struct{}{})
+	if err != nil {
+		return fmt.Errorf("failed to clear image pack state event: %w", err)
+	}
+	user.updateEmoteRooms(ctx, roomID, stateKey, false)
+	return nil
+}
+
+// updateEmoteRooms enables or disables an image pack globally for the user using double puppeting.
+func (user *User) updateEmoteRooms(ctx context.Context, roomID id.RoomID, stateKey string, enable bool) {
+	puppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	if puppet == nil || puppet.CustomIntent() == nil {
+		return
+	}
+	intent := puppet.CustomIntent()
+	var content EmoteRoomsEventContent
+	err := intent.GetAccountData(ctx, AccountDataEmoteRooms.Type, &content)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get emote rooms account data to update it")
+		return
+	}
+	if content.Rooms == nil {
+		content.Rooms = make(map[id.RoomID]map[string]any)
+	}
+	if enable {
+		if content.Rooms[roomID] == nil {
+			content.Rooms[roomID] = make(map[string]any)
+		}
+		content.Rooms[roomID][stateKey] = map[string]any{}
+	} else if content.Rooms[roomID] != nil {
+		delete(content.Rooms[roomID], stateKey)
+		if len(content.Rooms[roomID]) == 0 {
+			delete(content.Rooms, roomID)
+		}
+	}
+	err = intent.SetAccountData(ctx, AccountDataEmoteRooms.Type, &content)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to update emote rooms account data")
+	}
+}
+
+func (portal *Portal) GetStickerPack(ctx context.Context, packID, packKey []byte) *database.StickerPack {
+	if isPlaceholderStickerPack(packID) {
+		return nil
+	}
+	client, _ := ctx.Value(msgconvContextKeyClient).(*signalmeow.Client)
+	pack, err := portal.bridge.getStickerPack(ctx, client, packID, packKey)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Str("pack_id", hex.EncodeToString(packID)).
+			Msg("Failed to get sticker pack")
+		return nil
+	}
+	return pack
+}
+
+func (portal *Portal) GetSignalSticker(ctx context.Context, mxc id.ContentURIString) *signalpb.DataMessage_Sticker {
+	sticker, err := portal.bridge.DB.Sticker.GetByMXC(ctx, mxc)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get sticker by mxc from database")
+		return nil
+	} else if sticker == nil {
+		return nil
+	}
+	pack, err := portal.bridge.DB.StickerPack.GetByID(ctx, sticker.PackID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get sticker pack from database")
+		return nil
+	} else if pack == nil {
+		return nil
+	}
+	signalSticker := &signalpb.DataMessage_Sticker{
+		PackId:    pack.ID,
+		PackKey:   pack.Key,
+		StickerId: proto.Uint32(sticker.ID),
+	}
+	if sticker.Emoji != "" {
+		signalSticker.Emoji = proto.String(sticker.Emoji)
+	}
+	return signalSticker
+}
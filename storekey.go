@@ -0,0 +1,96 @@
+// mautrix-signal - A Matrix-signal puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// NewStoreKeyEnv is the environment variable that the new key for the --rotate-store-key flag is read from.
+const NewStoreKeyEnv = "MAUTRIX_SIGNAL_NEW_STORE_KEY"
+
+// disableStoreKey is the value of NewStoreKeyEnv that decrypts the store instead of rotating the key.
+const disableStoreKey = "disable"
+
+func parseStoreEncryptionKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("store encryption key is not valid base64: %w", err)
+	}
+	return decoded, nil
+}
+
+func (br *SignalBridge) initStoreEncryption() error {
+	key, err := parseStoreEncryptionKey(br.Config.Signal.StoreEncryptionKey)
+	if err != nil {
+		return err
+	}
+	return br.MeowStore.SetEncryptionKey(key)
+}
+
+// runStoreKeyRotationFlag handles the --rotate-store-key flag.
+// It returns false if the flag wasn't used and the bridge should start normally.
+func (br *SignalBridge) runStoreKeyRotationFlag() bool {
+	if !*rotateStoreKeyFlag {
+		return false
+	}
+	log := br.ZLog.With().Str("action", "rotate store key").Logger()
+	ctx := log.WithContext(context.TODO())
+	err := br.rotateStoreKey(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to rotate store encryption key")
+		os.Exit(1)
+	}
+	log.Info().Msg("Store encryption key rotated, update signal.store_encryption_key in the config before starting the bridge")
+	return true
+}
+
+func (br *SignalBridge) rotateStoreKey(ctx context.Context) error {
+	newKeyStr := os.Getenv(NewStoreKeyEnv)
+	if newKeyStr == "" {
+		return fmt.Errorf("the %s environment variable must be set", NewStoreKeyEnv)
+	}
+	var newKey []byte
+	if newKeyStr != disableStoreKey {
+		var err error
+		newKey, err = parseStoreEncryptionKey(newKeyStr)
+		if err != nil {
+			return err
+		}
+	}
+	oldKey, err := parseStoreEncryptionKey(br.Config.Signal.StoreEncryptionKey)
+	if err != nil {
+		return err
+	}
+	var oldKeys [][]byte
+	if oldKey != nil {
+		oldKeys = append(oldKeys, oldKey)
+	}
+	err = br.MeowStore.SetEncryptionKey(newKey, oldKeys...)
+	if err != nil {
+		return err
+	}
+	return br.MeowStore.MigrateEncryption(ctx)
+}
@@ -39,6 +39,7 @@ import (
 	"go.mau.fi/mautrix-signal/pkg/signalmeow"
 	"go.mau.fi/mautrix-signal/pkg/signalmeow/events"
 	signalpb "go.mau.fi/mautrix-signal/pkg/signalmeow/protobuf"
+	"go.mau.fi/mautrix-signal/pkg/signalmeow/types"
 )
 
 var (
@@ -171,6 +172,16 @@ type User struct {
 
 	spaceMembershipChecked bool
 	spaceCreateLock        sync.Mutex
+
+	// queueEmpty is set once the Signal server has sent everything that was queued while the bridge was offline.
+	// Expensive work like avatar refreshes and own read receipts is deferred until then.
+	queueEmpty       bool
+	deferredLock     sync.Mutex
+	deferredReadSelf []*signalpb.SyncMessage_Read
+	deferredAvatars  map[uuid.UUID]*types.Contact
+
+	outboxLoopOnce sync.Once
+	outboxWake     chan struct{}
 }
 
 var (
@@ -426,8 +437,16 @@ func (user *User) startupTryConnect(retryCount int) {
 			err := connectionStatus.Err
 			switch connectionStatus.Event {
 			case signalmeow.SignalConnectionEventConnected:
+				// The server sends all queued messages after connecting, so we're not fully connected until it's done
+				user.log.Debug().Msg("Sending Backfilling BridgeState")
+				user.setQueueEmpty(false)
+				user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBackfilling})
+
+			case signalmeow.SignalConnectionEventQueueEmpty:
 				user.log.Debug().Msg("Sending Connected BridgeState")
 				user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+				user.setQueueEmpty(true)
+				user.wakeOutbox()
 
 			case signalmeow.SignalConnectionEventDisconnected:
 				user.log.Debug().Msg("Received SignalConnectionEventDisconnected")
@@ -550,7 +569,7 @@ func (user *User) Login() (<-chan signalmeow.ProvisioningResponse, error) {
 	user.Lock()
 	defer user.Unlock()
 
-	provChan := signalmeow.PerformProvisioning(context.TODO(), user.bridge.MeowStore, user.bridge.Config.Signal.DeviceName)
+	provChan := signalmeow.PerformProvisioning(context.TODO(), user.bridge.SignalServer, user.bridge.MeowStore, user.bridge.Config.Signal.DeviceName)
 
 	return provChan, nil
 }
@@ -565,7 +584,10 @@ func (user *User) saveSignalID(ctx context.Context, id uuid.UUID, number string)
 	if user.SignalID == id && user.SignalUsername == number {
 		return
 	}
-	if user.SignalID != id {
+	if user.SignalID != uuid.Nil && user.SignalID != id {
+		delete(user.bridge.usersBySignalID, user.SignalID)
+	}
+	if id != uuid.Nil && user.SignalID != id {
 		existingUser := user.bridge.unlockedGetUserBySignalID(id)
 		if existingUser != nil {
 			// TODO this doesn't clear the signal store properly
@@ -585,7 +607,9 @@ func (user *User) saveSignalID(ctx context.Context, id uuid.UUID, number string)
 	}
 	user.SignalID = id
 	user.SignalUsername = number
-	user.bridge.usersBySignalID[id] = user
+	if id != uuid.Nil {
+		user.bridge.usersBySignalID[id] = user
+	}
 	err := user.Update(ctx)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to save user's signal UUID")
@@ -619,7 +643,13 @@ func (user *User) populateSignalDevice() *signalmeow.Client {
 
 	user.Client = &signalmeow.Client{
 		Store:        device,
+		Server:       user.bridge.SignalServer,
 		EventHandler: user.eventHandler,
+
+		TrackDuplicateEnvelope: user.bridge.Metrics.TrackDuplicateEnvelope,
+		TrackEnvelopeQueue:     user.bridge.Metrics.TrackEnvelopeQueue,
+		TrackEnvelopeStage:     user.bridge.Metrics.TrackEnvelopeStage,
+		TrackPreKeyCounts:      user.bridge.Metrics.TrackPreKeyCounts,
 	}
 	go user.tryAutomaticDoublePuppeting()
 	return user.Client
@@ -751,6 +781,73 @@ func (user *User) handleContactList(evt *events.ContactList) {
 	}
 }
 
+func (user *User) setQueueEmpty(empty bool) {
+	user.deferredLock.Lock()
+	user.queueEmpty = empty
+	if !empty {
+		user.deferredLock.Unlock()
+		return
+	}
+	readSelf := user.deferredReadSelf
+	avatars := user.deferredAvatars
+	user.deferredReadSelf = nil
+	user.deferredAvatars = nil
+	user.deferredLock.Unlock()
+
+	if len(readSelf) == 0 && len(avatars) == 0 {
+		return
+	}
+	log := user.log.With().Str("action", "handle deferred work").Logger()
+	log.Debug().
+		Int("read_receipt_count", len(readSelf)).
+		Int("avatar_count", len(avatars)).
+		Msg("Message queue is empty, handling deferred read receipts and avatar updates")
+	go func() {
+		if len(readSelf) > 0 {
+			// The messages have been received, but portals may still be bridging them
+			user.bridge.waitForPortalSignalMessages()
+			user.handleReadSelf(&events.ReadSelf{Messages: readSelf})
+		}
+		ctx := log.WithContext(context.TODO())
+		for signalID, info := range avatars {
+			puppet := user.bridge.GetPuppetBySignalID(signalID)
+			if puppet != nil {
+				puppet.UpdateInfo(ctx, user, info)
+			}
+		}
+	}()
+}
+
+// deferReadSelf stores own read receipts until the message queue is empty,
+// as the messages they refer to may not have been bridged yet.
+func (user *User) deferReadSelf(evt *events.ReadSelf) bool {
+	user.deferredLock.Lock()
+	defer user.deferredLock.Unlock()
+	if user.queueEmpty {
+		return false
+	}
+	user.deferredReadSelf = append(user.deferredReadSelf, evt.Messages...)
+	return true
+}
+
+// deferAvatarUpdate returns true if the avatar of the given user shouldn't be updated yet.
+// The puppet info will be updated again after the message queue is empty.
+func (user *User) deferAvatarUpdate(signalID uuid.UUID, info *types.Contact) bool {
+	user.deferredLock.Lock()
+	defer user.deferredLock.Unlock()
+	if user.queueEmpty {
+		return false
+	}
+	if user.deferredAvatars == nil {
+		user.deferredAvatars = make(map[uuid.UUID]*types.Contact)
+	}
+	// Keep the previous info if the new one doesn't have any (i.e. it'd be fetched again anyway)
+	if prevInfo, ok := user.deferredAvatars[signalID]; !ok || info != nil || prevInfo == nil {
+		user.deferredAvatars[signalID] = info
+	}
+	return true
+}
+
 func (user *User) eventHandler(rawEvt events.SignalEvent) {
 	switch evt := rawEvt.(type) {
 	case *events.ChatEvent:
@@ -759,11 +856,14 @@ func (user *User) eventHandler(rawEvt events.SignalEvent) {
 			portal.signalMessages <- portalSignalMessage{user: user, evt: evt}
 		} else {
 			user.log.Warn().Str("chat_id", evt.Info.ChatID).Msg("Couldn't get portal, dropping message")
+			user.markInboxEntryHandled(evt.Info, signalmeow.InboxEntryIgnored)
 		}
 	case *events.Receipt:
 		user.handleReceipt(evt)
 	case *events.ReadSelf:
-		user.handleReadSelf(evt)
+		if !user.deferReadSelf(evt) {
+			user.handleReadSelf(evt)
+		}
 	case *events.Call:
 		portal := user.GetPortalByChatID(evt.Info.ChatID)
 		content := &event.MessageEventContent{MsgType: event.MsgNotice}
@@ -775,14 +875,74 @@ func (user *User) eventHandler(rawEvt events.SignalEvent) {
 		} else {
 			content.Body = "Call ended"
 		}
-		portal.sendMainIntentMessage(context.TODO(), content)
+		_, err := portal.sendMainIntentMessage(context.TODO(), content)
+		if err != nil {
+			user.markInboxEntryHandled(evt.Info, signalmeow.InboxEntryFailed)
+		} else {
+			user.markInboxEntryHandled(evt.Info, signalmeow.InboxEntryBridged)
+		}
 	case *events.ContactList:
 		user.handleContactList(evt)
+	case *events.QueueEmpty:
+		// Bridge state and deferred work are handled through SignalConnectionEventQueueEmpty
+		user.log.Debug().Msg("Signal message queue is empty")
+	case *events.RateLimitChallenge:
+		user.handleRateLimitChallenge(evt)
+	case *events.SessionReset:
+		user.handleSessionReset(evt)
+	case *events.StickerPackOperation:
+		// Installing a pack requires downloading and uploading all the stickers, so don't block the receive loop
+		go user.handleStickerPackOperation(evt)
 	default:
 		user.log.Warn().Type("event_type", evt).Msg("Unrecognized event type from signalmeow")
 	}
 }
 
+func (user *User) handleSessionReset(evt *events.SessionReset) {
+	log := user.log.With().
+		Str("action", "handle session reset").
+		Stringer("sender_uuid", evt.Info.Sender).
+		Logger()
+	ctx := log.WithContext(context.TODO())
+	portal := user.GetPortalByChatID(evt.Info.ChatID)
+	if portal == nil || portal.MXID == "" {
+		log.Debug().Msg("Sender reset secure session, but there's no portal to notify")
+		user.markInboxEntryHandled(evt.Info, signalmeow.InboxEntryIgnored)
+		return
+	}
+	_, err := portal.sendMainIntentMessage(ctx, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    "The secure session was reset by the other user",
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to send session reset notice")
+		user.markInboxEntryHandled(evt.Info, signalmeow.InboxEntryFailed)
+	} else {
+		user.markInboxEntryHandled(evt.Info, signalmeow.InboxEntryIgnored)
+	}
+}
+
+// markInboxEntryHandled tells signalmeow whether the event was bridged, so that it's either removed
+// from the inbox (with a delivery receipt if it was bridged) or kept to be retried.
+func (user *User) markInboxEntryHandled(info events.MessageInfo, result signalmeow.InboxEntryResult) {
+	if info.ServerGUID == "" {
+		return
+	}
+	client := user.Client
+	if client == nil {
+		// The entry will be replayed on the next connection
+		return
+	}
+	log := user.log.With().
+		Str("action", "mark inbox entry handled").
+		Str("server_guid", info.ServerGUID).
+		Logger()
+	err := client.MarkInboxEntryHandled(log.WithContext(context.TODO()), info.ServerGUID, result)
+	if err != nil {
+		log.Err(err).Msg("Failed to mark inbox entry as handled")
+	}
+}
+
 func (user *User) GetPortalByChatID(signalID string) *Portal {
 	pk := database.PortalKey{
 		ChatID:   signalID,